@@ -0,0 +1,73 @@
+package bmp
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"image"
+	"io"
+	"math"
+)
+
+// arrayHeaderLen is the size of BITMAPARRAYFILEHEADER without the file header
+// of the image following it.
+const arrayHeaderLen = 14
+
+// EncodeAll writes the images to w as an OS/2 bitmap array file ("BA"),
+// typically holding versions of the same picture for different displays.
+func EncodeAll(w io.Writer, imgs []image.Image) error {
+	return EncodeAllWithOptions(w, imgs, nil)
+}
+
+// EncodeAllWithOptions writes the images to w as an OS/2 bitmap array file ("BA")
+// with the given options, for example HeaderCore for OS/2 1.x readers.
+// Every image is stored as a BMP file following its array header,
+// with the offset of its pixels relative to the start of the array file.
+// Every image is encoded in memory before it is written, so its headers can be
+// adjusted, and arrays whose offsets do not fit in 4 GiB fail with ErrTooLarge.
+func EncodeAllWithOptions(w io.Writer, imgs []image.Image, opts *Options) error {
+	if len(imgs) == 0 {
+		return errors.New("bmp: no images")
+	}
+	var off uint32
+	var buf bytes.Buffer
+	for i, m := range imgs {
+		buf.Reset()
+		if err := EncodeWithOptions(&buf, m, opts); err != nil {
+			return err
+		}
+		b := buf.Bytes()
+		end, err := nextOffset(off, len(b))
+		if err != nil {
+			return err
+		}
+		var h [arrayHeaderLen]byte
+		h[0], h[1] = 'B', 'A'
+		// The header includes the file and DIB headers of the image.
+		binary.LittleEndian.PutUint32(h[2:], arrayHeaderLen+fileHeaderLen+readUint32(b[fileHeaderLen:]))
+		if i < len(imgs)-1 {
+			binary.LittleEndian.PutUint32(h[6:], end)
+		}
+		// The display resolution, cxDisplay and cyDisplay, is left 0.
+		binary.LittleEndian.PutUint32(b[10:], readUint32(b[10:])+off+arrayHeaderLen)
+		if _, err := w.Write(h[:]); err != nil {
+			return err
+		}
+		if _, err := w.Write(b); err != nil {
+			return err
+		}
+		off = end
+	}
+	return nil
+}
+
+// nextOffset returns the offset following an image of n bytes stored
+// with its array header at the offset off, or ErrTooLarge if it does not fit
+// the offsets of the array.
+func nextOffset(off uint32, n int) (uint32, error) {
+	end := uint64(off) + arrayHeaderLen + uint64(n)
+	if end > math.MaxUint32 {
+		return 0, ErrTooLarge
+	}
+	return uint32(end), nil
+}
@@ -0,0 +1,82 @@
+package bmp
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"io/ioutil"
+	"math"
+	"testing"
+)
+
+func TestEncodeAll(t *testing.T) {
+	var imgs []image.Image
+	for _, file := range []string{"testdata/pal1bg.bmp", "testdata/pal8.bmp", "testdata/rgb24.bmp"} {
+		img, err := Decode(bytes.NewReader(mustReadFile(file)))
+		if err != nil {
+			t.Fatalf("Decode(%q) = _, %v; want nil", file, err)
+		}
+		imgs = append(imgs, img)
+	}
+	for _, opts := range []*Options{nil, {Header: HeaderCore}} {
+		var buf bytes.Buffer
+		if err := EncodeAllWithOptions(&buf, imgs, opts); err != nil {
+			t.Fatalf("EncodeAllWithOptions() = %v; want nil", err)
+		}
+		b := buf.Bytes()
+		if ok, kind := Sniff(b); !ok || kind != KindBitmapArray {
+			t.Errorf("Sniff() = %t, %v; want true, %v", ok, kind, KindBitmapArray)
+		}
+		var off uint32
+		for i, img := range imgs {
+			if string(b[off:off+2]) != "BA" {
+				t.Fatalf("signature of image %d = %q; want \"BA\"", i, b[off:off+2])
+			}
+			next := readUint32(b[off+6:])
+			end := next
+			if i == len(imgs)-1 {
+				if next != 0 {
+					t.Errorf("offNext of the last image = %d; want 0", next)
+				}
+				end = uint32(len(b))
+			}
+			if size := readUint32(b[off+2:]); size != arrayHeaderLen+fileHeaderLen+readUint32(b[off+arrayHeaderLen+fileHeaderLen:]) {
+				t.Errorf("cbSize of image %d = %d", i, size)
+			}
+			// The offset of the pixels is relative to the start of the array.
+			file := append([]byte(nil), b[off+arrayHeaderLen:end]...)
+			binary.LittleEndian.PutUint32(file[10:], readUint32(file[10:])-off-arrayHeaderLen)
+			var expected bytes.Buffer
+			if err := EncodeWithOptions(&expected, img, opts); err != nil {
+				t.Fatalf("EncodeWithOptions() = %v; want nil", err)
+			}
+			if !bytes.Equal(file, expected.Bytes()) {
+				t.Errorf("image %d differs from EncodeWithOptions()", i)
+			}
+			off = next
+		}
+	}
+	if err := EncodeAll(ioutil.Discard, nil); err == nil {
+		t.Error("EncodeAll() = nil; want non-nil")
+	}
+}
+
+func TestNextOffset(t *testing.T) {
+	tests := []struct {
+		off  uint32
+		n    int
+		want uint32
+		err  error
+	}{
+		{0, 100, arrayHeaderLen + 100, nil},
+		{1000, 100, 1000 + arrayHeaderLen + 100, nil},
+		{math.MaxUint32 - arrayHeaderLen - 100, 100, math.MaxUint32, nil},
+		{math.MaxUint32 - arrayHeaderLen - 100, 101, 0, ErrTooLarge},
+		{math.MaxUint32, 0, 0, ErrTooLarge},
+	}
+	for _, test := range tests {
+		if got, err := nextOffset(test.off, test.n); got != test.want || err != test.err {
+			t.Errorf("nextOffset(%d, %d) = %d, %v; want %d, %v", test.off, test.n, got, err, test.want, test.err)
+		}
+	}
+}
@@ -0,0 +1,113 @@
+package bmp
+
+import (
+	"image"
+	"image/color"
+)
+
+// modelBytesPerPixel returns the number of bytes used by a single pixel
+// of the images with the color model m, or 0 if m is not supported.
+func modelBytesPerPixel(m color.Model) int {
+	switch m {
+	case color.RGBAModel, color.NRGBAModel, color.CMYKModel:
+		return 4
+	case color.RGBA64Model, color.NRGBA64Model:
+		return 8
+	case color.GrayModel:
+		return 1
+	case color.Gray16Model:
+		return 2
+	}
+	return 0
+}
+
+// modelImage returns an image of the given size for the color model m
+// backed by pix, tightly packed, along with a function storing a single
+// alpha-premultiplied 16-bit color to its pixels, or nil if m is not supported.
+func modelImage(m color.Model, rect image.Rectangle, pix []byte) (img image.Image, store func(p []byte, r, g, b, a uint32)) {
+	stride := rect.Dx() * modelBytesPerPixel(m)
+	switch m {
+	case color.RGBAModel:
+		return &image.RGBA{Pix: pix, Stride: stride, Rect: rect}, func(p []byte, r, g, b, a uint32) {
+			p[0], p[1], p[2], p[3] = uint8(r>>8), uint8(g>>8), uint8(b>>8), uint8(a>>8)
+		}
+	case color.RGBA64Model:
+		return &image.RGBA64{Pix: pix, Stride: stride, Rect: rect}, func(p []byte, r, g, b, a uint32) {
+			p[0], p[1], p[2], p[3] = uint8(r>>8), uint8(r), uint8(g>>8), uint8(g)
+			p[4], p[5], p[6], p[7] = uint8(b>>8), uint8(b), uint8(a>>8), uint8(a)
+		}
+	case color.NRGBAModel:
+		return &image.NRGBA{Pix: pix, Stride: stride, Rect: rect}, func(p []byte, r, g, b, a uint32) {
+			r, g, b = unpremultiply(r, g, b, a)
+			p[0], p[1], p[2], p[3] = uint8(r>>8), uint8(g>>8), uint8(b>>8), uint8(a>>8)
+		}
+	case color.NRGBA64Model:
+		return &image.NRGBA64{Pix: pix, Stride: stride, Rect: rect}, func(p []byte, r, g, b, a uint32) {
+			r, g, b = unpremultiply(r, g, b, a)
+			p[0], p[1], p[2], p[3] = uint8(r>>8), uint8(r), uint8(g>>8), uint8(g)
+			p[4], p[5], p[6], p[7] = uint8(b>>8), uint8(b), uint8(a>>8), uint8(a)
+		}
+	case color.GrayModel:
+		return &image.Gray{Pix: pix, Stride: stride, Rect: rect}, func(p []byte, r, g, b, a uint32) {
+			// This formula is the same as in color.GrayModel.
+			p[0] = uint8((19595*r + 38470*g + 7471*b + 1<<15) >> 24)
+		}
+	case color.Gray16Model:
+		return &image.Gray16{Pix: pix, Stride: stride, Rect: rect}, func(p []byte, r, g, b, a uint32) {
+			// This formula is the same as in color.Gray16Model.
+			y := (19595*r + 38470*g + 7471*b + 1<<15) >> 16
+			p[0], p[1] = uint8(y>>8), uint8(y)
+		}
+	case color.CMYKModel:
+		return &image.CMYK{Pix: pix, Stride: stride, Rect: rect}, func(p []byte, r, g, b, a uint32) {
+			p[0], p[1], p[2], p[3] = color.RGBToCMYK(uint8(r>>8), uint8(g>>8), uint8(b>>8))
+		}
+	}
+	return nil, nil
+}
+
+// unpremultiply returns the non-alpha-premultiplied 16-bit color channels
+// the same way as color.NRGBA64Model.
+func unpremultiply(r, g, b, a uint32) (uint32, uint32, uint32) {
+	switch a {
+	case 0xFFFF:
+		return r, g, b
+	case 0:
+		return 0, 0, 0
+	}
+	return (r * 0xFFFF) / a, (g * 0xFFFF) / a, (b * 0xFFFF) / a
+}
+
+// decodeModel reads the pixels from d.r into an image with the color model m,
+// converting every row as soon as it is read.
+func (d *decoder) decodeModel(m color.Model) (image.Image, error) {
+	bpp := modelBytesPerPixel(m)
+	if bpp == 0 {
+		return nil, UnsupportedError("color model")
+	}
+	stride := d.c.Width * bpp
+	pix, err := d.pixels(stride*d.c.Height, false)
+	if err != nil {
+		return nil, err
+	}
+	img, store := modelImage(m, image.Rect(0, 0, d.c.Width, d.c.Height), pix)
+	if d.c.Width == 0 || d.c.Height == 0 {
+		return img, nil
+	}
+	buf := getBuffer(d.c.Width * 4)
+	defer putBuffer(buf)
+	tmp := (*buf)[:d.c.Width*4]
+	err = d.decodeRows(func(y int, row []byte) error {
+		d.convertRow(tmp, RGBA32, row)
+		p := pix[y*stride : y*stride+d.c.Width*bpp]
+		for i, j := 0, 0; i < len(p); i, j = i+bpp, j+4 {
+			r, g, b, a := color.NRGBA{tmp[j+0], tmp[j+1], tmp[j+2], tmp[j+3]}.RGBA()
+			store(p[i:], r, g, b, a)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return img, nil
+}
@@ -0,0 +1,125 @@
+package bmp
+
+import (
+	"image"
+	"io"
+	"io/ioutil"
+)
+
+// Decoder reads BMP images stored one after another in a stream,
+// like frames sent by capture hardware.
+type Decoder struct {
+	r    io.Reader
+	opts DecodeOptions
+	prev image.Image
+	// d, if non-nil, is the decoder of the next image with its header read.
+	d   *decoder
+	err error
+}
+
+// NewDecoder returns a decoder reading images from r with the given options.
+func NewDecoder(r io.Reader, opts *DecodeOptions) *Decoder {
+	dec := &Decoder{r: r}
+	if opts != nil {
+		dec.opts = *opts
+	}
+	return dec
+}
+
+// DecodeExtendedConfig reads the header of the next image from the stream, unless
+// it is already read, and returns the color model, dimensions and storage details
+// of the image. It returns io.EOF if the stream ends before the next image.
+func (dec *Decoder) DecodeExtendedConfig() (ExtendedConfig, error) {
+	if err := dec.next(); err != nil {
+		return ExtendedConfig{}, err
+	}
+	return dec.d.extendedConfig(), nil
+}
+
+// next reads the header of the next image to dec.d, unless it is already read.
+func (dec *Decoder) next() error {
+	if dec.d != nil {
+		return nil
+	}
+	d := newDecoder(dec.r, &dec.opts)
+	if d.cr == nil {
+		d.cr = &countingReader{r: dec.r}
+		d.r = d.cr
+	}
+	if err := d.DecodeConfig(); err != nil {
+		if err == io.ErrUnexpectedEOF && d.cr.n == 0 {
+			err = io.EOF
+		}
+		return err
+	}
+	dec.d = d
+	return nil
+}
+
+// skip discards any data between the current position and the end of the file
+// of the current image, as declared in its header, and moves to the next image.
+func (dec *Decoder) skip() error {
+	d := dec.d
+	dec.d = nil
+	if n := int64(d.fileSize) - d.cr.n; n > 0 {
+		if _, err := io.CopyN(ioutil.Discard, d.r, n); err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+// Decode reads the next image from the stream and returns it as an image.Image.
+// Any data between the pixels and the end of the file, as declared in its header,
+// is skipped. Decode returns io.EOF if the stream ends before the next image.
+func (dec *Decoder) Decode() (image.Image, error) {
+	if err := dec.next(); err != nil {
+		return nil, err
+	}
+	d := dec.d
+	if dec.opts.ReuseImage {
+		d.reuse = dec.prev
+	}
+	img, err := d.Decode()
+	if err != nil {
+		dec.d = nil
+		return nil, err
+	}
+	if err := dec.skip(); err != nil {
+		return nil, err
+	}
+	dec.prev = img
+	return img, nil
+}
+
+// DecodeRows reads the pixels of the next image from the stream and calls fn for
+// every row in the order they are stored, with y being the row index in the image
+// and row holding its pixels in the pixel format reported by DecodeExtendedConfig.
+// The row is only valid during the call. If fn returns false, the rest of the image
+// is skipped. DecodeRows returns io.EOF if the stream ends before the next image.
+func (dec *Decoder) DecodeRows(fn func(y int, row []byte) bool) error {
+	if err := dec.next(); err != nil {
+		return err
+	}
+	d := dec.d
+	if d.c.Width > 0 && d.c.Height > 0 {
+		err := d.decodeRows(func(y int, row []byte) error {
+			if !fn(y, row) {
+				return errStop
+			}
+			return nil
+		})
+		if err != nil && err != errStop {
+			dec.d = nil
+			return err
+		}
+	}
+	return dec.skip()
+}
+
+// Err returns the error, if any, that was encountered during the last iteration
+// by Rows.
+func (dec *Decoder) Err() error { return dec.err }
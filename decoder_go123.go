@@ -0,0 +1,16 @@
+//go:build go1.23
+// +build go1.23
+
+package bmp
+
+import "iter"
+
+// Rows returns an iterator over the rows of the next image from the stream,
+// yielding them the same way as DecodeRows. Breaking out of the loop skips
+// the rest of the image. The error encountered during the iteration,
+// if any, is reported by Err.
+func (dec *Decoder) Rows() iter.Seq2[int, []byte] {
+	return func(yield func(int, []byte) bool) {
+		dec.err = dec.DecodeRows(yield)
+	}
+}
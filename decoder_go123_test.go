@@ -0,0 +1,47 @@
+//go:build go1.23
+// +build go1.23
+
+package bmp
+
+import (
+	"bytes"
+	"io"
+	"testing"
+)
+
+func TestDecoderRows(t *testing.T) {
+	in := mustReadFile("testdata/rgb24.bmp")
+	dec := NewDecoder(bytes.NewReader(append(append([]byte(nil), in...), in...)), nil)
+	c, err := dec.DecodeExtendedConfig()
+	if err != nil {
+		t.Fatalf("DecodeExtendedConfig() = _, %v; want nil", err)
+	}
+	rows := 0
+	for y, row := range dec.Rows() {
+		if y != c.Height-1-rows {
+			t.Fatalf("y = %d; want %d", y, c.Height-1-rows)
+		}
+		if len(row) != c.PixelFormat.Stride(c.Width) {
+			t.Fatalf("len(row) = %d; want %d", len(row), c.PixelFormat.Stride(c.Width))
+		}
+		if rows++; rows == 5 {
+			break
+		}
+	}
+	if err := dec.Err(); err != nil {
+		t.Fatalf("Err() = %v; want nil", err)
+	}
+	rows = 0
+	for range dec.Rows() {
+		rows++
+	}
+	if err := dec.Err(); err != nil || rows != c.Height {
+		t.Fatalf("rows, Err() = %d, %v; want %d, nil", rows, err, c.Height)
+	}
+	for range dec.Rows() {
+		t.Fatal("Rows() yielded a row; want none")
+	}
+	if err := dec.Err(); err != io.EOF {
+		t.Errorf("Err() = %v; want %v", err, io.EOF)
+	}
+}
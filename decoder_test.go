@@ -0,0 +1,85 @@
+package bmp
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"io"
+	"testing"
+)
+
+func TestDecoder(t *testing.T) {
+	files := []string{"testdata/rgb24.bmp", "testdata/pal8rle.bmp", "testdata/pal8v5.bmp", "testdata/pal8.bmp", "testdata/pal4rlecut.bmp", "testdata/rgb24.bmp"}
+	var stream []byte
+	for _, file := range files {
+		stream = append(stream, mustReadFile(file)...)
+	}
+	for _, reuse := range []bool{false, true} {
+		t.Run(fmt.Sprintf("ReuseImage=%t", reuse), func(t *testing.T) {
+			dec := NewDecoder(bytes.NewReader(stream), &DecodeOptions{ReuseImage: reuse})
+			var prev image.Image
+			for i, file := range files {
+				img, err := dec.Decode()
+				if err != nil {
+					t.Fatalf("Decode() = _, %v; want nil", err)
+				}
+				expected, err := Decode(bytes.NewReader(mustReadFile(file)))
+				if err != nil {
+					t.Fatalf("Decode() = _, %v; want nil", err)
+				}
+				compare(t, expected, img)
+				if i == 3 {
+					if reused := img == prev; reused != reuse {
+						t.Errorf("reused = %t; want %t", reused, reuse)
+					}
+				}
+				prev = img
+			}
+			if _, err := dec.Decode(); err != io.EOF {
+				t.Errorf("Decode() = _, %v; want %v", err, io.EOF)
+			}
+		})
+	}
+}
+
+func TestDecoderDecodeRows(t *testing.T) {
+	files := []string{"testdata/rgb24.bmp", "testdata/pal8rle.bmp", "testdata/pal4.bmp", "testdata/pal8topdown.bmp"}
+	var stream []byte
+	for _, file := range files {
+		stream = append(stream, mustReadFile(file)...)
+	}
+	dec := NewDecoder(bytes.NewReader(stream), nil)
+	for i, file := range files {
+		c, err := dec.DecodeExtendedConfig()
+		if err != nil {
+			t.Fatalf("DecodeExtendedConfig() = _, %v; want nil", err)
+		}
+		expected := make([]byte, c.PixelFormat.Size(c.Width, c.Height))
+		if _, err := DecodeRaw(bytes.NewReader(mustReadFile(file)), expected, c.PixelFormat.Stride(c.Width), c.PixelFormat); err != nil {
+			t.Fatalf("DecodeRaw() = _, %v; want nil", err)
+		}
+		pix := make([]byte, len(expected))
+		rows := 0
+		err = dec.DecodeRows(func(y int, row []byte) bool {
+			copy(pix[y*c.PixelFormat.Stride(c.Width):], row)
+			rows++
+			// Stop early on the first image.
+			return i > 0 || rows < 10
+		})
+		if err != nil {
+			t.Fatalf("DecodeRows() = %v; want nil", err)
+		}
+		if i == 0 {
+			if rows != 10 {
+				t.Errorf("rows = %d; want 10", rows)
+			}
+			continue
+		}
+		if !bytes.Equal(pix, expected) {
+			t.Errorf("DecodeRows() rows of %s differ from DecodeRaw()", file)
+		}
+	}
+	if err := dec.DecodeRows(func(int, []byte) bool { return true }); err != io.EOF {
+		t.Errorf("DecodeRows() = %v; want %v", err, io.EOF)
+	}
+}
@@ -0,0 +1,160 @@
+// Package dib implements a decoder and encoder of packed device-independent
+// bitmaps (CF_DIB), as exchanged by the Windows clipboard and OLE:
+// a BITMAPINFO, that is a DIB header and a color table, immediately followed
+// by the pixels, without the BITMAPFILEHEADER of BMP files.
+//
+// The headers, color tables and pixels are the same as in BMP files,
+// so they are read and written by package bmp. DecodeV5 and EncodeV5 handle
+// the color space of packed DIBs with BITMAPV5HEADER (CF_DIBV5).
+package dib
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"io"
+
+	"github.com/sergeymakinen/go-bmp"
+)
+
+const (
+	fileHeaderLen = 14
+	coreHeaderLen = 12
+	infoHeaderLen = 40
+	// maxHeaderLen is the largest DIB header read, far larger than
+	// the 124-byte BITMAPV5HEADER to leave room for unknown versions.
+	maxHeaderLen = 4 << 10
+)
+
+const (
+	biBitFields      = 3
+	biAlphaBitFields = 6
+)
+
+// readHeader reads the DIB header of a packed DIB from r and returns it
+// preceded by the BITMAPFILEHEADER a BMP file of it would have,
+// with the offset of the pixels following the color masks and the color table.
+func readHeader(r io.Reader) ([]byte, error) {
+	var size [4]byte
+	if _, err := io.ReadFull(r, size[:]); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	infoLen := binary.LittleEndian.Uint32(size[:])
+	if infoLen < coreHeaderLen || infoLen > maxHeaderLen {
+		return nil, bmp.FormatError("invalid DIB header size")
+	}
+	b := make([]byte, fileHeaderLen+infoLen)
+	copy(b[fileHeaderLen:], size[:])
+	if _, err := io.ReadFull(r, b[fileHeaderLen+4:]); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	h := b[fileHeaderLen:]
+	var bpp, compression, colors, entryLen, maskLen uint32
+	if infoLen == coreHeaderLen {
+		// BITMAPCOREHEADER has 16-bit dimensions and 3-byte color table entries.
+		bpp, entryLen = uint32(binary.LittleEndian.Uint16(h[10:])), 3
+	} else {
+		// The fields of OS/2 2.x headers that are left out are 0.
+		var info [infoHeaderLen]byte
+		copy(info[:], h)
+		bpp, entryLen = uint32(binary.LittleEndian.Uint16(info[14:])), 4
+		compression, colors = binary.LittleEndian.Uint32(info[16:]), binary.LittleEndian.Uint32(info[32:])
+	}
+	if infoLen == infoHeaderLen {
+		// Later versions store the color masks in the header.
+		switch compression {
+		case biBitFields:
+			maskLen = 3 * 4
+		case biAlphaBitFields:
+			maskLen = 4 * 4
+		}
+	}
+	if colors == 0 && bpp <= 8 {
+		colors = 1 << bpp
+	}
+	if colors > 1<<16 {
+		return nil, bmp.FormatError("invalid number of colors")
+	}
+	offset := fileHeaderLen + infoLen + maskLen + colors*entryLen
+	b[0], b[1] = 'B', 'M'
+	// The file size is unknown and left 0.
+	binary.LittleEndian.PutUint32(b[10:], offset)
+	return b, nil
+}
+
+// fileReader returns a reader of the BMP file of the packed DIB read from r.
+func fileReader(r io.Reader) (io.Reader, error) {
+	h, err := readHeader(r)
+	if err != nil {
+		return nil, err
+	}
+	return io.MultiReader(bytes.NewReader(h), r), nil
+}
+
+// Decode reads a packed DIB from r and returns it as an image.Image.
+func Decode(r io.Reader) (image.Image, error) {
+	return DecodeWithOptions(r, nil)
+}
+
+// DecodeWithOptions reads a packed DIB from r with the given options
+// and returns it as an image.Image.
+func DecodeWithOptions(r io.Reader, opts *bmp.DecodeOptions) (image.Image, error) {
+	fr, err := fileReader(r)
+	if err != nil {
+		return nil, err
+	}
+	return bmp.DecodeWithOptions(fr, opts)
+}
+
+// DecodeConfig returns the color model and dimensions of a packed DIB without
+// decoding the entire image. The header and the color table are consumed.
+func DecodeConfig(r io.Reader) (image.Config, error) {
+	fr, err := fileReader(r)
+	if err != nil {
+		return image.Config{}, err
+	}
+	return bmp.DecodeConfig(fr)
+}
+
+// skipWriter writes to w all but the first n bytes written to it.
+type skipWriter struct {
+	w io.Writer
+	n int
+}
+
+func (s *skipWriter) Write(b []byte) (int, error) {
+	skipped := 0
+	if s.n > 0 {
+		if len(b) <= s.n {
+			s.n -= len(b)
+			return len(b), nil
+		}
+		skipped, b = s.n, b[s.n:]
+		s.n = 0
+	}
+	n, err := s.w.Write(b)
+	return skipped + n, err
+}
+
+// Encode writes the image m to w as a packed DIB.
+func Encode(w io.Writer, m image.Image) error {
+	return EncodeWithOptions(w, m, nil)
+}
+
+// EncodeWithOptions writes the image m to w as a packed DIB with the given options.
+// PixelAlignment is ignored since readers expect the pixels right after
+// the color table.
+func EncodeWithOptions(w io.Writer, m image.Image, opts *bmp.Options) error {
+	var o bmp.Options
+	if opts != nil {
+		o = *opts
+	}
+	o.PixelAlignment = 0
+	return bmp.EncodeWithOptions(&skipWriter{w: w, n: fileHeaderLen}, m, &o)
+}
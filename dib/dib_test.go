@@ -0,0 +1,162 @@
+package dib
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/color"
+	"image/color/palette"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	"github.com/sergeymakinen/go-bmp"
+)
+
+func compare(t *testing.T, expected, actual image.Image) {
+	if !expected.Bounds().Eq(actual.Bounds()) {
+		t.Fatalf("Bounds() = %s; want %s", actual.Bounds(), expected.Bounds())
+	}
+	for y := expected.Bounds().Min.Y; y < expected.Bounds().Max.Y; y++ {
+		for x := expected.Bounds().Min.X; x < expected.Bounds().Max.X; x++ {
+			expectedR, expectedG, expectedB, expectedA := expected.At(x, y).RGBA()
+			actualR, actualG, actualB, actualA := actual.At(x, y).RGBA()
+			if expectedR != actualR || expectedG != actualG || expectedB != actualB || expectedA != actualA {
+				t.Fatalf("At(%d, %d) = %v; want %v", x, y, actual.At(x, y), expected.At(x, y))
+			}
+		}
+	}
+}
+
+func TestDecode(t *testing.T) {
+	files, err := filepath.Glob("../testdata/*.bmp")
+	if err != nil {
+		panic("failed to list test files: " + err.Error())
+	}
+	for _, file := range files {
+		t.Run(file, func(t *testing.T) {
+			in, err := ioutil.ReadFile(file)
+			if err != nil {
+				panic("failed to read " + file + ": " + err.Error())
+			}
+			want, err := bmp.Decode(bytes.NewReader(in))
+			if err != nil {
+				t.Fatalf("bmp.Decode() = _, %v; want nil", err)
+			}
+			h, err := readHeader(bytes.NewReader(in[fileHeaderLen:]))
+			if err != nil {
+				t.Fatalf("readHeader() = _, %v; want nil", err)
+			}
+			if offset, wantOffset := binary.LittleEndian.Uint32(h[10:]), binary.LittleEndian.Uint32(in[10:]); offset != wantOffset {
+				// The pixels do not immediately follow the color table.
+				t.Skipf("pixel offset = %d; file has %d", offset, wantOffset)
+			}
+			c, err := DecodeConfig(bytes.NewReader(in[fileHeaderLen:]))
+			if err != nil {
+				t.Fatalf("DecodeConfig() = _, %v; want nil", err)
+			}
+			if c.Width != want.Bounds().Dx() || c.Height != want.Bounds().Dy() {
+				t.Errorf("DecodeConfig() = %dx%d; want %dx%d", c.Width, c.Height, want.Bounds().Dx(), want.Bounds().Dy())
+			}
+			img, err := Decode(bytes.NewReader(in[fileHeaderLen:]))
+			if err != nil {
+				t.Fatalf("Decode() = _, %v; want nil", err)
+			}
+			compare(t, want, img)
+		})
+	}
+}
+
+func TestDecodeShouldFail(t *testing.T) {
+	tests := []struct {
+		b   []byte
+		err string
+	}{
+		{nil, io.ErrUnexpectedEOF.Error()},
+		{[]byte{40, 0, 0, 0, 1}, io.ErrUnexpectedEOF.Error()},
+		{[]byte{8, 0, 0, 0}, "bmp: invalid format: invalid DIB header size"},
+		{[]byte{0, 0, 1, 0}, "bmp: invalid format: invalid DIB header size"},
+	}
+	for _, test := range tests {
+		if _, err := Decode(bytes.NewReader(test.b)); err == nil || err.Error() != test.err {
+			t.Errorf("Decode(%v) = _, %v; want %s", test.b, err, test.err)
+		}
+	}
+}
+
+func TestEncode(t *testing.T) {
+	paletted := image.NewPaletted(image.Rect(0, 0, 7, 5), palette.WebSafe)
+	nrgba := image.NewNRGBA(image.Rect(0, 0, 7, 5))
+	for i := range paletted.Pix {
+		paletted.Pix[i] = uint8(i * 7 % len(palette.WebSafe))
+	}
+	for i := range nrgba.Pix {
+		nrgba.Pix[i] = uint8(i * 11)
+	}
+	tests := []struct {
+		m    image.Image
+		opts *bmp.Options
+	}{
+		{paletted, nil},
+		{paletted, &bmp.Options{BitsPerPixel: 4, Compression: bmp.CompressionRLE4}},
+		{paletted, &bmp.Options{Header: bmp.HeaderCore}},
+		{paletted, &bmp.Options{Header: bmp.HeaderOS2, BitsPerPixel: 4}},
+		{nrgba, nil},
+		{nrgba, &bmp.Options{BitsPerPixel: 16, RGB565: true}},
+		{nrgba, &bmp.Options{BitsPerPixel: 24, PixelAlignment: 64}},
+		{nrgba, &bmp.Options{Header: bmp.HeaderV5, ICCProfile: []byte("profile")}},
+		{image.NewGray(image.Rect(0, 0, 3, 3)), &bmp.Options{TopDown: true}},
+	}
+	for i, test := range tests {
+		t.Run(strconv.Itoa(i), func(t *testing.T) {
+			var b bytes.Buffer
+			if err := EncodeWithOptions(&b, test.m, test.opts); err != nil {
+				t.Fatalf("EncodeWithOptions() = %v; want nil", err)
+			}
+			var o bmp.Options
+			if test.opts != nil {
+				o = *test.opts
+			}
+			o.PixelAlignment = 0
+			var file bytes.Buffer
+			if err := bmp.EncodeWithOptions(&file, test.m, &o); err != nil {
+				t.Fatalf("bmp.EncodeWithOptions() = %v; want nil", err)
+			}
+			if !bytes.Equal(b.Bytes(), file.Bytes()[fileHeaderLen:]) {
+				t.Fatalf("EncodeWithOptions() = %x; want %x", b.Bytes(), file.Bytes()[fileHeaderLen:])
+			}
+			img, err := Decode(&b)
+			if err != nil {
+				t.Fatalf("Decode() = _, %v; want nil", err)
+			}
+			want, err := bmp.Decode(&file)
+			if err != nil {
+				t.Fatalf("bmp.Decode() = _, %v; want nil", err)
+			}
+			compare(t, want, img)
+		})
+	}
+}
+
+func TestDecodeCore(t *testing.T) {
+	m := image.NewPaletted(image.Rect(0, 0, 3, 2), color.Palette{color.Black, color.White})
+	m.Pix[1], m.Pix[5] = 1, 1
+	var b bytes.Buffer
+	if err := EncodeWithOptions(&b, m, &bmp.Options{Header: bmp.HeaderCore}); err != nil {
+		t.Fatalf("EncodeWithOptions() = %v; want nil", err)
+	}
+	// The header is followed by 2 3-byte color table entries and 2 4-byte rows.
+	if want := coreHeaderLen + 2*3 + 2*4; b.Len() != want {
+		t.Fatalf("EncodeWithOptions() = %d bytes; want %d", b.Len(), want)
+	}
+	img, err := Decode(&b)
+	if err != nil {
+		t.Fatalf("Decode() = _, %v; want nil", err)
+	}
+	if b.Len() != 0 {
+		t.Errorf("Decode() left %d bytes", b.Len())
+	}
+	compare(t, m, img)
+}
@@ -0,0 +1,126 @@
+package dib
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"io"
+	"io/ioutil"
+
+	"github.com/sergeymakinen/go-bmp"
+)
+
+const v5InfoHeaderLen = 124
+
+const (
+	// PROFILE_EMBEDDED and PROFILE_LINKED color space types.
+	profileEmbedded = 0x4D424544
+	profileLinked   = 0x4C494E4B
+)
+
+// Profile is the color space of a packed DIB with BITMAPV5HEADER (CF_DIBV5).
+type Profile struct {
+	// Intent is the rendering intent of the image.
+	Intent bmp.RenderingIntent
+
+	// ICC is the embedded ICC color profile, if any.
+	ICC []byte
+
+	// Link is the path of a linked ICC color profile, if any,
+	// decoded from the Latin-1 range of Windows-1252.
+	Link string
+}
+
+// countingReader counts the bytes read from r.
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(b []byte) (int, error) {
+	n, err := c.r.Read(b)
+	c.n += int64(n)
+	return n, err
+}
+
+// DecodeV5 is like DecodeWithOptions but also returns the color space of packed DIBs
+// with BITMAPV5HEADER (CF_DIBV5), including the ICC profile that follows the pixels.
+// The profile is nil for earlier header versions. Images with an alpha mask
+// are decoded with their alpha, and ones with an empty alpha mask as opaque.
+func DecodeV5(r io.Reader, opts *bmp.DecodeOptions) (image.Image, *Profile, error) {
+	h, err := readHeader(r)
+	if err != nil {
+		return nil, nil, err
+	}
+	cr := &countingReader{r: r}
+	img, err := bmp.DecodeWithOptions(io.MultiReader(bytes.NewReader(h), cr), opts)
+	if err != nil {
+		return nil, nil, err
+	}
+	info := h[fileHeaderLen:]
+	if len(info) < v5InfoHeaderLen {
+		return img, nil, nil
+	}
+	p := &Profile{}
+	// LCS_GM_BUSINESS, LCS_GM_GRAPHICS, LCS_GM_IMAGES and LCS_GM_ABS_COLORIMETRIC.
+	switch binary.LittleEndian.Uint32(info[108:]) {
+	case 1:
+		p.Intent = bmp.IntentSaturation
+	case 2:
+		p.Intent = bmp.IntentRelativeColorimetric
+	case 8:
+		p.Intent = bmp.IntentAbsoluteColorimetric
+	}
+	csType := binary.LittleEndian.Uint32(info[56:])
+	offset, size := int64(binary.LittleEndian.Uint32(info[112:])), int64(binary.LittleEndian.Uint32(info[116:]))
+	if (csType != profileEmbedded && csType != profileLinked) || size == 0 {
+		return img, p, nil
+	}
+	// The offset of the profile is relative to the DIB header.
+	gap := offset - int64(len(info)) - cr.n
+	if gap < 0 {
+		return nil, nil, bmp.FormatError("invalid profile offset")
+	}
+	if _, err := io.CopyN(ioutil.Discard, r, gap); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, nil, err
+	}
+	// The profile is read without trusting its size for the allocation.
+	b, err := ioutil.ReadAll(io.LimitReader(r, size))
+	if err != nil {
+		return nil, nil, err
+	}
+	if int64(len(b)) < size {
+		return nil, nil, io.ErrUnexpectedEOF
+	}
+	if csType == profileLinked {
+		if i := bytes.IndexByte(b, 0); i >= 0 {
+			b = b[:i]
+		}
+		runes := make([]rune, len(b))
+		for i, c := range b {
+			runes[i] = rune(c)
+		}
+		p.Link = string(runes)
+	} else {
+		p.ICC = b
+	}
+	return img, p, nil
+}
+
+// EncodeV5 writes the image m to w as a packed DIB with BITMAPV5HEADER (CF_DIBV5),
+// whatever the Header of opts, with the profile and the rendering intent of opts.
+// Non-opaque images are written with 32 bits per pixel and an alpha mask unless
+// opts set otherwise, and so are paletted ones with non-opaque colors,
+// so consumers of the Windows clipboard keep their transparency.
+func EncodeV5(w io.Writer, m image.Image, opts *bmp.Options) error {
+	var o bmp.Options
+	if opts != nil {
+		o = *opts
+	}
+	o.Header = bmp.HeaderV5
+	o.PalettedAlpha = true
+	return EncodeWithOptions(w, m, &o)
+}
@@ -0,0 +1,86 @@
+package dib
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"io"
+	"reflect"
+	"strconv"
+	"testing"
+
+	"github.com/sergeymakinen/go-bmp"
+)
+
+func TestEncodeDecodeV5(t *testing.T) {
+	nrgba := image.NewNRGBA(image.Rect(0, 0, 5, 3))
+	for i := range nrgba.Pix {
+		nrgba.Pix[i] = uint8(i * 17)
+	}
+	paletted := image.NewPaletted(image.Rect(0, 0, 5, 3), color.Palette{
+		color.NRGBA{0xFF, 0, 0, 0xFF},
+		color.NRGBA{0, 0xFF, 0, 0x80},
+		color.NRGBA{},
+	})
+	for i := range paletted.Pix {
+		paletted.Pix[i] = uint8(i % 3)
+	}
+	opaque := image.NewPaletted(image.Rect(0, 0, 5, 3), color.Palette{color.Black, color.White})
+	tests := []struct {
+		m    image.Image
+		opts *bmp.Options
+		want *Profile
+	}{
+		{nrgba, nil, &Profile{}},
+		{nrgba, &bmp.Options{ICCProfile: []byte("icc profile"), Intent: bmp.IntentSaturation}, &Profile{Intent: bmp.IntentSaturation, ICC: []byte("icc profile")}},
+		{nrgba, &bmp.Options{ICCProfileLink: "C:\\profil\u00e9.icc", Intent: bmp.IntentAbsoluteColorimetric}, &Profile{Intent: bmp.IntentAbsoluteColorimetric, Link: "C:\\profil\u00e9.icc"}},
+		{nrgba, &bmp.Options{Header: bmp.HeaderInfo, ICCProfile: []byte{1, 2, 3}}, &Profile{ICC: []byte{1, 2, 3}}},
+		{paletted, &bmp.Options{ICCProfile: []byte{1}, Intent: bmp.IntentRelativeColorimetric}, &Profile{Intent: bmp.IntentRelativeColorimetric, ICC: []byte{1}}},
+		{opaque, &bmp.Options{BitsPerPixel: 4, Compression: bmp.CompressionRLE4, ICCProfile: []byte{4, 5}}, &Profile{ICC: []byte{4, 5}}},
+	}
+	for i, test := range tests {
+		t.Run(strconv.Itoa(i), func(t *testing.T) {
+			var b bytes.Buffer
+			if err := EncodeV5(&b, test.m, test.opts); err != nil {
+				t.Fatalf("EncodeV5() = %v; want nil", err)
+			}
+			img, p, err := DecodeV5(&b, nil)
+			if err != nil {
+				t.Fatalf("DecodeV5() = _, _, %v; want nil", err)
+			}
+			if !reflect.DeepEqual(p, test.want) {
+				t.Errorf("DecodeV5() = _, %+v, _; want %+v", p, test.want)
+			}
+			if b.Len() != 0 {
+				t.Errorf("DecodeV5() left %d bytes", b.Len())
+			}
+			compare(t, test.m, img)
+		})
+	}
+}
+
+func TestDecodeV5Earlier(t *testing.T) {
+	var b bytes.Buffer
+	if err := Encode(&b, image.NewGray(image.Rect(0, 0, 2, 2))); err != nil {
+		t.Fatalf("Encode() = %v; want nil", err)
+	}
+	if _, p, err := DecodeV5(&b, nil); p != nil || err != nil {
+		t.Errorf("DecodeV5() = _, %v, %v; want nil, nil", p, err)
+	}
+}
+
+func TestDecodeV5ShouldFail(t *testing.T) {
+	var b bytes.Buffer
+	if err := EncodeV5(&b, image.NewNRGBA(image.Rect(0, 0, 2, 2)), &bmp.Options{ICCProfile: []byte("profile")}); err != nil {
+		t.Fatalf("EncodeV5() = %v; want nil", err)
+	}
+	in := b.Bytes()
+	if _, _, err := DecodeV5(bytes.NewReader(in[:len(in)-1]), nil); err != io.ErrUnexpectedEOF {
+		t.Errorf("DecodeV5() = _, _, %v; want %v", err, io.ErrUnexpectedEOF)
+	}
+	// Point the profile into the pixels.
+	in[112] = 0
+	if _, _, err := DecodeV5(bytes.NewReader(in), nil); err == nil || err.Error() != "bmp: invalid format: invalid profile offset" {
+		t.Errorf("DecodeV5() = _, _, %v; want invalid profile offset", err)
+	}
+}
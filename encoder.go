@@ -0,0 +1,183 @@
+package bmp
+
+import (
+	"errors"
+	"image"
+	"io"
+)
+
+// Encoder writes a BMP image row by row, so images larger than
+// the available memory can be generated.
+type Encoder struct {
+	e *encoder
+	// row holds the row being written in the pixel format of the Encoder,
+	// and b holds it in the output format.
+	row, b        []byte
+	y, y1, yDelta int
+	written       int
+	// data holds the compressed row and n is the size of the compressed pixels written so far.
+	data []byte
+	n    int64
+	// opaqueOnly makes non-opaque rows rejected.
+	opaqueOnly bool
+	err        error
+}
+
+// NewEncoder writes the headers of a width x height image with the pixels
+// in format f to w and returns an Encoder writing its rows.
+// The options and the formats are the same as in EncodeRaw.
+// Dithering, quantization, Drawer and CompressionAuto are not supported
+// since they need the whole image.
+// CompressionRLE4 is only supported if w is an io.WriteSeeker, in which case
+// the sizes in the headers are patched by Close.
+func NewEncoder(w io.Writer, width, height int, f PixelFormat, opts *Options) (*Encoder, error) {
+	if !f.valid() || f == Paletted8 {
+		return nil, UnsupportedError("pixel format " + f.String())
+	}
+	if width < 0 || height < 0 {
+		return nil, FormatError("negative bounds")
+	}
+	if opts != nil {
+		if _, ok := w.(io.WriteSeeker); opts.Compression == CompressionAuto || (opts.Compression == CompressionRLE4 && !ok) || opts.Dither || opts.Quantizer != nil || opts.Drawer != nil {
+			return nil, UnsupportedError("compression, quantization or dithering of a streamed image")
+		}
+	}
+	enc := &Encoder{row: make([]byte, f.Stride(width))}
+	if opts != nil && opts.Alpha == AlphaOpaqueOnly {
+		// The rows are checked as they are written.
+		o := *opts
+		o.Alpha = AlphaStraight
+		opts = &o
+		enc.opaqueOnly = f == BGRA32 || f == RGBA32
+	}
+	// The image has all its rows in enc.row.
+	m, opts := newRawImage(enc.row, 0, f, image.Rect(0, 0, width, height), opts)
+	e, err := newEncoder(w, width, height, opts)
+	if err != nil {
+		return nil, err
+	}
+	if err := e.prepare(m); err != nil {
+		return nil, err
+	}
+	if err := e.writeHeader(); err != nil {
+		return nil, err
+	}
+	enc.e = e
+	enc.b = make([]byte, e.step)
+	enc.y, enc.y1, enc.yDelta = e.rows()
+	if width == 0 {
+		// There are no pixels to write.
+		enc.y = enc.y1
+	}
+	return enc, nil
+}
+
+// WriteRow writes the next row of pixels stored in the pixel format of enc.
+// Rows are written in the order they are stored: from top to bottom
+// if Options.TopDown is set, and from bottom to top otherwise.
+func (enc *Encoder) WriteRow(row []byte) error {
+	if enc.err != nil {
+		return enc.err
+	}
+	if enc.y == enc.y1 {
+		return errors.New("bmp: too many rows")
+	}
+	if len(row) < len(enc.row) {
+		return errors.New("bmp: row too short")
+	}
+	if enc.opaqueOnly && !opaqueRow(row[:len(enc.row)]) {
+		return FormatError("non-opaque image")
+	}
+	copy(enc.row, row)
+	b := enc.b
+	if enc.e.opts.Compression == CompressionRLE4 {
+		enc.data = enc.e.compressRow(enc.data[:0], enc.b, enc.y)
+		b = enc.data
+		enc.n += int64(len(b))
+	} else {
+		enc.e.row(b, enc.y)
+	}
+	if _, err := enc.e.w.Write(b); err != nil {
+		enc.err = err
+		return err
+	}
+	enc.y += enc.yDelta
+	enc.written++
+	enc.e.progress(enc.written)
+	return nil
+}
+
+// Close writes the data following the pixels. It returns an error
+// if not all rows were written. It does not close the underlying writer.
+func (enc *Encoder) Close() error {
+	if enc.err != nil {
+		return enc.err
+	}
+	if enc.y != enc.y1 {
+		enc.err = errors.New("bmp: not all rows written")
+		return enc.err
+	}
+	enc.err = errors.New("bmp: encoder closed")
+	if enc.e.opts.Compression == CompressionRLE4 {
+		if enc.n == 0 {
+			// No rows were written.
+			enc.data = enc.e.compressRow(enc.data[:0], nil, -1)
+			if _, err := enc.e.w.Write(enc.data); err != nil {
+				return err
+			}
+			enc.n += int64(len(enc.data))
+		}
+		if err := enc.e.patchSizes(enc.n); err != nil {
+			return err
+		}
+	}
+	return enc.e.writeTrailer()
+}
+
+// ImageEncoder writes whole images one after another with the same options.
+// Unlike EncodeWithOptions, it keeps its buffers between the images,
+// which reduces allocations when many images are converted.
+// An ImageEncoder is not safe for concurrent use.
+type ImageEncoder struct {
+	w       io.Writer
+	opts    Options
+	scratch scratch
+}
+
+// NewImageEncoder returns an ImageEncoder writing images to w with the given options.
+func NewImageEncoder(w io.Writer, opts *Options) *ImageEncoder {
+	enc := &ImageEncoder{w: w}
+	if opts != nil {
+		enc.opts = *opts
+	}
+	return enc
+}
+
+// Reset makes enc write the next images to w, keeping its buffers.
+func (enc *ImageEncoder) Reset(w io.Writer) { enc.w = w }
+
+// Encode writes the image m in BMP format.
+// The image is not retained after Encode returns.
+func (enc *ImageEncoder) Encode(m image.Image) error {
+	d := m.Bounds().Size()
+	if d.X < 0 || d.Y < 0 {
+		return FormatError("negative bounds")
+	}
+	e, err := newEncoder(enc.w, d.X, d.Y, &enc.opts)
+	if err != nil {
+		return err
+	}
+	// The buffers are free for the next image however this one ends.
+	enc.scratch.n = 0
+	e.scratch = &enc.scratch
+	defer func() {
+		enc.scratch.n = 0
+		e.scratch = nil
+		e.release()
+	}()
+	e.lazyOpacity = true
+	if err := e.prepare(m); err != nil {
+		return err
+	}
+	return e.writeAll()
+}
@@ -0,0 +1,304 @@
+package bmp
+
+import (
+	"bytes"
+	"errors"
+	"image"
+	"image/color"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+func TestEncoder(t *testing.T) {
+	in := mustReadFile("testdata/rgb24.bmp")
+	c, err := DecodeConfig(bytes.NewReader(in))
+	if err != nil {
+		t.Fatalf("DecodeConfig() = _, %v; want nil", err)
+	}
+	for _, f := range []PixelFormat{Gray8, RGB555, RGB565, BGR24, BGRA32, RGBA32} {
+		for _, opts := range []*Options{
+			nil,
+			{TopDown: true},
+			{BitsPerPixel: 4},
+			{Header: HeaderV5, ICCProfile: []byte("profile")},
+		} {
+			t.Run(f.String(), func(t *testing.T) {
+				stride := f.Stride(c.Width)
+				pix := make([]byte, stride*c.Height)
+				if _, err := DecodeRaw(bytes.NewReader(in), pix, stride, f); err != nil {
+					t.Fatalf("DecodeRaw() = _, %v; want nil", err)
+				}
+				var expected bytes.Buffer
+				if err := EncodeRaw(&expected, c.Width, c.Height, stride, f, pix, opts); err != nil {
+					t.Fatalf("EncodeRaw() = %v; want nil", err)
+				}
+				var buf bytes.Buffer
+				enc, err := NewEncoder(&buf, c.Width, c.Height, f, opts)
+				if err != nil {
+					t.Fatalf("NewEncoder() = _, %v; want nil", err)
+				}
+				y0, y1, yDelta := c.Height-1, -1, -1
+				if opts != nil && opts.TopDown {
+					y0, y1, yDelta = 0, c.Height, 1
+				}
+				for y := y0; y != y1; y += yDelta {
+					if err := enc.WriteRow(pix[y*stride : (y+1)*stride]); err != nil {
+						t.Fatalf("WriteRow() = %v; want nil", err)
+					}
+				}
+				if err := enc.WriteRow(pix[:stride]); err == nil {
+					t.Error("WriteRow() = nil; want non-nil")
+				}
+				if err := enc.Close(); err != nil {
+					t.Fatalf("Close() = %v; want nil", err)
+				}
+				if !bytes.Equal(buf.Bytes(), expected.Bytes()) {
+					t.Error("Encoder output differs from EncodeRaw()")
+				}
+			})
+		}
+	}
+}
+
+func TestEncoderErrors(t *testing.T) {
+	for _, opts := range []*Options{
+		{Compression: CompressionRLE4},
+		{Compression: CompressionAuto},
+		{Bilevel: true, Dither: true},
+	} {
+		if _, err := NewEncoder(ioutil.Discard, 2, 2, BGR24, opts); err == nil {
+			t.Errorf("NewEncoder(%+v) = _, nil; want non-nil", opts)
+		}
+	}
+	if _, err := NewEncoder(ioutil.Discard, 2, 2, Paletted8, nil); err == nil {
+		t.Error("NewEncoder() = _, nil; want non-nil")
+	}
+	enc, err := NewEncoder(ioutil.Discard, 2, 2, BGR24, nil)
+	if err != nil {
+		t.Fatalf("NewEncoder() = _, %v; want nil", err)
+	}
+	if err := enc.WriteRow(make([]byte, 5)); err == nil {
+		t.Error("WriteRow() = nil; want non-nil")
+	}
+	if err := enc.WriteRow(make([]byte, 6)); err != nil {
+		t.Fatalf("WriteRow() = %v; want nil", err)
+	}
+	if err := enc.Close(); err == nil {
+		t.Error("Close() = nil; want non-nil")
+	}
+	// An empty image has no rows.
+	var buf bytes.Buffer
+	if enc, err = NewEncoder(&buf, 0, 3, BGR24, nil); err != nil {
+		t.Fatalf("NewEncoder() = _, %v; want nil", err)
+	}
+	if err := enc.Close(); err != nil {
+		t.Fatalf("Close() = %v; want nil", err)
+	}
+	var expected bytes.Buffer
+	if err := Encode(&expected, image.NewRGBA(image.Rect(0, 0, 0, 3))); err != nil {
+		t.Fatalf("Encode() = %v; want nil", err)
+	}
+	if !bytes.Equal(buf.Bytes(), expected.Bytes()) {
+		t.Error("Encoder output differs from Encode()")
+	}
+}
+
+// seekBuffer is an in-memory io.ReadWriteSeeker.
+type seekBuffer struct {
+	b   []byte
+	off int
+}
+
+func (s *seekBuffer) Read(p []byte) (int, error) {
+	if s.off >= len(s.b) {
+		return 0, io.EOF
+	}
+	n := copy(p, s.b[s.off:])
+	s.off += n
+	return n, nil
+}
+
+func (s *seekBuffer) Write(p []byte) (int, error) {
+	if n := s.off + len(p); n > len(s.b) {
+		s.b = append(s.b, make([]byte, n-len(s.b))...)
+	}
+	copy(s.b[s.off:], p)
+	s.off += len(p)
+	return len(p), nil
+}
+
+func (s *seekBuffer) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += int64(s.off)
+	case io.SeekEnd:
+		offset += int64(len(s.b))
+	}
+	if offset < 0 {
+		return 0, errors.New("negative position")
+	}
+	s.off = int(offset)
+	return offset, nil
+}
+
+func TestEncodeRLE4Seeker(t *testing.T) {
+	img, err := Decode(bytes.NewReader(mustReadFile("testdata/pal4.bmp")))
+	if err != nil {
+		t.Fatalf("Decode() = _, %v; want nil", err)
+	}
+	gray := image.NewGray(image.Rect(0, 0, 37, 21))
+	for i := range gray.Pix {
+		gray.Pix[i] = uint8(i / 40 * 17)
+	}
+	for _, opts := range []*Options{
+		{Compression: CompressionRLE4},
+		{Compression: CompressionRLE4, ICCProfile: []byte("profile")},
+	} {
+		var expected bytes.Buffer
+		if err := EncodeWithOptions(&expected, img, opts); err != nil {
+			t.Fatalf("EncodeWithOptions() = %v; want nil", err)
+		}
+		// The header is patched relative to the initial position.
+		s := &seekBuffer{}
+		s.Write([]byte("prefix"))
+		if err := EncodeWithOptions(s, img, opts); err != nil {
+			t.Fatalf("EncodeWithOptions() = %v; want nil", err)
+		}
+		if !bytes.Equal(s.b[6:], expected.Bytes()) {
+			t.Error("EncodeWithOptions() output to an io.WriteSeeker differs")
+		}
+		for _, height := range []int{gray.Rect.Dy(), 0} {
+			pix := gray.Pix[:height*gray.Stride]
+			expected.Reset()
+			if err := EncodeRaw(&expected, gray.Rect.Dx(), height, gray.Stride, Gray8, pix, opts); err != nil {
+				t.Fatalf("EncodeRaw() = %v; want nil", err)
+			}
+			s := &seekBuffer{}
+			enc, err := NewEncoder(s, gray.Rect.Dx(), height, Gray8, opts)
+			if err != nil {
+				t.Fatalf("NewEncoder() = _, %v; want nil", err)
+			}
+			for y := height - 1; y >= 0; y-- {
+				if err := enc.WriteRow(pix[y*gray.Stride : (y+1)*gray.Stride]); err != nil {
+					t.Fatalf("WriteRow() = %v; want nil", err)
+				}
+			}
+			if err := enc.Close(); err != nil {
+				t.Fatalf("Close() = %v; want nil", err)
+			}
+			if !bytes.Equal(s.b, expected.Bytes()) {
+				t.Errorf("Encoder output for height %d differs from EncodeRaw()", height)
+			}
+		}
+	}
+	if _, err := NewEncoder(ioutil.Discard, 1, 1, Gray8, &Options{Compression: CompressionRLE4}); err == nil {
+		t.Error("NewEncoder() = _, nil; want non-nil")
+	}
+}
+
+func TestImageEncoder(t *testing.T) {
+	files, err := filepath.Glob("testdata/*.bmp")
+	if err != nil {
+		panic("failed to list test files: " + err.Error())
+	}
+	var imgs []image.Image
+	for _, file := range files {
+		img, err := Decode(bytes.NewReader(mustReadFile(file)))
+		if err != nil {
+			t.Fatalf("Decode() = _, %v; want nil", err)
+		}
+		sub := img.(interface {
+			SubImage(r image.Rectangle) image.Image
+		}).SubImage(image.Rect(3, 5, 40, 9))
+		imgs = append(imgs, img, sub)
+	}
+	for _, opts := range []*Options{
+		nil,
+		{BitsPerPixel: 4},
+		{BitsPerPixel: 16, Dither: true},
+		{Bilevel: true, Dither: true},
+		{Compression: CompressionAuto},
+		{Header: HeaderCore},
+	} {
+		var buf, expected bytes.Buffer
+		enc := NewImageEncoder(ioutil.Discard, opts)
+		for _, img := range imgs {
+			buf.Reset()
+			expected.Reset()
+			enc.Reset(&buf)
+			if err := enc.Encode(img); err != nil {
+				t.Fatalf("Encode() = %v; want nil", err)
+			}
+			if err := EncodeWithOptions(&expected, img, opts); err != nil {
+				t.Fatalf("EncodeWithOptions() = %v; want nil", err)
+			}
+			if !bytes.Equal(buf.Bytes(), expected.Bytes()) {
+				t.Fatalf("Encode() output with %+v differs from EncodeWithOptions()", opts)
+			}
+		}
+	}
+	img := imgs[0]
+	opts := &Options{BitsPerPixel: 2}
+	enc := NewImageEncoder(ioutil.Discard, opts)
+	reused := testing.AllocsPerRun(10, func() { enc.Encode(img) })
+	allocated := testing.AllocsPerRun(10, func() { EncodeWithOptions(ioutil.Discard, img, opts) })
+	if reused >= allocated {
+		t.Errorf("Encode() allocations = %v; want < %v", reused, allocated)
+	}
+}
+
+func TestImageEncoderSequence(t *testing.T) {
+	paletted := image.NewPaletted(image.Rect(0, 0, 7, 3), color.Palette{color.Black, color.White, color.NRGBA{0xFF, 0, 0, 0xFF}})
+	for i := range paletted.Pix {
+		paletted.Pix[i] = uint8(i % 3)
+	}
+	nrgba := image.NewNRGBA(image.Rect(2, 1, 35, 6))
+	for i := range nrgba.Pix {
+		nrgba.Pix[i] = uint8(i * 7919 >> 3)
+	}
+	gray := image.NewGray(image.Rect(0, 0, 100, 1))
+	for i := range gray.Pix {
+		gray.Pix[i] = uint8(i * 5)
+	}
+	rgba := image.NewRGBA(image.Rect(0, 0, 2, 40))
+	for i := range rgba.Pix {
+		rgba.Pix[i] = uint8(i * 13)
+		if i%4 == 3 {
+			rgba.Pix[i] = 0xFF
+		}
+	}
+	nrgba64 := image.NewNRGBA64(image.Rect(0, 0, 5, 5))
+	for i := range nrgba64.Pix {
+		nrgba64.Pix[i] = uint8(i * 31)
+	}
+	imgs := []image.Image{paletted, nrgba, gray, rgba, nrgba64, image.NewGray(image.Rect(0, 0, 0, 0)), paletted}
+	for _, opts := range []*Options{
+		nil,
+		{Compression: CompressionAuto},
+		{BitsPerPixel: 8, Dither: true},
+		// Only the images written with a color table of at least 3 colors succeed.
+		{ImportantColors: 3},
+	} {
+		enc := NewImageEncoder(ioutil.Discard, opts)
+		for i, img := range imgs {
+			var buf, expected bytes.Buffer
+			err := EncodeWithOptions(&expected, img, opts)
+			// Fail the previous image while its rows are written.
+			enc.Reset(&headerWriter{n: fileHeaderLen + infoHeaderLen + 1})
+			enc.Encode(imgs[(i+len(imgs)-1)%len(imgs)])
+			enc.Reset(&buf)
+			if got := enc.Encode(img); (got == nil) != (err == nil) || (err != nil && got.Error() != err.Error()) {
+				t.Fatalf("%d: Encode() with %+v = %v; want %v", i, opts, got, err)
+			}
+			if enc.scratch.n != 0 {
+				t.Errorf("%d: %d buffers in use after Encode()", i, enc.scratch.n)
+			}
+			if err == nil && !bytes.Equal(buf.Bytes(), expected.Bytes()) {
+				t.Fatalf("%d: Encode() output with %+v differs from EncodeWithOptions()", i, opts)
+			}
+		}
+	}
+}
@@ -3,13 +3,14 @@ package bmp_test
 import (
 	"image/color"
 	"image/draw"
+	"io"
 	"os"
 
 	"github.com/sergeymakinen/go-bmp"
 )
 
 func Example() {
-	f, _ := os.Open("file.bmp")
+	f, _ := os.OpenFile("file.bmp", os.O_RDWR, 0)
 	img, _ := bmp.Decode(f)
 	for i := 10; i < 20; i++ {
 		img.(draw.Image).Set(i, i, color.NRGBA{
@@ -19,7 +20,8 @@ func Example() {
 			A: 255,
 		})
 	}
-	f.Truncate(0)
-	bmp.Encode(f, img)
+	// Rewrite the pixels in place.
+	f.Seek(0, io.SeekStart)
+	bmp.Update(f, img)
 	f.Close()
 }
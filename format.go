@@ -0,0 +1,244 @@
+package bmp
+
+import (
+	"encoding/binary"
+	"image/color"
+	"strconv"
+)
+
+// PixelFormat describes the memory layout of raw pixels.
+type PixelFormat int
+
+const (
+	// Paletted8 stores every pixel as a 1-byte palette index.
+	Paletted8 PixelFormat = iota + 1
+	// Gray8 stores every pixel as a 1-byte luminance value.
+	Gray8
+	// RGB555 stores every pixel as a little-endian uint16 with 5 bits per channel
+	// and the most significant bit unused.
+	RGB555
+	// RGB565 stores every pixel as a little-endian uint16 with 5 bits for red,
+	// 6 bits for green and 5 bits for blue.
+	RGB565
+	// BGR24 stores every pixel as 3 bytes in blue, green, red order.
+	BGR24
+	// BGRA32 stores every pixel as 4 bytes in blue, green, red, alpha order.
+	// The alpha is not premultiplied.
+	BGRA32
+	// RGBA32 stores every pixel as 4 bytes in red, green, blue, alpha order.
+	// The alpha is not premultiplied.
+	RGBA32
+)
+
+var pixelFormatNames = map[PixelFormat]string{
+	Paletted8: "Paletted8",
+	Gray8:     "Gray8",
+	RGB555:    "RGB555",
+	RGB565:    "RGB565",
+	BGR24:     "BGR24",
+	BGRA32:    "BGRA32",
+	RGBA32:    "RGBA32",
+}
+
+func (f PixelFormat) String() string {
+	if s, ok := pixelFormatNames[f]; ok {
+		return s
+	}
+	return "PixelFormat(" + strconv.Itoa(int(f)) + ")"
+}
+
+func (f PixelFormat) valid() bool { return f >= Paletted8 && f <= RGBA32 }
+
+// BytesPerPixel returns the number of bytes used by a single pixel,
+// or 0 if f is not a valid pixel format.
+func (f PixelFormat) BytesPerPixel() int {
+	switch f {
+	case Paletted8, Gray8:
+		return 1
+	case RGB555, RGB565:
+		return 2
+	case BGR24:
+		return 3
+	case BGRA32, RGBA32:
+		return 4
+	}
+	return 0
+}
+
+// Stride returns the number of bytes between vertically adjacent pixels
+// of a tightly packed image that is width pixels wide.
+func (f PixelFormat) Stride(width int) int { return width * f.BytesPerPixel() }
+
+// Size returns the number of bytes needed to store a tightly packed image
+// that is width pixels wide and height pixels tall.
+func (f PixelFormat) Size(width, height int) int { return f.Stride(width) * height }
+
+// expand5 and expand6 map 5 and 6-bit color channels to 8 bits,
+// replicating the high bits in the low ones so the maximum value maps to 0xFF.
+var (
+	expand5 [1 << 5]uint8
+	expand6 [1 << 6]uint8
+)
+
+// unpackTables map the bytes of 1, 2 and 4 bit-per-pixel pixels to the 8, 4 or 2
+// palette indexes they hold, most significant bits first. The table of bpp
+// bits per pixel is unpackTables[bpp>>1].
+var unpackTables [3][256][8]uint8
+
+func init() {
+	for i := range expand5 {
+		expand5[i] = uint8(i<<3 | i>>2)
+	}
+	for i := range expand6 {
+		expand6[i] = uint8(i<<2 | i>>4)
+	}
+	for _, bpp := range []uint{1, 2, 4} {
+		t := &unpackTables[bpp>>1]
+		for b := range t {
+			for i := uint(0); i < 8/bpp; i++ {
+				t[b][i] = uint8(b>>(8-bpp*(i+1))) & (1<<bpp - 1)
+			}
+		}
+	}
+}
+
+// load returns the i-th pixel of b as non-alpha-premultiplied 8-bit color channels.
+// p is the palette used by Paletted8 pixels.
+func (f PixelFormat) load(b []byte, i int, p []color.RGBA) (r, g, bl, a uint8) {
+	switch f {
+	case Paletted8:
+		if int(b[i]) >= len(p) {
+			return 0, 0, 0, 0xFF
+		}
+		c := p[b[i]]
+		return c.R, c.G, c.B, 0xFF
+	case Gray8:
+		return b[i], b[i], b[i], 0xFF
+	case RGB555:
+		pixel := readUint16(b[2*i:])
+		return expand5[(pixel&0x7C00)>>10], expand5[(pixel&0x3E0)>>5], expand5[pixel&0x1F], 0xFF
+	case RGB565:
+		pixel := readUint16(b[2*i:])
+		return expand5[(pixel&0xF800)>>11], expand6[(pixel&0x7E0)>>5], expand5[pixel&0x1F], 0xFF
+	case BGR24:
+		// The pixels are sliced to their size for a single bounds check.
+		s := b[3*i : 3*i+3]
+		return s[2], s[1], s[0], 0xFF
+	case BGRA32:
+		s := b[4*i : 4*i+4]
+		return s[2], s[1], s[0], s[3]
+	case RGBA32:
+		s := b[4*i : 4*i+4]
+		return s[0], s[1], s[2], s[3]
+	}
+	panic("unreachable")
+}
+
+// store sets the i-th pixel of b to the given non-alpha-premultiplied 8-bit color channels.
+// Storing to Paletted8 is not supported.
+func (f PixelFormat) store(b []byte, i int, r, g, bl, a uint8) {
+	switch f {
+	case Gray8:
+		// This formula is the same as in color.GrayModel.
+		b[i] = uint8((19595*uint32(r)*0x101 + 38470*uint32(g)*0x101 + 7471*uint32(bl)*0x101 + 1<<15) >> 24)
+	case RGB555:
+		// Round to the nearest 5-bit value.
+		pixel := uint16((uint32(r)*31+127)/255)<<10 | uint16((uint32(g)*31+127)/255)<<5 | uint16((uint32(bl)*31+127)/255)
+		binary.LittleEndian.PutUint16(b[2*i:], pixel)
+	case RGB565:
+		// Round to the nearest 5 or 6-bit value.
+		pixel := uint16((uint32(r)*31+127)/255)<<11 | uint16((uint32(g)*63+127)/255)<<5 | uint16((uint32(bl)*31+127)/255)
+		binary.LittleEndian.PutUint16(b[2*i:], pixel)
+	case BGR24:
+		s := b[3*i : 3*i+3]
+		s[0], s[1], s[2] = bl, g, r
+	case BGRA32:
+		s := b[4*i : 4*i+4]
+		s[0], s[1], s[2], s[3] = bl, g, r, a
+	case RGBA32:
+		s := b[4*i : 4*i+4]
+		s[0], s[1], s[2], s[3] = r, g, bl, a
+	default:
+		panic("unreachable")
+	}
+}
+
+// swapRB32Generic stores the 4-byte pixels of src in dst with their first and third
+// bytes swapped, converting between RGBA and BGRA. If opaque is true,
+// the alpha is set to 0xFF. Four pixels are converted at a time.
+func swapRB32Generic(dst, src []byte, opaque bool) {
+	var alpha uint64
+	if opaque {
+		alpha = 0xFF000000FF000000
+	}
+	dst = dst[:len(src)]
+	n := len(src) &^ 15
+	for i := 0; i < n; i += 16 {
+		v := binary.LittleEndian.Uint64(src[i:])
+		w := binary.LittleEndian.Uint64(src[i+8:])
+		binary.LittleEndian.PutUint64(dst[i:], swapRB64(v)|alpha)
+		binary.LittleEndian.PutUint64(dst[i+8:], swapRB64(w)|alpha)
+	}
+	if n+8 <= len(src) {
+		v := binary.LittleEndian.Uint64(src[n:])
+		binary.LittleEndian.PutUint64(dst[n:], swapRB64(v)|alpha)
+		n += 8
+	}
+	if n < len(src) {
+		dst[n+0], dst[n+1], dst[n+2], dst[n+3] = src[n+2], src[n+1], src[n+0], src[n+3]|uint8(alpha>>56)
+	}
+}
+
+// swapRB64 swaps the first and third bytes of the two 4-byte pixels in v.
+func swapRB64(v uint64) uint64 {
+	return v&0xFF00FF00FF00FF00 | (v&0x000000FF000000FF)<<16 | (v>>16)&0x000000FF000000FF
+}
+
+// copyOpaque32 copies the 4-byte pixels of src to dst with their alpha,
+// the fourth byte, set to 0xFF. Two pixels are copied at a time.
+func copyOpaque32(dst, src []byte) {
+	dst = dst[:len(src)]
+	n := len(src) &^ 7
+	for i := 0; i < n; i += 8 {
+		binary.LittleEndian.PutUint64(dst[i:], binary.LittleEndian.Uint64(src[i:])|0xFF000000FF000000)
+	}
+	if n < len(src) {
+		dst[n+0], dst[n+1], dst[n+2], dst[n+3] = src[n+0], src[n+1], src[n+2], 0xFF
+	}
+}
+
+// rgbaToBGRGeneric stores the 4-byte RGBA pixels of src in dst as 3-byte BGR ones,
+// discarding the alpha, and reports whether they were all fully opaque.
+// Two pixels are converted at a time.
+func rgbaToBGRGeneric(dst, src []byte) (opaque bool) {
+	n := len(src) &^ 7
+	j := 0
+	alpha := uint64(0xFF000000FF000000)
+	for i := 0; i < n; i, j = i+8, j+6 {
+		v := binary.LittleEndian.Uint64(src[i:])
+		alpha &= v
+		w := uint32(v>>16&0xFF | v&0xFF00 | (v&0xFF)<<16 | (v>>48&0xFF)<<24)
+		binary.LittleEndian.PutUint32(dst[j:], w)
+		binary.LittleEndian.PutUint16(dst[j+4:], uint16(v>>40&0xFF|(v>>32&0xFF)<<8))
+	}
+	opaque = alpha == 0xFF000000FF000000
+	for i := n; i < len(src); i, j = i+4, j+3 {
+		dst[j+0], dst[j+1], dst[j+2] = src[i+2], src[i+1], src[i+0]
+		opaque = opaque && src[i+3] == 0xFF
+	}
+	return opaque
+}
+
+// bgrToRGBAGeneric stores the 3-byte BGR pixels of src in dst as opaque 4-byte RGBA ones.
+// Every pixel is loaded and stored at once.
+func bgrToRGBAGeneric(dst, src []byte) {
+	i, j := 0, 0
+	// The load reads the first byte of the next pixel.
+	for ; j+4 <= len(src); i, j = i+4, j+3 {
+		v := binary.LittleEndian.Uint32(src[j:])
+		binary.LittleEndian.PutUint32(dst[i:], v>>16&0xFF|v&0xFF00|(v&0xFF)<<16|0xFF000000)
+	}
+	for ; j < len(src); i, j = i+4, j+3 {
+		dst[i+0], dst[i+1], dst[i+2], dst[i+3] = src[j+2], src[j+1], src[j+0], 0xFF
+	}
+}
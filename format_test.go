@@ -0,0 +1,80 @@
+package bmp
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestSwizzle(t *testing.T) {
+	// The sizes cover the blocks of the SIMD implementations and their tails.
+	for n := 0; n <= 40; n++ {
+		src := make([]byte, n*4)
+		for i := range src {
+			src[i] = uint8(i*37 + 1)
+		}
+		for _, opaque := range []bool{false, true} {
+			expected := make([]byte, n*4)
+			for i := 0; i < len(src); i += 4 {
+				expected[i+0], expected[i+1], expected[i+2], expected[i+3] = src[i+2], src[i+1], src[i+0], src[i+3]
+				if opaque {
+					expected[i+3] = 0xFF
+				}
+			}
+			dst := make([]byte, n*4)
+			swapRB32(dst, src, opaque)
+			if !bytes.Equal(dst, expected) {
+				t.Errorf("swapRB32(_, %v, %t) = %v; want %v", src, opaque, dst, expected)
+			}
+		}
+		expected := append([]byte(nil), src...)
+		for i := 3; i < len(expected); i += 4 {
+			expected[i] = 0xFF
+		}
+		dst := make([]byte, n*4)
+		copyOpaque32(dst, src)
+		if !bytes.Equal(dst, expected) {
+			t.Errorf("copyOpaque32(_, %v) = %v; want %v", src, dst, expected)
+		}
+		expected = make([]byte, n*3)
+		for i, j := 0, 0; i < len(src); i, j = i+4, j+3 {
+			expected[j+0], expected[j+1], expected[j+2] = src[i+2], src[i+1], src[i+0]
+		}
+		dst = make([]byte, n*3)
+		if rgbaToBGR(dst, src) && n > 0 {
+			t.Errorf("rgbaToBGR(_, %v) = true; want false", src)
+		}
+		if !bytes.Equal(dst, expected) {
+			t.Errorf("rgbaToBGR(_, %v) = %v; want %v", src, dst, expected)
+		}
+		opaque := append([]byte(nil), src...)
+		for i := 3; i < len(opaque); i += 4 {
+			opaque[i] = 0xFF
+		}
+		if n > 0 && !rgbaToBGR(dst, opaque) {
+			t.Errorf("rgbaToBGR(_, %v) = false; want true", opaque)
+		}
+		for i := 3; i < len(opaque); i += 4 {
+			opaque[i] = 0xFE
+			if rgbaToBGR(dst, opaque) {
+				t.Errorf("rgbaToBGR(_, %v) = true; want false", opaque)
+			}
+			opaque[i] = 0xFF
+		}
+		bgr := expected
+		expected = make([]byte, n*4)
+		for i, j := 0, 0; j < len(bgr); i, j = i+4, j+3 {
+			expected[i+0], expected[i+1], expected[i+2], expected[i+3] = bgr[j+2], bgr[j+1], bgr[j+0], 0xFF
+		}
+		dst = make([]byte, n*4)
+		bgrToRGBA(dst, bgr)
+		if !bytes.Equal(dst, expected) {
+			t.Errorf("bgrToRGBA(_, %v) = %v; want %v", bgr, dst, expected)
+		}
+		// The BGR pixels may be stored at the end of the RGBA ones.
+		copy(dst[n:], bgr)
+		bgrToRGBA(dst, dst[n:])
+		if !bytes.Equal(dst, expected) {
+			t.Errorf("bgrToRGBA(_, %v) in place = %v; want %v", bgr, dst, expected)
+		}
+	}
+}
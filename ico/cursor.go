@@ -0,0 +1,114 @@
+package ico
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"image"
+	"io"
+	"io/ioutil"
+
+	"github.com/sergeymakinen/go-bmp"
+)
+
+const (
+	// dirHeaderLen and dirEntryLen are the sizes of ICONDIR and ICONDIRENTRY.
+	dirHeaderLen = 6
+	dirEntryLen  = 16
+	// typeCursor is the type of CUR files in their ICONDIR.
+	typeCursor = 2
+	// maxSize is the largest width and height of the images in the directory.
+	maxSize = 256
+)
+
+// Cursor is an image of a CUR file along with its hotspot.
+type Cursor struct {
+	Image image.Image
+
+	// Hotspot is the point of Image that is the position of the pointer.
+	Hotspot image.Point
+}
+
+// DecodeCursors reads a CUR file from r and returns its images, decoded like
+// by Decode, with their hotspots, in the order of the directory.
+// The whole file is read into memory since the images may be stored in any order.
+func DecodeCursors(r io.Reader) ([]Cursor, error) {
+	b, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	if len(b) < dirHeaderLen || binary.LittleEndian.Uint16(b[0:]) != 0 || binary.LittleEndian.Uint16(b[2:]) != typeCursor {
+		return nil, bmp.FormatError("not a CUR file")
+	}
+	n := int(binary.LittleEndian.Uint16(b[4:]))
+	if len(b) < dirHeaderLen+n*dirEntryLen {
+		return nil, io.ErrUnexpectedEOF
+	}
+	cursors := make([]Cursor, n)
+	for i := range cursors {
+		e := b[dirHeaderLen+i*dirEntryLen:]
+		size, offset := binary.LittleEndian.Uint32(e[8:]), binary.LittleEndian.Uint32(e[12:])
+		if uint64(offset)+uint64(size) > uint64(len(b)) {
+			return nil, bmp.FormatError("invalid image offset")
+		}
+		m, err := Decode(bytes.NewReader(b[offset : offset+size]))
+		if err != nil {
+			return nil, err
+		}
+		cursors[i] = Cursor{
+			Image:   m,
+			Hotspot: image.Pt(int(binary.LittleEndian.Uint16(e[4:])), int(binary.LittleEndian.Uint16(e[6:]))),
+		}
+	}
+	return cursors, nil
+}
+
+// EncodeCursors writes the cursors to w as a CUR file, with their images
+// encoded like by EncodeWithOptions with the given options. The images must be
+// at most 256 pixels wide and tall and the hotspots must be within them.
+func EncodeCursors(w io.Writer, cursors []Cursor, opts *bmp.Options) error {
+	if len(cursors) == 0 {
+		return errors.New("ico: no images")
+	}
+	if len(cursors) > 0xFFFF {
+		return errors.New("ico: too many images")
+	}
+	dir := make([]byte, dirHeaderLen+len(cursors)*dirEntryLen)
+	binary.LittleEndian.PutUint16(dir[2:], typeCursor)
+	binary.LittleEndian.PutUint16(dir[4:], uint16(len(cursors)))
+	var buf bytes.Buffer
+	for i, c := range cursors {
+		r := c.Image.Bounds()
+		if r.Dx() == 0 || r.Dy() == 0 || r.Dx() > maxSize || r.Dy() > maxSize {
+			return bmp.UnsupportedError("cursor size")
+		}
+		if !c.Hotspot.In(r) {
+			return errors.New("ico: hotspot outside of the image")
+		}
+		offset := len(dir) + buf.Len()
+		if err := EncodeWithOptions(&buf, c.Image, opts); err != nil {
+			return err
+		}
+		h := buf.Bytes()[offset-len(dir):]
+		e := dir[dirHeaderLen+i*dirEntryLen:]
+		// 256 is stored as 0.
+		e[0], e[1] = uint8(r.Dx()), uint8(r.Dy())
+		if bpp := binary.LittleEndian.Uint16(h[14:]); bpp < 8 {
+			colors := binary.LittleEndian.Uint32(h[32:])
+			if colors == 0 {
+				colors = 1 << bpp
+			}
+			e[2] = uint8(colors)
+		}
+		p := c.Hotspot.Sub(r.Min)
+		binary.LittleEndian.PutUint16(e[4:], uint16(p.X))
+		binary.LittleEndian.PutUint16(e[6:], uint16(p.Y))
+		binary.LittleEndian.PutUint32(e[8:], uint32(len(h)))
+		binary.LittleEndian.PutUint32(e[12:], uint32(offset))
+	}
+	if _, err := w.Write(dir); err != nil {
+		return err
+	}
+	_, err := w.Write(buf.Bytes())
+	return err
+}
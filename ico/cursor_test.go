@@ -0,0 +1,115 @@
+package ico
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/color"
+	"testing"
+
+	"github.com/sergeymakinen/go-bmp"
+)
+
+func TestEncodeDecodeCursors(t *testing.T) {
+	big := image.NewNRGBA(image.Rect(0, 0, 256, 256))
+	for i := range big.Pix {
+		big.Pix[i] = uint8(i)
+	}
+	small := image.NewPaletted(image.Rect(10, 20, 42, 52), color.Palette{color.Black, color.Transparent})
+	for i := range small.Pix {
+		small.Pix[i] = uint8(i % 2)
+	}
+	cursors := []Cursor{
+		{Image: big, Hotspot: image.Pt(128, 255)},
+		{Image: small, Hotspot: image.Pt(11, 22)},
+	}
+	var b bytes.Buffer
+	if err := EncodeCursors(&b, cursors, nil); err != nil {
+		t.Fatalf("EncodeCursors() = %v; want nil", err)
+	}
+	in := b.Bytes()
+	// The dimensions, the number of colors and the hotspot of the entries.
+	for i, want := range [][8]byte{
+		{0, 0, 0, 0, 128, 0, 255, 0},
+		{32, 32, 2, 0, 1, 0, 2, 0},
+	} {
+		var e [8]byte
+		copy(e[:], in[dirHeaderLen+i*dirEntryLen:])
+		if e != want {
+			t.Errorf("entry %d = %v; want %v", i, e, want)
+		}
+	}
+	got, err := DecodeCursors(&b)
+	if err != nil {
+		t.Fatalf("DecodeCursors() = _, %v; want nil", err)
+	}
+	if len(got) != len(cursors) {
+		t.Fatalf("DecodeCursors() = %d cursors; want %d", len(got), len(cursors))
+	}
+	for i, c := range cursors {
+		if want := c.Hotspot.Sub(c.Image.Bounds().Min); got[i].Hotspot != want {
+			t.Errorf("cursor %d hotspot = %v; want %v", i, got[i].Hotspot, want)
+		}
+		want := image.NewNRGBA(image.Rect(0, 0, c.Image.Bounds().Dx(), c.Image.Bounds().Dy()))
+		r := c.Image.Bounds()
+		for y := r.Min.Y; y < r.Max.Y; y++ {
+			for x := r.Min.X; x < r.Max.X; x++ {
+				want.Set(x-r.Min.X, y-r.Min.Y, c.Image.At(x, y))
+			}
+		}
+		compare(t, want, got[i].Image)
+	}
+}
+
+func TestEncodeCursorsShouldFail(t *testing.T) {
+	m := image.NewGray(image.Rect(0, 0, 2, 2))
+	tests := []struct {
+		cursors []Cursor
+		err     string
+	}{
+		{nil, "ico: no images"},
+		{[]Cursor{{Image: image.NewGray(image.Rect(0, 0, 257, 1))}}, "bmp: unsupported feature: cursor size"},
+		{[]Cursor{{Image: image.NewGray(image.Rect(0, 0, 0, 0))}}, "bmp: unsupported feature: cursor size"},
+		{[]Cursor{{Image: m, Hotspot: image.Pt(2, 0)}}, "ico: hotspot outside of the image"},
+		{[]Cursor{{Image: m}, {Image: m, Hotspot: image.Pt(0, -1)}}, "ico: hotspot outside of the image"},
+	}
+	for i, test := range tests {
+		if err := EncodeCursors(&bytes.Buffer{}, test.cursors, nil); err == nil || err.Error() != test.err {
+			t.Errorf("%d: EncodeCursors() = %v; want %s", i, err, test.err)
+		}
+	}
+	var b bytes.Buffer
+	if err := EncodeCursors(&b, []Cursor{{Image: m}}, &bmp.Options{Header: bmp.HeaderV5}); err != nil {
+		t.Fatalf("EncodeCursors() = %v; want nil", err)
+	}
+	if size := binary.LittleEndian.Uint32(b.Bytes()[dirHeaderLen+dirEntryLen:]); size != infoHeaderLen {
+		t.Errorf("header size = %d; want %d", size, infoHeaderLen)
+	}
+}
+
+func TestDecodeCursorsShouldFail(t *testing.T) {
+	var b bytes.Buffer
+	if err := EncodeCursors(&b, []Cursor{{Image: image.NewGray(image.Rect(0, 0, 2, 2))}}, nil); err != nil {
+		t.Fatalf("EncodeCursors() = %v; want nil", err)
+	}
+	in := b.Bytes()
+	icon := append([]byte(nil), in...)
+	icon[2] = 1
+	badOffset := append([]byte(nil), in...)
+	binary.LittleEndian.PutUint32(badOffset[dirHeaderLen+12:], uint32(len(in)))
+	tests := []struct {
+		b   []byte
+		err string
+	}{
+		{nil, "bmp: invalid format: not a CUR file"},
+		{icon, "bmp: invalid format: not a CUR file"},
+		{in[:dirHeaderLen+dirEntryLen-1], "unexpected EOF"},
+		{badOffset, "bmp: invalid format: invalid image offset"},
+		{in[:len(in)-1], "bmp: invalid format: invalid image offset"},
+	}
+	for i, test := range tests {
+		if _, err := DecodeCursors(bytes.NewReader(test.b)); err == nil || err.Error() != test.err {
+			t.Errorf("%d: DecodeCursors() = _, %v; want %s", i, err, test.err)
+		}
+	}
+}
@@ -0,0 +1,227 @@
+// Package ico implements a decoder and encoder of the images stored in ICO
+// and CUR files: packed DIBs, without the BITMAPFILEHEADER of BMP files,
+// whose DIB header has twice the height of the image since the pixels
+// (the XOR mask) are followed by a 1 bit-per-pixel AND mask of the same size
+// marking the transparent pixels.
+//
+// The directory of ICO files, locating and describing the images, is left
+// to the caller, and so are images stored as PNG. DecodeCursors and EncodeCursors
+// read and write whole CUR files, whose directory holds the hotspots of the images.
+package ico
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/color"
+	"io"
+
+	"github.com/sergeymakinen/go-bmp"
+	"github.com/sergeymakinen/go-bmp/dib"
+)
+
+const (
+	infoHeaderLen = 40
+	// maxHeaderLen is the largest DIB header read.
+	maxHeaderLen = 4 << 10
+)
+
+// pngHeader is the start of the images stored as PNG.
+const pngHeader = "\x89PNG"
+
+// readHeader reads the DIB header of an icon image from r and returns it
+// with the height of the image rather than of both masks, and the width
+// and height of the image.
+func readHeader(r io.Reader) (h []byte, width, height int, err error) {
+	var size [4]byte
+	if _, err := io.ReadFull(r, size[:]); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, 0, 0, err
+	}
+	if string(size[:]) == pngHeader {
+		return nil, 0, 0, bmp.UnsupportedError("PNG icon image")
+	}
+	infoLen := binary.LittleEndian.Uint32(size[:])
+	if infoLen < infoHeaderLen || infoLen > maxHeaderLen {
+		return nil, 0, 0, bmp.UnsupportedError("DIB header version")
+	}
+	h = make([]byte, infoLen)
+	copy(h, size[:])
+	if _, err := io.ReadFull(r, h[4:]); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, 0, 0, err
+	}
+	width = int(int32(binary.LittleEndian.Uint32(h[4:])))
+	// The height covers the XOR and AND masks, which are stored bottom-up.
+	height = int(int32(binary.LittleEndian.Uint32(h[8:])))
+	if width < 0 || height < 0 || height%2 != 0 {
+		return nil, 0, 0, bmp.FormatError("invalid icon dimensions")
+	}
+	height /= 2
+	binary.LittleEndian.PutUint32(h[8:], uint32(height))
+	return h, width, height, nil
+}
+
+// maskStride returns the size of a row of an AND mask of the given width.
+func maskStride(width int) int {
+	return (width + 31) / 32 * 4
+}
+
+// Decode reads an icon image from r and returns it as an *image.NRGBA
+// with the transparent pixels of the AND mask transparent.
+func Decode(r io.Reader) (image.Image, error) {
+	return DecodeWithOptions(r, nil)
+}
+
+// DecodeWithOptions reads an icon image from r with the given options
+// and returns it as an *image.NRGBA, whatever the ColorModel and ExpandPalette of opts.
+//
+// Images with 32 bits per pixel are decoded with their alpha, as Windows does,
+// unless it is 0 for all the pixels, as in icons predating the alpha channel,
+// in which case the AND mask is applied instead. The AND mask may then be missing.
+// The pixels of images with fewer bits per pixel that the AND mask marks
+// are transparent, including the ones that are not black, which Windows
+// draws inverting the colors of the screen.
+func DecodeWithOptions(r io.Reader, opts *bmp.DecodeOptions) (image.Image, error) {
+	h, width, height, err := readHeader(r)
+	if err != nil {
+		return nil, err
+	}
+	var o bmp.DecodeOptions
+	if opts != nil {
+		o = *opts
+	}
+	o.ColorModel, o.ExpandPalette = nil, true
+	m, err := dib.DecodeWithOptions(io.MultiReader(bytes.NewReader(h), r), &o)
+	if err != nil {
+		return nil, err
+	}
+	var img *image.NRGBA
+	switch m := m.(type) {
+	case *image.NRGBA:
+		img = m
+	case *image.RGBA:
+		// Images without alpha are opaque, so their pixels are the same.
+		img = &image.NRGBA{Pix: m.Pix, Stride: m.Stride, Rect: m.Rect}
+	default:
+		panic("unreachable")
+	}
+	bpp := binary.LittleEndian.Uint16(h[14:])
+	alpha := false
+	if bpp == 32 {
+		for i := 3; i < len(img.Pix); i += 4 {
+			if img.Pix[i] != 0 {
+				alpha = true
+				break
+			}
+		}
+		if !alpha {
+			for i := 3; i < len(img.Pix); i += 4 {
+				img.Pix[i] = 0xFF
+			}
+		}
+	}
+	if width == 0 || height == 0 {
+		return img, nil
+	}
+	stride := maskStride(width)
+	row := make([]byte, stride)
+	for y := height - 1; y >= 0; y-- {
+		if _, err := io.ReadFull(r, row); err != nil {
+			if err == io.EOF && bpp == 32 && y == height-1 {
+				// Icons with alpha may omit the mask.
+				return img, nil
+			}
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return nil, err
+		}
+		if alpha {
+			// The mask is read past, but the alpha is used instead.
+			continue
+		}
+		pix := img.Pix[y*img.Stride : y*img.Stride+width*4]
+		for x := 0; x < width; x++ {
+			if row[x/8]&(0x80>>uint(x%8)) != 0 {
+				pix[x*4+0], pix[x*4+1], pix[x*4+2], pix[x*4+3] = 0, 0, 0, 0
+			}
+		}
+	}
+	return img, nil
+}
+
+// DecodeConfig returns the color model and dimensions of an icon image without
+// decoding the entire image. The color model is color.NRGBAModel.
+// The header is consumed.
+func DecodeConfig(r io.Reader) (image.Config, error) {
+	_, width, height, err := readHeader(r)
+	if err != nil {
+		return image.Config{}, err
+	}
+	return image.Config{
+		ColorModel: color.NRGBAModel,
+		Width:      width,
+		Height:     height,
+	}, nil
+}
+
+// Encode writes the image m to w as an icon image, ready to be stored
+// in an ICO file.
+func Encode(w io.Writer, m image.Image) error {
+	return EncodeWithOptions(w, m, nil)
+}
+
+// EncodeWithOptions writes the image m to w as an icon image with the given options.
+// The pixels are written bottom-up and uncompressed with BITMAPINFOHEADER,
+// as Windows requires, whatever the header, orientation, compression
+// and color space options. Non-opaque images are written with 32 bits per pixel
+// by default, keeping their alpha. The AND mask that follows marks the pixels
+// with an alpha of 0 for images written with 32 bits per pixel, and less than
+// half of the maximum otherwise.
+func EncodeWithOptions(w io.Writer, m image.Image, opts *bmp.Options) error {
+	var o bmp.Options
+	if opts != nil {
+		o = *opts
+	}
+	o.Header = bmp.HeaderInfo
+	o.TopDown = false
+	o.Compression = bmp.CompressionNone
+	o.ICCProfile, o.ICCProfileLink, o.Calibration, o.Intent = nil, "", nil, bmp.IntentPerceptual
+	var buf bytes.Buffer
+	if err := dib.EncodeWithOptions(&buf, m, &o); err != nil {
+		return err
+	}
+	b := buf.Bytes()
+	r := m.Bounds()
+	stride := maskStride(r.Dx())
+	mask := make([]byte, stride*r.Dy())
+	// The alpha of 32 bit-per-pixel images is kept, so only the fully transparent
+	// pixels are masked for the readers that ignore it.
+	threshold := uint32(0x8000)
+	if binary.LittleEndian.Uint16(b[14:]) == 32 {
+		threshold = 1
+	}
+	for y := r.Min.Y; y < r.Max.Y; y++ {
+		row := mask[(r.Max.Y-1-y)*stride:]
+		for x := r.Min.X; x < r.Max.X; x++ {
+			if _, _, _, a := m.At(x, y).RGBA(); a < threshold {
+				i := x - r.Min.X
+				row[i/8] |= 0x80 >> uint(i%8)
+			}
+		}
+	}
+	binary.LittleEndian.PutUint32(b[8:], uint32(2*r.Dy()))
+	if n := binary.LittleEndian.Uint32(b[20:]); n != 0 {
+		binary.LittleEndian.PutUint32(b[20:], n+uint32(len(mask)))
+	}
+	if _, err := w.Write(b); err != nil {
+		return err
+	}
+	_, err := w.Write(mask)
+	return err
+}
@@ -0,0 +1,159 @@
+package ico
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/color"
+	"strconv"
+	"testing"
+
+	"github.com/sergeymakinen/go-bmp"
+)
+
+func compare(t *testing.T, expected, actual image.Image) {
+	if !expected.Bounds().Eq(actual.Bounds()) {
+		t.Fatalf("Bounds() = %s; want %s", actual.Bounds(), expected.Bounds())
+	}
+	for y := expected.Bounds().Min.Y; y < expected.Bounds().Max.Y; y++ {
+		for x := expected.Bounds().Min.X; x < expected.Bounds().Max.X; x++ {
+			want := color.NRGBAModel.Convert(expected.At(x, y))
+			if got := color.NRGBAModel.Convert(actual.At(x, y)); got != want {
+				t.Fatalf("At(%d, %d) = %v; want %v", x, y, got, want)
+			}
+		}
+	}
+}
+
+func TestEncodeDecode(t *testing.T) {
+	nrgba := image.NewNRGBA(image.Rect(0, 0, 33, 3))
+	for i := range nrgba.Pix {
+		nrgba.Pix[i] = uint8(i * 7)
+	}
+	// Transparent pixels are black with 24 bits per pixel.
+	masked := image.NewNRGBA(image.Rect(0, 0, 5, 4))
+	for i := range masked.Pix {
+		masked.Pix[i] = 0xFF
+		if i%12 == 3 {
+			masked.Pix[i-3], masked.Pix[i-2], masked.Pix[i-1], masked.Pix[i] = 0, 0, 0, 0
+		}
+	}
+	paletted := image.NewPaletted(image.Rect(0, 0, 7, 2), color.Palette{
+		color.NRGBA{0xFF, 0, 0, 0xFF},
+		color.NRGBA{},
+		color.NRGBA{0, 0, 0xFF, 0xFF},
+	})
+	for i := range paletted.Pix {
+		paletted.Pix[i] = uint8(i % 3)
+	}
+	tests := []struct {
+		m    image.Image
+		opts *bmp.Options
+		bpp  uint16
+	}{
+		{nrgba, nil, 32},
+		{nrgba, &bmp.Options{Header: bmp.HeaderV5, TopDown: true, ICCProfile: []byte{1}}, 32},
+		{masked, &bmp.Options{BitsPerPixel: 24}, 24},
+		{masked, &bmp.Options{BitsPerPixel: 32}, 32},
+		{paletted, nil, 2},
+		{paletted, &bmp.Options{BitsPerPixel: 4, Compression: bmp.CompressionRLE4}, 4},
+		{image.NewGray(image.Rect(0, 0, 0, 0)), nil, 8},
+	}
+	for i, test := range tests {
+		t.Run(strconv.Itoa(i), func(t *testing.T) {
+			var b bytes.Buffer
+			if err := EncodeWithOptions(&b, test.m, test.opts); err != nil {
+				t.Fatalf("EncodeWithOptions() = %v; want nil", err)
+			}
+			in := b.Bytes()
+			r := test.m.Bounds()
+			if size := binary.LittleEndian.Uint32(in); size != infoHeaderLen {
+				t.Errorf("header size = %d; want %d", size, infoHeaderLen)
+			}
+			if height := binary.LittleEndian.Uint32(in[8:]); height != uint32(2*r.Dy()) {
+				t.Errorf("height = %d; want %d", height, 2*r.Dy())
+			}
+			if bpp := binary.LittleEndian.Uint16(in[14:]); bpp != test.bpp {
+				t.Errorf("bit depth = %d; want %d", bpp, test.bpp)
+			}
+			c, err := DecodeConfig(bytes.NewReader(in))
+			if err != nil {
+				t.Fatalf("DecodeConfig() = _, %v; want nil", err)
+			}
+			if c.Width != r.Dx() || c.Height != r.Dy() {
+				t.Errorf("DecodeConfig() = %dx%d; want %dx%d", c.Width, c.Height, r.Dx(), r.Dy())
+			}
+			img, err := Decode(&b)
+			if err != nil {
+				t.Fatalf("Decode() = _, %v; want nil", err)
+			}
+			if b.Len() != 0 {
+				t.Errorf("Decode() left %d bytes", b.Len())
+			}
+			compare(t, test.m, img)
+		})
+	}
+}
+
+// icon32 returns a 32 bit-per-pixel icon image of 2x2 pixels with all
+// the alpha 0 and the mask masking the top left pixel.
+func icon32() []byte {
+	b := make([]byte, infoHeaderLen+2*2*4+2*4)
+	binary.LittleEndian.PutUint32(b[0:], infoHeaderLen)
+	binary.LittleEndian.PutUint32(b[4:], 2)
+	binary.LittleEndian.PutUint32(b[8:], 4)
+	binary.LittleEndian.PutUint16(b[12:], 1)
+	binary.LittleEndian.PutUint16(b[14:], 32)
+	for i := infoHeaderLen; i < infoHeaderLen+2*2*4; i += 4 {
+		b[i], b[i+1], b[i+2] = 0x10, 0x20, 0x30
+	}
+	// The mask rows are stored bottom-up.
+	b[len(b)-4] = 0x80
+	return b
+}
+
+func TestDecodeNoAlpha(t *testing.T) {
+	opaque := color.NRGBA{0x30, 0x20, 0x10, 0xFF}
+	want := image.NewNRGBA(image.Rect(0, 0, 2, 2))
+	want.SetNRGBA(1, 0, opaque)
+	want.SetNRGBA(0, 1, opaque)
+	want.SetNRGBA(1, 1, opaque)
+	img, err := Decode(bytes.NewReader(icon32()))
+	if err != nil {
+		t.Fatalf("Decode() = _, %v; want nil", err)
+	}
+	compare(t, want, img)
+	// Without the mask, all the pixels are opaque.
+	want.SetNRGBA(0, 0, opaque)
+	in := icon32()
+	img, err = Decode(bytes.NewReader(in[:len(in)-2*4]))
+	if err != nil {
+		t.Fatalf("Decode() = _, %v; want nil", err)
+	}
+	compare(t, want, img)
+}
+
+func TestDecodeShouldFail(t *testing.T) {
+	in := icon32()
+	odd := icon32()
+	binary.LittleEndian.PutUint32(odd[8:], 3)
+	// Images with less than 32 bits per pixel need the mask.
+	noMask := icon32()
+	binary.LittleEndian.PutUint16(noMask[14:], 24)
+	tests := []struct {
+		b   []byte
+		err string
+	}{
+		{in[:2], "unexpected EOF"},
+		{[]byte("\x89PNG\r\n\x1a\n"), "bmp: unsupported feature: PNG icon image"},
+		{[]byte{12, 0, 0, 0}, "bmp: unsupported feature: DIB header version"},
+		{odd, "bmp: invalid format: invalid icon dimensions"},
+		{in[:len(in)-3], "unexpected EOF"},
+		{noMask[:infoHeaderLen+2*8], "unexpected EOF"},
+	}
+	for i, test := range tests {
+		if _, err := Decode(bytes.NewReader(test.b)); err == nil || err.Error() != test.err {
+			t.Errorf("%d: Decode() = _, %v; want %s", i, err, test.err)
+		}
+	}
+}
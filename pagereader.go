@@ -0,0 +1,118 @@
+package bmp
+
+import "io"
+
+const (
+	// pageSize is the alignment of the reads from io.ReaderAt inputs,
+	// the size of memory pages on most systems.
+	pageSize = 4 << 10
+	// pageReadSize is the minimum size of the reads from io.ReaderAt inputs.
+	pageReadSize = 256 << 10
+)
+
+// pageReader reads the pixels of an input that is an io.ReaderAt, such as *os.File
+// or a reader of a memory-mapped file, with large reads aligned to pageSize,
+// so they map onto whole pages of the file. The rows held by its buffer
+// are used without copying them, and the input is only advanced past the bytes
+// consumed once the pixels are read.
+type pageReader struct {
+	r io.ReaderAt
+	s io.Seeker
+	// off is the offset of the next byte to read and end is the offset of the end of the pixels.
+	off, end int64
+	// buf holds the bytes of the input starting at the offset start.
+	buf   []byte
+	start int64
+	pool  *[]byte
+}
+
+// pageReader returns the reader of the n bytes of the uncompressed pixels
+// in rows of stride bytes, or nil if the input is not an unbuffered io.ReaderAt
+// at a known offset.
+func (d *decoder) pageReader(n int64, stride int) *pageReader {
+	if d.opts.NoBuffer || d.cr != nil || d.buffered() {
+		return nil
+	}
+	ra, ok := d.r.(io.ReaderAt)
+	if !ok {
+		return nil
+	}
+	s, ok := d.r.(io.Seeker)
+	if !ok {
+		return nil
+	}
+	off, err := s.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return nil
+	}
+	size := pageReadSize
+	if size < stride+pageSize {
+		// A row starting anywhere in the first page fits.
+		size = (stride + 2*pageSize - 1) &^ (pageSize - 1)
+	}
+	pool := getBuffer(size)
+	return &pageReader{r: ra, s: s, off: off, end: off + n, start: off, pool: pool, buf: (*pool)[:0]}
+}
+
+// fill reads the bytes starting at the page of p.off, of which at least n are needed.
+func (p *pageReader) fill(n int) error {
+	p.start = p.off &^ (pageSize - 1)
+	b := (*p.pool)[:cap(*p.pool)]
+	if max := (p.end+pageSize-1)&^(pageSize-1) - p.start; int64(len(b)) > max {
+		b = b[:max]
+	}
+	k, err := p.r.ReadAt(b, p.start)
+	p.buf = b[:k]
+	if int64(k) < p.off-p.start+int64(n) {
+		if err == nil || err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return err
+	}
+	return nil
+}
+
+// next returns the next n bytes, which are only valid until the next call.
+func (p *pageReader) next(n int) ([]byte, error) {
+	if p.off+int64(n) > p.end {
+		return nil, io.ErrUnexpectedEOF
+	}
+	if p.off < p.start || p.off+int64(n) > p.start+int64(len(p.buf)) {
+		if err := p.fill(n); err != nil {
+			return nil, err
+		}
+	}
+	i := int(p.off - p.start)
+	p.off += int64(n)
+	return p.buf[i : i+n], nil
+}
+
+func (p *pageReader) Read(b []byte) (int, error) {
+	if p.off >= p.end {
+		return 0, io.EOF
+	}
+	if n := p.end - p.off; int64(len(b)) > n {
+		b = b[:n]
+	}
+	if p.off < p.start || p.off >= p.start+int64(len(p.buf)) {
+		if err := p.fill(1); err != nil {
+			if len(p.buf) <= int(p.off-p.start) && err == io.ErrUnexpectedEOF {
+				err = io.EOF
+			}
+			return 0, err
+		}
+	}
+	n := copy(b, p.buf[p.off-p.start:])
+	p.off += int64(n)
+	return n, nil
+}
+
+// close releases the buffer of p and advances the input past the bytes read.
+func (p *pageReader) close() error {
+	if p.pool != nil {
+		putBuffer(p.pool)
+		p.pool, p.buf = nil, nil
+	}
+	_, err := p.s.Seek(p.off, io.SeekStart)
+	return err
+}
@@ -0,0 +1,43 @@
+package bmp
+
+import (
+	"math/bits"
+	"sync"
+)
+
+// maxPooledClass is the size class of the largest pooled buffers (64 MiB).
+// Larger buffers are rare enough to be left to the garbage collector.
+const maxPooledClass = 26
+
+// bufferPools holds the scratch buffers shared by all the encoders and decoders.
+// The buffers of capacity 1<<i are stored in bufferPools[i].
+var bufferPools [maxPooledClass + 1]sync.Pool
+
+// sizeClass returns the size class of the buffers of n bytes.
+func sizeClass(n int) int { return bits.Len(uint(n - 1)) }
+
+// getBuffer returns a pooled buffer with a capacity of at least n bytes.
+// Its contents are undefined.
+func getBuffer(n int) *[]byte {
+	c := sizeClass(n)
+	if c > maxPooledClass {
+		b := make([]byte, n)
+		return &b
+	}
+	if p, ok := bufferPools[c].Get().(*[]byte); ok {
+		return p
+	}
+	b := make([]byte, 1<<uint(c))
+	return &b
+}
+
+// putBuffer returns the buffer got from getBuffer to its pool.
+// The buffer must not be used afterwards.
+func putBuffer(p *[]byte) {
+	c := sizeClass(cap(*p))
+	if c > maxPooledClass || cap(*p) != 1<<uint(c) {
+		return
+	}
+	*p = (*p)[:cap(*p)]
+	bufferPools[c].Put(p)
+}
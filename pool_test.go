@@ -0,0 +1,20 @@
+package bmp
+
+import "testing"
+
+func TestBufferPool(t *testing.T) {
+	for _, n := range []int{1, 2, 3, 100, 1 << 10, 1<<10 + 1, 1<<maxPooledClass + 1} {
+		p := getBuffer(n)
+		if len(*p) < n {
+			t.Errorf("len(*getBuffer(%d)) = %d; want >= %d", n, len(*p), n)
+		}
+		if n <= 1<<maxPooledClass && cap(*p) != 1<<uint(sizeClass(n)) {
+			t.Errorf("cap(*getBuffer(%d)) = %d; want %d", n, cap(*p), 1<<uint(sizeClass(n)))
+		}
+		*p = (*p)[:1]
+		putBuffer(p)
+		if n <= 1<<maxPooledClass && len(*p) != cap(*p) {
+			t.Errorf("len(*p) = %d after putBuffer(); want %d", len(*p), cap(*p))
+		}
+	}
+}
@@ -0,0 +1,119 @@
+package bmp
+
+import "io"
+
+// readAheadSize is the size of the chunks of rows read ahead of their conversion.
+const readAheadSize = 256 << 10
+
+// chunk is a chunk of rows read by a chunkReader along with the error
+// that stopped the reading, if any.
+type chunk struct {
+	b   []byte
+	err error
+}
+
+// chunkReader reads the pixels of an input with DecodeOptions.ReadAhead
+// on another goroutine, a chunk of whole rows at a time, filling one of
+// its two buffers while the rows of the other one are converted.
+type chunkReader struct {
+	full chan chunk
+	free chan []byte
+	stop chan struct{}
+	// cur holds the rows of the current chunk that are not consumed yet
+	// and err is the error that ended it.
+	cur  []byte
+	err  error
+	prev []byte
+	size int
+	pool [2]*[]byte
+}
+
+// readAhead starts reading the n bytes of the uncompressed pixels in rows
+// of stride bytes from d.r.
+func (d *decoder) readAhead(n int64, stride int) *chunkReader {
+	size := readAheadSize / stride * stride
+	if size == 0 {
+		size = stride
+	}
+	if int64(size) > n {
+		size = int(n)
+	}
+	c := &chunkReader{stop: make(chan struct{}), size: size}
+	c.full = make(chan chunk, len(c.pool))
+	c.free = make(chan []byte, len(c.pool))
+	for i := range c.pool {
+		c.pool[i] = getBuffer(size)
+		c.free <- (*c.pool[i])[:size]
+	}
+	go c.read(d.r, n)
+	return c
+}
+
+// read reads the chunks of the n bytes from r until they are all read,
+// an error occurs or the reading is stopped.
+func (c *chunkReader) read(r io.Reader, n int64) {
+	defer close(c.full)
+	for n > 0 {
+		var b []byte
+		select {
+		case b = <-c.free:
+		case <-c.stop:
+			return
+		}
+		if int64(len(b)) > n {
+			b = b[:n]
+		}
+		k, err := io.ReadFull(r, b)
+		n -= int64(k)
+		// full has room for all the buffers, so this never blocks.
+		c.full <- chunk{b[:k], err}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// next returns the next n bytes, which are only valid until the next call.
+// Like io.ReadFull, it returns io.EOF if the input ends before them
+// and io.ErrUnexpectedEOF if it ends in their middle.
+func (c *chunkReader) next(n int) ([]byte, error) {
+	// The chunks hold whole rows unless they end with an error.
+	if len(c.cur) == 0 && c.err == nil {
+		if c.prev != nil {
+			c.free <- c.prev[:c.size]
+		}
+		ch, ok := <-c.full
+		if !ok {
+			ch.err = io.EOF
+		}
+		c.cur, c.err, c.prev = ch.b, ch.err, ch.b
+		if c.err == io.ErrUnexpectedEOF && len(c.cur)%n == 0 {
+			// The input ends at a row boundary.
+			c.err = io.EOF
+		}
+	}
+	if len(c.cur) < n {
+		if len(c.cur) > 0 {
+			return nil, io.ErrUnexpectedEOF
+		}
+		return nil, c.err
+	}
+	b := c.cur[:n]
+	c.cur = c.cur[n:]
+	return b, nil
+}
+
+// close stops the reading, waits for it to end and releases the buffers of c.
+func (c *chunkReader) close() error {
+	if c.stop == nil {
+		return nil
+	}
+	close(c.stop)
+	for range c.full {
+	}
+	for _, p := range c.pool {
+		putBuffer(p)
+	}
+	c.stop, c.cur, c.prev = nil, nil, nil
+	return nil
+}
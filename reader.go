@@ -34,15 +34,29 @@
 package bmp
 
 import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
 	"image"
 	"image/color"
 	"io"
+	"io/ioutil"
+	"runtime"
 	"strconv"
+	"sync"
 )
 
+// maxInt is the maximum value of int.
+const maxInt = int(^uint(0) >> 1)
+
 const (
-	fileHeaderLen = 14
-	infoHeaderLen = 40
+	fileHeaderLen    = 14
+	coreHeaderLen    = 12
+	infoHeaderLen    = 40
+	v4InfoHeaderLen  = 108
+	v5InfoHeaderLen  = 124
+	os2InfoHeaderLen = 64
 )
 
 // FormatError reports that the input is not a valid BMP.
@@ -63,18 +77,144 @@ func readUint32(b []byte) uint32 {
 	return uint32(b[0]) | uint32(b[1])<<8 | uint32(b[2])<<16 | uint32(b[3])<<24
 }
 
+// DecodeOptions are the decoding parameters.
+// A nil *DecodeOptions is equivalent to the zero value.
+type DecodeOptions struct {
+	// ExpandPalette makes paletted images decode to *image.RGBA instead of *image.Paletted.
+	ExpandPalette bool
+
+	// ScanAlpha makes DecodeExtendedConfigWithOptions read the pixels
+	// to report whether the alpha channel contains data.
+	ScanAlpha bool
+
+	// Trace, if non-nil, receives structural events.
+	Trace *DecodeTrace
+
+	// ColorModel, if non-nil, is the color model of the decoded image.
+	// The pixels are converted as soon as they are read, without decoding
+	// to the native color model first. The supported models are
+	// color.RGBAModel, color.RGBA64Model, color.NRGBAModel, color.NRGBA64Model,
+	// color.GrayModel, color.Gray16Model and color.CMYKModel.
+	ColorModel color.Model
+
+	// MaxBytes, if positive, is the maximum number of bytes read from the input.
+	// Reading more results in ErrLimitExceeded.
+	MaxBytes int64
+
+	// MaxRLEOps, if positive, is the maximum number of RLE operations executed.
+	// Executing more results in ErrLimitExceeded.
+	MaxRLEOps int
+
+	// UnknownHeader, if non-nil, is called with the size of a DIB header
+	// that is not a BITMAPINFOHEADER, BITMAPV4HEADER, BITMAPV5HEADER nor
+	// the 64-byte OS/2 BITMAPINFOHEADER2, but is at least as large as
+	// a BITMAPINFOHEADER. If it returns true, the leading bytes of the header
+	// are decoded as a BITMAPINFOHEADER and the extra bytes are skipped.
+	// Color masks are not read from such headers.
+	UnknownHeader func(size uint32) bool
+
+	// ReuseImage makes Decoder.Decode store the pixels in the image returned
+	// by the previous call if it has the same type and dimensions,
+	// instead of allocating a new image.
+	ReuseImage bool
+
+	// BulkRead makes the pixels of uncompressed images read in one call
+	// into a buffer holding all of them, instead of row by row, which is faster
+	// for inputs with a high per-call overhead at the cost of memory.
+	// It is the default for *bytes.Reader and *bytes.Buffer inputs
+	// holding the whole pixel array.
+	BulkRead bool
+
+	// Alloc, if non-nil, allocates the n bytes of the pixels of the decoded images
+	// and of the masks of DecodeWithMask instead of the Go heap, for example
+	// from an arena or memory-mapped memory.
+	// It must return a slice of at least n bytes, whose contents are overwritten,
+	// and which must not be modified while the image is used.
+	// The pixels of reused images are not allocated.
+	// The pixels are stored a row at a time as they are read and, unless ColorModel
+	// or BulkRead is set, the decoder holds no other buffer of the size of the image,
+	// so images larger than memory can be decoded into memory-mapped files
+	// from inputs that are not in memory, such as *os.File.
+	Alloc func(n int) []byte
+
+	// NoBuffer disables buffering the pixels of uncompressed images read
+	// from inputs that are not buffered, that is do not implement io.ByteReader,
+	// such as *os.File or net.Conn. They are read several rows at a time by default,
+	// but never past the pixels. Inputs that are also an io.ReaderAt and io.Seeker,
+	// such as *os.File, are read with large reads aligned to memory pages instead,
+	// with the rows used straight from the buffer.
+	NoBuffer bool
+
+	// ReadAhead makes the pixels of uncompressed images read by another goroutine,
+	// a chunk of rows at a time, while the previous chunk is converted,
+	// which hides the conversion behind the latency of slow inputs such as
+	// network file systems. The input is never read past the pixels
+	// and not used once the decoding returns.
+	ReadAhead bool
+}
+
+// ErrLimitExceeded reports that decoding exceeded a limit set in DecodeOptions.
+var ErrLimitExceeded = errors.New("bmp: decode limit exceeded")
+
 type decoder struct {
 	r                             io.Reader
+	cr                            *countingReader
+	opts                          DecodeOptions
 	c                             image.Config
 	bpp                           uint16
+	format                        PixelFormat
+	pal                           []color.RGBA
 	topDown, rgb565, noAlpha, rle bool
+	// mask, if non-nil, gets the pixels set by RLE data marked as opaque.
+	mask     *image.Alpha
+	hasAlpha bool
+	// fileSize is the bfSize field of the file header.
+	fileSize uint32
+	// gap is the number of bytes between the color table and the pixels.
+	gap uint32
+	// reuse, if non-nil, is the image to store the pixels in if it is compatible.
+	reuse image.Image
+	// concurrent reports whether the function passed to decodeRows
+	// can be called concurrently.
+	concurrent bool
+	// hdr, palBuf and rleBuf are the scratch space of the headers, the palette
+	// and RLE operations, kept here to not allocate them on every decode.
+	hdr    [1024]byte
+	palBuf [256]color.RGBA
+	rleBuf rleBuffer
+}
+
+func newDecoder(r io.Reader, opts *DecodeOptions) *decoder {
+	d := &decoder{r: r}
+	if opts != nil {
+		d.opts = *opts
+	}
+	if d.opts.Trace != nil || d.opts.MaxBytes > 0 {
+		d.cr = &countingReader{r: r, max: d.opts.MaxBytes}
+		d.r = d.cr
+	}
+	return d
+}
+
+// offset returns the number of bytes read from d.r if it is counted.
+func (d *decoder) offset() int64 {
+	if d.cr == nil {
+		return 0
+	}
+	return d.cr.n
 }
 
+// DecodeConfig reads the headers and the color table and skips to the pixels.
 func (d *decoder) DecodeConfig() error {
-	const (
-		v4InfoHeaderLen = 108
-		v5InfoHeaderLen = 124
-	)
+	if err := d.decodeHeader(); err != nil {
+		return err
+	}
+	return d.skipGap()
+}
+
+// decodeHeader reads the headers and the color table, leaving the gap
+// before the pixels unread.
+func (d *decoder) decodeHeader() error {
 	const (
 		biRGB       = 0
 		biRLE8      = 1
@@ -82,8 +222,8 @@ func (d *decoder) DecodeConfig() error {
 		biBitFields = 3
 	)
 	// We only support those BMP images that are a BITMAPFILEHEADER
-	// immediately followed by a BITMAPINFOHEADER.
-	var b [1024]byte
+	// immediately followed by a BITMAPCOREHEADER, a BITMAPINFOHEADER or its extensions.
+	b := &d.hdr
 	if _, err := io.ReadFull(d.r, b[:fileHeaderLen+4]); err != nil {
 		if err == io.EOF {
 			err = io.ErrUnexpectedEOF
@@ -93,17 +233,55 @@ func (d *decoder) DecodeConfig() error {
 	if string(b[:2]) != "BM" {
 		return FormatError("not a BMP file")
 	}
+	d.fileSize = readUint32(b[2:])
+	trace := d.opts.Trace
+	if trace != nil && trace.FileHeader != nil {
+		trace.FileHeader(0, b[:fileHeaderLen])
+	}
 	offset := readUint32(b[10:])
 	infoLen := readUint32(b[14:])
-	if infoLen != infoHeaderLen && infoLen != v4InfoHeaderLen && infoLen != v5InfoHeaderLen {
-		return UnsupportedError("DIB header version")
+	// readLen is the length of the DIB header part that is interpreted.
+	readLen := infoLen
+	if infoLen != coreHeaderLen && infoLen != infoHeaderLen && infoLen != os2InfoHeaderLen &&
+		infoLen != v4InfoHeaderLen && infoLen != v5InfoHeaderLen {
+		if infoLen < infoHeaderLen || d.opts.UnknownHeader == nil || !d.opts.UnknownHeader(infoLen) {
+			return UnsupportedError("DIB header version")
+		}
+		readLen = infoHeaderLen
 	}
-	if _, err := io.ReadFull(d.r, b[fileHeaderLen+4:fileHeaderLen+infoLen]); err != nil {
+	if _, err := io.ReadFull(d.r, b[fileHeaderLen+4:fileHeaderLen+readLen]); err != nil {
 		if err == io.EOF {
 			err = io.ErrUnexpectedEOF
 		}
 		return err
 	}
+	if trace != nil && trace.InfoHeader != nil {
+		trace.InfoHeader(fileHeaderLen, b[fileHeaderLen:fileHeaderLen+readLen])
+	}
+	if infoLen > readLen {
+		if _, err := io.CopyN(ioutil.Discard, d.r, int64(infoLen-readLen)); err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return err
+		}
+	}
+	// entryLen is the size of the color table entries.
+	entryLen := uint32(4)
+	if infoLen == coreHeaderLen {
+		// BITMAPCOREHEADER only has 16-bit dimensions, the planes and the bit depth,
+		// and a color table of 3-byte entries. It is widened to a BITMAPINFOHEADER.
+		width, height := readUint16(b[18:]), readUint16(b[20:])
+		planes, bpp := readUint16(b[22:]), readUint16(b[24:])
+		for i := fileHeaderLen + 4; i < fileHeaderLen+infoHeaderLen; i++ {
+			b[i] = 0
+		}
+		binary.LittleEndian.PutUint32(b[18:], uint32(width))
+		binary.LittleEndian.PutUint32(b[22:], uint32(height))
+		binary.LittleEndian.PutUint16(b[26:], planes)
+		binary.LittleEndian.PutUint16(b[28:], bpp)
+		entryLen = 3
+	}
 	width := int(int32(readUint32(b[18:])))
 	height := int(int32(readUint32(b[22:])))
 	if height < 0 {
@@ -117,6 +295,11 @@ func (d *decoder) DecodeConfig() error {
 	}
 	d.bpp = readUint16(b[28:])
 	compression, colors := readUint32(b[30:]), readUint32(b[46:])
+	// The OS/2 2.x BITMAPINFOHEADER2 shares the leading fields of BITMAPINFOHEADER,
+	// but its compression methods past RLE4 are Huffman 1D and RLE24 instead of BITFIELDS.
+	if infoLen == os2InfoHeaderLen && compression > biRLE4 {
+		return UnsupportedError("compression method")
+	}
 	colorMaskLen := uint32(0)
 	switch {
 	case compression == biBitFields:
@@ -128,6 +311,9 @@ func (d *decoder) DecodeConfig() error {
 				}
 				return err
 			}
+			if trace != nil && trace.ColorMasks != nil {
+				trace.ColorMasks(int64(fileHeaderLen+infoLen), b[fileHeaderLen+infoLen:fileHeaderLen+infoLen+colorMaskLen])
+			}
 		}
 		switch {
 		case d.bpp == 16 && readUint32(b[54:]) == 0xF800 && readUint32(b[58:]) == 0x7E0 && readUint32(b[62:]) == 0x1F:
@@ -138,12 +324,14 @@ func (d *decoder) DecodeConfig() error {
 			// RGB555
 			fallthrough
 		case d.bpp == 32 && readUint32(b[54:]) == 0xFF0000 && readUint32(b[58:]) == 0xFF00 && readUint32(b[62:]) == 0xFF &&
-			(infoLen == infoHeaderLen || readUint32(b[66:]) == 0xFF000000):
+			(infoLen == infoHeaderLen || readUint32(b[66:]) == 0xFF000000 || readUint32(b[66:]) == 0):
 			// If compression is set to BITFIELDS, but the bitmask is set to the default bitmask
 			// that would be used if compression was set to 0, we can continue as if compression was 0.
 			compression = biRGB
-			// Also disable the alpha for 32 bit-per-pixel images if the mask was used with BITMAPINFOHEADER.
-			if infoLen == infoHeaderLen {
+			// Also disable the alpha for 32 bit-per-pixel images if the mask was used with BITMAPINFOHEADER
+			// or the alpha mask of later versions is empty, as written by applications
+			// putting opaque images on the Windows clipboard.
+			if d.bpp == 32 && (infoLen == infoHeaderLen || readUint32(b[66:]) == 0) {
 				d.noAlpha = true
 			}
 		}
@@ -158,19 +346,33 @@ func (d *decoder) DecodeConfig() error {
 	case 1, 2, 4, 8:
 		if colors == 0 {
 			colors = 1 << d.bpp
+		} else if colors > 256 {
+			return FormatError("invalid number of colors")
 		}
-		if offset != fileHeaderLen+infoLen+colors*4 {
+		if offset < fileHeaderLen+infoLen+colors*entryLen {
 			return UnsupportedError("bitmap offset")
 		}
-		if _, err := io.ReadFull(d.r, b[:colors*4]); err != nil {
+		if _, err := io.ReadFull(d.r, b[:colors*entryLen]); err != nil {
 			return err
 		}
+		if trace != nil && trace.Palette != nil {
+			trace.Palette(int64(fileHeaderLen+infoLen), b[:colors*entryLen])
+		}
+		d.gap = offset - (fileHeaderLen + infoLen + colors*entryLen)
 		pcm := make(color.Palette, colors)
+		d.pal = d.palBuf[:colors]
 		for i := range pcm {
 			// BMP images are stored in BGR order rather than RGB order.
-			// Every 4th byte is padding.
-			pcm[i] = color.RGBA{b[4*i+2], b[4*i+1], b[4*i+0], 0xFF}
+			// Every 4th byte of the entries of BITMAPINFOHEADER and later is padding.
+			e := b[entryLen*uint32(i):]
+			d.pal[i] = color.RGBA{e[2], e[1], e[0], 0xFF}
+			pcm[i] = d.pal[i]
 		}
+		// Indexes past the palette are opaque black, so any byte can index palBuf.
+		for i := int(colors); i < len(d.palBuf); i++ {
+			d.palBuf[i] = color.RGBA{A: 0xFF}
+		}
+		d.format = Paletted8
 		d.c = image.Config{
 			ColorModel: pcm,
 			Width:      width,
@@ -178,9 +380,14 @@ func (d *decoder) DecodeConfig() error {
 		}
 		return nil
 	case 16:
-		if offset != fileHeaderLen+infoLen+colorMaskLen {
+		if offset < fileHeaderLen+infoLen+colorMaskLen {
 			return UnsupportedError("bitmap offset")
 		}
+		d.gap = offset - (fileHeaderLen + infoLen + colorMaskLen)
+		d.format = RGB555
+		if d.rgb565 {
+			d.format = RGB565
+		}
 		d.c = image.Config{
 			ColorModel: color.RGBAModel,
 			Width:      width,
@@ -188,9 +395,14 @@ func (d *decoder) DecodeConfig() error {
 		}
 		return nil
 	case 24, 32:
-		if offset != fileHeaderLen+infoLen+colorMaskLen {
+		if offset < fileHeaderLen+infoLen+colorMaskLen {
 			return UnsupportedError("bitmap offset")
 		}
+		d.gap = offset - (fileHeaderLen + infoLen + colorMaskLen)
+		d.format = BGR24
+		if d.bpp == 32 {
+			d.format = BGRA32
+		}
 		d.c = image.Config{
 			ColorModel: color.RGBAModel,
 			Width:      width,
@@ -202,300 +414,851 @@ func (d *decoder) DecodeConfig() error {
 	}
 }
 
+// skipGap skips the bytes between the color table and the pixels,
+// such as the ones aligning the pixels.
+func (d *decoder) skipGap() error {
+	if d.gap == 0 {
+		return nil
+	}
+	if _, err := io.CopyN(ioutil.Discard, d.r, int64(d.gap)); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return err
+	}
+	return nil
+}
+
 func (d *decoder) Decode() (image.Image, error) {
-	if d.rle {
-		return d.decodeRLE()
+	if d.opts.ColorModel != nil {
+		return d.decodeModel(d.opts.ColorModel)
 	}
-	switch d.bpp {
-	case 1, 2, 4:
-		return d.decodeSmallPaletted()
-	case 8:
-		return d.decodePaletted()
-	case 16:
-		return d.decodeRGB5x5()
-	case 24:
-		return d.decodeRGB()
-	case 32:
-		return d.decodeNRGBA()
+	rect := image.Rect(0, 0, d.c.Width, d.c.Height)
+	switch {
+	case d.format == Paletted8 && !d.opts.ExpandPalette:
+		paletted, ok := d.reuse.(*image.Paletted)
+		if ok && paletted.Rect == rect {
+			paletted.Palette = d.c.ColorModel.(color.Palette)
+			if d.rle {
+				// Pixels skipped by RLE data must be reset.
+				for i := range paletted.Pix {
+					paletted.Pix[i] = 0
+				}
+			}
+		} else {
+			pix, err := d.pixels(d.c.Width*d.c.Height, d.rle)
+			if err != nil {
+				return nil, err
+			}
+			paletted = &image.Paletted{Pix: pix, Stride: d.c.Width, Rect: rect, Palette: d.c.ColorModel.(color.Palette)}
+		}
+		if err := d.decodeInto(paletted.Pix, paletted.Stride, Paletted8); err != nil {
+			return nil, err
+		}
+		return paletted, nil
+	case d.format == BGRA32:
+		nrgba, ok := d.reuse.(*image.NRGBA)
+		if !ok || nrgba.Rect != rect {
+			pix, err := d.pixels(4*d.c.Width*d.c.Height, false)
+			if err != nil {
+				return nil, err
+			}
+			nrgba = &image.NRGBA{Pix: pix, Stride: 4 * d.c.Width, Rect: rect}
+		}
+		if err := d.decodeInto(nrgba.Pix, nrgba.Stride, RGBA32); err != nil {
+			return nil, err
+		}
+		return nrgba, nil
+	default:
+		rgba, ok := d.reuse.(*image.RGBA)
+		if !ok || rgba.Rect != rect {
+			pix, err := d.pixels(4*d.c.Width*d.c.Height, false)
+			if err != nil {
+				return nil, err
+			}
+			rgba = &image.RGBA{Pix: pix, Stride: 4 * d.c.Width, Rect: rect}
+		}
+		if err := d.decodeInto(rgba.Pix, rgba.Stride, RGBA32); err != nil {
+			return nil, err
+		}
+		return rgba, nil
 	}
-	panic("unreachable")
 }
 
-// decodeSmallPaletted reads a bpp (< 8) bit-per-pixel BMP image from d.r.
-// If d.topDown is false, the image rows will be read bottom-up.
-func (d *decoder) decodeSmallPaletted() (image.Image, error) {
-	paletted := image.NewPaletted(image.Rect(0, 0, d.c.Width, d.c.Height), d.c.ColorModel.(color.Palette))
+// pixels returns n bytes for the pixels of the decoded image, allocated by
+// DecodeOptions.Alloc if set. They are zeroed if zero is true or Alloc is not set.
+func (d *decoder) pixels(n int, zero bool) ([]byte, error) {
+	if d.opts.Alloc == nil {
+		return make([]byte, n), nil
+	}
+	b := d.opts.Alloc(n)
+	if len(b) < n {
+		return nil, errors.New("bmp: allocated pixel buffer too small")
+	}
+	b = b[:n]
+	if zero {
+		for i := range b {
+			b[i] = 0
+		}
+	}
+	return b, nil
+}
+
+// decodeInto reads the pixels from d.r and stores them in pix converted to format f,
+// with stride bytes between vertically adjacent pixels.
+func (d *decoder) decodeInto(pix []byte, stride int, f PixelFormat) error {
 	if d.c.Width == 0 || d.c.Height == 0 {
-		return paletted, nil
+		return nil
+	}
+	if d.rle && f == Paletted8 {
+		return d.decodeRLE(pix, stride)
+	}
+	if d.rle && f == RGBA32 {
+		return d.decodeRLEInPlace(pix, stride)
+	}
+	if f == RGBA32 && d.format == BGR24 && !d.rle && !d.opts.ReadAhead && (d.opts.Trace == nil || d.opts.Trace.Row == nil) &&
+		!d.bulkRead(int64(d.rowLen())*int64(d.c.Height)) {
+		return d.decodeBGR24(pix, stride)
+	}
+	d.concurrent = true
+	defer func() { d.concurrent = false }()
+	return d.decodeRows(func(y int, row []byte) error {
+		d.convertRow(pix[y*stride:], f, row)
+		return nil
+	})
+}
+
+// decodeRLEInPlace reads an RLE-encoded BMP image from d.r and stores its pixels
+// in pix as RGBA32, with stride bytes between vertically adjacent pixels.
+// The palette indexes are decoded to the last quarter of every row and expanded
+// from there, so no other buffer of the size of the image is used.
+func (d *decoder) decodeRLEInPlace(pix []byte, stride int) error {
+	w := d.c.Width
+	for y := 0; y < d.c.Height; y++ {
+		// Pixels skipped by RLE data are 0.
+		idx := pix[y*stride+3*w : y*stride+4*w]
+		for i := range idx {
+			idx[i] = 0
+		}
+	}
+	if err := d.decodeRLE(pix[3*w:], stride); err != nil {
+		return err
+	}
+	for y := 0; y < d.c.Height; y++ {
+		d.convertRow(pix[y*stride:], RGBA32, pix[y*stride+3*w:y*stride+4*w])
+	}
+	return nil
+}
+
+// decodeRows reads the pixels from d.r and calls fn for every row in the order
+// they are stored, with y being the row index in the image and row holding
+// d.c.Width pixels in d.format.
+// If d.topDown is false, the image rows will be read bottom-up.
+func (d *decoder) decodeRows(fn func(y int, row []byte) error) error {
+	if d.rle {
+		buf := getBuffer(d.c.Width * d.c.Height)
+		defer putBuffer(buf)
+		pix := (*buf)[:d.c.Width*d.c.Height]
+		// Pixels skipped by RLE data are 0.
+		for i := range pix {
+			pix[i] = 0
+		}
+		if err := d.decodeRLE(pix, d.c.Width); err != nil {
+			return err
+		}
+		for y := d.c.Height - 1; y >= 0; y-- {
+			if err := fn(y, pix[y*d.c.Width:(y+1)*d.c.Width]); err != nil {
+				return err
+			}
+		}
+		return nil
 	}
-	// There are specified bpp bits per pixel, and each row is 4-byte aligned.
-	pixelsPerByte := 8 / int(d.bpp)
-	b := make([]byte, ((d.c.Width+pixelsPerByte-1)/pixelsPerByte+3)&^3)
 	y0, y1, yDelta := d.c.Height-1, -1, -1
 	if d.topDown {
 		y0, y1, yDelta = 0, d.c.Height, +1
 	}
-	for y := y0; y != y1; y += yDelta {
-		p := paletted.Pix[y*paletted.Stride : y*paletted.Stride+d.c.Width]
-		if _, err := io.ReadFull(d.r, b); err != nil {
-			return nil, err
+	stride := d.rowLen()
+	rowLen := d.c.Width * d.format.BytesPerPixel()
+	unpacked := 0
+	if d.bpp < 8 {
+		unpacked = d.c.Width
+	}
+	// The only scratch buffer, taken from the pool, holds either all the pixels
+	// or a single row, followed by the unpacked row if the pixels are less than a byte.
+	var b, row, pix []byte
+	var src rowSource
+	r := d.r
+	off := d.offset()
+	n := int64(stride) * int64(d.c.Height)
+	if d.opts.ReadAhead && !d.bulkRead(n) {
+		src = d.readAhead(n, stride)
+	} else if pr := d.pageReader(n, stride); pr != nil {
+		src = pr
+	}
+	if src != nil {
+		// The rows are read from the buffer of src.
+		defer src.close()
+		buf := getBuffer(unpacked)
+		defer putBuffer(buf)
+		row = (*buf)[:unpacked]
+	} else if d.bulkRead(n) {
+		buf := getBuffer(int(n) + unpacked)
+		defer putBuffer(buf)
+		pix = (*buf)[:int(n)+unpacked]
+		if _, err := io.ReadFull(d.r, pix[:n]); err != nil {
+			return err
 		}
-		byte, bit := 0, 8-d.bpp
-		for x := 0; x < d.c.Width; x++ {
-			p[x] = (b[byte] >> bit) & (1<<d.bpp - 1)
-			if bit == 0 {
-				bit = 8 - d.bpp
-				byte++
-			} else {
-				bit -= d.bpp
+		row = pix[n:]
+		pix = pix[:n]
+	} else {
+		buf := getBuffer(stride + unpacked)
+		defer putBuffer(buf)
+		b = (*buf)[:stride+unpacked]
+		row = b[stride:]
+		b = b[:stride]
+		r = d.rowReader(n)
+	}
+	if d.bpp >= 8 && b != nil {
+		row = b[:rowLen]
+	}
+	if pix != nil && d.concurrent && d.bpp >= 16 && n >= parallelMinSize && (d.opts.Trace == nil || d.opts.Trace.Row == nil) {
+		return d.convertParallel(pix, stride, rowLen, fn)
+	}
+	for i, y := 0, y0; y != y1; i, y = i+1, y+yDelta {
+		if pix != nil {
+			b = pix[i*stride : (i+1)*stride]
+			if d.bpp >= 8 {
+				row = b[:rowLen]
+			}
+		} else if src != nil {
+			var err error
+			if b, err = src.next(stride); err != nil {
+				return err
 			}
+			if d.bpp >= 8 {
+				row = b[:rowLen]
+			}
+		} else if _, err := io.ReadFull(r, b); err != nil {
+			return err
+		}
+		if d.opts.Trace != nil && d.opts.Trace.Row != nil {
+			d.opts.Trace.Row(y, off+int64(i)*int64(stride), b)
+		}
+		if d.bpp < 8 {
+			d.unpackRow(row, b)
+		}
+		if err := fn(y, row); err != nil {
+			return err
 		}
 	}
-	return paletted, nil
+	if src != nil {
+		return src.close()
+	}
+	return nil
 }
 
-// decodePaletted reads an 8 bit-per-pixel BMP image from d.r.
-// If d.topDown is false, the image rows will be read bottom-up.
-func (d *decoder) decodePaletted() (image.Image, error) {
-	paletted := image.NewPaletted(image.Rect(0, 0, d.c.Width, d.c.Height), d.c.ColorModel.(color.Palette))
-	if d.c.Width == 0 || d.c.Height == 0 {
-		return paletted, nil
+// rowSource is a reader of the rows of uncompressed pixels into its own buffer,
+// such as *pageReader and *chunkReader.
+type rowSource interface {
+	// next returns the next n bytes, which are only valid until the next call.
+	next(n int) ([]byte, error)
+	// close releases the buffer and ends the reading.
+	close() error
+}
+
+// rowLen returns the size of a stored row of uncompressed pixels.
+func (d *decoder) rowLen() int {
+	// There are specified bpp bits per pixel, and each row is 4-byte aligned.
+	return ((d.c.Width*int(d.bpp)+7)/8 + 3) &^ 3
+}
+
+// rowReader returns the reader of the n bytes of the uncompressed pixels,
+// buffering several rows if d.r is not buffered, but never reading past the pixels.
+func (d *decoder) rowReader(n int64) io.Reader {
+	if d.opts.NoBuffer || d.buffered() {
+		return d.r
+	}
+	stride := d.rowLen()
+	size := stride
+	if size < rowBufferSize {
+		size = rowBufferSize / stride * stride
 	}
-	var tmp [4]byte
+	return bufio.NewReaderSize(io.LimitReader(d.r, n), size)
+}
+
+// decodeBGR24 reads 24 bit-per-pixel pixels from d.r and stores them in pix as RGBA32,
+// with stride bytes between vertically adjacent pixels. Every row is read
+// into the end of its RGBA32 row and expanded in place.
+func (d *decoder) decodeBGR24(pix []byte, stride int) error {
+	w := d.c.Width
+	n := int64(d.rowLen()) * int64(d.c.Height)
 	y0, y1, yDelta := d.c.Height-1, -1, -1
 	if d.topDown {
 		y0, y1, yDelta = 0, d.c.Height, +1
 	}
+	if pr := d.pageReader(n, d.rowLen()); pr != nil {
+		// The rows are converted straight from the buffer of pr.
+		defer pr.close()
+		for y := y0; y != y1; y += yDelta {
+			b, err := pr.next(d.rowLen())
+			if err != nil {
+				return err
+			}
+			bgrToRGBA(pix[y*stride:y*stride+w*4], b[:w*3])
+		}
+		return pr.close()
+	}
+	r := d.rowReader(n)
+	var pad [3]byte
 	for y := y0; y != y1; y += yDelta {
-		p := paletted.Pix[y*paletted.Stride : y*paletted.Stride+d.c.Width]
-		if _, err := io.ReadFull(d.r, p); err != nil {
-			return nil, err
+		p := pix[y*stride : y*stride+w*4]
+		if _, err := io.ReadFull(r, p[w:]); err != nil {
+			return err
 		}
-		// Each row is 4-byte aligned.
-		if d.c.Width%4 != 0 {
-			_, err := io.ReadFull(d.r, tmp[:4-d.c.Width%4])
-			if err != nil {
-				return nil, err
+		if _, err := io.ReadFull(r, pad[:d.rowLen()-w*3]); err != nil {
+			if err == io.EOF {
+				// The row is incomplete.
+				err = io.ErrUnexpectedEOF
 			}
+			return err
 		}
+		// Converting from front to back never overwrites the pixels not converted yet.
+		bgrToRGBA(p, p[w:])
 	}
-	return paletted, nil
+	return nil
 }
 
-// decodeRLE reads an 4 or 8 bit-per-pixel RLE-encoded BMP image from d.r.
-func (d *decoder) decodeRLE() (image.Image, error) {
-	paletted := image.NewPaletted(image.Rect(0, 0, d.c.Width, d.c.Height), d.c.ColorModel.(color.Palette))
-	if d.c.Width == 0 || d.c.Height == 0 {
-		return paletted, nil
+// rowBufferSize is the minimum size of the buffer of rows read from unbuffered inputs.
+const rowBufferSize = 32 << 10
+
+// buffered reports whether the input is buffered or in memory,
+// so reading it row by row is cheap.
+func (d *decoder) buffered() bool {
+	r := d.r
+	if d.cr != nil {
+		r = d.cr.r
 	}
-	var b [256]byte
-	read := func() (byte, byte, error) {
-		if _, err := io.ReadFull(d.r, b[:2]); err != nil {
-			return 0, 0, err
-		}
-		return b[0], b[1], nil
+	_, ok := r.(io.ByteReader)
+	return ok
+}
+
+// parallelMinSize is the minimum size of the pixels converted in parallel.
+const parallelMinSize = 1 << 20
+
+// parallelMaxRLESize is the maximum number of pixels of RLE images decoded
+// in parallel, as their operations are held in memory until they are all read.
+const parallelMaxRLESize = 1 << 28
+
+// convertParallel calls fn for every row of pix, stored with stride bytes per row,
+// from GOMAXPROCS goroutines working on disjoint ranges of rows.
+// fn must be safe for concurrent use.
+func (d *decoder) convertParallel(pix []byte, stride, rowLen int, fn func(y int, row []byte) error) error {
+	workers := runtime.GOMAXPROCS(0)
+	if workers > d.c.Height {
+		workers = d.c.Height
 	}
-	x, y := 0, d.c.Height-1
-	isValid := func() bool { return x >= 0 && x < paletted.Stride && y >= 0 && y < d.c.Height }
-Loop:
-	for {
-		b1, b2, err := read()
-		if err != nil {
-			return nil, err
-		}
-		switch b1 {
-		case 0:
-			switch b2 {
-			case 0:
-				// EOL.
-				x, y = 0, y-1
-				if !isValid() {
-					return nil, FormatError("invalid RLE data")
+	per := (d.c.Height + workers - 1) / workers
+	errs := make([]error, workers)
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := w * per; i < (w+1)*per && i < d.c.Height; i++ {
+				y := d.c.Height - 1 - i
+				if d.topDown {
+					y = i
 				}
-			case 1:
-				// EOF.
-				break Loop
-			case 2:
-				// Delta.
-				b1, b2, err := read()
-				if err != nil {
-					return nil, err
-				}
-				x, y = x+int(b1), y-int(b2)
-				if !isValid() {
-					return nil, FormatError("invalid RLE data")
-				}
-			default:
-				// Absolute mode.
-				n := (uint16(b2)*d.bpp + 8 - 1) / 8
-				if (d.bpp == 8 && b2&0x1 != 0) || (d.bpp == 4 && ((b2&0x3 == 1) || (b2&0x3 == 2))) {
-					n++
-				}
-				if _, err := io.ReadFull(d.r, b[:n]); err != nil {
-					return nil, err
-				}
-				for i, j := uint8(0), 0; i < b2; i++ {
-					var c byte
-					if d.bpp == 8 {
-						c = b[i]
-					} else {
-						c = (b[j] >> 4) & 0xF
-					}
-					if !isValid() {
-						return nil, FormatError("invalid RLE data")
-					}
-					paletted.Pix[y*paletted.Stride+x] = c
-					x++
-					if d.bpp == 4 {
-						if i++; i < b2 {
-							if !isValid() {
-								return nil, FormatError("invalid RLE data")
-							}
-							paletted.Pix[y*paletted.Stride+x] = b[j] & 0xF
-							x++
-						}
-						if i%2 != 0 {
-							j++
-						}
-					}
+				if err := fn(y, pix[i*stride:i*stride+rowLen]); err != nil {
+					errs[w] = err
+					return
 				}
 			}
-		default:
-			// Encoded mode.
-			// TODO(sergeymakinen): Consider ignoring pixels past the end of the row.
-			for i := uint8(0); i < b1; i++ {
-				if !isValid() {
-					return nil, FormatError("invalid RLE data")
-				}
-				var c byte
-				if d.bpp == 8 {
-					c = b2
-				} else {
-					if i%2 == 0 {
-						c = (b2 >> 4) & 0xF
-					} else {
-						c = b2 & 0xF
-					}
-				}
-				paletted.Pix[y*paletted.Stride+x] = c
-				x++
-			}
+		}(w)
+	}
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			return err
 		}
 	}
-	return paletted, nil
+	return nil
 }
 
-// decodeRGB5x5 reads a 16 bit-per-pixel BMP image from d.r.
-// If d.topDown is false, the image rows will be read bottom-up.
-// If d.rgb565 is true, the image will be read as RGB565, otherwise as RGB555.
-func (d *decoder) decodeRGB5x5() (image.Image, error) {
-	rgba := image.NewRGBA(image.Rect(0, 0, d.c.Width, d.c.Height))
-	if d.c.Width == 0 || d.c.Height == 0 {
-		return rgba, nil
+// bulkRead reports whether the n bytes of the pixels are read in one call
+// rather than row by row.
+func (d *decoder) bulkRead(n int64) bool {
+	if n > int64(maxInt) {
+		return false
 	}
-	// There are 2 bytes per pixel, and each row is 4-byte aligned.
-	b := make([]byte, (2*d.c.Width+3)&^3)
-	y0, y1, yDelta := d.c.Height-1, -1, -1
-	if d.topDown {
-		y0, y1, yDelta = 0, d.c.Height, +1
+	if d.opts.BulkRead {
+		return true
 	}
-	for y := y0; y != y1; y += yDelta {
-		if _, err := io.ReadFull(d.r, b); err != nil {
-			return nil, err
+	r := d.r
+	if d.cr != nil {
+		r = d.cr.r
+	}
+	// The whole pixel array is already in memory, so the buffer is not
+	// larger than the input.
+	switch r := r.(type) {
+	case *bytes.Reader:
+		return int64(r.Len()) >= n
+	case *bytes.Buffer:
+		return int64(r.Len()) >= n
+	}
+	return false
+}
+
+// unpackRow stores 1 byte per pixel in dst for every bpp (< 8) bit-per-pixel pixel in src.
+func (d *decoder) unpackRow(dst, src []byte) {
+	t := &unpackTables[d.bpp>>1]
+	ppb := 8 / int(d.bpp)
+	n := len(dst) / ppb * ppb
+	for i, j := 0, 0; i < n; i, j = i+ppb, j+1 {
+		copy(dst[i:i+ppb], t[src[j]][:ppb])
+	}
+	if n < len(dst) {
+		copy(dst[n:], t[src[n/ppb]][:])
+	}
+}
+
+// convertRow converts d.c.Width pixels of src in d.format to dst in format f.
+// If d.noAlpha is true, the alpha will be forcibly set to 0xFF.
+func (d *decoder) convertRow(dst []byte, f PixelFormat, src []byte) {
+	switch {
+	case f == d.format && !d.noAlpha:
+		copy(dst, src)
+	case f == RGBA32 && d.format == RGB565:
+		// The loops below slice the pixels to their size,
+		// so the compiler checks the bounds once per pixel.
+		src = src[:d.c.Width*2]
+		for i := 0; i < len(src); i += 2 {
+			pixel := readUint16(src[i : i+2])
+			p := dst[i*2 : i*2+4]
+			p[0], p[1], p[2], p[3] = expand5[(pixel&0xF800)>>11], expand6[(pixel&0x7E0)>>5], expand5[pixel&0x1F], 0xFF
 		}
-		p := rgba.Pix[y*rgba.Stride : y*rgba.Stride+d.c.Width*4]
-		for i, j := 0, 0; i < len(p); i, j = i+4, j+2 {
-			pixel := readUint16(b[j:])
-			if d.rgb565 {
-				p[i+0] = uint8((pixel&0xF800)>>11) << 3
-				p[i+1] = uint8((pixel&0x7E0)>>5) << 2
-			} else {
-				p[i+0] = uint8((pixel&0x7C00)>>10) << 3
-				p[i+1] = uint8((pixel&0x3E0)>>5) << 3
-			}
-			p[i+2] = uint8(pixel&0x1F) << 3
-			p[i+3] = 0xFF
+	case f == RGBA32 && d.format == RGB555:
+		src = src[:d.c.Width*2]
+		for i := 0; i < len(src); i += 2 {
+			pixel := readUint16(src[i : i+2])
+			p := dst[i*2 : i*2+4]
+			p[0], p[1], p[2], p[3] = expand5[(pixel&0x7C00)>>10], expand5[(pixel&0x3E0)>>5], expand5[pixel&0x1F], 0xFF
+		}
+	case f == RGBA32 && d.format == Paletted8:
+		pal := &d.palBuf
+		for x, v := range src[:d.c.Width] {
+			c := pal[v]
+			p := dst[x*4 : x*4+4]
+			p[0], p[1], p[2], p[3] = c.R, c.G, c.B, c.A
+		}
+	case f == RGBA32 && d.format == BGR24:
+		// BMP images are stored in BGR order rather than RGB order.
+		bgrToRGBA(dst[:d.c.Width*4], src[:d.c.Width*3])
+	case f == RGBA32 && d.format == BGRA32:
+		// BMP images are stored in BGRA order rather than RGBA order.
+		swapRB32(dst[:d.c.Width*4], src[:d.c.Width*4], d.noAlpha)
+	case f == d.format && (f == BGRA32 || f == RGBA32):
+		copyOpaque32(dst[:d.c.Width*4], src[:d.c.Width*4])
+	case d.noAlpha:
+		for x := 0; x < d.c.Width; x++ {
+			r, g, b, _ := d.format.load(src, x, d.pal)
+			f.store(dst, x, r, g, b, 0xFF)
+		}
+	default:
+		for x := 0; x < d.c.Width; x++ {
+			r, g, b, a := d.format.load(src, x, d.pal)
+			f.store(dst, x, r, g, b, a)
 		}
 	}
-	return rgba, nil
 }
 
-// decodeRGB reads a 24 bit-per-pixel BMP image from d.r.
-// If d.topDown is false, the image rows will be read bottom-up.
-func (d *decoder) decodeRGB() (image.Image, error) {
-	rgba := image.NewRGBA(image.Rect(0, 0, d.c.Width, d.c.Height))
-	if d.c.Width == 0 || d.c.Height == 0 {
-		return rgba, nil
+// decodeRLE reads an 4 or 8 bit-per-pixel RLE-encoded BMP image from d.r
+// and stores its palette indexes in pix, with stride bytes between vertically adjacent pixels.
+func (d *decoder) decodeRLE(pix []byte, stride int) error {
+	x, y := 0, d.c.Height-1
+	isValid := func() bool { return x >= 0 && x < d.c.Width && y >= 0 && y < d.c.Height }
+	trace := d.opts.Trace
+	if trace != nil && trace.RLEOpcode == nil {
+		trace = nil
 	}
-	// There are 3 bytes per pixel, and each row is 4-byte aligned.
-	b := make([]byte, (3*d.c.Width+3)&^3)
-	y0, y1, yDelta := d.c.Height-1, -1, -1
-	if d.topDown {
-		y0, y1, yDelta = 0, d.c.Height, +1
+	if n := d.c.Width * d.c.Height; n >= parallelMinSize && n <= parallelMaxRLESize &&
+		trace == nil && runtime.GOMAXPROCS(0) > 1 {
+		return d.decodeRLEParallel(pix, stride)
 	}
-	for y := y0; y != y1; y += yDelta {
-		if _, err := io.ReadFull(d.r, b); err != nil {
-			return nil, err
+	for ops := 1; ; ops++ {
+		if d.opts.MaxRLEOps > 0 && ops > d.opts.MaxRLEOps {
+			return ErrLimitExceeded
 		}
-		p := rgba.Pix[y*rgba.Stride : y*rgba.Stride+d.c.Width*4]
-		for i, j := 0, 0; i < len(p); i, j = i+4, j+3 {
-			// BMP images are stored in BGR order rather than RGB order.
-			p[i+0] = b[j+2]
-			p[i+1] = b[j+1]
-			p[i+2] = b[j+0]
-			p[i+3] = 0xFF
+		off := d.offset()
+		op, b, err := readRLEOp(d.r, d.bpp, &d.rleBuf)
+		if err != nil {
+			return err
+		}
+		if trace != nil {
+			trace.RLEOpcode(off, b)
+		}
+		switch op.Kind {
+		case RLEEndOfLine:
+			x, y = 0, y-1
+			if !isValid() {
+				return FormatError("invalid RLE data")
+			}
+		case RLEEndOfBitmap:
+			return nil
+		case RLEDelta:
+			x, y = x+op.DX, y-op.DY
+			if !isValid() {
+				return FormatError("invalid RLE data")
+			}
+		default:
+			if x, err = d.putRLEPixels(pix, stride, op, x, y); err != nil {
+				return err
+			}
 		}
 	}
-	return rgba, nil
 }
 
-// decodeNRGBA reads a 32 bit-per-pixel BMP image from d.r.
-// If d.topDown is false, the image rows will be read bottom-up.
-// If d.noAlpha is true, the image will have the alpha forcibly set to 0xFF.
-func (d *decoder) decodeNRGBA() (image.Image, error) {
-	rgba := image.NewNRGBA(image.Rect(0, 0, d.c.Width, d.c.Height))
-	if d.c.Width == 0 || d.c.Height == 0 {
-		return rgba, nil
+// putRLEPixels stores the pixels of the run or absolute operation op in pix
+// starting at x, y and returns the x following them.
+func (d *decoder) putRLEPixels(pix []byte, stride int, op RLEOp, x, y int) (int, error) {
+	// TODO(sergeymakinen): Consider ignoring pixels past the end of the row.
+	for i := 0; i < op.Count; i++ {
+		if x < 0 || x >= d.c.Width || y < 0 || y >= d.c.Height {
+			return x, FormatError("invalid RLE data")
+		}
+		pix[y*stride+x] = op.Pixel(i, int(d.bpp))
+		if d.mask != nil {
+			d.mask.Pix[y*d.mask.Stride+x] = 0xFF
+		}
+		x++
 	}
-	y0, y1, yDelta := d.c.Height-1, -1, -1
-	if d.topDown {
-		y0, y1, yDelta = 0, d.c.Height, +1
+	return x, nil
+}
+
+// decodeRLEParallel is decodeRLE for large images. The operations are read
+// and validated first, keeping their bytes along with the positions at which
+// groups of rows start, and the groups are then rasterized by GOMAXPROCS goroutines.
+// As the rows are only ever moved up, the groups set disjoint pixels.
+func (d *decoder) decodeRLEParallel(pix []byte, stride int) error {
+	type group struct {
+		start, x, y int
 	}
-	for y := y0; y != y1; y += yDelta {
-		p := rgba.Pix[y*rgba.Stride : y*rgba.Stride+d.c.Width*4]
-		if _, err := io.ReadFull(d.r, p); err != nil {
-			return nil, err
+	workers := runtime.GOMAXPROCS(0)
+	if workers > d.c.Height {
+		workers = d.c.Height
+	}
+	per := (d.c.Height + workers - 1) / workers
+	buf := getBuffer(d.c.Width * d.c.Height / 4)
+	defer putBuffer(buf)
+	data := (*buf)[:0]
+	groups := make([]group, 1, workers)
+	groups[0] = group{y: d.c.Height - 1}
+	x, y := 0, d.c.Height-1
+scan:
+	for ops := 1; ; ops++ {
+		if d.opts.MaxRLEOps > 0 && ops > d.opts.MaxRLEOps {
+			return ErrLimitExceeded
+		}
+		op, b, err := readRLEOp(d.r, d.bpp, &d.rleBuf)
+		if err != nil {
+			return err
 		}
-		for i := 0; i < len(p); i += 4 {
-			// BMP images are stored in BGRA order rather than RGBA order.
-			p[i+0], p[i+2] = p[i+2], p[i+0]
-			if d.noAlpha {
-				p[i+3] = 0xFF
+		// The positions are validated the same way as by decodeRLE and putRLEPixels:
+		// pixels may end a row, but the moves must stay within the image.
+		switch op.Kind {
+		case RLEEndOfLine:
+			x, y = 0, y-1
+			if y < 0 {
+				return FormatError("invalid RLE data")
+			}
+		case RLEEndOfBitmap:
+			break scan
+		case RLEDelta:
+			x, y = x+op.DX, y-op.DY
+			if x >= d.c.Width || y < 0 {
+				return FormatError("invalid RLE data")
+			}
+		default:
+			if y < 0 || x+op.Count > d.c.Width {
+				return FormatError("invalid RLE data")
 			}
+			x += op.Count
+		}
+		data = append(data, b...)
+		if op.Kind != RLERun && op.Kind != RLEAbsolute && d.c.Height-1-y >= len(groups)*per {
+			groups = append(groups, group{start: len(data), x: x, y: y})
 		}
 	}
-	return rgba, nil
+	errs := make([]error, len(groups))
+	var wg sync.WaitGroup
+	for i, g := range groups {
+		end := len(data)
+		if i+1 < len(groups) {
+			end = groups[i+1].start
+		}
+		wg.Add(1)
+		go func(i int, g group, r *bytes.Reader) {
+			defer wg.Done()
+			var buf rleBuffer
+			x, y := g.x, g.y
+			for {
+				op, _, err := readRLEOp(r, d.bpp, &buf)
+				if err == io.EOF {
+					return
+				}
+				if err != nil {
+					errs[i] = err
+					return
+				}
+				switch op.Kind {
+				case RLEEndOfLine:
+					x, y = 0, y-1
+				case RLEDelta:
+					x, y = x+op.DX, y-op.DY
+				default:
+					if x, err = d.putRLEPixels(pix, stride, op, x, y); err != nil {
+						errs[i] = err
+						return
+					}
+				}
+			}
+		}(i, g, bytes.NewReader(data[g.start:end]))
+	}
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
 // Decode reads a BMP image from r and returns it as an image.Image.
 func Decode(r io.Reader) (image.Image, error) {
-	d := &decoder{r: r}
+	return DecodeWithOptions(r, nil)
+}
+
+// DecodeWithOptions reads a BMP image from r with the given options
+// and returns it as an image.Image.
+func DecodeWithOptions(r io.Reader, opts *DecodeOptions) (image.Image, error) {
+	d := newDecoder(r, opts)
 	if err := d.DecodeConfig(); err != nil {
 		return nil, err
 	}
 	return d.Decode()
 }
 
+// DecodeWithMask is like DecodeWithOptions but also returns a mask of the pixels
+// defined by the image data. RLE-compressed images may skip pixels with delta,
+// end-of-line and end-of-bitmap codes, leaving them undefined by the specification
+// and set to the palette index 0 by the decoder. The mask has such pixels
+// transparent and all other pixels opaque, so it can be used with draw.DrawMask.
+// The mask is nil for images that are not RLE-compressed.
+func DecodeWithMask(r io.Reader, opts *DecodeOptions) (image.Image, *image.Alpha, error) {
+	d := newDecoder(r, opts)
+	if err := d.DecodeConfig(); err != nil {
+		return nil, nil, err
+	}
+	if d.rle {
+		pix, err := d.pixels(d.c.Width*d.c.Height, true)
+		if err != nil {
+			return nil, nil, err
+		}
+		d.mask = &image.Alpha{Pix: pix, Stride: d.c.Width, Rect: image.Rect(0, 0, d.c.Width, d.c.Height)}
+	}
+	img, err := d.Decode()
+	if err != nil {
+		return nil, nil, err
+	}
+	return img, d.mask, nil
+}
+
+// DecodeRaw reads a BMP image from r and stores its pixels in pix converted to format f,
+// with stride bytes between vertically adjacent pixels, without allocating an image.Image.
+// Only paletted images may be decoded to Paletted8, in which case the palette
+// is the color model of the returned config.
+func DecodeRaw(r io.Reader, pix []byte, stride int, f PixelFormat) (image.Config, error) {
+	d := &decoder{r: r}
+	if err := d.DecodeConfig(); err != nil {
+		return image.Config{}, err
+	}
+	if !f.valid() || (f == Paletted8 && d.format != Paletted8) {
+		return image.Config{}, UnsupportedError("pixel format conversion")
+	}
+	if d.c.Width > 0 && d.c.Height > 0 {
+		if n := f.Stride(d.c.Width); stride < n || len(pix) < stride*(d.c.Height-1)+n {
+			return image.Config{}, errors.New("bmp: pixel buffer too small")
+		}
+	}
+	if err := d.decodeInto(pix, stride, f); err != nil {
+		return image.Config{}, err
+	}
+	return d.c, nil
+}
+
+// ExtendedConfig holds the color model, dimensions and storage details of a BMP image.
+type ExtendedConfig struct {
+	image.Config
+
+	// PixelFormat is the format which the pixels can be decoded to by DecodeRaw
+	// without a conversion.
+	PixelFormat PixelFormat
+
+	// BitsPerPixel is the number of bits used by a single pixel in the file.
+	BitsPerPixel int
+
+	// TopDown reports whether the rows are stored top-down.
+	TopDown bool
+
+	// HasAlpha reports whether any pixel is not fully opaque.
+	// It is only set if the ScanAlpha option is used.
+	HasAlpha bool
+}
+
+// DecodeExtendedConfig returns the color model, dimensions and storage details
+// of a BMP image without decoding the entire image.
+// See DecodeConfig for how r is read.
+func DecodeExtendedConfig(r io.Reader) (ExtendedConfig, error) {
+	d, err := peekConfig(r)
+	if err != nil {
+		return ExtendedConfig{}, err
+	}
+	return d.extendedConfig(), nil
+}
+
+// DecodeExtendedConfigWithOptions is like DecodeExtendedConfig but uses the given options.
+// If ScanAlpha is used, the pixels are read as well and are only left unconsumed
+// if r is an io.Seeker. The scan stops at the first pixel that is not fully opaque.
+func DecodeExtendedConfigWithOptions(r io.Reader, opts *DecodeOptions) (ExtendedConfig, error) {
+	if opts == nil || !opts.ScanAlpha {
+		return DecodeExtendedConfig(r)
+	}
+	var d *decoder
+	scan := func() error {
+		d = newDecoder(r, opts)
+		if err := d.DecodeConfig(); err != nil {
+			return err
+		}
+		return d.scanAlpha()
+	}
+	var err error
+	if s, ok := r.(io.Seeker); ok {
+		err = seekBack(s, scan)
+	} else {
+		err = scan()
+	}
+	if err != nil {
+		return ExtendedConfig{}, err
+	}
+	c := d.extendedConfig()
+	c.HasAlpha = d.hasAlpha
+	return c, nil
+}
+
+var errStop = errors.New("stop")
+
+// scanAlpha reads the pixels from d.r and sets d.hasAlpha if any pixel is not fully opaque.
+func (d *decoder) scanAlpha() error {
+	if d.format != BGRA32 || d.noAlpha || d.c.Width == 0 || d.c.Height == 0 {
+		return nil
+	}
+	err := d.decodeRows(func(y int, row []byte) error {
+		for i := 3; i < len(row); i += 4 {
+			if row[i] != 0xFF {
+				d.hasAlpha = true
+				return errStop
+			}
+		}
+		return nil
+	})
+	if err == errStop {
+		err = nil
+	}
+	return err
+}
+
+func (d *decoder) extendedConfig() ExtendedConfig {
+	return ExtendedConfig{
+		Config:       d.c,
+		PixelFormat:  d.format,
+		BitsPerPixel: int(d.bpp),
+		TopDown:      d.topDown,
+	}
+}
+
 // DecodeConfig returns the color model and dimensions of a BMP image without
 // decoding the entire image.
+//
+// If r has a Peek method, like bufio.Reader, or is an io.Seeker,
+// the header is left unconsumed, so the image can be decoded from r afterwards.
+// Otherwise the header and the color table are consumed, and so are they
+// if they do not fit in the buffer of the Peek method, such as the 4096 bytes
+// of the bufio.Reader of image.DecodeConfig. The bytes between the color table
+// and the pixels are never read.
 func DecodeConfig(r io.Reader) (image.Config, error) {
-	d := &decoder{r: r}
-	if err := d.DecodeConfig(); err != nil {
+	d, err := peekConfig(r)
+	if err != nil {
 		return image.Config{}, err
 	}
 	return d.c, nil
 }
 
+// peeker is implemented by readers that can return the next bytes
+// without advancing, like bufio.Reader.
+type peeker interface {
+	Peek(n int) ([]byte, error)
+}
+
+// peekReader reads from a peeker without advancing it.
+type peekReader struct {
+	p peeker
+	n int
+}
+
+func (r *peekReader) Read(b []byte) (int, error) {
+	buf, err := r.p.Peek(r.n + len(b))
+	if len(buf) <= r.n {
+		if err == nil {
+			err = io.EOF
+		}
+		return 0, err
+	}
+	n := copy(b, buf[r.n:])
+	r.n += n
+	return n, nil
+}
+
+// peekConfig reads the header from r, leaving it unconsumed if possible.
+// If the header does not fit in the buffer of a peeker, it is consumed.
+func peekConfig(r io.Reader) (*decoder, error) {
+	switch rr := r.(type) {
+	case peeker:
+		d := &decoder{r: &peekReader{p: rr}}
+		if err := d.decodeHeader(); err != bufio.ErrBufferFull {
+			return d, err
+		}
+	case io.Seeker:
+		d := &decoder{r: r}
+		return d, seekBack(rr, d.decodeHeader)
+	}
+	d := &decoder{r: r}
+	return d, d.decodeHeader()
+}
+
+// seekBack calls fn and restores the offset of s afterwards.
+// If the offset of s cannot be determined, fn is just called.
+func seekBack(s io.Seeker, fn func() error) error {
+	off, err := s.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return fn()
+	}
+	err = fn()
+	if _, serr := s.Seek(off, io.SeekStart); err == nil {
+		err = serr
+	}
+	return err
+}
+
 func init() {
 	image.RegisterFormat("bmp", "BM????\x00\x00\x00\x00", Decode, DecodeConfig)
 }
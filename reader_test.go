@@ -3,14 +3,20 @@ package bmp
 // This code uses BMP images generated by BMP Suite (https://entropymine.com/jason/bmpsuite/).
 
 import (
+	"bufio"
 	"bytes"
 	"encoding/binary"
 	"fmt"
 	"image"
 	"image/color"
+	"image/color/palette"
 	"image/png"
+	"io"
 	"io/ioutil"
+	"math/rand"
 	"path/filepath"
+	"reflect"
+	"runtime"
 	"strings"
 	"testing"
 )
@@ -62,14 +68,15 @@ type rgb5x5Image struct {
 }
 
 func (p rgb5x5Image) At(x, y int) color.Color {
+	// The channels are truncated and their high bits replicated in the low ones.
 	c := p.Image.At(x, y).(color.RGBA)
-	c.R &= 0xF8
+	c.R = c.R&0xF8 | c.R>>5
 	if p.rgb565 {
-		c.G &= 0xFC
+		c.G = c.G&0xFC | c.G>>6
 	} else {
-		c.G &= 0xF8
+		c.G = c.G&0xF8 | c.G>>5
 	}
-	c.B &= 0xF8
+	c.B = c.B&0xF8 | c.B>>5
 	return c
 }
 
@@ -132,3 +139,1000 @@ func TestDecodeShouldFail(t *testing.T) {
 		})
 	}
 }
+
+func TestDecodeRaw(t *testing.T) {
+	files, err := filepath.Glob("testdata/*.bmp")
+	if err != nil {
+		panic("failed to list test files: " + err.Error())
+	}
+	for _, file := range files {
+		t.Run(file, func(t *testing.T) {
+			in, err := ioutil.ReadFile(file)
+			if err != nil {
+				panic("failed to read " + file + ": " + err.Error())
+			}
+			img, err := Decode(bytes.NewReader(in))
+			if err != nil {
+				t.Fatalf("Decode() = _, %v; want nil", err)
+			}
+			b := img.Bounds()
+			nrgba := image.NewNRGBA(b)
+			c, err := DecodeRaw(bytes.NewReader(in), nrgba.Pix, nrgba.Stride, RGBA32)
+			if err != nil {
+				t.Fatalf("DecodeRaw() = _, %v; want nil", err)
+			}
+			if c.Width != b.Dx() || c.Height != b.Dy() {
+				t.Fatalf("DecodeRaw() = %dx%d, _; want %dx%d", c.Width, c.Height, b.Dx(), b.Dy())
+			}
+			compare(t, img, nrgba)
+			if paletted, ok := img.(*image.Paletted); ok {
+				pix := make([]byte, len(paletted.Pix))
+				if _, err := DecodeRaw(bytes.NewReader(in), pix, paletted.Stride, Paletted8); err != nil {
+					t.Fatalf("DecodeRaw() = _, %v; want nil", err)
+				}
+				if !bytes.Equal(pix, paletted.Pix) {
+					t.Errorf("DecodeRaw() = %v; want %v", pix, paletted.Pix)
+				}
+			} else if _, err := DecodeRaw(bytes.NewReader(in), nrgba.Pix, nrgba.Stride, Paletted8); err == nil {
+				t.Error("DecodeRaw() = _, nil; want non-nil")
+			}
+			gray := image.NewGray(b)
+			if _, err := DecodeRaw(bytes.NewReader(in), gray.Pix, gray.Stride, Gray8); err != nil {
+				t.Fatalf("DecodeRaw() = _, %v; want nil", err)
+			}
+			compare(t, grayImage{img}, gray)
+			if _, err := DecodeRaw(bytes.NewReader(in), gray.Pix, gray.Stride-1, Gray8); err == nil && b.Dx() > 0 {
+				t.Error("DecodeRaw() = _, nil; want non-nil")
+			}
+		})
+	}
+}
+
+type grayImage struct {
+	image.Image
+}
+
+func (p grayImage) At(x, y int) color.Color {
+	r, g, b, _ := p.Image.At(x, y).RGBA()
+	return color.GrayModel.Convert(color.RGBA64{R: uint16(r), G: uint16(g), B: uint16(b), A: 0xFFFF})
+}
+
+func TestDecodeExtendedConfig(t *testing.T) {
+	tests := []struct {
+		file string
+		c    ExtendedConfig
+	}{
+		{"testdata/pal1bg.bmp", ExtendedConfig{PixelFormat: Paletted8, BitsPerPixel: 1}},
+		{"testdata/pal8topdown.bmp", ExtendedConfig{PixelFormat: Paletted8, BitsPerPixel: 8, TopDown: true}},
+		{"testdata/rgb16.bmp", ExtendedConfig{PixelFormat: RGB555, BitsPerPixel: 16}},
+		{"testdata/rgb16-565.bmp", ExtendedConfig{PixelFormat: RGB565, BitsPerPixel: 16}},
+		{"testdata/rgb24.bmp", ExtendedConfig{PixelFormat: BGR24, BitsPerPixel: 24}},
+		{"testdata/rgb32bfdef.bmp", ExtendedConfig{PixelFormat: BGRA32, BitsPerPixel: 32}},
+	}
+	for _, test := range tests {
+		t.Run(test.file, func(t *testing.T) {
+			in, err := ioutil.ReadFile(test.file)
+			if err != nil {
+				panic("failed to read " + test.file + ": " + err.Error())
+			}
+			c, err := DecodeExtendedConfig(bytes.NewReader(in))
+			if err != nil {
+				t.Fatalf("DecodeExtendedConfig() = _, %v; want nil", err)
+			}
+			if c.PixelFormat != test.c.PixelFormat || c.BitsPerPixel != test.c.BitsPerPixel || c.TopDown != test.c.TopDown {
+				t.Errorf("DecodeExtendedConfig() = {%s %d %t}, _; want {%s %d %t}", c.PixelFormat, c.BitsPerPixel, c.TopDown, test.c.PixelFormat, test.c.BitsPerPixel, test.c.TopDown)
+			}
+			if size := c.PixelFormat.Size(c.Width, c.Height); size != c.PixelFormat.Stride(c.Width)*c.Height || size != c.Width*c.Height*c.PixelFormat.BytesPerPixel() {
+				t.Errorf("Size() = %d; want %d", size, c.Width*c.Height*c.PixelFormat.BytesPerPixel())
+			}
+		})
+	}
+}
+
+func TestDecodeExpandPalette(t *testing.T) {
+	files, err := filepath.Glob("testdata/pal*.bmp")
+	if err != nil {
+		panic("failed to list test files: " + err.Error())
+	}
+	for _, file := range files {
+		t.Run(file, func(t *testing.T) {
+			in, err := ioutil.ReadFile(file)
+			if err != nil {
+				panic("failed to read " + file + ": " + err.Error())
+			}
+			img, err := Decode(bytes.NewReader(in))
+			if err != nil {
+				t.Fatalf("Decode() = _, %v; want nil", err)
+			}
+			img2, err := DecodeWithOptions(bytes.NewReader(in), &DecodeOptions{ExpandPalette: true})
+			if err != nil {
+				t.Fatalf("DecodeWithOptions() = _, %v; want nil", err)
+			}
+			if _, ok := img2.(*image.RGBA); !ok {
+				t.Fatalf("DecodeWithOptions() = %T, _; want *image.RGBA", img2)
+			}
+			compare(t, img, img2)
+		})
+	}
+}
+
+func TestDecodeWithMask(t *testing.T) {
+	tests := []struct {
+		file      string
+		undefined bool
+	}{
+		{"testdata/pal4.bmp", false},
+		{"testdata/pal4rle.bmp", false},
+		{"testdata/pal4rlecut.bmp", true},
+		{"testdata/pal4rletrns.bmp", true},
+		{"testdata/pal8rle.bmp", false},
+	}
+	for _, test := range tests {
+		t.Run(test.file, func(t *testing.T) {
+			in, err := ioutil.ReadFile(test.file)
+			if err != nil {
+				panic("failed to read " + test.file + ": " + err.Error())
+			}
+			img, mask, err := DecodeWithMask(bytes.NewReader(in), nil)
+			if err != nil {
+				t.Fatalf("DecodeWithMask() = _, _, %v; want nil", err)
+			}
+			if test.file == "testdata/pal4.bmp" {
+				if mask != nil {
+					t.Fatalf("DecodeWithMask() = _, %v, _; want nil", mask)
+				}
+				return
+			}
+			if mask == nil {
+				t.Fatal("DecodeWithMask() = _, nil, _; want non-nil")
+			}
+			if !mask.Bounds().Eq(img.Bounds()) {
+				t.Fatalf("Bounds() = %s; want %s", mask.Bounds(), img.Bounds())
+			}
+			if undefined := !mask.Opaque(); undefined != test.undefined {
+				t.Errorf("!Opaque() = %t; want %t", undefined, test.undefined)
+			}
+		})
+	}
+}
+
+func TestDecodeConfigThenDecode(t *testing.T) {
+	in, err := ioutil.ReadFile("testdata/pal8.bmp")
+	if err != nil {
+		panic("failed to read testdata/pal8.bmp: " + err.Error())
+	}
+	tests := []struct {
+		name string
+		r    io.Reader
+	}{
+		{"Peeker", bufio.NewReader(bytes.NewBuffer(in))},
+		{"Seeker", bytes.NewReader(in)},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			c, err := DecodeConfig(test.r)
+			if err != nil {
+				t.Fatalf("DecodeConfig() = _, %v; want nil", err)
+			}
+			if _, err := DecodeExtendedConfig(test.r); err != nil {
+				t.Fatalf("DecodeExtendedConfig() = _, %v; want nil", err)
+			}
+			img, err := Decode(test.r)
+			if err != nil {
+				t.Fatalf("Decode() = _, %v; want nil", err)
+			}
+			if c.Width != img.Bounds().Dx() || c.Height != img.Bounds().Dy() {
+				t.Errorf("DecodeConfig() = %dx%d, _; want %s", c.Width, c.Height, img.Bounds().Size())
+			}
+		})
+	}
+}
+
+func TestDecodeConfigLargeGap(t *testing.T) {
+	m := image.NewPaletted(image.Rect(0, 0, 3, 2), color.Palette{color.Black, color.White})
+	m.Pix[1] = 1
+	var buf bytes.Buffer
+	// The pixels start past the 4096-byte buffer of image.DecodeConfig.
+	if err := EncodeWithOptions(&buf, m, &Options{PixelAlignment: 8192}); err != nil {
+		t.Fatalf("EncodeWithOptions() = %v; want nil", err)
+	}
+	in := buf.Bytes()
+	c, name, err := image.DecodeConfig(bytes.NewReader(in))
+	if err != nil || name != "bmp" {
+		t.Fatalf("image.DecodeConfig() = _, %q, %v; want bmp, nil", name, err)
+	}
+	if c.Width != 3 || c.Height != 2 {
+		t.Errorf("image.DecodeConfig() = %dx%d, _, _; want 3x2", c.Width, c.Height)
+	}
+	img, _, err := image.Decode(bytes.NewReader(in))
+	if err != nil {
+		t.Fatalf("image.Decode() = _, _, %v; want nil", err)
+	}
+	compare(t, m, img)
+	r := bufio.NewReader(bytes.NewReader(in))
+	if _, err := DecodeConfig(r); err != nil {
+		t.Fatalf("DecodeConfig() = _, %v; want nil", err)
+	}
+	if img, err = Decode(r); err != nil {
+		t.Fatalf("Decode() = _, %v; want nil", err)
+	}
+	compare(t, m, img)
+	// The header does not fit in the smallest buffer, so it is consumed.
+	r = bufio.NewReaderSize(bytes.NewReader(in), 16)
+	if c, err = DecodeConfig(r); err != nil {
+		t.Fatalf("DecodeConfig() = _, %v; want nil", err)
+	}
+	if c.Width != 3 || c.Height != 2 {
+		t.Errorf("DecodeConfig() = %dx%d, _; want 3x2", c.Width, c.Height)
+	}
+}
+
+func TestDecodeExtendedConfigScanAlpha(t *testing.T) {
+	img := image.NewNRGBA(image.Rect(0, 0, 3, 2))
+	for i := range img.Pix {
+		img.Pix[i] = 0xFF
+	}
+	var buf bytes.Buffer
+	img.Pix[3] = 0
+	if err := Encode(&buf, img); err != nil {
+		t.Fatalf("Encode() = %v; want nil", err)
+	}
+	translucent := buf.Bytes()
+	tests := []struct {
+		name     string
+		in       []byte
+		hasAlpha bool
+	}{
+		{"Translucent", translucent, true},
+		{"Opaque", mustReadFile("testdata/rgb24.bmp"), false},
+		{"NoAlpha", mustReadFile("testdata/rgb32bfdef.bmp"), false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			r := bytes.NewReader(test.in)
+			c, err := DecodeExtendedConfigWithOptions(r, &DecodeOptions{ScanAlpha: true})
+			if err != nil {
+				t.Fatalf("DecodeExtendedConfigWithOptions() = _, %v; want nil", err)
+			}
+			if c.HasAlpha != test.hasAlpha {
+				t.Errorf("HasAlpha = %t; want %t", c.HasAlpha, test.hasAlpha)
+			}
+			if _, err := Decode(r); err != nil {
+				t.Errorf("Decode() = _, %v; want nil", err)
+			}
+		})
+	}
+}
+
+func mustReadFile(file string) []byte {
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		panic("failed to read " + file + ": " + err.Error())
+	}
+	return b
+}
+
+func TestDecodeTrace(t *testing.T) {
+	t.Run("Rows", func(t *testing.T) {
+		in := mustReadFile("testdata/pal8.bmp")
+		var events []string
+		rows, next := 0, int64(0)
+		trace := &DecodeTrace{
+			FileHeader: func(offset int64, b []byte) {
+				events = append(events, fmt.Sprintf("FileHeader(%d, %d)", offset, len(b)))
+			},
+			InfoHeader: func(offset int64, b []byte) {
+				events = append(events, fmt.Sprintf("InfoHeader(%d, %d)", offset, len(b)))
+			},
+			Palette: func(offset int64, b []byte) {
+				events = append(events, fmt.Sprintf("Palette(%d, %d)", offset, len(b)))
+			},
+			Row: func(y int, offset int64, b []byte) {
+				if rows == 0 {
+					events = append(events, fmt.Sprintf("Row(%d, %d, %d)", y, offset, len(b)))
+				} else if offset != next {
+					t.Errorf("Row() offset = %d; want %d", offset, next)
+				}
+				rows++
+				next = offset + int64(len(b))
+			},
+		}
+		img, err := DecodeWithOptions(bytes.NewReader(in), &DecodeOptions{Trace: trace})
+		if err != nil {
+			t.Fatalf("DecodeWithOptions() = _, %v; want nil", err)
+		}
+		expected := []string{"FileHeader(0, 14)", "InfoHeader(14, 40)", "Palette(54, 1008)", "Row(63, 1062, 128)"}
+		if fmt.Sprint(events) != fmt.Sprint(expected) {
+			t.Errorf("events = %v; want %v", events, expected)
+		}
+		if rows != img.Bounds().Dy() || next != int64(len(in)) {
+			t.Errorf("rows = %d, end = %d; want %d, %d", rows, next, img.Bounds().Dy(), len(in))
+		}
+	})
+	t.Run("RLEOpcodes", func(t *testing.T) {
+		in := mustReadFile("testdata/pal8rle.bmp")
+		next := int64(1062)
+		eof := false
+		trace := &DecodeTrace{
+			RLEOpcode: func(offset int64, b []byte) {
+				if offset != next {
+					t.Fatalf("RLEOpcode() offset = %d; want %d", offset, next)
+				}
+				next = offset + int64(len(b))
+				eof = b[0] == 0 && b[1] == 1
+			},
+		}
+		if _, err := DecodeWithOptions(bytes.NewReader(in), &DecodeOptions{Trace: trace}); err != nil {
+			t.Fatalf("DecodeWithOptions() = _, %v; want nil", err)
+		}
+		if !eof || next != int64(len(in)) {
+			t.Errorf("last opcode is EOF = %t, end = %d; want true, %d", eof, next, len(in))
+		}
+	})
+}
+
+func TestDecodeColorModel(t *testing.T) {
+	models := []color.Model{
+		color.RGBAModel,
+		color.RGBA64Model,
+		color.NRGBAModel,
+		color.NRGBA64Model,
+		color.GrayModel,
+		color.Gray16Model,
+		color.CMYKModel,
+	}
+	files, err := filepath.Glob("testdata/*.bmp")
+	if err != nil {
+		panic("failed to list test files: " + err.Error())
+	}
+	for _, file := range files {
+		in := mustReadFile(file)
+		img, err := Decode(bytes.NewReader(in))
+		if err != nil {
+			t.Fatalf("Decode() = _, %v; want nil", err)
+		}
+		for _, m := range models {
+			img2, err := DecodeWithOptions(bytes.NewReader(in), &DecodeOptions{ColorModel: m})
+			if err != nil {
+				t.Fatalf("DecodeWithOptions() = _, %v; want nil", err)
+			}
+			t.Run(fmt.Sprintf("%s;%T", file, img2), func(t *testing.T) {
+				if img2.ColorModel() != m {
+					t.Fatalf("ColorModel() = %v; want %v", img2.ColorModel(), m)
+				}
+				compare(t, convertedImage{img, m}, img2)
+			})
+		}
+	}
+	if _, err := DecodeWithOptions(bytes.NewReader(mustReadFile("testdata/rgb24.bmp")), &DecodeOptions{ColorModel: color.AlphaModel}); err == nil {
+		t.Error("DecodeWithOptions() = _, nil; want non-nil")
+	}
+}
+
+type convertedImage struct {
+	image.Image
+	m color.Model
+}
+
+func (p convertedImage) At(x, y int) color.Color { return p.m.Convert(p.Image.At(x, y)) }
+
+func TestDecodeLimits(t *testing.T) {
+	tests := []struct {
+		name string
+		file string
+		opts DecodeOptions
+		err  error
+	}{
+		{"MaxBytes", "testdata/rgb24.bmp", DecodeOptions{MaxBytes: 1000}, ErrLimitExceeded},
+		{"MaxBytesExact", "testdata/rgb24.bmp", DecodeOptions{MaxBytes: 24630}, nil},
+		{"MaxBytesHeader", "testdata/rgb24.bmp", DecodeOptions{MaxBytes: 20}, ErrLimitExceeded},
+		{"MaxRLEOps", "testdata/pal8rle.bmp", DecodeOptions{MaxRLEOps: 10}, ErrLimitExceeded},
+		{"MaxRLEOpsEnough", "testdata/pal8rle.bmp", DecodeOptions{MaxRLEOps: 1 << 20}, nil},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if _, err := DecodeWithOptions(bytes.NewReader(mustReadFile(test.file)), &test.opts); err != test.err {
+				t.Errorf("DecodeWithOptions() = _, %v; want %v", err, test.err)
+			}
+		})
+	}
+}
+
+func TestDecodeUnknownHeader(t *testing.T) {
+	in := mustReadFile("testdata/pal8.bmp")
+	// Insert 20 vendor-specific bytes after the BITMAPINFOHEADER.
+	b := append([]byte(nil), in[:fileHeaderLen+infoHeaderLen]...)
+	b = append(b, make([]byte, 20)...)
+	b = append(b, in[fileHeaderLen+infoHeaderLen:]...)
+	binary.LittleEndian.PutUint32(b[2:], uint32(len(b)))
+	binary.LittleEndian.PutUint32(b[10:], readUint32(in[10:])+20)
+	binary.LittleEndian.PutUint32(b[14:], infoHeaderLen+20)
+	if _, err := Decode(bytes.NewReader(b)); err == nil || err.Error() != "bmp: unsupported feature: DIB header version" {
+		t.Fatalf("Decode() = _, %v; want %s", err, "bmp: unsupported feature: DIB header version")
+	}
+	var size uint32
+	img, err := DecodeWithOptions(bytes.NewReader(b), &DecodeOptions{
+		UnknownHeader: func(n uint32) bool {
+			size = n
+			return true
+		},
+	})
+	if err != nil {
+		t.Fatalf("DecodeWithOptions() = _, %v; want nil", err)
+	}
+	if size != infoHeaderLen+20 {
+		t.Errorf("UnknownHeader() size = %d; want %d", size, infoHeaderLen+20)
+	}
+	expected, err := Decode(bytes.NewReader(in))
+	if err != nil {
+		t.Fatalf("Decode() = _, %v; want nil", err)
+	}
+	compare(t, expected, img)
+}
+
+func TestDecodeEmptyAlphaMask(t *testing.T) {
+	m := image.NewNRGBA(image.Rect(0, 0, 3, 2))
+	for i := range m.Pix {
+		m.Pix[i] = uint8(i * 13)
+	}
+	for _, header := range []HeaderVersion{HeaderV4, HeaderV5} {
+		t.Run(fmt.Sprint(header), func(t *testing.T) {
+			var b bytes.Buffer
+			if err := EncodeWithOptions(&b, m, &Options{Header: header}); err != nil {
+				t.Fatalf("EncodeWithOptions() = %v; want nil", err)
+			}
+			in := b.Bytes()
+			if mask := readUint32(in[66:]); mask != 0xFF000000 {
+				t.Fatalf("alpha mask = %#x; want 0xff000000", mask)
+			}
+			binary.LittleEndian.PutUint32(in[66:], 0)
+			img, err := Decode(bytes.NewReader(in))
+			if err != nil {
+				t.Fatalf("Decode() = _, %v; want nil", err)
+			}
+			for y := 0; y < 2; y++ {
+				for x := 0; x < 3; x++ {
+					c := m.NRGBAAt(x, y)
+					c.A = 0xFF
+					if got := color.NRGBAModel.Convert(img.At(x, y)); got != c {
+						t.Errorf("At(%d, %d) = %v; want %v", x, y, got, c)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestDecodeBulkRead(t *testing.T) {
+	files, err := filepath.Glob("testdata/*.bmp")
+	if err != nil {
+		panic("failed to list test files: " + err.Error())
+	}
+	for _, file := range files {
+		t.Run(file, func(t *testing.T) {
+			in := mustReadFile(file)
+			// A plain io.Reader is read row by row.
+			expected, err := Decode(struct{ io.Reader }{bytes.NewReader(in)})
+			if err != nil {
+				t.Skipf("Decode() = _, %v", err)
+			}
+			for name, test := range map[string]struct {
+				r    io.Reader
+				opts *DecodeOptions
+			}{
+				"bytes.Reader": {bytes.NewReader(in), nil},
+				"bytes.Buffer": {bytes.NewBuffer(in), nil},
+				"BulkRead":     {struct{ io.Reader }{bytes.NewReader(in)}, &DecodeOptions{BulkRead: true}},
+			} {
+				img, err := DecodeWithOptions(test.r, test.opts)
+				if err != nil {
+					t.Fatalf("DecodeWithOptions() with %s = _, %v; want nil", name, err)
+				}
+				compare(t, expected, img)
+			}
+			// Truncated pixels fail either way.
+			truncated := in[:len(in)-1]
+			_, err1 := Decode(bytes.NewReader(truncated))
+			_, err2 := Decode(struct{ io.Reader }{bytes.NewReader(truncated)})
+			if (err1 == nil) != (err2 == nil) {
+				t.Errorf("Decode() of truncated file = _, %v; want _, %v", err1, err2)
+			}
+		})
+	}
+}
+
+// readCounter is an unbuffered reader counting the calls to Read.
+type readCounter struct {
+	r     io.Reader
+	reads int
+}
+
+func (r *readCounter) Read(p []byte) (int, error) {
+	r.reads++
+	return r.r.Read(p)
+}
+
+func TestDecodeBuffer(t *testing.T) {
+	in := mustReadFile("testdata/rgb24.bmp")
+	// The file is followed by another one, which must not be read.
+	stream := append(append([]byte(nil), in...), in...)
+	expected, err := Decode(bytes.NewReader(in))
+	if err != nil {
+		t.Fatalf("Decode() = _, %v; want nil", err)
+	}
+	rows := expected.Bounds().Dy()
+	for _, opts := range []*DecodeOptions{nil, {NoBuffer: true}} {
+		r := &readCounter{r: bytes.NewReader(stream)}
+		img, err := DecodeWithOptions(r, opts)
+		if err != nil {
+			t.Fatalf("DecodeWithOptions() = _, %v; want nil", err)
+		}
+		compare(t, expected, img)
+		if opts == nil && r.reads >= rows {
+			t.Errorf("reads = %d; want less than %d", r.reads, rows)
+		} else if opts != nil && r.reads < rows {
+			t.Errorf("reads with NoBuffer = %d; want at least %d", r.reads, rows)
+		}
+		if n := r.r.(*bytes.Reader).Len(); n != len(in) {
+			t.Errorf("unread bytes = %d; want %d", n, len(in))
+		}
+	}
+}
+
+func TestDecodeParallel(t *testing.T) {
+	img := image.NewNRGBA(image.Rect(0, 0, 800, 700))
+	for i := range img.Pix {
+		img.Pix[i] = uint8(i * 7)
+	}
+	for _, opts := range []*Options{{BitsPerPixel: 16}, {BitsPerPixel: 24}, {BitsPerPixel: 32}, {BitsPerPixel: 32, TopDown: true}} {
+		var buf bytes.Buffer
+		if err := EncodeWithOptions(&buf, img, opts); err != nil {
+			t.Fatalf("EncodeWithOptions() = %v; want nil", err)
+		}
+		// A plain io.Reader is converted sequentially.
+		expected, err := Decode(struct{ io.Reader }{bytes.NewReader(buf.Bytes())})
+		if err != nil {
+			t.Fatalf("Decode() = _, %v; want nil", err)
+		}
+		actual, err := Decode(bytes.NewReader(buf.Bytes()))
+		if err != nil {
+			t.Fatalf("Decode() = _, %v; want nil", err)
+		}
+		compare(t, expected, actual)
+	}
+}
+
+func TestDecodeRGB5x5Expansion(t *testing.T) {
+	for _, f := range []PixelFormat{RGB555, RGB565} {
+		b := make([]byte, 2)
+		for v := 0; v < 1<<16; v++ {
+			if f == RGB555 && v&0x8000 != 0 {
+				continue
+			}
+			b[0], b[1] = uint8(v), uint8(v>>8)
+			r, g, bl, a := f.load(b, 0, nil)
+			// Expanded channels are stored back as they were.
+			f.store(b, 0, r, g, bl, a)
+			if got := int(readUint16(b)); got != v {
+				t.Fatalf("%s pixel %#04x stored back as %#04x", f, v, got)
+			}
+		}
+		b[0], b[1] = 0xFF, 0xFF
+		if r, g, bl, _ := f.load(b, 0, nil); r != 0xFF || g != 0xFF || bl != 0xFF {
+			t.Errorf("%s white = %d, %d, %d; want 255, 255, 255", f, r, g, bl)
+		}
+	}
+}
+
+func TestDecodeBGR24InPlace(t *testing.T) {
+	for w := 1; w <= 9; w++ {
+		img := image.NewNRGBA(image.Rect(0, 0, w, 3))
+		for i := range img.Pix {
+			img.Pix[i] = uint8(i*29 + 3)
+			if i%4 == 3 {
+				img.Pix[i] = 0xFF
+			}
+		}
+		for _, opts := range []*Options{{BitsPerPixel: 24}, {BitsPerPixel: 24, TopDown: true}} {
+			var buf bytes.Buffer
+			if err := EncodeWithOptions(&buf, img, opts); err != nil {
+				t.Fatalf("EncodeWithOptions() = %v; want nil", err)
+			}
+			// A plain io.Reader is read row by row into the destination.
+			actual, err := Decode(struct{ io.Reader }{bytes.NewReader(buf.Bytes())})
+			if err != nil {
+				t.Fatalf("Decode() = _, %v; want nil", err)
+			}
+			compare(t, img, actual)
+			truncated := buf.Bytes()[:buf.Len()-1]
+			if _, err := Decode(struct{ io.Reader }{bytes.NewReader(truncated)}); err != io.ErrUnexpectedEOF {
+				t.Errorf("Decode() of truncated image = _, %v; want %v", err, io.ErrUnexpectedEOF)
+			}
+		}
+	}
+}
+
+func TestDecodeAllocs(t *testing.T) {
+	// Decoding allocates the decoder, the image and a single scratch buffer.
+	// Paletted images also allocate their palette, every color of which is
+	// boxed in a color.Color, and the color model holding it.
+	const (
+		maxAllocs         = 5
+		maxPalettedAllocs = maxAllocs + 2
+	)
+	files, err := filepath.Glob("testdata/*.bmp")
+	if err != nil {
+		panic("failed to glob testdata/*.bmp: " + err.Error())
+	}
+	for _, file := range files {
+		t.Run(file, func(t *testing.T) {
+			b := mustReadFile(file)
+			c, err := DecodeConfig(bytes.NewReader(b))
+			if err != nil {
+				t.Fatalf("DecodeConfig() = _, %v; want nil", err)
+			}
+			max := maxAllocs
+			if p, ok := c.ColorModel.(color.Palette); ok {
+				max = maxPalettedAllocs + len(p)
+			}
+			var r bytes.Reader
+			allocs := testing.AllocsPerRun(10, func() {
+				r.Reset(b)
+				if _, err := Decode(&r); err != nil {
+					t.Fatalf("Decode() = _, %v; want nil", err)
+				}
+			})
+			if int(allocs) > max {
+				t.Errorf("Decode() allocs = %v; want <= %d", allocs, max)
+			}
+		})
+	}
+}
+
+// readAtRecorder is an io.ReaderAt recording the offsets and sizes of the reads.
+type readAtRecorder struct {
+	r     io.ReaderAt
+	reads [][2]int64
+}
+
+func (r *readAtRecorder) ReadAt(p []byte, off int64) (int, error) {
+	r.reads = append(r.reads, [2]int64{off, int64(len(p))})
+	return r.r.ReadAt(p, off)
+}
+
+func TestDecodeReaderAt(t *testing.T) {
+	img := image.NewNRGBA(image.Rect(0, 0, 301, 500))
+	for i := range img.Pix {
+		img.Pix[i] = uint8(i * 7)
+		if i%4 == 3 {
+			img.Pix[i] = 0xFF
+		}
+	}
+	for _, opts := range []*Options{{BitsPerPixel: 24}, {BitsPerPixel: 16}, {BitsPerPixel: 4, Dither: true}} {
+		var buf bytes.Buffer
+		if err := EncodeWithOptions(&buf, img, opts); err != nil {
+			t.Fatalf("EncodeWithOptions() = %v; want nil", err)
+		}
+		in := buf.Bytes()
+		expected, err := Decode(bytes.NewReader(in))
+		if err != nil {
+			t.Fatalf("Decode() = _, %v; want nil", err)
+		}
+		// The file is followed by a byte, which must be left unread.
+		stream := append(append([]byte(nil), in...), 'x')
+		ra := &readAtRecorder{r: bytes.NewReader(stream)}
+		r := io.NewSectionReader(ra, 0, int64(len(stream)))
+		actual, err := Decode(r)
+		if err != nil {
+			t.Fatalf("Decode() = _, %v; want nil", err)
+		}
+		compare(t, expected, actual)
+		pixels := 0
+		for _, read := range ra.reads {
+			if read[1] < pageSize {
+				// The headers are read by io.SectionReader.Read.
+				continue
+			}
+			pixels++
+			if read[0]%pageSize != 0 || read[1] < pageReadSize && read[0]+read[1] < int64(len(in)) {
+				t.Errorf("%d bpp: ReadAt(%d bytes, %d); want aligned reads of at least %d bytes", opts.BitsPerPixel, read[1], read[0], pageReadSize)
+			}
+		}
+		if pixels == 0 {
+			t.Errorf("%d bpp: no ReadAt calls for the pixels", opts.BitsPerPixel)
+		}
+		if rest, _ := ioutil.ReadAll(r); string(rest) != "x" {
+			t.Errorf("%d bpp: unread bytes = %q; want %q", opts.BitsPerPixel, rest, "x")
+		}
+		truncated := io.NewSectionReader(bytes.NewReader(in), 0, int64(len(in)-1))
+		if _, err := Decode(truncated); err != io.ErrUnexpectedEOF {
+			t.Errorf("%d bpp: Decode() of truncated image = _, %v; want %v", opts.BitsPerPixel, err, io.ErrUnexpectedEOF)
+		}
+	}
+}
+
+func TestDecodeAlloc(t *testing.T) {
+	files, err := filepath.Glob("testdata/*.bmp")
+	if err != nil {
+		panic("failed to glob testdata/*.bmp: " + err.Error())
+	}
+	for _, file := range files {
+		t.Run(file, func(t *testing.T) {
+			b := mustReadFile(file)
+			for _, opts := range []*DecodeOptions{{}, {ExpandPalette: true}, {ColorModel: color.NRGBA64Model}} {
+				expected, err := DecodeWithOptions(bytes.NewReader(b), opts)
+				if err != nil {
+					t.Fatalf("DecodeWithOptions() = _, %v; want nil", err)
+				}
+				var allocated []byte
+				o := *opts
+				o.Alloc = func(n int) []byte {
+					// The contents are garbage and the buffer is larger than needed.
+					allocated = bytes.Repeat([]byte{0xAA}, n+10)
+					return allocated
+				}
+				actual, err := DecodeWithOptions(bytes.NewReader(b), &o)
+				if err != nil {
+					t.Fatalf("DecodeWithOptions() = _, %v; want nil", err)
+				}
+				compare(t, expected, actual)
+				if allocated == nil {
+					t.Fatal("Alloc was not called")
+				}
+				if pix := reflect.ValueOf(actual).Elem().FieldByName("Pix").Bytes(); &pix[0] != &allocated[0] {
+					t.Error("Pix is not the allocated buffer")
+				}
+				o.Alloc = func(n int) []byte { return make([]byte, n-1) }
+				if _, err := DecodeWithOptions(bytes.NewReader(b), &o); err == nil {
+					t.Error("DecodeWithOptions() with too small buffer = _, nil; want non-nil")
+				}
+			}
+		})
+	}
+}
+
+func TestDecodeRLEParallel(t *testing.T) {
+	const w, h = 1024, 1024
+	var buf bytes.Buffer
+	if err := EncodeWithOptions(&buf, image.NewPaletted(image.Rect(0, 0, w, h), palette.Plan9), &Options{BitsPerPixel: 8}); err != nil {
+		t.Fatalf("EncodeWithOptions() = %v; want nil", err)
+	}
+	hdr := buf.Bytes()[:readUint32(buf.Bytes()[10:])]
+	// BI_RLE8.
+	binary.LittleEndian.PutUint32(hdr[30:], 1)
+	rng := rand.New(rand.NewSource(1))
+	var rle []byte
+	for y := 0; y < h-10; y++ {
+		x := 0
+		// Most rows are filled up to their end, the others end early.
+		for x < w && rng.Intn(100) != 0 {
+			// The operations are cut to the end of the row.
+			left := w - x
+			switch rng.Intn(3) {
+			case 0:
+				n := 1 + rng.Intn(255)
+				if n > left {
+					n = left
+				}
+				rle = append(rle, byte(n), byte(rng.Intn(256)))
+				x += n
+			case 1:
+				n := 3 + rng.Intn(253)
+				if n > left {
+					if left < 3 {
+						continue
+					}
+					n = left
+				}
+				rle = append(rle, 0, byte(n))
+				for i := 0; i < n; i++ {
+					rle = append(rle, byte(rng.Intn(256)))
+				}
+				if n%2 != 0 {
+					rle = append(rle, 0)
+				}
+				x += n
+			case 2:
+				if left < 8 {
+					continue
+				}
+				dx, dy := rng.Intn(8), 0
+				if rng.Intn(50) == 0 {
+					dy = 1
+				}
+				rle = append(rle, 0, 2, byte(dx), byte(dy))
+				x, y = x+dx, y+dy
+			}
+		}
+		rle = append(rle, 0, 0)
+	}
+	rle = append(rle, 0, 1)
+	in := append(append([]byte{}, hdr...), rle...)
+	decode := func(in []byte, procs int) (image.Image, *image.Alpha, error) {
+		defer runtime.GOMAXPROCS(runtime.GOMAXPROCS(procs))
+		return DecodeWithMask(bytes.NewReader(in), nil)
+	}
+	want, wantMask, err := decode(in, 1)
+	if err != nil {
+		t.Fatalf("DecodeWithMask() = _, _, %v; want nil", err)
+	}
+	got, gotMask, err := decode(in, 4)
+	if err != nil {
+		t.Fatalf("DecodeWithMask() = _, _, %v; want nil", err)
+	}
+	if !reflect.DeepEqual(got, want) || !reflect.DeepEqual(gotMask, wantMask) {
+		t.Error("DecodeWithMask() with GOMAXPROCS > 1 differs from GOMAXPROCS = 1")
+	}
+	for _, n := range []int{len(hdr) + len(rle)/2, len(in) - 2} {
+		_, _, want := decode(in[:n], 1)
+		if _, _, err := decode(in[:n], 4); err == nil || err != want {
+			t.Errorf("DecodeWithMask() of %d bytes = _, _, %v; want %v", n, err, want)
+		}
+	}
+	for _, tail := range [][]byte{
+		// The delta moves past the top row.
+		{0, 2, 0, 255},
+		// The run passes the end of the row.
+		{0, 2, 255, 0, 0, 2, 255, 0, 0, 2, 255, 0, 0, 2, 255, 0, 5, 0},
+		// The delta moves to the end of the row.
+		{0, 2, 255, 0, 0, 2, 255, 0, 0, 2, 255, 0, 0, 2, 255, 0, 0, 2, 4, 0},
+	} {
+		bad := append(append([]byte{}, in[:len(in)-2]...), tail...)
+		_, _, wantErr := decode(bad, 1)
+		if wantErr == nil {
+			t.Fatalf("DecodeWithMask() of %v = _, _, nil; want an error", tail)
+		}
+		if _, _, err := decode(bad, 4); err != wantErr {
+			t.Errorf("DecodeWithMask() of %v = _, _, %v; want %v", tail, err, wantErr)
+		}
+	}
+	// The rows of RLE4 images written by the encoder end at the edge.
+	m := image.NewPaletted(image.Rect(0, 0, w, h), palette.Plan9[:16])
+	for i := range m.Pix {
+		m.Pix[i] = uint8(i / 300 % 16)
+	}
+	buf.Reset()
+	if err := EncodeWithOptions(&buf, m, &Options{Compression: CompressionRLE4}); err != nil {
+		t.Fatalf("EncodeWithOptions() = %v; want nil", err)
+	}
+	in = buf.Bytes()
+	want, _, err = decode(in, 1)
+	if err != nil {
+		t.Fatalf("DecodeWithMask() = _, _, %v; want nil", err)
+	}
+	got, _, err = decode(in, 4)
+	if err != nil {
+		t.Fatalf("DecodeWithMask() of RLE4 = _, _, %v; want nil", err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Error("DecodeWithMask() of RLE4 with GOMAXPROCS > 1 differs from GOMAXPROCS = 1")
+	}
+	compare(t, m, got)
+}
+
+func TestUnpackRow(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	src := make([]byte, 8)
+	rng.Read(src)
+	for _, bpp := range []uint16{1, 2, 4} {
+		d := &decoder{bpp: bpp}
+		for n := 0; n <= 8*8/int(bpp); n++ {
+			dst := make([]byte, n)
+			d.unpackRow(dst, src)
+			for x, v := range dst {
+				bit := uint(x) * uint(bpp)
+				if want := src[bit/8] >> (8 - uint(bpp) - bit%8) & (1<<bpp - 1); v != want {
+					t.Fatalf("unpackRow() with %d bpp pixel %d = %d; want %d", bpp, x, v, want)
+				}
+			}
+		}
+	}
+}
+
+func TestDecodeRLEInPlace(t *testing.T) {
+	for _, file := range []string{"testdata/pal4rle.bmp", "testdata/pal4rlecut.bmp", "testdata/pal8rle.bmp"} {
+		t.Run(file, func(t *testing.T) {
+			b := mustReadFile(file)
+			expected, err := DecodeWithOptions(bytes.NewReader(b), &DecodeOptions{ExpandPalette: true})
+			if err != nil {
+				t.Fatalf("DecodeWithOptions() = _, %v; want nil", err)
+			}
+			r := expected.Bounds()
+			// The rows are padded and the contents are garbage.
+			stride := 4*r.Dx() + 3
+			pix := bytes.Repeat([]byte{0xAA}, stride*r.Dy())
+			if _, err := DecodeRaw(bytes.NewReader(b), pix, stride, RGBA32); err != nil {
+				t.Fatalf("DecodeRaw() = _, %v; want nil", err)
+			}
+			compare(t, expected, &image.RGBA{Pix: pix, Stride: stride, Rect: r})
+			var allocated [][]byte
+			opts := &DecodeOptions{Alloc: func(n int) []byte {
+				allocated = append(allocated, bytes.Repeat([]byte{0xAA}, n))
+				return allocated[len(allocated)-1]
+			}}
+			_, mask, err := DecodeWithMask(bytes.NewReader(b), opts)
+			if err != nil {
+				t.Fatalf("DecodeWithMask() = _, _, %v; want nil", err)
+			}
+			_, expectedMask, _ := DecodeWithMask(bytes.NewReader(b), nil)
+			if len(allocated) != 2 || &mask.Pix[0] != &allocated[0][0] {
+				t.Error("DecodeWithMask() mask is not allocated by Alloc")
+			}
+			if !bytes.Equal(mask.Pix, expectedMask.Pix) {
+				t.Error("DecodeWithMask() mask differs from the one without Alloc")
+			}
+		})
+	}
+}
+
+func TestDecodeReadAhead(t *testing.T) {
+	files, err := filepath.Glob("testdata/*.bmp")
+	if err != nil {
+		panic("failed to list test files: " + err.Error())
+	}
+	big := image.NewNRGBA(image.Rect(0, 0, 600, 400))
+	for i := range big.Pix {
+		big.Pix[i] = uint8(i * 7)
+	}
+	inputs := map[string][]byte{}
+	for _, bpp := range []int{1, 24, 32} {
+		// The pixels span several chunks.
+		var buf bytes.Buffer
+		if err := EncodeWithOptions(&buf, big, &Options{BitsPerPixel: bpp}); err != nil {
+			t.Fatalf("EncodeWithOptions() = %v; want nil", err)
+		}
+		inputs[fmt.Sprintf("big%d", bpp)] = buf.Bytes()
+	}
+	for _, file := range files {
+		inputs[file] = mustReadFile(file)
+	}
+	for name, in := range inputs {
+		t.Run(name, func(t *testing.T) {
+			expected, err := Decode(struct{ io.Reader }{bytes.NewReader(in)})
+			if err != nil {
+				t.Skipf("Decode() = _, %v", err)
+			}
+			// The file is followed by another one, which must not be read.
+			r := bytes.NewReader(append(append([]byte(nil), in...), in...))
+			img, err := DecodeWithOptions(struct{ io.Reader }{r}, &DecodeOptions{ReadAhead: true})
+			if err != nil {
+				t.Fatalf("DecodeWithOptions() = _, %v; want nil", err)
+			}
+			compare(t, expected, img)
+			if r.Len() != len(in) {
+				t.Errorf("unread bytes = %d; want %d", r.Len(), len(in))
+			}
+			for _, n := range []int{len(in) - 1, len(in) - len(in)/3} {
+				_, want := Decode(struct{ io.Reader }{bytes.NewReader(in[:n])})
+				_, err := DecodeWithOptions(struct{ io.Reader }{bytes.NewReader(in[:n])}, &DecodeOptions{ReadAhead: true})
+				if err != want {
+					t.Errorf("DecodeWithOptions() of %d bytes = _, %v; want %v", n, err, want)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkDecode(b *testing.B) {
+	img := benchImage()
+	for _, bench := range benchOptions {
+		b.Run(bench.name, func(b *testing.B) {
+			var buf bytes.Buffer
+			if err := EncodeWithOptions(&buf, img, &bench.opts); err != nil {
+				b.Fatalf("EncodeWithOptions() = %v; want nil", err)
+			}
+			in := buf.Bytes()
+			if _, err := Decode(bytes.NewReader(in)); err != nil {
+				b.Skipf("Decode() = _, %v", err)
+			}
+			b.SetBytes(int64(len(img.Pix)))
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if _, err := Decode(bytes.NewReader(in)); err != nil {
+					b.Fatalf("Decode() = _, %v; want nil", err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,228 @@
+package bmp
+
+import "io"
+
+// RLEOpKind is a kind of RLE operation.
+type RLEOpKind int
+
+const (
+	// RLERun repeats the pixels in Value Count times.
+	RLERun RLEOpKind = iota + 1
+	// RLEAbsolute copies Count pixels from Data.
+	RLEAbsolute
+	// RLEDelta moves the current position DX pixels right and DY rows up.
+	RLEDelta
+	// RLEEndOfLine moves the current position to the start of the next row up.
+	RLEEndOfLine
+	// RLEEndOfBitmap ends the image.
+	RLEEndOfBitmap
+)
+
+var rleOpKindNames = [...]string{
+	RLERun:         "run",
+	RLEAbsolute:    "absolute",
+	RLEDelta:       "delta",
+	RLEEndOfLine:   "end of line",
+	RLEEndOfBitmap: "end of bitmap",
+}
+
+func (k RLEOpKind) String() string {
+	if k < RLERun || k > RLEEndOfBitmap {
+		return "unknown"
+	}
+	return rleOpKindNames[k]
+}
+
+// RLEOp is a single operation of an RLE4 or RLE8 compressed image.
+type RLEOp struct {
+	Kind RLEOpKind
+
+	// Count is the number of pixels set by RLERun and RLEAbsolute.
+	Count int
+
+	// Value is the pixel repeated by RLERun. For RLE4 it holds 2 palette indexes
+	// that alternate, starting with the high-order 4 bits.
+	Value byte
+
+	// Data holds the pixels copied by RLEAbsolute, packed as in the file
+	// with no padding.
+	Data []byte
+
+	// DX and DY are the offsets of RLEDelta.
+	DX, DY int
+}
+
+// Pixel returns the i-th palette index set by o in an image with bpp bits per pixel.
+func (o RLEOp) Pixel(i, bpp int) byte {
+	b := o.Value
+	if o.Kind == RLEAbsolute {
+		if bpp == 8 {
+			return o.Data[i]
+		}
+		b = o.Data[i/2]
+	} else if bpp == 8 {
+		return b
+	}
+	if i%2 == 0 {
+		return (b >> 4) & 0xF
+	}
+	return b & 0xF
+}
+
+// rleBuffer holds a single RLE operation as read from the file.
+type rleBuffer [2 + 256]byte
+
+// readRLEOp reads a single RLE operation from r for an image with bpp bits per pixel
+// and returns it along with its bytes in the file. Both are stored in buf.
+func readRLEOp(r io.Reader, bpp uint16, buf *rleBuffer) (RLEOp, []byte, error) {
+	b := buf[:]
+	if _, err := io.ReadFull(r, b[:2]); err != nil {
+		return RLEOp{}, nil, err
+	}
+	if b[0] != 0 {
+		return RLEOp{Kind: RLERun, Count: int(b[0]), Value: b[1]}, b[:2], nil
+	}
+	switch b[1] {
+	case 0:
+		return RLEOp{Kind: RLEEndOfLine}, b[:2], nil
+	case 1:
+		return RLEOp{Kind: RLEEndOfBitmap}, b[:2], nil
+	case 2:
+		if _, err := io.ReadFull(r, b[2:4]); err != nil {
+			return RLEOp{}, nil, err
+		}
+		return RLEOp{Kind: RLEDelta, DX: int(b[2]), DY: int(b[3])}, b[:4], nil
+	}
+	// Absolute mode data is padded to a 2-byte boundary.
+	count := uint16(b[1])
+	n := (count*bpp + 8 - 1) / 8
+	if (bpp == 8 && count&0x1 != 0) || (bpp == 4 && ((count&0x3 == 1) || (count&0x3 == 2))) {
+		n++
+	}
+	if _, err := io.ReadFull(r, b[2:2+n]); err != nil {
+		return RLEOp{}, nil, err
+	}
+	return RLEOp{Kind: RLEAbsolute, Count: int(count), Data: b[2 : 2+(count*bpp+8-1)/8]}, b[:2+n], nil
+}
+
+// RLEReader reads the operations of an RLE4 or RLE8 compressed BMP image
+// without rasterizing them.
+type RLEReader struct {
+	d   *decoder
+	buf rleBuffer
+	eof bool
+}
+
+// NewRLEReader reads the header of an RLE4 or RLE8 compressed BMP image from r
+// and returns a reader of its operations.
+func NewRLEReader(r io.Reader) (*RLEReader, error) {
+	d := newDecoder(r, nil)
+	if err := d.DecodeConfig(); err != nil {
+		return nil, err
+	}
+	if !d.rle {
+		return nil, FormatError("not an RLE-compressed image")
+	}
+	return &RLEReader{d: d}, nil
+}
+
+// Config returns the color model, dimensions and storage details of the image.
+func (r *RLEReader) Config() ExtendedConfig { return r.d.extendedConfig() }
+
+// Next returns the next operation. Data of the returned operation is only valid
+// until the next call. After the RLEEndOfBitmap operation, Next returns io.EOF.
+func (r *RLEReader) Next() (RLEOp, error) {
+	if r.eof {
+		return RLEOp{}, io.EOF
+	}
+	op, _, err := readRLEOp(r.d.r, r.d.bpp, &r.buf)
+	if err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return RLEOp{}, err
+	}
+	r.eof = op.Kind == RLEEndOfBitmap
+	return op, nil
+}
+
+// appendRLE4 appends the RLE4 encoding of the dx 4 bit-per-pixel pixels
+// packed in row to b, with no end-of-line code.
+func appendRLE4(b, row []byte, dx int) []byte {
+	pixel := func(x int) byte {
+		if x%2 == 0 {
+			return row[x/2] >> 4
+		}
+		return row[x/2] & 0xF
+	}
+	// runLen returns the number of pixels starting at x that alternate
+	// between the first 2 of them.
+	runLen := func(x int) int {
+		n := 1
+		for n < 255 && x+n < dx && pixel(x+n) == pixel(x+n%2) {
+			n++
+		}
+		return n
+	}
+	run := func(x, n int) {
+		c := pixel(x) << 4
+		if n > 1 {
+			c |= pixel(x + 1)
+		} else {
+			c |= pixel(x)
+		}
+		b = append(b, byte(n), c)
+	}
+	flush := func(x0, x1 int) {
+		for x0 < x1 {
+			n := x1 - x0
+			if n > 255 {
+				n = 255
+			}
+			if n < 3 {
+				// Absolute mode needs at least 3 pixels.
+				run(x0, n)
+				x0 += n
+				continue
+			}
+			b = append(b, 0, byte(n))
+			for i := 0; i < n; i += 2 {
+				c := pixel(x0+i) << 4
+				if i+1 < n {
+					c |= pixel(x0 + i + 1)
+				}
+				b = append(b, c)
+			}
+			// Absolute mode data is padded to a 2-byte boundary.
+			if (n+1)/2%2 != 0 {
+				b = append(b, 0)
+			}
+			x0 += n
+		}
+	}
+	if k := dx / 2; uniformRow(row[:k], 1) && (dx%2 == 0 || pixel(dx-1) == pixel(0)) {
+		// The pixels alternate between the 2 of the first byte,
+		// so the row is made of the longest runs.
+		for x := 0; x < dx; x += 255 {
+			n := dx - x
+			if n > 255 {
+				n = 255
+			}
+			run(x, n)
+		}
+		return b
+	}
+	lit := 0
+	for x := 0; x < dx; {
+		if n := runLen(x); n >= 4 || x+n == dx {
+			flush(lit, x)
+			run(x, n)
+			x += n
+			lit = x
+			continue
+		}
+		x++
+	}
+	flush(lit, dx)
+	return b
+}
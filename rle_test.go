@@ -0,0 +1,61 @@
+package bmp
+
+import (
+	"bytes"
+	"image"
+	"io"
+	"testing"
+)
+
+func TestRLEReader(t *testing.T) {
+	for _, file := range []string{"testdata/pal4rle.bmp", "testdata/pal4rletrns.bmp", "testdata/pal8rle.bmp"} {
+		t.Run(file, func(t *testing.T) {
+			in := mustReadFile(file)
+			img, err := Decode(bytes.NewReader(in))
+			if err != nil {
+				t.Fatalf("Decode() = _, %v; want nil", err)
+			}
+			paletted := img.(*image.Paletted)
+			r, err := NewRLEReader(bytes.NewReader(in))
+			if err != nil {
+				t.Fatalf("NewRLEReader() = _, %v; want nil", err)
+			}
+			c := r.Config()
+			// Replay the operations and compare the result with the decoded image.
+			pix := make([]byte, c.Width*c.Height)
+			x, y := 0, c.Height-1
+			for {
+				op, err := r.Next()
+				if err == io.EOF {
+					break
+				}
+				if err != nil {
+					t.Fatalf("Next() = _, %v; want nil", err)
+				}
+				switch op.Kind {
+				case RLEEndOfLine:
+					x, y = 0, y-1
+				case RLEDelta:
+					x, y = x+op.DX, y-op.DY
+				case RLERun, RLEAbsolute:
+					for i := 0; i < op.Count; i++ {
+						pix[y*c.Width+x] = op.Pixel(i, c.BitsPerPixel)
+						x++
+					}
+				case RLEEndOfBitmap:
+				default:
+					t.Fatalf("Next() = %v, _; want a valid operation", op.Kind)
+				}
+			}
+			if !bytes.Equal(pix, paletted.Pix) {
+				t.Error("replayed operations differ from Decode()")
+			}
+			if _, err := r.Next(); err != io.EOF {
+				t.Errorf("Next() = _, %v; want %v", err, io.EOF)
+			}
+		})
+	}
+	if _, err := NewRLEReader(bytes.NewReader(mustReadFile("testdata/pal8.bmp"))); err == nil {
+		t.Error("NewRLEReader() = _, nil; want non-nil")
+	}
+}
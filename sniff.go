@@ -0,0 +1,109 @@
+package bmp
+
+// Kind is a kind of BMP or DIB content.
+type Kind int
+
+const (
+	// KindUnknown is not a BMP or DIB content.
+	KindUnknown Kind = iota
+	// KindBitmap is a Windows or OS/2 bitmap file ("BM").
+	KindBitmap
+	// KindBitmapArray is an OS/2 bitmap array file ("BA").
+	KindBitmapArray
+	// KindColorIcon is an OS/2 color icon file ("CI").
+	KindColorIcon
+	// KindColorPointer is an OS/2 color pointer file ("CP").
+	KindColorPointer
+	// KindIcon is an OS/2 monochrome icon file ("IC").
+	KindIcon
+	// KindPointer is an OS/2 monochrome pointer file ("PT").
+	KindPointer
+	// KindDIB is a packed DIB: a DIB header immediately followed by
+	// the color table and the pixels, with no file header.
+	KindDIB
+)
+
+var kindNames = [...]string{
+	KindUnknown:      "unknown",
+	KindBitmap:       "bitmap",
+	KindBitmapArray:  "bitmap array",
+	KindColorIcon:    "color icon",
+	KindColorPointer: "color pointer",
+	KindIcon:         "icon",
+	KindPointer:      "pointer",
+	KindDIB:          "DIB",
+}
+
+func (k Kind) String() string {
+	if k < 0 || int(k) >= len(kindNames) {
+		return kindNames[KindUnknown]
+	}
+	return kindNames[k]
+}
+
+var fileKinds = map[string]Kind{
+	"BM": KindBitmap,
+	"BA": KindBitmapArray,
+	"CI": KindColorIcon,
+	"CP": KindColorPointer,
+	"IC": KindIcon,
+	"PT": KindPointer,
+}
+
+// Sniff reports whether prefix, the first bytes of some content, looks like
+// a BMP file, an OS/2 container or a packed DIB, and which kind of it.
+// The longer prefix is, the fewer false positives are reported;
+// at least 32 bytes are recommended.
+func Sniff(prefix []byte) (bool, Kind) {
+	if len(prefix) >= 2 {
+		if k, ok := fileKinds[string(prefix[:2])]; ok {
+			if k == KindBitmapArray {
+				// An array header is followed by the file header of the first image.
+				if len(prefix) < fileHeaderLen+2 {
+					return true, k
+				}
+				if k2, ok := fileKinds[string(prefix[fileHeaderLen:fileHeaderLen+2])]; !ok || k2 == KindBitmapArray {
+					return false, KindUnknown
+				}
+				return true, k
+			}
+			if len(prefix) < fileHeaderLen || sniffDIB(prefix[fileHeaderLen:]) {
+				return true, k
+			}
+		}
+	}
+	if len(prefix) >= 4 && sniffDIB(prefix) {
+		return true, KindDIB
+	}
+	return false, KindUnknown
+}
+
+// sniffDIB reports whether b looks like the start of a DIB header.
+// It only validates as many fields as b holds.
+func sniffDIB(b []byte) bool {
+	if len(b) < 4 {
+		return true
+	}
+	var planesOff, bppOff int
+	switch readUint32(b) {
+	case 12:
+		// BITMAPCOREHEADER.
+		planesOff, bppOff = 8, 10
+	case 16, 40, 52, 56, 64, 108, 124:
+		// OS/2 2.x, BITMAPINFOHEADER and its extensions.
+		planesOff, bppOff = 12, 14
+	default:
+		return false
+	}
+	if len(b) >= planesOff+2 && readUint16(b[planesOff:]) != 1 {
+		return false
+	}
+	if len(b) >= bppOff+2 {
+		switch readUint16(b[bppOff:]) {
+		case 1, 2, 4, 8, 16, 24, 32, 64:
+		default:
+			return false
+		}
+	}
+	return true
+}
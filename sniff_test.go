@@ -0,0 +1,40 @@
+package bmp
+
+import (
+	"io/ioutil"
+	"testing"
+)
+
+func TestSniff(t *testing.T) {
+	in, err := ioutil.ReadFile("testdata/pal8.bmp")
+	if err != nil {
+		panic("failed to read testdata/pal8.bmp: " + err.Error())
+	}
+	arr := append([]byte("BA\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00"), in...)
+	icon := append([]byte("IC"), in[2:]...)
+	tests := []struct {
+		name   string
+		prefix []byte
+		ok     bool
+		kind   Kind
+	}{
+		{"Empty", nil, false, KindUnknown},
+		{"Bitmap", in[:32], true, KindBitmap},
+		{"BitmapSignature", in[:2], true, KindBitmap},
+		{"BitmapArray", arr[:48], true, KindBitmapArray},
+		{"BitmapArrayBadEntry", append([]byte("BA\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00XX"), in[2:32]...), false, KindUnknown},
+		{"Icon", icon[:32], true, KindIcon},
+		{"DIB", in[fileHeaderLen : fileHeaderLen+32], true, KindDIB},
+		{"BadDIBHeaderSize", []byte("\x11\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x01\x00\x08\x00"), false, KindUnknown},
+		{"BadPlanes", []byte("\x28\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x02\x00\x08\x00"), false, KindUnknown},
+		{"BadBitDepth", []byte("\x28\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x01\x00\x07\x00"), false, KindUnknown},
+		{"PNG", []byte("\x89PNG\r\n\x1a\n\x00\x00\x00\rIHDR"), false, KindUnknown},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if ok, kind := Sniff(test.prefix); ok != test.ok || kind != test.kind {
+				t.Errorf("Sniff() = %t, %s; want %t, %s", ok, kind, test.ok, test.kind)
+			}
+		})
+	}
+}
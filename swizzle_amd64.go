@@ -0,0 +1,75 @@
+//go:build !purego
+// +build !purego
+
+package bmp
+
+// useSSSE3 reports whether the CPU supports the PSHUFB instruction.
+var useSSSE3 = func() bool {
+	_, _, ecx, _ := cpuid(1, 0)
+	return ecx&(1<<9) != 0
+}()
+
+func cpuid(eaxArg, ecxArg uint32) (eax, ebx, ecx, edx uint32)
+
+// The functions below convert blocks of 16 source bytes.
+
+//go:noescape
+func swapRB32SSSE3(dst, src *byte, blocks int, opaque bool)
+
+// rgbaToBGRSSSE3 stores 16 bytes for every 12 converted ones.
+//
+//go:noescape
+func rgbaToBGRSSSE3(dst, src *byte, blocks int) (opaque bool)
+
+// bgrToRGBASSSE3 loads 16 bytes for every 12 converted ones.
+//
+//go:noescape
+func bgrToRGBASSSE3(dst, src *byte, blocks int)
+
+// swapRB32 stores the 4-byte pixels of src in dst with their first and third
+// bytes swapped, converting between RGBA and BGRA. If opaque is true,
+// the alpha is set to 0xFF.
+func swapRB32(dst, src []byte, opaque bool) {
+	n := 0
+	if useSSSE3 && len(src) >= 16 {
+		_ = dst[len(src)-1]
+		n = len(src) &^ 15
+		swapRB32SSSE3(&dst[0], &src[0], n/16, opaque)
+	}
+	swapRB32Generic(dst[n:], src[n:], opaque)
+}
+
+// rgbaToBGR stores the 4-byte RGBA pixels of src in dst as 3-byte BGR ones,
+// discarding the alpha, and reports whether they were all fully opaque.
+func rgbaToBGR(dst, src []byte) bool {
+	blocks := 0
+	if useSSSE3 {
+		blocks = len(src) / 16
+		if n := (len(dst) - 4) / 12; n < blocks {
+			blocks = n
+		}
+	}
+	if blocks <= 0 {
+		return rgbaToBGRGeneric(dst, src)
+	}
+	opaque := rgbaToBGRSSSE3(&dst[0], &src[0], blocks)
+	return rgbaToBGRGeneric(dst[blocks*12:], src[blocks*16:]) && opaque
+}
+
+// bgrToRGBA stores the 3-byte BGR pixels of src in dst as opaque 4-byte RGBA ones.
+// src may be the end of dst.
+func bgrToRGBA(dst, src []byte) {
+	blocks := 0
+	if useSSSE3 {
+		blocks = (len(src) - 4) / 12
+		if n := len(dst) / 16; n < blocks {
+			blocks = n
+		}
+	}
+	if blocks <= 0 {
+		bgrToRGBAGeneric(dst, src)
+		return
+	}
+	bgrToRGBASSSE3(&dst[0], &src[0], blocks)
+	bgrToRGBAGeneric(dst[blocks*16:], src[blocks*12:])
+}
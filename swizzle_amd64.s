@@ -0,0 +1,101 @@
+//go:build !purego
+// +build !purego
+
+#include "textflag.h"
+
+// The shuffles of PSHUFB, with 0x80 zeroing the byte.
+DATA swapRB32Mask<>+0(SB)/8, $0x0704050603000102
+DATA swapRB32Mask<>+8(SB)/8, $0x0F0C0D0E0B08090A
+GLOBL swapRB32Mask<>(SB), RODATA|NOPTR, $16
+
+DATA rgbaToBGRMask<>+0(SB)/8, $0x090A040506000102
+DATA rgbaToBGRMask<>+8(SB)/8, $0x808080800C0D0E08
+GLOBL rgbaToBGRMask<>(SB), RODATA|NOPTR, $16
+
+DATA bgrToRGBAMask<>+0(SB)/8, $0x8003040580000102
+DATA bgrToRGBAMask<>+8(SB)/8, $0x80090A0B80060708
+GLOBL bgrToRGBAMask<>(SB), RODATA|NOPTR, $16
+
+DATA alphaMask<>+0(SB)/8, $0xFF000000FF000000
+DATA alphaMask<>+8(SB)/8, $0xFF000000FF000000
+GLOBL alphaMask<>(SB), RODATA|NOPTR, $16
+
+// func cpuid(eaxArg, ecxArg uint32) (eax, ebx, ecx, edx uint32)
+TEXT ·cpuid(SB), NOSPLIT, $0-24
+	MOVL eaxArg+0(FP), AX
+	MOVL ecxArg+4(FP), CX
+	CPUID
+	MOVL AX, eax+8(FP)
+	MOVL BX, ebx+12(FP)
+	MOVL CX, ecx+16(FP)
+	MOVL DX, edx+20(FP)
+	RET
+
+// func swapRB32SSSE3(dst, src *byte, blocks int, opaque bool)
+TEXT ·swapRB32SSSE3(SB), NOSPLIT, $0-25
+	MOVQ dst+0(FP), DI
+	MOVQ src+8(FP), SI
+	MOVQ blocks+16(FP), CX
+	MOVOU swapRB32Mask<>(SB), X1
+	PXOR X2, X2
+	MOVBLZX opaque+24(FP), AX
+	TESTQ AX, AX
+	JZ swapLoop
+	MOVOU alphaMask<>(SB), X2
+
+swapLoop:
+	MOVOU (SI), X0
+	PSHUFB X1, X0
+	POR X2, X0
+	MOVOU X0, (DI)
+	ADDQ $16, SI
+	ADDQ $16, DI
+	DECQ CX
+	JNZ swapLoop
+	RET
+
+// func rgbaToBGRSSSE3(dst, src *byte, blocks int) (opaque bool)
+TEXT ·rgbaToBGRSSSE3(SB), NOSPLIT, $0-25
+	MOVQ dst+0(FP), DI
+	MOVQ src+8(FP), SI
+	MOVQ blocks+16(FP), CX
+	MOVOU rgbaToBGRMask<>(SB), X1
+	MOVOU alphaMask<>(SB), X2
+	PCMPEQB X3, X3
+
+rgbaLoop:
+	MOVOU (SI), X0
+	PAND X0, X3
+	PSHUFB X1, X0
+	MOVOU X0, (DI)
+	ADDQ $16, SI
+	ADDQ $12, DI
+	DECQ CX
+	JNZ rgbaLoop
+
+	// The pixels are opaque if the alpha bytes of X3 are all set.
+	PAND X2, X3
+	PCMPEQB X2, X3
+	PMOVMSKB X3, AX
+	CMPL AX, $0xFFFF
+	SETEQ opaque+24(FP)
+	RET
+
+// func bgrToRGBASSSE3(dst, src *byte, blocks int)
+TEXT ·bgrToRGBASSSE3(SB), NOSPLIT, $0-24
+	MOVQ dst+0(FP), DI
+	MOVQ src+8(FP), SI
+	MOVQ blocks+16(FP), CX
+	MOVOU bgrToRGBAMask<>(SB), X1
+	MOVOU alphaMask<>(SB), X2
+
+bgrLoop:
+	MOVOU (SI), X0
+	PSHUFB X1, X0
+	POR X2, X0
+	MOVOU X0, (DI)
+	ADDQ $12, SI
+	ADDQ $16, DI
+	DECQ CX
+	JNZ bgrLoop
+	RET
@@ -0,0 +1,57 @@
+//go:build !purego
+// +build !purego
+
+package bmp
+
+// The functions below convert blocks of 16 pixels.
+
+//go:noescape
+func swapRB32NEON(dst, src *byte, blocks int, opaque bool)
+
+//go:noescape
+func rgbaToBGRNEON(dst, src *byte, blocks int) (opaque bool)
+
+//go:noescape
+func bgrToRGBANEON(dst, src *byte, blocks int)
+
+// swapRB32 stores the 4-byte pixels of src in dst with their first and third
+// bytes swapped, converting between RGBA and BGRA. If opaque is true,
+// the alpha is set to 0xFF.
+func swapRB32(dst, src []byte, opaque bool) {
+	n := 0
+	if len(src) >= 64 {
+		_ = dst[len(src)-1]
+		n = len(src) &^ 63
+		swapRB32NEON(&dst[0], &src[0], n/64, opaque)
+	}
+	swapRB32Generic(dst[n:], src[n:], opaque)
+}
+
+// rgbaToBGR stores the 4-byte RGBA pixels of src in dst as 3-byte BGR ones,
+// discarding the alpha, and reports whether they were all fully opaque.
+func rgbaToBGR(dst, src []byte) bool {
+	blocks := len(src) / 64
+	if n := len(dst) / 48; n < blocks {
+		blocks = n
+	}
+	if blocks == 0 {
+		return rgbaToBGRGeneric(dst, src)
+	}
+	opaque := rgbaToBGRNEON(&dst[0], &src[0], blocks)
+	return rgbaToBGRGeneric(dst[blocks*48:], src[blocks*64:]) && opaque
+}
+
+// bgrToRGBA stores the 3-byte BGR pixels of src in dst as opaque 4-byte RGBA ones.
+// src may be the end of dst.
+func bgrToRGBA(dst, src []byte) {
+	blocks := len(src) / 48
+	if n := len(dst) / 64; n < blocks {
+		blocks = n
+	}
+	if blocks == 0 {
+		bgrToRGBAGeneric(dst, src)
+		return
+	}
+	bgrToRGBANEON(&dst[0], &src[0], blocks)
+	bgrToRGBAGeneric(dst[blocks*64:], src[blocks*48:])
+}
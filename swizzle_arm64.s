@@ -0,0 +1,73 @@
+//go:build !purego
+// +build !purego
+
+#include "textflag.h"
+
+// The structured loads and stores deinterleave and interleave the channels
+// of 16 pixels in V0-V3 and V4-V7.
+
+// func swapRB32NEON(dst, src *byte, blocks int, opaque bool)
+TEXT ·swapRB32NEON(SB), NOSPLIT, $0-25
+	MOVD  dst+0(FP), R0
+	MOVD  src+8(FP), R1
+	MOVD  blocks+16(FP), R2
+	MOVBU opaque+24(FP), R3
+	VMOVI $255, V8.B16
+
+swapLoop:
+	VLD4.P 64(R1), [V0.B16, V1.B16, V2.B16, V3.B16]
+	VMOV   V2.B16, V4.B16
+	VMOV   V1.B16, V5.B16
+	VMOV   V0.B16, V6.B16
+	VMOV   V3.B16, V7.B16
+	CBZ    R3, swapStore
+	VMOV   V8.B16, V7.B16
+
+swapStore:
+	VST4.P [V4.B16, V5.B16, V6.B16, V7.B16], 64(R0)
+	SUBS   $1, R2, R2
+	BNE    swapLoop
+	RET
+
+// func rgbaToBGRNEON(dst, src *byte, blocks int) (opaque bool)
+TEXT ·rgbaToBGRNEON(SB), NOSPLIT, $0-25
+	MOVD  dst+0(FP), R0
+	MOVD  src+8(FP), R1
+	MOVD  blocks+16(FP), R2
+	VMOVI $255, V8.B16
+
+rgbaLoop:
+	VLD4.P 64(R1), [V0.B16, V1.B16, V2.B16, V3.B16]
+	VAND   V3.B16, V8.B16, V8.B16
+	VMOV   V2.B16, V4.B16
+	VMOV   V1.B16, V5.B16
+	VMOV   V0.B16, V6.B16
+	VST3.P [V4.B16, V5.B16, V6.B16], 48(R0)
+	SUBS   $1, R2, R2
+	BNE    rgbaLoop
+
+	// The pixels are opaque if all the bits of V8 are set.
+	VMOV V8.D[0], R3
+	VMOV V8.D[1], R4
+	AND  R3, R4, R3
+	CMN  $1, R3
+	CSET EQ, R3
+	MOVB R3, opaque+24(FP)
+	RET
+
+// func bgrToRGBANEON(dst, src *byte, blocks int)
+TEXT ·bgrToRGBANEON(SB), NOSPLIT, $0-24
+	MOVD  dst+0(FP), R0
+	MOVD  src+8(FP), R1
+	MOVD  blocks+16(FP), R2
+	VMOVI $255, V7.B16
+
+bgrLoop:
+	VLD3.P 48(R1), [V0.B16, V1.B16, V2.B16]
+	VMOV   V2.B16, V4.B16
+	VMOV   V1.B16, V5.B16
+	VMOV   V0.B16, V6.B16
+	VST4.P [V4.B16, V5.B16, V6.B16, V7.B16], 64(R0)
+	SUBS   $1, R2, R2
+	BNE    bgrLoop
+	RET
@@ -0,0 +1,17 @@
+//go:build (!amd64 && !arm64) || purego
+// +build !amd64,!arm64 purego
+
+package bmp
+
+// swapRB32 stores the 4-byte pixels of src in dst with their first and third
+// bytes swapped, converting between RGBA and BGRA. If opaque is true,
+// the alpha is set to 0xFF.
+func swapRB32(dst, src []byte, opaque bool) { swapRB32Generic(dst, src, opaque) }
+
+// rgbaToBGR stores the 4-byte RGBA pixels of src in dst as 3-byte BGR ones,
+// discarding the alpha, and reports whether they were all fully opaque.
+func rgbaToBGR(dst, src []byte) bool { return rgbaToBGRGeneric(dst, src) }
+
+// bgrToRGBA stores the 3-byte BGR pixels of src in dst as opaque 4-byte RGBA ones.
+// src may be the end of dst.
+func bgrToRGBA(dst, src []byte) { bgrToRGBAGeneric(dst, src) }
@@ -0,0 +1,52 @@
+package bmp
+
+import "io"
+
+// DecodeTrace is a set of hooks called on structural events while decoding.
+// Any hook may be nil.
+//
+// Offsets are in bytes relative to the start of the BMP data.
+// The byte slices passed to the hooks are only valid during the call
+// and must not be modified.
+type DecodeTrace struct {
+	// FileHeader is called after the BITMAPFILEHEADER is read.
+	FileHeader func(offset int64, b []byte)
+
+	// InfoHeader is called after the DIB header is read.
+	InfoHeader func(offset int64, b []byte)
+
+	// ColorMasks is called after the color masks following
+	// a BITMAPINFOHEADER are read.
+	ColorMasks func(offset int64, b []byte)
+
+	// Palette is called after the color table is read.
+	Palette func(offset int64, b []byte)
+
+	// Row is called after the stored row y, padding included, is read.
+	Row func(y int, offset int64, b []byte)
+
+	// RLEOpcode is called after an RLE opcode, operands included, is read
+	// and before it is executed.
+	RLEOpcode func(offset int64, b []byte)
+}
+
+// countingReader counts the bytes read from r.
+// If max is positive, reading more than max bytes results in ErrLimitExceeded.
+type countingReader struct {
+	r      io.Reader
+	n, max int64
+}
+
+func (r *countingReader) Read(b []byte) (int, error) {
+	if r.max > 0 {
+		if r.n >= r.max && len(b) > 0 {
+			return 0, ErrLimitExceeded
+		}
+		if int64(len(b)) > r.max-r.n {
+			b = b[:r.max-r.n]
+		}
+	}
+	n, err := r.r.Read(b)
+	r.n += int64(n)
+	return n, err
+}
@@ -0,0 +1,136 @@
+package bmp
+
+import (
+	"image/color"
+	"io"
+)
+
+// Transcode rewrites the BMP image read from src to dst without decoding its pixels:
+// the rows are copied in the pixel format they are stored in, along with the color table.
+// The options set the header version, the orientation of the rows, the alignment
+// of the pixels and the ICC profile of the output, and the gaps and the ICC profile
+// of the input are dropped. Compressed images and options converting the pixels,
+// such as a different BitsPerPixel or Compression, are not supported.
+// The rows are copied a chunk at a time, so the memory used does not depend on the size
+// of the image, unless the orientation changes while src is not an io.ReadSeeker
+// and dst is not an io.WriteSeeker, in which case all the pixels are read first.
+func Transcode(dst io.Writer, src io.Reader, opts *Options) error {
+	d := newDecoder(src, nil)
+	if err := d.DecodeConfig(); err != nil {
+		return err
+	}
+	if d.rle {
+		return UnsupportedError("transcoding of compressed image")
+	}
+	var o Options
+	if opts != nil {
+		o = *opts
+	}
+	if (o.BitsPerPixel != 0 && o.BitsPerPixel != int(d.bpp)) || o.Compression != CompressionNone ||
+		o.Grayscale || o.Bilevel || o.A2RGB10 {
+		return UnsupportedError("conversion of transcoded pixels")
+	}
+	o.BitsPerPixel = int(d.bpp)
+	o.RGB565 = d.rgb565
+	e, err := newEncoder(dst, d.c.Width, d.c.Height, &o)
+	if err != nil {
+		return err
+	}
+	defer e.release()
+	if e.opts.Header < HeaderInfo && (d.bpp == 2 || d.bpp > 24) {
+		return UnsupportedError("bit depth of OS/2 header")
+	}
+	e.bpp = int(d.bpp)
+	if p, ok := d.c.ColorModel.(color.Palette); ok {
+		e.setPalette(p)
+	}
+	if err := e.layout(); err != nil {
+		return err
+	}
+	if err := e.writeHeader(); err != nil {
+		return err
+	}
+	if e.dx != 0 && e.dy != 0 {
+		if err := e.copyRows(d, src); err != nil {
+			return err
+		}
+	}
+	return e.writeTrailer()
+}
+
+// copyRows copies the rows of the image read by d from src to e.w,
+// in the order of e.opts.TopDown.
+func (e *encoder) copyRows(d *decoder, src io.Reader) error {
+	n := e.chunkRows()
+	flip := d.topDown != e.opts.TopDown
+	rs, seekSrc := src.(io.ReadSeeker)
+	ws, seekDst := e.w.(io.WriteSeeker)
+	var srcStart, dstStart int64
+	var err error
+	switch {
+	case !flip:
+	case seekSrc:
+		// The chunks are read from the end.
+		if srcStart, err = rs.Seek(0, io.SeekCurrent); err != nil {
+			return err
+		}
+	case seekDst:
+		// The chunks are written from the end.
+		if dstStart, err = ws.Seek(0, io.SeekCurrent); err != nil {
+			return err
+		}
+	default:
+		n = e.dy
+	}
+	buf := e.alloc(n * e.step)
+	for i := 0; i < e.dy; i += n {
+		rows := e.dy - i
+		if rows > n {
+			rows = n
+		}
+		b := buf[:rows*e.step]
+		if flip && seekSrc {
+			if _, err := rs.Seek(srcStart+int64(e.dy-i-rows)*int64(e.step), io.SeekStart); err != nil {
+				return err
+			}
+		}
+		if _, err := io.ReadFull(src, b); err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return err
+		}
+		if d.noAlpha {
+			// The alpha is not stored, but it would be read from the output.
+			copyOpaque32(b, b)
+		}
+		if flip {
+			reverseRows(b, e.step)
+			if seekDst && !seekSrc {
+				if _, err := ws.Seek(dstStart+int64(e.dy-i-rows)*int64(e.step), io.SeekStart); err != nil {
+					return err
+				}
+			}
+		}
+		if _, err := e.w.Write(b); err != nil {
+			return err
+		}
+		for r := 1; r <= rows; r++ {
+			e.progress(i + r)
+		}
+	}
+	if flip && seekDst && !seekSrc {
+		_, err = ws.Seek(dstStart+int64(e.dy)*int64(e.step), io.SeekStart)
+	}
+	return err
+}
+
+// reverseRows reverses the order of the rows of step bytes in b.
+func reverseRows(b []byte, step int) {
+	for i, j := 0, len(b)-step; i < j; i, j = i+step, j-step {
+		r1, r2 := b[i:i+step], b[j:j+step]
+		for k := range r1 {
+			r1[k], r2[k] = r2[k], r1[k]
+		}
+	}
+}
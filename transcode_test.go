@@ -0,0 +1,79 @@
+package bmp
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+func TestTranscode(t *testing.T) {
+	files, err := filepath.Glob("testdata/*.bmp")
+	if err != nil {
+		panic("failed to list test files: " + err.Error())
+	}
+	for _, file := range files {
+		t.Run(file, func(t *testing.T) {
+			b := mustReadFile(file)
+			expected, err := Decode(bytes.NewReader(b))
+			if err != nil {
+				t.Fatalf("Decode() = _, %v; want nil", err)
+			}
+			if compression := readUint32(b[30:]); compression == 1 || compression == 2 {
+				if err := Transcode(ioutil.Discard, bytes.NewReader(b), nil); err == nil {
+					t.Error("Transcode() of compressed image = nil; want non-nil")
+				}
+				return
+			}
+			for _, opts := range []*Options{
+				{},
+				{TopDown: true},
+				{TopDown: true, ChunkSize: 1},
+				{Header: HeaderV5, PixelAlignment: 256},
+			} {
+				for _, test := range []struct {
+					name string
+					src  func() io.Reader
+					dst  func() (io.Writer, func() []byte)
+				}{
+					{
+						"SeekableSource",
+						func() io.Reader { return bytes.NewReader(b) },
+						func() (io.Writer, func() []byte) { var buf bytes.Buffer; return &buf, buf.Bytes },
+					},
+					{
+						"SeekableDestination",
+						func() io.Reader { return struct{ io.Reader }{bytes.NewReader(b)} },
+						func() (io.Writer, func() []byte) {
+							buf := &seekBuffer{}
+							return buf, func() []byte { return buf.b }
+						},
+					},
+					{
+						"Stream",
+						func() io.Reader { return struct{ io.Reader }{bytes.NewReader(b)} },
+						func() (io.Writer, func() []byte) { var buf bytes.Buffer; return &buf, buf.Bytes },
+					},
+				} {
+					w, output := test.dst()
+					if err := Transcode(w, test.src(), opts); err != nil {
+						t.Fatalf("%s: Transcode(_, _, %+v) = %v; want nil", test.name, *opts, err)
+					}
+					c, err := DecodeExtendedConfig(bytes.NewReader(output()))
+					if err != nil {
+						t.Fatalf("%s: DecodeExtendedConfig() = _, %v; want nil", test.name, err)
+					}
+					if c.TopDown != opts.TopDown {
+						t.Errorf("%s: TopDown = %t; want %t", test.name, c.TopDown, opts.TopDown)
+					}
+					actual, err := Decode(bytes.NewReader(output()))
+					if err != nil {
+						t.Fatalf("%s: Decode() = _, %v; want nil", test.name, err)
+					}
+					compare(t, expected, actual)
+				}
+			}
+		})
+	}
+}
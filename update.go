@@ -0,0 +1,112 @@
+package bmp
+
+import (
+	"errors"
+	"image"
+	"image/color"
+	"image/draw"
+	"io"
+)
+
+// Update rewrites the pixels of the BMP image stored in f at its current offset
+// with the pixels of m, leaving the headers and the color table intact.
+// m must have the dimensions of the stored image. Its pixels are converted
+// to the pixel format of the stored image, and mapped to the nearest colors
+// of its color table if it has one. Compressed images cannot be updated.
+func Update(f io.ReadWriteSeeker, m image.Image) error {
+	return UpdateRect(f, m, m.Bounds())
+}
+
+// UpdateRect is like Update, but only rewrites the rows of the stored image
+// overlapping r, which is in the coordinates of m.
+func UpdateRect(f io.ReadWriteSeeker, m image.Image, r image.Rectangle) error {
+	d := newDecoder(f, nil)
+	if err := d.DecodeConfig(); err != nil {
+		return err
+	}
+	if d.rle {
+		return UnsupportedError("update of compressed image")
+	}
+	bounds := m.Bounds()
+	if bounds.Dx() != d.c.Width || bounds.Dy() != d.c.Height {
+		return errors.New("bmp: image dimensions differ from the stored image")
+	}
+	// DecodeConfig stops at the pixels.
+	pixOffset, err := f.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return err
+	}
+	if d.format == Paletted8 {
+		pal := d.c.ColorModel.(color.Palette)
+		if len(pal) > 1<<d.bpp {
+			// The pixels cannot index the extra colors.
+			pal = pal[:1<<d.bpp]
+		}
+		if p, ok := m.(*image.Paletted); !ok || !samePalette(p.Palette, pal) {
+			p := image.NewPaletted(bounds, pal)
+			draw.Draw(p, bounds, m, bounds.Min, draw.Src)
+			m = p
+		}
+	}
+	e, err := newEncoder(f, d.c.Width, d.c.Height, &Options{
+		BitsPerPixel: int(d.bpp),
+		TopDown:      d.topDown,
+		RGB565:       d.rgb565,
+	})
+	if err != nil {
+		return err
+	}
+	defer e.release()
+	if err := e.prepare(m); err != nil {
+		return err
+	}
+	if e.data != nil || e.bpp != int(d.bpp) {
+		return UnsupportedError("update of pixel format")
+	}
+	r = r.Intersect(bounds)
+	if r.Empty() {
+		return nil
+	}
+	// The stored rows y0 to y1 are contiguous.
+	y0, y1 := r.Min.Y-bounds.Min.Y, r.Max.Y-bounds.Min.Y
+	if !d.topDown {
+		y0, y1 = e.dy-y1, e.dy-y0
+	}
+	if _, err := f.Seek(pixOffset+int64(y0)*int64(e.step), io.SeekStart); err != nil {
+		return err
+	}
+	n := e.chunkRows()
+	buf := e.alloc(n * e.step)
+	for i := y0; i < y1; i += n {
+		rows := y1 - i
+		if rows > n {
+			rows = n
+		}
+		for j := 0; j < rows; j++ {
+			y := i + j
+			if !d.topDown {
+				y = e.dy - 1 - y
+			}
+			e.row(buf[j*e.step:(j+1)*e.step], y)
+		}
+		if _, err := f.Write(buf[:rows*e.step]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// samePalette reports whether the palettes have the same colors.
+func samePalette(p1, p2 color.Palette) bool {
+	if len(p1) != len(p2) {
+		return false
+	}
+	for i := range p1 {
+		r1, g1, b1, a1 := p1[i].RGBA()
+		r2, g2, b2, a2 := p2[i].RGBA()
+		if r1 != r2 || g1 != g2 || b1 != b2 || a1 != a2 {
+			return false
+		}
+	}
+	return true
+}
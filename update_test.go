@@ -0,0 +1,109 @@
+package bmp
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/color"
+	"image/draw"
+	"path/filepath"
+	"testing"
+)
+
+func TestUpdate(t *testing.T) {
+	files, err := filepath.Glob("testdata/*.bmp")
+	if err != nil {
+		panic("failed to list test files: " + err.Error())
+	}
+	for _, file := range files {
+		t.Run(file, func(t *testing.T) {
+			b := mustReadFile(file)
+			img, err := Decode(bytes.NewReader(b))
+			if err != nil {
+				t.Skipf("Decode() = _, %v", err)
+			}
+			bounds := img.Bounds()
+			if compression := readUint32(b[30:]); compression == 1 || compression == 2 {
+				if err := Update(&seekBuffer{b: b}, img); err == nil {
+					t.Error("Update() of compressed image = nil; want non-nil")
+				}
+				return
+			}
+			if bounds.Dy() < 3 {
+				t.Skip("too few rows")
+			}
+			// Fill the second and third rows with a color stored exactly.
+			var c color.Color = color.Black
+			if _, ok := img.(*image.Paletted); ok {
+				c = img.At(bounds.Min.X, bounds.Min.Y)
+			}
+			expected := image.NewNRGBA(bounds)
+			draw.Draw(expected, bounds, img, bounds.Min, draw.Src)
+			r := image.Rect(bounds.Min.X, bounds.Min.Y+1, bounds.Max.X, bounds.Min.Y+3)
+			for y := r.Min.Y; y < r.Max.Y; y++ {
+				for x := r.Min.X; x < r.Max.X; x++ {
+					expected.Set(x, y, c)
+				}
+			}
+			// Only the rows in r are updated.
+			updated := image.NewNRGBA(bounds)
+			draw.Draw(updated, bounds, expected, bounds.Min, draw.Src)
+			for x := bounds.Min.X; x < bounds.Max.X; x++ {
+				updated.Set(x, bounds.Max.Y-1, c)
+			}
+			f := &seekBuffer{b: append([]byte(nil), b...)}
+			if err := UpdateRect(f, updated, r); err != nil {
+				t.Fatalf("UpdateRect() = %v; want nil", err)
+			}
+			if len(f.b) != len(b) {
+				t.Fatalf("size = %d; want %d", len(f.b), len(b))
+			}
+			if off := readUint32(b[10:]); !bytes.Equal(f.b[:off], b[:off]) {
+				t.Error("headers changed")
+			}
+			actual, err := Decode(bytes.NewReader(f.b))
+			if err != nil {
+				t.Fatalf("Decode() = _, %v; want nil", err)
+			}
+			compare(t, expected, actual)
+		})
+	}
+	f := &seekBuffer{b: mustReadFile("testdata/rgb24.bmp")}
+	if err := Update(f, image.NewRGBA(image.Rect(0, 0, 1, 1))); err == nil {
+		t.Error("Update() = nil; want non-nil")
+	}
+}
+
+func TestUpdateLargeColorTable(t *testing.T) {
+	red, blue := color.RGBA{0xFF, 0, 0, 0xFF}, color.RGBA{0, 0, 0xFF, 0xFF}
+	m := image.NewPaletted(image.Rect(0, 0, 8, 2), color.Palette{red, blue})
+	var buf bytes.Buffer
+	if err := EncodeWithOptions(&buf, m, &Options{BitsPerPixel: 1}); err != nil {
+		t.Fatalf("EncodeWithOptions() = %v; want nil", err)
+	}
+	// Store black and white after the 2 colors 1 bit per pixel can index.
+	in := buf.Bytes()
+	off := readUint32(in[10:])
+	b := append(append([]byte(nil), in[:off]...), 0, 0, 0, 0, 0xFF, 0xFF, 0xFF, 0)
+	b = append(b, in[off:]...)
+	binary.LittleEndian.PutUint32(b[2:], uint32(len(b)))
+	binary.LittleEndian.PutUint32(b[10:], off+8)
+	binary.LittleEndian.PutUint32(b[46:], 4)
+	// The left half is red and the right half blue.
+	for y := 0; y < 2; y++ {
+		for x := 4; x < 8; x++ {
+			m.SetColorIndex(x, y, 1)
+		}
+	}
+	updated := image.NewRGBA(m.Rect)
+	draw.Draw(updated, updated.Rect, m, image.Point{}, draw.Src)
+	f := &seekBuffer{b: b}
+	if err := Update(f, updated); err != nil {
+		t.Fatalf("Update() = %v; want nil", err)
+	}
+	img, err := Decode(bytes.NewReader(f.b))
+	if err != nil {
+		t.Fatalf("Decode() = _, %v; want nil", err)
+	}
+	compare(t, m, img)
+}
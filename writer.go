@@ -31,73 +31,681 @@
 package bmp
 
 import (
+	"bytes"
 	"encoding/binary"
+	"errors"
 	"image"
+	"image/color"
+	"image/color/palette"
+	"image/draw"
 	"io"
+	"io/ioutil"
+	"math"
 	"strconv"
+	"sync"
+	"sync/atomic"
 )
 
-func encodeSmallPaletted(w io.Writer, pix []uint8, bpp, dx, dy, stride, step int) error {
-	b := make([]byte, step)
-	for y := dy - 1; y >= 0; y-- {
-		byte, bit := 0, 8-bpp
-		for x := 0; x < dx; x++ {
-			b[byte] = (b[byte] & ^((1<<bpp - 1) << bit)) | (pix[y*stride+x] << bit)
-			if bit == 0 {
-				bit = 8 - bpp
-				byte++
-			} else {
-				bit -= bpp
-			}
+// Options are the encoding parameters.
+// A nil *Options is equivalent to the zero value.
+type Options struct {
+	// TopDown makes the rows stored top-down instead of bottom-up.
+	TopDown bool
+
+	// BitsPerPixel, if non-zero, is the number of bits per pixel to write:
+	// 1, 2, 4, 8, 16, 24, 32 or 64. Otherwise it is chosen by the type of the image.
+	//
+	// Paletted images that do not fit the requested depth and non-paletted images
+	// written with 8 or less bits per pixel are mapped to a fixed palette:
+	// black and white for 1, 4 grays for 2, the 16 VGA colors for 4 and Plan 9 for 8.
+	// Gray and Gray16 images are written with 8 bits per pixel by default,
+	// and so are Alpha and Alpha16 ones, with the alpha as the luminance.
+	// With 4 or less bits per pixel they use a ramp of evenly spaced grays,
+	// so 4 bits per pixel halve the size of low dynamic range scans.
+	// 16-bit grays are rounded to the nearest level.
+	// 16 bits per pixel are written as uncompressed RGB555 (X1R5G5B5),
+	// which is understood by every reader, unless RGB565 is set.
+	// 5 and 6-bit channels are rounded to the nearest value.
+	// Non-opaque images written with 16 or 24 bits per pixel are composited over black.
+	// So 24 writes every image, paletted, gray or not, opaque or not, with
+	// the same format for consumers that only understand 24 bits per pixel.
+	// DropAlpha does the same without compositing.
+	// Likewise, 32 writes every image as BGRA, with opaque alpha if the image
+	// has none, so the stride does not depend on whether the image is opaque.
+	// 64 bits per pixel keep 16 bits per channel, stored as linear light
+	// in the s2.13 fixed point format, the way Windows reads them.
+	BitsPerPixel int
+
+	// MinBitsPerPixel, if non-zero, is the minimum number of bits per pixel
+	// chosen for paletted images when BitsPerPixel is 0: 2, 4 or 8.
+	// 4 avoids 2 bits per pixel, which many readers reject, and 8 is understood
+	// by all readers.
+	MinBitsPerPixel int
+
+	// PalettedAlpha makes paletted images with non-opaque colors written with
+	// 32 bits per pixel and at least HeaderV4 when BitsPerPixel is 0, so their
+	// transparency is kept. Otherwise their palette is written without the alpha.
+	PalettedAlpha bool
+
+	// ExpandPalette makes paletted images with more than 256 colors,
+	// which do not fit a color table, written with 24 bits per pixel,
+	// or 32 if they are not opaque, when BitsPerPixel is 0, or converted
+	// to BitsPerPixel otherwise. Without it, encoding them fails.
+	ExpandPalette bool
+
+	// Grayscale makes the image converted to grays and written with the ramp
+	// of evenly spaced grays, with 8 bits per pixel by default or 1, 2 or 4.
+	// Non-opaque images are composited over black.
+	Grayscale bool
+
+	// Bilevel makes the image converted to black and white and written
+	// with 1 bit per pixel. It implies 1 bit per pixel.
+	Bilevel bool
+
+	// Threshold is the luminance from which pixels become white
+	// in bilevel images. 0 means 128.
+	Threshold uint8
+
+	// Dither makes images written with reduced color depth dithered with
+	// Floyd-Steinberg error diffusion to avoid banding: bilevel images instead of
+	// thresholded, 16 bits per pixel instead of rounded, and non-paletted images
+	// written with 8 or less bits per pixel instead of mapped to the nearest color,
+	// unless Drawer is set.
+	Dither bool
+
+	// Header is the version of the DIB header to write.
+	Header HeaderVersion
+
+	// XPixelsPerMeter and YPixelsPerMeter are the horizontal and vertical
+	// resolution of the image. Multiply DPI by 39.3701 to get pixels per meter.
+	// 0 means 3780, that is 96 DPI as written by most Windows applications,
+	// so that office suites importing the image give it the expected size.
+	// A negative value leaves the resolution unspecified.
+	XPixelsPerMeter, YPixelsPerMeter int
+
+	// CompactGrayPalette makes Gray and Alpha images written with 8 bits per pixel
+	// stored with a palette of only the gray levels they use, in ascending order,
+	// instead of the full ramp of 256 grays, which trims up to 1 KiB of small images.
+	CompactGrayPalette bool
+
+	// GrayPalette, if non-nil, is the palette of 256 colors used instead of
+	// the ramp of grays for gray images written with 8 bits per pixel,
+	// with the gray levels as the indexes, for example a false-color palette
+	// for thermal imaging. It also applies to Grayscale.
+	GrayPalette color.Palette
+
+	// PadPalette makes the palette padded with black to 2^BitsPerPixel entries,
+	// as required by some old readers. Otherwise it only has as many entries
+	// as the image palette and biClrUsed is set accordingly.
+	PadPalette bool
+
+	// PaletteReserved is the value of the reserved 4th byte of the color table
+	// entries. Most applications write 0, the default, and some 0xFF.
+	PaletteReserved uint8
+
+	// Halftone is the halftoning algorithm a printer driver should use for the image.
+	// It implies HeaderOS2 unless Header is set otherwise, which is an error.
+	Halftone HalftoneAlgorithm
+
+	// HalftoneParams are the parameters of Halftone: the damping percentage
+	// of error diffusion, or the width and height of the PANDA
+	// and super-circle patterns in pixels.
+	HalftoneParams [2]uint32
+
+	// ImportantColors is the number of palette entries required to display
+	// the image, counted from the first one. 0 means all of them.
+	ImportantColors int
+
+	// ICCProfile, if non-empty, is an ICC color profile embedded after the pixels.
+	// It implies HeaderV5.
+	ICCProfile []byte
+
+	// Intent is the rendering intent of the image. Intents other than
+	// IntentPerceptual imply HeaderV5.
+	Intent RenderingIntent
+
+	// Calibration, if non-nil, marks the colors as calibrated RGB
+	// (LCS_CALIBRATED_RGB) with the given endpoints and gamma instead of sRGB.
+	// It implies at least HeaderV4 and cannot be used together with a profile.
+	Calibration *Calibration
+
+	// ICCProfileLink, if non-empty, is the path of an external ICC color profile
+	// linked instead of embedded. It is stored after the pixels in the Windows-1252
+	// code page, so it can only contain characters in the Latin-1 range.
+	// It implies HeaderV5 and cannot be used together with ICCProfile.
+	ICCProfileLink string
+
+	// A2RGB10 makes 32 bits per pixel stored with 10 bits per color channel
+	// and 2 bits of alpha (A2R10G10B10) with BITFIELDS color masks.
+	// It implies 32 bits per pixel and at least HeaderV4 to store the alpha mask.
+	A2RGB10 bool
+
+	// RGB565 makes 16 bits per pixel stored as RGB565 with BITFIELDS color masks
+	// instead of RGB555. It implies 16 bits per pixel.
+	RGB565 bool
+
+	// Compression is the compression method.
+	// Compressed images cannot be stored top-down.
+	Compression Compression
+
+	// Quantizer, if non-nil, makes non-paletted images written with a palette
+	// it builds for them, with up to 2^BitsPerPixel colors, or 256 if BitsPerPixel is 0.
+	// The bit depth is then chosen by the number of colors.
+	Quantizer draw.Quantizer
+
+	// Drawer, if non-nil, converts non-paletted images to the palette of the output,
+	// for example draw.FloydSteinberg to dither them.
+	// Otherwise every pixel is mapped to the nearest color.
+	Drawer draw.Drawer
+
+	// Alpha is how the alpha channel of non-opaque images is written.
+	Alpha AlphaMode
+
+	// Opaque is whether the images are known to be opaque, sparing their scan.
+	Opaque Opacity
+
+	// LargeFile makes uncompressed images larger than 4 GiB written with
+	// the file and image sizes in the headers set to 0, as allowed for them,
+	// instead of failing with ErrTooLarge. Readers that rely on the sizes
+	// cannot read such images. Compressed images and ones with an ICC profile
+	// still fail since the sizes or the offset of the profile are required.
+	LargeFile bool
+
+	// ZeroImageSize makes the image size in the header (biSizeImage) 0
+	// for uncompressed images without color masks, as allowed for them and
+	// required by some readers. Otherwise it is exact.
+	ZeroImageSize bool
+
+	// Workers, if greater than 1, is the number of goroutines converting
+	// the rows of uncompressed images in parallel, which speeds up large images.
+	// The rows are still written in order. It only applies to the image types
+	// and conversions that are safe to run concurrently, such as RGBA, NRGBA,
+	// YCbCr, CMYK, paletted and raw pixels and dithered images.
+	Workers int
+
+	// PixelAlignment, if greater than 1, is the alignment in bytes
+	// of the offset of the pixels, for example 4096 for memory-mapped files.
+	// The color table is followed by zero bytes up to the offset.
+	PixelAlignment int
+
+	// ChunkSize is the number of bytes of pixels accumulated before each write
+	// to the underlying writer, which matters for unbuffered and network writers.
+	// At least one row is written at a time. If 0, 256 KiB is used.
+	ChunkSize int
+
+	// Progress, if non-nil, is called as the rows are written with the number
+	// of the rows written so far and the height of the image: after every
+	// ProgressRows rows and after the last one. 0 ProgressRows means every row.
+	// Compressed pixels that are buffered are reported at once.
+	Progress     func(written, total int)
+	ProgressRows int
+
+	// DropAlpha makes the image written with 24 bits per pixel, discarding the alpha
+	// of non-opaque images and keeping their colors as not premultiplied by it,
+	// instead of compositing them over black. It implies 24 bits per pixel.
+	DropAlpha bool
+}
+
+// AlphaMode is a convention of storing the alpha channel.
+type AlphaMode int
+
+const (
+	// AlphaStraight stores the colors of images written with 32 bits per pixel
+	// not premultiplied by the alpha, as most readers expect.
+	AlphaStraight AlphaMode = iota
+	// AlphaPremultiplied stores the colors of images written with 32 bits per pixel
+	// premultiplied by the alpha, as expected by the Windows AlphaBlend function.
+	AlphaPremultiplied
+	// AlphaOpaqueOnly makes encoding non-opaque images fail instead of
+	// storing their alpha or compositing them over black.
+	AlphaOpaqueOnly
+)
+
+// Opacity is whether the encoded images are known to be fully opaque.
+type Opacity int
+
+const (
+	// OpacityUnknown makes the encoder find out whether the images are opaque,
+	// scanning them if necessary.
+	OpacityUnknown Opacity = iota
+	// OpacityOpaque asserts that the images are opaque, so their alpha
+	// is never scanned and is dropped if they are written without it.
+	OpacityOpaque
+	// OpacityTranslucent asserts that the images are not opaque, so they are
+	// written with their alpha, if possible, without being scanned.
+	OpacityTranslucent
+)
+
+// GDIOptions returns the options writing images the way Windows GDI and DirectDraw
+// blitting functions expect a DIB section, as created by CreateDIBSection:
+// top-down rows of uncompressed 32-bit BGRA pixels with the alpha premultiplied,
+// as required by AlphaBlend, with BITMAPINFOHEADER. The result can be modified.
+func GDIOptions() *Options {
+	return &Options{
+		TopDown:      true,
+		BitsPerPixel: 32,
+		Header:       HeaderInfo,
+		Compression:  CompressionNone,
+		Alpha:        AlphaPremultiplied,
+	}
+}
+
+// ErrTooLarge reports that the image is too large for the sizes and offsets
+// in the BMP headers, which are limited to 4 GiB.
+var ErrTooLarge = UnsupportedError("image larger than 4 GiB")
+
+// HeaderVersion is a version of the DIB header.
+type HeaderVersion int
+
+const (
+	// HeaderInfo is the 40-byte BITMAPINFOHEADER understood by every reader.
+	HeaderInfo HeaderVersion = iota
+	// HeaderV4 is the 108-byte BITMAPV4HEADER. Unlike HeaderInfo,
+	// it stores the color masks of 16 and 32 bits per pixel images explicitly,
+	// including the alpha mask, so readers don't ignore the alpha channel.
+	HeaderV4
+	// HeaderV5 is the 124-byte BITMAPV5HEADER. It extends HeaderV4
+	// and marks the pixels as sRGB with the perceptual rendering intent
+	// so color-managed applications interpret them correctly.
+	HeaderV5
+
+	// HeaderCore is the 12-byte OS/2 BITMAPCOREHEADER understood by ancient readers,
+	// with a color table of 3-byte entries always padded to 2^BitsPerPixel colors.
+	// It only stores uncompressed bottom-up images up to 65535x65535 pixels
+	// with 1, 4, 8 or 24 bits per pixel, without resolution nor important colors.
+	// By default, images are written with the nearest supported bit depth.
+	HeaderCore HeaderVersion = -1
+	// HeaderOS2 is the 64-byte OS/2 2.x BITMAPINFOHEADER2. It extends HeaderInfo
+	// with the halftoning algorithm used by OS/2 printer drivers.
+	// It only stores bottom-up images with 1, 4, 8 or 24 bits per pixel,
+	// without color masks nor profiles.
+	// By default, images are written with the nearest supported bit depth.
+	HeaderOS2 HeaderVersion = -2
+)
+
+// RenderingIntent is a rendering intent stored in BITMAPV5HEADER.
+type RenderingIntent int
+
+const (
+	// IntentPerceptual (LCS_GM_IMAGES) maintains contrast, for photographs.
+	IntentPerceptual RenderingIntent = iota
+	// IntentRelativeColorimetric (LCS_GM_GRAPHICS) maintains colorimetric match
+	// relative to the white point, for graphics.
+	IntentRelativeColorimetric
+	// IntentSaturation (LCS_GM_BUSINESS) maintains saturation, for business charts.
+	IntentSaturation
+	// IntentAbsoluteColorimetric (LCS_GM_ABS_COLORIMETRIC) maintains
+	// colorimetric match to the nearest color in the destination gamut, for proofs.
+	IntentAbsoluteColorimetric
+)
+
+// CIEXYZ is a color in the CIE 1931 XYZ color space.
+type CIEXYZ struct {
+	X, Y, Z float64
+}
+
+// Calibration is a calibrated RGB color space stored in BITMAPV4HEADER
+// and BITMAPV5HEADER.
+type Calibration struct {
+	// Red, Green and Blue are the endpoints of the color space.
+	// Their coordinates must be in [0, 4).
+	Red, Green, Blue CIEXYZ
+
+	// GammaRed, GammaGreen and GammaBlue are the gamma of the color channels.
+	// They must be in [0, 65536).
+	GammaRed, GammaGreen, GammaBlue float64
+}
+
+// valid reports whether the values of c can be stored.
+func (c *Calibration) valid() bool {
+	for _, v := range []float64{
+		c.Red.X, c.Red.Y, c.Red.Z,
+		c.Green.X, c.Green.Y, c.Green.Z,
+		c.Blue.X, c.Blue.Y, c.Blue.Z,
+	} {
+		// FXPT2DOT30.
+		if !(v >= 0 && v < 4) {
+			return false
 		}
-		if _, err := w.Write(b); err != nil {
-			return err
+	}
+	for _, v := range []float64{c.GammaRed, c.GammaGreen, c.GammaBlue} {
+		// 16.16 fixed point.
+		if !(v >= 0 && v < 65536) {
+			return false
 		}
 	}
-	return nil
+	return true
 }
 
-func encodePaletted(w io.Writer, pix []uint8, dx, dy, stride, step int) error {
-	var padding []byte
-	if dx < step {
-		padding = make([]byte, step-dx)
+// fixedPoint returns v in the unsigned fixed point format with bits fractional bits.
+func fixedPoint(v float64, bits uint) uint32 {
+	f := math.Round(v * float64(uint64(1)<<bits))
+	if f > math.MaxUint32 {
+		return math.MaxUint32
 	}
-	for y := dy - 1; y >= 0; y-- {
+	return uint32(f)
+}
+
+// HalftoneAlgorithm is a halftoning algorithm stored in BITMAPINFOHEADER2.
+type HalftoneAlgorithm int
+
+const (
+	// HalftoneNone means the image is not halftoned.
+	HalftoneNone HalftoneAlgorithm = iota
+	// HalftoneErrorDiffusion is error diffusion halftoning.
+	HalftoneErrorDiffusion
+	// HalftonePanda is Processing Algorithm for Noncoded Document Acquisition
+	// (PANDA) halftoning.
+	HalftonePanda
+	// HalftoneSuperCircle is super-circle halftoning.
+	HalftoneSuperCircle
+)
+
+// Compression is a compression method of the pixels.
+type Compression int
+
+const (
+	// CompressionNone stores the pixels uncompressed.
+	CompressionNone Compression = iota
+	// CompressionRLE4 stores the pixels with 4 bits per pixel and run-length encoding.
+	// It implies 4 bits per pixel, so images with more than 16 colors
+	// are mapped as described in Options.BitsPerPixel.
+	CompressionRLE4
+	// CompressionAuto stores the pixels with CompressionRLE4 if the image
+	// fits in 4 bits per pixel and this makes the output smaller,
+	// and uncompressed otherwise.
+	CompressionAuto
+)
+
+type encoder struct {
+	w            io.Writer
+	opts         Options
+	dx, dy, step int
+	bpp          int
+	// palette holds the color table entries in BGR0 order.
+	palette  []byte
+	colorUse uint32
+	data     []byte // Compressed pixels.
+	// start is the position of the file header in w and pixOffset is the
+	// offset of the pixels. They are used to patch the sizes of the compressed
+	// pixels written without buffering.
+	start     int64
+	pixOffset uint32
+	// row stores the row y of the image, converted to the output format, in b.
+	row func(b []byte, y int)
+	// concurrent reports whether row can be called concurrently.
+	concurrent bool
+	// scratch, if non-nil, holds the buffers reused from the previous image.
+	scratch *scratch
+	// pooled holds the buffers taken from the pool if scratch is nil.
+	pooled []*[]byte
+	// lazyOpacity lets plan assume that RGBA and NRGBA images are opaque
+	// instead of scanning them, leaving writeAll to check them as their rows
+	// are converted.
+	lazyOpacity bool
+	// assumed is the image plan assumed to be opaque, if any.
+	assumed image.Image
+	// translucent is set to 1 once a row of assumed is found not to be opaque.
+	translucent uint32
+	// hdr holds the headers, the masks and the color table while they are written.
+	hdr [fileHeaderLen + v5InfoHeaderLen + 256*4]byte
+}
+
+// scratch holds buffers reused by the encoders of consecutive images.
+type scratch struct {
+	bufs [][]byte
+	// n is the number of buffers in use by the current image.
+	n int
+}
+
+// alloc returns a zeroed buffer of n bytes, reused from e.scratch if possible
+// or taken from the pool otherwise.
+func (e *encoder) alloc(n int) []byte {
+	s := e.scratch
+	if s == nil {
+		p := getBuffer(n)
+		e.pooled = append(e.pooled, p)
+		b := (*p)[:n]
+		for i := range b {
+			b[i] = 0
+		}
+		return b
+	}
+	if s.n == len(s.bufs) {
+		s.bufs = append(s.bufs, nil)
+	}
+	b := s.bufs[s.n]
+	s.n++
+	if cap(b) < n {
+		b = make([]byte, n)
+		s.bufs[s.n-1] = b
+		return b
+	}
+	b = b[:n]
+	for i := range b {
+		b[i] = 0
+	}
+	return b
+}
+
+// release returns the buffers taken from the pool by alloc.
+// None of them may be used afterwards.
+func (e *encoder) release() {
+	for _, p := range e.pooled {
+		putBuffer(p)
+	}
+	e.pooled = nil
+}
+
+// allocMark records the buffers allocated by an encoder so far.
+type allocMark struct {
+	pooled, scratch int
+}
+
+// mark returns the buffers allocated by e so far.
+func (e *encoder) mark() allocMark {
+	m := allocMark{pooled: len(e.pooled)}
+	if e.scratch != nil {
+		m.scratch = e.scratch.n
+	}
+	return m
+}
+
+// releaseTo returns the buffers allocated by e since m was taken.
+// None of them may be used afterwards.
+func (e *encoder) releaseTo(m allocMark) {
+	for _, p := range e.pooled[m.pooled:] {
+		putBuffer(p)
+	}
+	e.pooled = e.pooled[:m.pooled]
+	if e.scratch != nil {
+		e.scratch.n = m.scratch
+	}
+}
+
+// rows returns the range of the row indexes in the order they are stored.
+func (e *encoder) rows() (y0, y1, yDelta int) {
+	if e.opts.TopDown {
+		return 0, e.dy, +1
+	}
+	return e.dy - 1, -1, -1
+}
+
+// setPalette stores the first colors of p in the color table for e.bpp bits per pixel.
+func (e *encoder) setPalette(p color.Palette) {
+	colors := 1 << e.bpp
+	used := colors
+	if len(p) < colors {
+		used = len(p)
+		if !e.opts.PadPalette {
+			colors = used
+			e.colorUse = uint32(colors)
+		}
+	}
+	e.palette = e.alloc(colors * 4)
+	for i := 0; i < colors; i++ {
+		if i < used {
+			r, g, b, _ := p[i].RGBA()
+			e.palette[i*4+0] = uint8(b >> 8)
+			e.palette[i*4+1] = uint8(g >> 8)
+			e.palette[i*4+2] = uint8(r >> 8)
+		}
+		e.palette[i*4+3] = e.opts.PaletteReserved
+	}
+}
+
+func (e *encoder) encodeSmallPaletted(pix []uint8, stride int) {
+	e.concurrent = true
+	e.row = func(b []byte, y int) {
+		e.packRow(b, pix[y*stride:y*stride+e.dx])
+	}
+}
+
+func (e *encoder) encodePaletted(pix []uint8, stride int) {
+	e.concurrent = true
+	e.row = func(b []byte, y int) {
 		min := y*stride + 0
-		max := y*stride + dx
-		if _, err := w.Write(pix[min:max]); err != nil {
-			return err
+		max := y*stride + e.dx
+		copy(b, pix[min:max])
+	}
+}
+
+// planRaw sets e to copy the raw pixels of m if they are stored
+// in the format written with bpp bits per pixel.
+// It reports false otherwise.
+func (e *encoder) planRaw(m *rawImage, bpp int) bool {
+	switch f := m.format; {
+	case f == BGR24 && bpp == 24,
+		f == BGRA32 && bpp == 32 && e.opts.Alpha != AlphaPremultiplied,
+		f == RGB555 && bpp == 16 && !e.opts.RGB565,
+		f == RGB565 && bpp == 16 && e.opts.RGB565:
+		e.bpp = bpp
+	default:
+		return false
+	}
+	n := m.format.Stride(e.dx)
+	e.concurrent = true
+	e.row = func(b []byte, y int) {
+		copy(b, m.pix[y*m.stride:y*m.stride+n])
+	}
+	return true
+}
+
+// planGray sets e to write the 8-bit gray pixels with 8 or less bits per pixel.
+// It reports false if another depth is requested.
+func (e *encoder) planGray(pix []uint8, stride int) bool {
+	switch bpp := e.opts.BitsPerPixel; bpp {
+	case 0, 8:
+		e.bpp = 8
+		if e.opts.CompactGrayPalette {
+			e.encodeCompactGray(pix, stride)
+			break
 		}
-		if padding != nil {
-			if _, err := w.Write(padding); err != nil {
-				return err
-			}
+		e.setPalette(e.grayLevels(8))
+		e.encodePaletted(pix, stride)
+	case 1, 2, 4:
+		e.bpp = bpp
+		e.setPalette(grayPalette(bpp))
+		e.encodeGray(pix, stride)
+	default:
+		return false
+	}
+	return true
+}
+
+// encodeCompactGray writes the gray pixels with 8 bits per pixel,
+// with a palette of the used levels only.
+func (e *encoder) encodeCompactGray(pix []uint8, stride int) {
+	var used [256]bool
+	for y := 0; y < e.dy; y++ {
+		for _, c := range pix[y*stride : y*stride+e.dx] {
+			used[c] = true
+		}
+	}
+	var p color.Palette
+	levels := e.grayLevels(8)
+	lut := e.alloc(256)
+	for c, ok := range used {
+		if ok {
+			lut[c] = uint8(len(p))
+			p = append(p, levels[c])
+		}
+	}
+	if len(p) == 0 {
+		// The palette of an empty image is not empty.
+		p = append(p, color.Gray{})
+	}
+	e.setPalette(p)
+	e.concurrent = true
+	e.row = func(b []byte, y int) {
+		for x, c := range pix[y*stride : y*stride+e.dx] {
+			b[x] = lut[c]
 		}
 	}
-	return nil
 }
 
-func encodeRGBA(w io.Writer, pix []uint8, dx, dy, stride, step int, opaque bool) error {
-	buf := make([]byte, step)
+// planGray16 sets e to write the 16-bit gray pixels with 8 or less bits per pixel.
+// It reports false if another depth is requested.
+func (e *encoder) planGray16(pix []uint8, stride int) bool {
+	switch bpp := e.opts.BitsPerPixel; bpp {
+	case 0, 1, 2, 4, 8:
+		e.bpp = 8
+		if bpp != 0 {
+			e.bpp = bpp
+		}
+		e.setPalette(e.grayLevels(e.bpp))
+		e.encodeGray16(pix, stride)
+	default:
+		return false
+	}
+	return true
+}
+
+// encodeGray writes the gray pixels with e.bpp (< 8) bits per pixel,
+// mapping them to the nearest gray of grayPalette(e.bpp).
+func (e *encoder) encodeGray(pix []uint8, stride int) {
+	max := 1<<e.bpp - 1
+	idx := e.alloc(e.dx)
+	lut := e.alloc(256)
+	for c := range lut {
+		lut[c] = uint8((c*max + 0x7F) / 0xFF)
+	}
+	e.row = func(b []byte, y int) {
+		row := pix[y*stride : y*stride+e.dx]
+		idx := idx[:len(row)]
+		for x, c := range row {
+			idx[x] = lut[c]
+		}
+		e.packRow(b, idx)
+	}
+}
+
+// encodeGray16 writes the 16-bit gray pixels with e.bpp (<= 8) bits per pixel,
+// mapping them to the nearest gray of grayPalette(e.bpp).
+func (e *encoder) encodeGray16(pix []uint8, stride int) {
+	max := uint32(1)<<e.bpp - 1
+	idx := e.alloc(e.dx)
+	e.row = func(b []byte, y int) {
+		row := pix[y*stride : y*stride+e.dx*2]
+		for x := range idx {
+			s := row[x*2 : x*2+2]
+			c := uint32(s[0])<<8 | uint32(s[1])
+			idx[x] = uint8((c*max + 0x7FFF) / 0xFFFF)
+		}
+		e.packRow(b, idx)
+	}
+}
+
+func (e *encoder) encodeRGBA(pix []uint8, stride int, opaque bool) {
+	e.concurrent = true
 	if opaque {
-		for y := dy - 1; y >= 0; y-- {
-			min := y*stride + 0
-			max := y*stride + dx*4
-			off := 0
-			for i := min; i < max; i += 4 {
-				buf[off+2] = pix[i+0]
-				buf[off+1] = pix[i+1]
-				buf[off+0] = pix[i+2]
-				off += 3
-			}
-			if _, err := w.Write(buf); err != nil {
-				return err
-			}
+		e.row = func(buf []byte, y int) {
+			rgbaToBGR(buf, pix[y*stride:y*stride+e.dx*4])
 		}
 	} else {
-		for y := dy - 1; y >= 0; y-- {
+		e.row = func(buf []byte, y int) {
 			min := y*stride + 0
-			max := y*stride + dx*4
+			max := y*stride + e.dx*4
 			off := 0
 			for i := min; i < max; i += 4 {
 				a := uint32(pix[i+3])
@@ -116,211 +724,1836 @@ func encodeRGBA(w io.Writer, pix []uint8, dx, dy, stride, step int, opaque bool)
 					off += 4
 					continue
 				}
+				if e.opts.Alpha == AlphaPremultiplied {
+					buf[off+2] = pix[i+0]
+					buf[off+1] = pix[i+1]
+					buf[off+0] = pix[i+2]
+					buf[off+3] = uint8(a)
+					off += 4
+					continue
+				}
 				buf[off+2] = uint8(((uint32(pix[i+0]) * 0xffff) / a) >> 8)
 				buf[off+1] = uint8(((uint32(pix[i+1]) * 0xffff) / a) >> 8)
 				buf[off+0] = uint8(((uint32(pix[i+2]) * 0xffff) / a) >> 8)
 				buf[off+3] = uint8(a)
 				off += 4
 			}
-			if _, err := w.Write(buf); err != nil {
-				return err
-			}
 		}
 	}
-	return nil
 }
 
-func encodeNRGBA(w io.Writer, pix []uint8, dx, dy, stride, step int, opaque bool) error {
-	buf := make([]byte, step)
+// encodeAssumedOpaque encodes the pixels of e.assumed as opaque,
+// setting e.translucent if they are not.
+func (e *encoder) encodeAssumedOpaque(pix []uint8, stride int) {
+	e.bpp = 24
+	e.concurrent = true
+	e.row = func(buf []byte, y int) {
+		if !rgbaToBGR(buf, pix[y*stride:y*stride+e.dx*4]) {
+			atomic.StoreUint32(&e.translucent, 1)
+		}
+	}
+}
+
+// planTranslucent plans e.assumed, found not to be opaque, with 32 bits per pixel.
+func (e *encoder) planTranslucent() error {
+	switch m := e.assumed.(type) {
+	case *image.RGBA:
+		e.encodeRGBA(m.Pix, m.Stride, false)
+	case *image.NRGBA:
+		e.encodeNRGBA(m.Pix, m.Stride, false)
+	}
+	e.bpp = 32
+	e.assumed = nil
+	e.translucent = 0
+	return e.layout()
+}
+
+func (e *encoder) encodeNRGBA(pix []uint8, stride int, opaque bool) {
+	e.concurrent = true
 	if opaque {
-		for y := dy - 1; y >= 0; y-- {
-			min := y*stride + 0
-			max := y*stride + dx*4
-			off := 0
-			for i := min; i < max; i += 4 {
-				buf[off+2] = pix[i+0]
-				buf[off+1] = pix[i+1]
-				buf[off+0] = pix[i+2]
-				off += 3
-			}
-			if _, err := w.Write(buf); err != nil {
-				return err
-			}
+		e.row = func(buf []byte, y int) {
+			rgbaToBGR(buf, pix[y*stride:y*stride+e.dx*4])
+		}
+	} else if e.opts.Alpha != AlphaPremultiplied {
+		e.row = func(buf []byte, y int) {
+			swapRB32(buf, pix[y*stride:y*stride+e.dx*4], false)
 		}
 	} else {
-		for y := dy - 1; y >= 0; y-- {
+		e.row = func(buf []byte, y int) {
 			min := y*stride + 0
-			max := y*stride + dx*4
+			max := y*stride + e.dx*4
 			off := 0
 			for i := min; i < max; i += 4 {
 				buf[off+2] = pix[i+0]
 				buf[off+1] = pix[i+1]
 				buf[off+0] = pix[i+2]
 				buf[off+3] = pix[i+3]
+				if a := uint32(pix[i+3]); a != 0xff {
+					buf[off+2] = uint8((uint32(pix[i+0])*a + 0x7f) / 0xff)
+					buf[off+1] = uint8((uint32(pix[i+1])*a + 0x7f) / 0xff)
+					buf[off+0] = uint8((uint32(pix[i+2])*a + 0x7f) / 0xff)
+				}
 				off += 4
 			}
-			if _, err := w.Write(buf); err != nil {
-				return err
-			}
 		}
 	}
-	return nil
 }
 
-func encode(w io.Writer, m image.Image, step int) error {
+func (e *encoder) encodeCMYK(pix []uint8, stride int) {
+	e.concurrent = true
+	e.row = func(buf []byte, y int) {
+		min := y*stride + 0
+		max := y*stride + e.dx*4
+		off := 0
+		for i := min; i < max; i += 4 {
+			buf[off+2], buf[off+1], buf[off+0] = color.CMYKToRGB(pix[i+0], pix[i+1], pix[i+2], pix[i+3])
+			off += 3
+		}
+	}
+}
+
+func (e *encoder) encodeYCbCr(m *image.YCbCr) {
 	b := m.Bounds()
-	buf := make([]byte, step)
-	for y := b.Max.Y - 1; y >= b.Min.Y; y-- {
+	e.concurrent = true
+	e.row = func(buf []byte, y int) {
 		off := 0
 		for x := b.Min.X; x < b.Max.X; x++ {
-			r, g, b, _ := m.At(x, y).RGBA()
-			buf[off+2] = byte(r >> 8)
-			buf[off+1] = byte(g >> 8)
-			buf[off+0] = byte(b >> 8)
+			yi, ci := m.YOffset(x, b.Min.Y+y), m.COffset(x, b.Min.Y+y)
+			buf[off+2], buf[off+1], buf[off+0] = color.YCbCrToRGB(m.Y[yi], m.Cb[ci], m.Cr[ci])
 			off += 3
 		}
-		if _, err := w.Write(buf); err != nil {
-			return err
-		}
 	}
-	return nil
 }
 
-// Encode writes the image m to w in BMP format.
-func Encode(w io.Writer, m image.Image) error {
-	d := m.Bounds().Size()
-	if d.X < 0 || d.Y < 0 {
-		return FormatError("negative bounds")
+// rgba64Image is an image with a non-allocating RGBA64At method,
+// like image.RGBA64Image in Go 1.17 and later.
+type rgba64Image interface {
+	image.Image
+	RGBA64At(x, y int) color.RGBA64
+}
+
+// fallbackChunk is the number of pixels encode converts at a time.
+const fallbackChunk = 64
+
+// encode writes the images without a specific path with 24 bits per pixel.
+// The pixels of a row are read in chunks, with RGBA64At if m has it,
+// so a single conversion loop serves all of them.
+func (e *encoder) encode(m image.Image) {
+	b := m.Bounds()
+	fill := func(c []color.RGBA64, x, y int) {
+		for i := range c {
+			r, g, b, a := m.At(x+i, y).RGBA()
+			c[i] = color.RGBA64{uint16(r), uint16(g), uint16(b), uint16(a)}
+		}
+	}
+	if m, ok := m.(rgba64Image); ok {
+		fill = func(c []color.RGBA64, x, y int) {
+			for i := range c {
+				c[i] = m.RGBA64At(x+i, y)
+			}
+		}
 	}
-	h := struct {
-		sigBM           [2]byte
-		fileSize        uint32
-		reserved        [2]uint16
-		pixOffset       uint32
-		dibHeaderSize   uint32
-		width           uint32
-		height          uint32
-		colorPlane      uint16
-		bpp             uint16
-		compression     uint32
-		imageSize       uint32
-		xPixelsPerMeter uint32
-		yPixelsPerMeter uint32
-		colorUse        uint32
-		colorImportant  uint32
-	}{
-		sigBM:         [2]byte{'B', 'M'},
-		fileSize:      fileHeaderLen + infoHeaderLen,
-		pixOffset:     fileHeaderLen + infoHeaderLen,
-		dibHeaderSize: infoHeaderLen,
-		width:         uint32(d.X),
-		height:        uint32(d.Y),
-		colorPlane:    1,
-	}
-	var step int
-	var palette []byte
-	var opaque bool
+	e.row = func(buf []byte, y int) {
+		var chunk [fallbackChunk]color.RGBA64
+		off := 0
+		for x := b.Min.X; x < b.Max.X; x += fallbackChunk {
+			c := chunk[:]
+			if n := b.Max.X - x; n < len(c) {
+				c = c[:n]
+			}
+			fill(c, x, b.Min.Y+y)
+			for _, c := range c {
+				buf[off+2] = byte(c.R >> 8)
+				buf[off+1] = byte(c.G >> 8)
+				buf[off+0] = byte(c.B >> 8)
+				off += 3
+			}
+		}
+	}
+}
+
+// nrgbaRow returns a function storing the row y of m in b
+// as non-alpha-premultiplied RGBA32 pixels.
+func nrgbaRow(m image.Image) func(b []byte, y int) {
+	bounds := m.Bounds()
 	switch m := m.(type) {
-	case *image.Gray:
-		step = (d.X + 3) &^ 3
-		palette = make([]byte, 1024)
-		for i := 0; i < 256; i++ {
-			palette[i*4+0] = uint8(i)
-			palette[i*4+1] = uint8(i)
-			palette[i*4+2] = uint8(i)
-			palette[i*4+3] = 0xFF
-		}
-		h.imageSize = uint32(d.Y * step)
-		h.fileSize += uint32(len(palette)) + h.imageSize
-		h.pixOffset += uint32(len(palette))
-		h.bpp = 8
+	case *image.NRGBA:
+		return func(b []byte, y int) {
+			copy(b, m.Pix[y*m.Stride:y*m.Stride+bounds.Dx()*4])
+		}
 	case *image.Paletted:
-		if len(m.Palette) == 0 || len(m.Palette) > 256 {
-			return FormatError("bad palette length: " + strconv.Itoa(len(m.Palette)))
+		p := make([]color.NRGBA, len(m.Palette))
+		for i, c := range m.Palette {
+			p[i] = color.NRGBAModel.Convert(c).(color.NRGBA)
 		}
-		switch {
-		case len(m.Palette) <= 2:
-			h.bpp = 1
-		case len(m.Palette) <= 4:
-			h.bpp = 2
-		case len(m.Palette) <= 16:
-			h.bpp = 4
-		default:
-			h.bpp = 8
+		return func(b []byte, y int) {
+			for x, i := range m.Pix[y*m.Stride : y*m.Stride+bounds.Dx()] {
+				var c color.NRGBA
+				if int(i) < len(p) {
+					c = p[i]
+				}
+				d := b[x*4 : x*4+4]
+				d[0], d[1], d[2], d[3] = c.R, c.G, c.B, c.A
+			}
 		}
-		colors := 1 << h.bpp
-		if len(m.Palette) < 1<<h.bpp {
-			colors = len(m.Palette)
-			h.colorUse = uint32(colors)
+	case *image.Gray:
+		return func(b []byte, y int) {
+			for x, c := range m.Pix[y*m.Stride : y*m.Stride+bounds.Dx()] {
+				d := b[x*4 : x*4+4]
+				d[0], d[1], d[2], d[3] = c, c, c, 0xFF
+			}
 		}
-		if h.bpp < 8 {
-			pixelsPerByte := 8 / int(h.bpp)
-			step = ((d.X+pixelsPerByte-1)/pixelsPerByte + 3) &^ 3
-		} else {
-			step = (d.X + 3) &^ 3
-		}
-		palette = make([]byte, colors*4)
-		for i := 0; i < len(m.Palette) && i < 1<<h.bpp; i++ {
-			r, g, b, _ := m.Palette[i].RGBA()
-			palette[i*4+0] = uint8(b >> 8)
-			palette[i*4+1] = uint8(g >> 8)
-			palette[i*4+2] = uint8(r >> 8)
-			palette[i*4+3] = 0xFF
-		}
-		h.imageSize = uint32(d.Y * step)
-		h.fileSize += uint32(len(palette)) + h.imageSize
-		h.pixOffset += uint32(len(palette))
-	case *image.RGBA:
-		opaque = m.Opaque()
-		if opaque {
-			step = (3*d.X + 3) &^ 3
-			h.bpp = 24
-		} else {
-			step = 4 * d.X
-			h.bpp = 32
+	case *image.YCbCr:
+		return func(b []byte, y int) {
+			for x := 0; x < bounds.Dx(); x++ {
+				yi, ci := m.YOffset(bounds.Min.X+x, bounds.Min.Y+y), m.COffset(bounds.Min.X+x, bounds.Min.Y+y)
+				b[x*4+0], b[x*4+1], b[x*4+2] = color.YCbCrToRGB(m.Y[yi], m.Cb[ci], m.Cr[ci])
+				b[x*4+3] = 0xFF
+			}
 		}
-		h.imageSize = uint32(d.Y * step)
-		h.fileSize += h.imageSize
-	case *image.NRGBA:
-		opaque = m.Opaque()
-		if opaque {
-			step = (3*d.X + 3) &^ 3
-			h.bpp = 24
-		} else {
-			step = 4 * d.X
-			h.bpp = 32
+	case *rawImage:
+		return func(b []byte, y int) {
+			for x := 0; x < bounds.Dx(); x++ {
+				b[x*4+0], b[x*4+1], b[x*4+2], b[x*4+3] = m.format.load(m.pix[y*m.stride:], x, nil)
+			}
+		}
+	case *image.CMYK:
+		return func(b []byte, y int) {
+			s := m.Pix[y*m.Stride : y*m.Stride+bounds.Dx()*4]
+			for i := 0; i < len(s); i += 4 {
+				c, d := s[i:i+4], b[i:i+4]
+				d[0], d[1], d[2] = color.CMYKToRGB(c[0], c[1], c[2], c[3])
+				d[3] = 0xFF
+			}
+		}
+	case *image.NRGBA64:
+		return func(b []byte, y int) {
+			s := m.Pix[y*m.Stride : y*m.Stride+bounds.Dx()*8]
+			for i, j := 0, 0; i < len(s); i, j = i+8, j+4 {
+				c, d := s[i:i+8], b[j:j+4]
+				// The high bytes of the big-endian channels.
+				d[0], d[1], d[2], d[3] = c[0], c[2], c[4], c[6]
+			}
+		}
+	case *image.RGBA64:
+		return func(b []byte, y int) {
+			s := m.Pix[y*m.Stride : y*m.Stride+bounds.Dx()*8]
+			for i, j := 0, 0; i < len(s); i, j = i+8, j+4 {
+				c, d := s[i:i+8], b[j:j+4]
+				if c[6] == 0xFF && c[7] == 0xFF {
+					d[0], d[1], d[2], d[3] = c[0], c[2], c[4], 0xFF
+					continue
+				}
+				a := uint32(c[6])<<8 | uint32(c[7])
+				r, g, bl := unpremultiply(uint32(c[0])<<8|uint32(c[1]), uint32(c[2])<<8|uint32(c[3]), uint32(c[4])<<8|uint32(c[5]), a)
+				d[0], d[1], d[2], d[3] = uint8(r>>8), uint8(g>>8), uint8(bl>>8), uint8(a>>8)
+			}
 		}
-		h.imageSize = uint32(d.Y * step)
-		h.fileSize += h.imageSize
-	default:
-		step = (3*d.X + 3) &^ 3
-		h.imageSize = uint32(d.Y * step)
-		h.fileSize += h.imageSize
-		h.bpp = 24
 	}
-	if err := binary.Write(w, binary.LittleEndian, h); err != nil {
-		return err
+	if m, ok := m.(rgba64Image); ok {
+		return func(b []byte, y int) {
+			for x := 0; x < bounds.Dx(); x++ {
+				c := m.RGBA64At(bounds.Min.X+x, bounds.Min.Y+y)
+				r, g, bl := unpremultiply(uint32(c.R), uint32(c.G), uint32(c.B), uint32(c.A))
+				b[x*4+0], b[x*4+1], b[x*4+2], b[x*4+3] = uint8(r>>8), uint8(g>>8), uint8(bl>>8), uint8(c.A>>8)
+			}
+		}
 	}
-	if palette != nil {
-		if err := binary.Write(w, binary.LittleEndian, palette); err != nil {
-			return err
+	return func(b []byte, y int) {
+		for x := 0; x < bounds.Dx(); x++ {
+			c := color.NRGBAModel.Convert(m.At(bounds.Min.X+x, bounds.Min.Y+y)).(color.NRGBA)
+			b[x*4+0], b[x*4+1], b[x*4+2], b[x*4+3] = c.R, c.G, c.B, c.A
 		}
 	}
-	if d.X == 0 || d.Y == 0 {
-		return nil
+}
+
+// grayPalettes holds the ramps of evenly spaced grays for 1, 2, 4 and 8 bits per pixel,
+// indexed by the bits per pixel, built once as every gray image uses one.
+var grayPalettes = func() (p [9]color.Palette) {
+	for _, bpp := range []int{1, 2, 4, 8} {
+		p[bpp] = make(color.Palette, 1<<bpp)
+		for i := range p[bpp] {
+			p[bpp][i] = color.Gray{uint8(i * 0xFF / (len(p[bpp]) - 1))}
+		}
 	}
-	switch m := m.(type) {
-	case *image.Gray:
-		return encodePaletted(w, m.Pix, d.X, d.Y, m.Stride, step)
+	return
+}()
+
+// grayPalette returns the ramp of evenly spaced grays used for bpp bits per pixel.
+// The palette is shared and must not be modified.
+func grayPalette(bpp int) color.Palette {
+	return grayPalettes[bpp]
+}
+
+// grayLevels returns the palette of gray images written with bpp bits per pixel:
+// Options.GrayPalette for 8 bits per pixel if set, and grayPalette(bpp) otherwise.
+func (e *encoder) grayLevels(bpp int) color.Palette {
+	if bpp == 8 && e.opts.GrayPalette != nil {
+		return e.opts.GrayPalette
+	}
+	return grayPalette(bpp)
+}
+
+// defaultPalette returns the fixed palette used for bpp bits per pixel.
+func defaultPalette(bpp int) color.Palette {
+	switch bpp {
+	case 1:
+		return color.Palette{color.Gray{0}, color.Gray{0xFF}}
+	case 2:
+		return color.Palette{color.Gray{0}, color.Gray{0x55}, color.Gray{0xAA}, color.Gray{0xFF}}
+	case 4:
+		return color.Palette{
+			color.RGBA{0x00, 0x00, 0x00, 0xFF}, color.RGBA{0x80, 0x00, 0x00, 0xFF},
+			color.RGBA{0x00, 0x80, 0x00, 0xFF}, color.RGBA{0x80, 0x80, 0x00, 0xFF},
+			color.RGBA{0x00, 0x00, 0x80, 0xFF}, color.RGBA{0x80, 0x00, 0x80, 0xFF},
+			color.RGBA{0x00, 0x80, 0x80, 0xFF}, color.RGBA{0xC0, 0xC0, 0xC0, 0xFF},
+			color.RGBA{0x80, 0x80, 0x80, 0xFF}, color.RGBA{0xFF, 0x00, 0x00, 0xFF},
+			color.RGBA{0x00, 0xFF, 0x00, 0xFF}, color.RGBA{0xFF, 0xFF, 0x00, 0xFF},
+			color.RGBA{0x00, 0x00, 0xFF, 0xFF}, color.RGBA{0xFF, 0x00, 0xFF, 0xFF},
+			color.RGBA{0x00, 0xFF, 0xFF, 0xFF}, color.RGBA{0xFF, 0xFF, 0xFF, 0xFF},
+		}
+	}
+	return palette.Plan9
+}
+
+// packRow stores the 1 byte per pixel palette indexes of src in b packed for e.bpp bits per pixel.
+func (e *encoder) packRow(b, src []byte) {
+	if e.bpp == 8 {
+		copy(b, src)
+		return
+	}
+	// Every byte is assembled from scratch, so neither the previous contents of b
+	// nor the bits of out-of-range indexes leak into the pixels or the padding.
+	bpp := uint(e.bpp)
+	mask := uint8(1<<bpp - 1)
+	var c uint8
+	i, n := 0, uint(0)
+	for _, v := range src {
+		c = c<<bpp | v&mask
+		if n += bpp; n == 8 {
+			b[i] = c
+			i++
+			c, n = 0, 0
+		}
+	}
+	if n != 0 {
+		b[i] = c << (8 - n)
+	}
+}
+
+// encodeMapped writes m with e.bpp (<= 8) bits per pixel, mapping its colors to p.
+func (e *encoder) encodeMapped(m image.Image, p color.Palette) {
+	e.setPalette(p)
+	idx := e.alloc(e.dx)
+	if paletted, ok := m.(*image.Paletted); ok {
+		lut := e.alloc(256)
+		for i, c := range paletted.Palette {
+			lut[i] = uint8(p.Index(c))
+		}
+		e.row = func(b []byte, y int) {
+			for x, i := range paletted.Pix[y*paletted.Stride : y*paletted.Stride+e.dx] {
+				idx[x] = lut[i]
+			}
+			e.packRow(b, idx)
+		}
+		return
+	}
+	src := nrgbaRow(m)
+	tmp := e.alloc(e.dx * 4)
+	cache := make(map[color.NRGBA]uint8)
+	index := func(x int) uint8 {
+		c := color.NRGBA{tmp[x*4+0], tmp[x*4+1], tmp[x*4+2], tmp[x*4+3]}
+		i, ok := cache[c]
+		if !ok {
+			i = uint8(p.Index(c))
+			cache[c] = i
+		}
+		return i
+	}
+	e.row = func(b []byte, y int) {
+		src(tmp, y)
+		if uniformRow(tmp, 4) {
+			// Only the first pixel is mapped.
+			if len(idx) > 0 {
+				idx[0] = index(0)
+				fillRow(idx, 1)
+			}
+		} else {
+			for x := range idx {
+				if x > 0 && readUint32(tmp[x*4:]) == readUint32(tmp[x*4-4:]) {
+					// The pixel continues a run.
+					idx[x] = idx[x-1]
+				} else {
+					idx[x] = index(x)
+				}
+			}
+		}
+		e.packRow(b, idx)
+	}
+}
+
+// grayRow returns a function storing the luminance of the row y of m,
+// composited over black, in the e.dx bytes of b.
+func (e *encoder) grayRow(m image.Image) func(b []byte, y int) {
+	src := nrgbaRow(m)
+	tmp := e.alloc(e.dx * 4)
+	return func(gray []byte, y int) {
+		src(tmp, y)
+		for x := range gray[:e.dx] {
+			r, g, b, a := uint32(tmp[x*4+0]), uint32(tmp[x*4+1]), uint32(tmp[x*4+2]), uint32(tmp[x*4+3])
+			Gray8.store(gray, x, uint8(r*a/0xFF), uint8(g*a/0xFF), uint8(b*a/0xFF), 0xFF)
+		}
+	}
+}
+
+// encodeGrayscale writes m with e.bpp (<= 8) bits per pixel,
+// converting it to the nearest gray of grayPalette(e.bpp).
+func (e *encoder) encodeGrayscale(m image.Image) {
+	e.setPalette(e.grayLevels(e.bpp))
+	src := e.grayRow(m)
+	max := 1<<e.bpp - 1
+	idx := e.alloc(e.dx)
+	e.row = func(b []byte, y int) {
+		src(idx, y)
+		if e.bpp < 8 {
+			for x, c := range idx {
+				idx[x] = uint8((int(c)*max + 0x7F) / 0xFF)
+			}
+		}
+		e.packRow(b, idx)
+	}
+}
+
+// encodeBilevel writes m with 1 bit per pixel, converting it to black and white.
+func (e *encoder) encodeBilevel(m image.Image) {
+	e.setPalette(defaultPalette(1))
+	threshold := int(e.opts.Threshold)
+	if threshold == 0 {
+		threshold = 0x80
+	}
+	src := e.grayRow(m)
+	gray := e.alloc(e.dx)
+	idx := e.alloc(e.dx)
+	if !e.opts.Dither {
+		e.row = func(b []byte, y int) {
+			src(gray, y)
+			for x, c := range gray {
+				idx[x] = 0
+				if int(c) >= threshold {
+					idx[x] = 1
+				}
+			}
+			e.packRow(b, idx)
+		}
+		return
+	}
+	// Error diffusion must go from top to bottom, whichever way rows are written,
+	// so the whole image is dithered upfront.
+	// cur and next hold the errors of the current and next rows multiplied by 16,
+	// shifted by 1 pixel.
+	plane := e.alloc(e.dx * e.dy)
+	cur, next := make([]int, e.dx+2), make([]int, e.dx+2)
+	for y := 0; y < e.dy; y++ {
+		src(gray, y)
+		for x, c := range gray {
+			v := int(c) + cur[x+1]/16
+			if v >= threshold {
+				plane[y*e.dx+x] = 1
+				v -= 0xFF
+			}
+			cur[x+2] += v * 7
+			next[x+0] += v * 3
+			next[x+1] += v * 5
+			next[x+2] += v * 1
+		}
+		cur, next = next, cur
+		for i := range next {
+			next[i] = 0
+		}
+	}
+	e.concurrent = true
+	e.row = func(b []byte, y int) {
+		e.packRow(b, plane[y*e.dx:(y+1)*e.dx])
+	}
+}
+
+var (
+	linearOnce  sync.Once
+	linearTable []uint16
+)
+
+// linear returns the table converting 16-bit sRGB channels to linear light
+// in the s2.13 fixed point format.
+func linear() []uint16 {
+	linearOnce.Do(func() {
+		linearTable = make([]uint16, 1<<16)
+		for i := range linearTable {
+			c := float64(i) / 0xFFFF
+			if c <= 0.04045 {
+				c /= 12.92
+			} else {
+				c = math.Pow((c+0.055)/1.055, 2.4)
+			}
+			linearTable[i] = uint16(c*(1<<13) + 0.5)
+		}
+	})
+	return linearTable
+}
+
+// nrgba64At returns a function returning the non-alpha-premultiplied
+// 16-bit color channels of the pixel (x, y) of m, relative to its bounds.
+func nrgba64At(m image.Image) func(x, y int) (r, g, b, a uint32) {
+	bounds := m.Bounds()
+	at := func(x, y int) (r, g, b, a uint32) {
+		r, g, b, a = m.At(bounds.Min.X+x, bounds.Min.Y+y).RGBA()
+		r, g, b = unpremultiply(r, g, b, a)
+		return
+	}
+	if m, ok := m.(rgba64Image); ok {
+		at = func(x, y int) (r, g, b, a uint32) {
+			c := m.RGBA64At(bounds.Min.X+x, bounds.Min.Y+y)
+			r, g, b = unpremultiply(uint32(c.R), uint32(c.G), uint32(c.B), uint32(c.A))
+			return r, g, b, uint32(c.A)
+		}
+	}
+	switch m := m.(type) {
+	case *image.NRGBA64:
+		at = func(x, y int) (r, g, b, a uint32) {
+			s := m.Pix[y*m.Stride+x*8 : y*m.Stride+x*8+8]
+			return uint32(s[0])<<8 | uint32(s[1]), uint32(s[2])<<8 | uint32(s[3]), uint32(s[4])<<8 | uint32(s[5]), uint32(s[6])<<8 | uint32(s[7])
+		}
+	case *image.RGBA64:
+		at = func(x, y int) (r, g, b, a uint32) {
+			s := m.Pix[y*m.Stride+x*8 : y*m.Stride+x*8+8]
+			a = uint32(s[6])<<8 | uint32(s[7])
+			r, g, b = unpremultiply(uint32(s[0])<<8|uint32(s[1]), uint32(s[2])<<8|uint32(s[3]), uint32(s[4])<<8|uint32(s[5]), a)
+			return
+		}
+	}
+	return at
+}
+
+// encodeBGRA64 writes m with 64 bits per pixel.
+func (e *encoder) encodeBGRA64(m image.Image) {
+	lut := linear()
+	at := nrgba64At(m)
+	e.row = func(b []byte, y int) {
+		for x := 0; x < e.dx; x++ {
+			r, g, bl, a := at(x, y)
+			binary.LittleEndian.PutUint16(b[x*8+0:], lut[bl])
+			binary.LittleEndian.PutUint16(b[x*8+2:], lut[g])
+			binary.LittleEndian.PutUint16(b[x*8+4:], lut[r])
+			binary.LittleEndian.PutUint16(b[x*8+6:], uint16((a*(1<<13)+0x7FFF)/0xFFFF))
+		}
+	}
+}
+
+// encodeA2RGB10 writes m with 32 bits per pixel, 10 bits per color channel and 2 bits of alpha.
+func (e *encoder) encodeA2RGB10(m image.Image) {
+	at := nrgba64At(m)
+	e.row = func(b []byte, y int) {
+		for x := 0; x < e.dx; x++ {
+			r, g, bl, a := at(x, y)
+			r, g, bl = (r*0x3FF+0x7FFF)/0xFFFF, (g*0x3FF+0x7FFF)/0xFFFF, (bl*0x3FF+0x7FFF)/0xFFFF
+			a = (a*3 + 0x7FFF) / 0xFFFF
+			binary.LittleEndian.PutUint32(b[x*4:], a<<30|r<<20|g<<10|bl)
+		}
+	}
+}
+
+// encodeFormat writes m with the pixels stored in format f.
+// Unless f has an alpha channel, the pixels are composited over black.
+func (e *encoder) encodeFormat(m image.Image, f PixelFormat) {
+	src := nrgbaRow(m)
+	tmp := e.alloc(e.dx * 4)
+	e.row = func(b []byte, y int) {
+		src(tmp, y)
+		n := e.dx
+		if uniformRow(tmp, 4) {
+			// Only the first pixel is converted.
+			n = 1
+		}
+		for x := 0; x < n; x++ {
+			c := tmp[x*4 : x*4+4]
+			r, g, bl, a := c[0], c[1], c[2], c[3]
+			if (f != BGRA32 || e.opts.Alpha == AlphaPremultiplied) && !e.opts.DropAlpha && a != 0xFF {
+				r = uint8(uint32(r) * uint32(a) / 0xFF)
+				g = uint8(uint32(g) * uint32(a) / 0xFF)
+				bl = uint8(uint32(bl) * uint32(a) / 0xFF)
+			}
+			f.store(b, x, r, g, bl, a)
+		}
+		if n < e.dx {
+			fillRow(b[:e.dx*f.BytesPerPixel()], f.BytesPerPixel())
+		}
+	}
+}
+
+// uniformRow reports whether all the pixels of size bytes in b are the same.
+func uniformRow(b []byte, size int) bool {
+	return len(b) <= size || bytes.Equal(b[size:], b[:len(b)-size])
+}
+
+// fillRow fills b with copies of its first pixel of size bytes.
+func fillRow(b []byte, size int) {
+	for n := size; n < len(b); n *= 2 {
+		copy(b[n:], b[:n])
+	}
+}
+
+// encodeDithered16 writes m with 16 bits per pixel in the format f,
+// dithering its channels with Floyd-Steinberg error diffusion.
+func (e *encoder) encodeDithered16(m image.Image, f PixelFormat) {
+	max := [3]int{31, 31, 31}
+	if f == RGB565 {
+		max[1] = 63
+	}
+	src := nrgbaRow(m)
+	tmp := e.alloc(e.dx * 4)
+	// As in encodeBilevel, the whole image is dithered upfront.
+	// cur and next hold the red, green and blue errors of the current and next rows
+	// multiplied by 16, shifted by 1 pixel.
+	n := f.Stride(e.dx)
+	plane := e.alloc(n * e.dy)
+	cur, next := make([]int, (e.dx+2)*3), make([]int, (e.dx+2)*3)
+	for y := 0; y < e.dy; y++ {
+		src(tmp, y)
+		for x := 0; x < e.dx; x++ {
+			a := int(tmp[x*4+3])
+			var c [3]uint8
+			for i := range c {
+				v := int(tmp[x*4+i])*a/0xFF + cur[(x+1)*3+i]/16
+				q := 0
+				if v > 0 {
+					if q = (v*max[i] + 0x7F) / 0xFF; q > max[i] {
+						q = max[i]
+					}
+				}
+				// store rounds the level back to q.
+				c[i] = uint8(q * 0xFF / max[i])
+				v -= int(c[i])
+				cur[(x+2)*3+i] += v * 7
+				next[x*3+i] += v * 3
+				next[(x+1)*3+i] += v * 5
+				next[(x+2)*3+i] += v * 1
+			}
+			f.store(plane[y*n:], x, c[0], c[1], c[2], 0xFF)
+		}
+		cur, next = next, cur
+		for i := range next {
+			next[i] = 0
+		}
+	}
+	e.concurrent = true
+	e.row = func(b []byte, y int) {
+		copy(b, plane[y*n:(y+1)*n])
+	}
+}
+
+// Encode writes the image m to w in BMP format.
+func Encode(w io.Writer, m image.Image) error {
+	return EncodeWithOptions(w, m, nil)
+}
+
+// EncodeWithOptions writes the image m to w in BMP format with the given options.
+// The output only depends on the pixels of m and the options: the same image
+// is always encoded to the same bytes, with the padding of the rows zeroed.
+func EncodeWithOptions(w io.Writer, m image.Image, opts *Options) error {
+	d := m.Bounds().Size()
+	if d.X < 0 || d.Y < 0 {
+		return FormatError("negative bounds")
+	}
+	e, err := newEncoder(w, d.X, d.Y, opts)
+	if err != nil {
+		return err
+	}
+	defer e.release()
+	e.lazyOpacity = true
+	if err := e.prepare(m); err != nil {
+		return err
+	}
+	return e.writeAll()
+}
+
+// EncodedSize returns the size of m encoded by EncodeWithOptions with the given
+// options, without encoding it. The size is exact unless the pixels are compressed
+// with CompressionRLE4, in which case it is an upper bound.
+func EncodedSize(m image.Image, opts *Options) (int64, error) {
+	d := m.Bounds().Size()
+	if d.X < 0 || d.Y < 0 {
+		return 0, FormatError("negative bounds")
+	}
+	e, err := newEncoder(ioutil.Discard, d.X, d.Y, opts)
+	if err != nil {
+		return 0, err
+	}
+	defer e.release()
+	if err := e.prepare(m); err != nil {
+		return 0, err
+	}
+	n := int64(e.headerLen()) + int64(len(e.opts.ICCProfile))
+	switch {
+	case e.data != nil:
+		// CompressionAuto has already compressed the pixels.
+		n += int64(len(e.data))
+	case e.opts.Compression == CompressionRLE4:
+		// Every 3 pixels take at most 4 bytes, and every row ends with a 2-byte code.
+		n += int64(e.dy) * (int64(e.dx+2)/3*4 + 2)
+		if e.dy == 0 {
+			n += 2
+		}
+	default:
+		n += int64(e.dy) * int64(e.step)
+	}
+	return n, nil
+}
+
+// newEncoder returns an encoder writing a dx x dy image to w
+// with the validated and normalized opts.
+func newEncoder(w io.Writer, dx, dy int, opts *Options) (*encoder, error) {
+	if dx > math.MaxInt32 || dy > math.MaxInt32 {
+		return nil, ErrTooLarge
+	}
+	e := &encoder{w: w, dx: dx, dy: dy}
+	if opts != nil {
+		e.opts = *opts
+	}
+	switch e.opts.BitsPerPixel {
+	case 0, 1, 2, 4, 8, 16, 24, 32, 64:
+	default:
+		return nil, UnsupportedError("bit depth " + strconv.Itoa(e.opts.BitsPerPixel))
+	}
+	switch e.opts.MinBitsPerPixel {
+	case 0, 2, 4, 8:
+	default:
+		return nil, UnsupportedError("minimum bit depth " + strconv.Itoa(e.opts.MinBitsPerPixel))
+	}
+	switch e.opts.Compression {
+	case CompressionNone, CompressionAuto:
+	case CompressionRLE4:
+		if e.opts.BitsPerPixel != 0 && e.opts.BitsPerPixel != 4 {
+			return nil, UnsupportedError("RLE4 compression with bit depth " + strconv.Itoa(e.opts.BitsPerPixel))
+		}
+		e.opts.BitsPerPixel = 4
+	default:
+		return nil, UnsupportedError("compression method")
+	}
+	if e.opts.Alpha < AlphaStraight || e.opts.Alpha > AlphaOpaqueOnly {
+		return nil, UnsupportedError("alpha mode")
+	}
+	if e.opts.Opaque < OpacityUnknown || e.opts.Opaque > OpacityTranslucent {
+		return nil, UnsupportedError("opacity")
+	}
+	if e.opts.Header < HeaderOS2 || e.opts.Header > HeaderV5 {
+		return nil, UnsupportedError("DIB header version")
+	}
+	if e.opts.Halftone != HalftoneNone {
+		switch {
+		case e.opts.Halftone < HalftoneNone || e.opts.Halftone > HalftoneSuperCircle:
+			return nil, UnsupportedError("halftoning algorithm")
+		case e.opts.Header == HeaderInfo:
+			e.opts.Header = HeaderOS2
+		case e.opts.Header != HeaderOS2:
+			return nil, UnsupportedError("halftoning without BITMAPINFOHEADER2")
+		}
+	}
+	if e.opts.ICCProfileLink != "" {
+		if len(e.opts.ICCProfile) > 0 {
+			return nil, UnsupportedError("embedded and linked profiles")
+		}
+		b, ok := profileLink(e.opts.ICCProfileLink)
+		if !ok {
+			return nil, UnsupportedError("profile path " + strconv.Quote(e.opts.ICCProfileLink))
+		}
+		// The path is written in place of an embedded profile.
+		e.opts.ICCProfile = b
+	}
+	if e.opts.Header == HeaderOS2 {
+		switch {
+		case e.opts.TopDown:
+			return nil, UnsupportedError("top-down image with BITMAPINFOHEADER2")
+		case len(e.opts.ICCProfile) > 0 || e.opts.A2RGB10 || e.opts.RGB565:
+			return nil, UnsupportedError("color masks or profile with BITMAPINFOHEADER2")
+		}
+	}
+	if e.opts.Header == HeaderCore {
+		switch {
+		case dx > 0xFFFF || dy > 0xFFFF:
+			return nil, UnsupportedError("dimension with BITMAPCOREHEADER")
+		case e.opts.TopDown:
+			return nil, UnsupportedError("top-down image with BITMAPCOREHEADER")
+		case e.opts.Compression == CompressionRLE4:
+			return nil, UnsupportedError("compression method with BITMAPCOREHEADER")
+		case len(e.opts.ICCProfile) > 0 || e.opts.A2RGB10 || e.opts.RGB565:
+			return nil, UnsupportedError("color masks or profile with BITMAPCOREHEADER")
+		}
+		e.opts.Compression = CompressionNone
+		e.opts.PadPalette = true
+	}
+	if len(e.opts.ICCProfile) > 0 {
+		e.opts.Header = HeaderV5
+	}
+	if e.opts.Intent != IntentPerceptual {
+		switch {
+		case e.opts.Intent < IntentPerceptual || e.opts.Intent > IntentAbsoluteColorimetric:
+			return nil, UnsupportedError("rendering intent")
+		case e.opts.Header < HeaderInfo:
+			return nil, UnsupportedError("rendering intent with OS/2 header")
+		}
+		e.opts.Header = HeaderV5
+	}
+	if e.opts.Calibration != nil {
+		switch {
+		case len(e.opts.ICCProfile) > 0:
+			return nil, UnsupportedError("calibration with profile")
+		case e.opts.Header < HeaderInfo:
+			return nil, UnsupportedError("calibration with OS/2 header")
+		case !e.opts.Calibration.valid():
+			return nil, FormatError("bad calibration")
+		}
+		if e.opts.Header < HeaderV4 {
+			e.opts.Header = HeaderV4
+		}
+	}
+	if e.opts.Bilevel {
+		if e.opts.BitsPerPixel != 0 && e.opts.BitsPerPixel != 1 {
+			return nil, UnsupportedError("bilevel image with bit depth " + strconv.Itoa(e.opts.BitsPerPixel))
+		}
+		e.opts.BitsPerPixel = 1
+	}
+	if e.opts.A2RGB10 {
+		if e.opts.BitsPerPixel != 0 && e.opts.BitsPerPixel != 32 {
+			return nil, UnsupportedError("A2R10G10B10 with bit depth " + strconv.Itoa(e.opts.BitsPerPixel))
+		}
+		e.opts.BitsPerPixel = 32
+		if e.opts.Header < HeaderV4 {
+			e.opts.Header = HeaderV4
+		}
+	}
+	if e.opts.DropAlpha {
+		if e.opts.BitsPerPixel != 0 && e.opts.BitsPerPixel != 24 {
+			return nil, UnsupportedError("dropped alpha with bit depth " + strconv.Itoa(e.opts.BitsPerPixel))
+		}
+		e.opts.BitsPerPixel = 24
+	}
+	if e.opts.Grayscale && !e.opts.Bilevel {
+		switch e.opts.BitsPerPixel {
+		case 0:
+			e.opts.BitsPerPixel = 8
+		case 1, 2, 4, 8:
+		default:
+			return nil, UnsupportedError("grayscale image with bit depth " + strconv.Itoa(e.opts.BitsPerPixel))
+		}
+	}
+	if e.opts.RGB565 {
+		if e.opts.BitsPerPixel != 0 && e.opts.BitsPerPixel != 16 {
+			return nil, UnsupportedError("RGB565 with bit depth " + strconv.Itoa(e.opts.BitsPerPixel))
+		}
+		e.opts.BitsPerPixel = 16
+	}
+	if e.opts.Compression == CompressionRLE4 && e.opts.TopDown {
+		return nil, UnsupportedError("top-down compressed image")
+	}
+	if e.opts.Header < HeaderInfo {
+		switch e.opts.BitsPerPixel {
+		case 0, 1, 4, 8, 24:
+		default:
+			return nil, UnsupportedError("bit depth " + strconv.Itoa(e.opts.BitsPerPixel) + " with OS/2 header")
+		}
+	}
+	if e.opts.GrayPalette != nil && len(e.opts.GrayPalette) != 256 {
+		return nil, FormatError("bad gray palette length: " + strconv.Itoa(len(e.opts.GrayPalette)))
+	}
+	if e.opts.Quantizer != nil && e.opts.BitsPerPixel > 8 {
+		return nil, UnsupportedError("quantized image with bit depth " + strconv.Itoa(e.opts.BitsPerPixel))
+	}
+	return e, nil
+}
+
+// prepare plans the output format for m and validates the options depending on it.
+func (e *encoder) prepare(m image.Image) error {
+	if err := e.plan(m); err != nil {
+		return err
+	}
+	if e.opts.Header < HeaderInfo && e.opts.BitsPerPixel == 0 && (e.bpp == 2 || e.bpp > 24) {
+		// Replan with the nearest bit depth the OS/2 headers support.
+		e.opts.BitsPerPixel = 24
+		if e.bpp == 2 {
+			e.opts.BitsPerPixel = 4
+		}
+		if err := e.plan(m); err != nil {
+			return err
+		}
+	}
+	if e.opts.Compression == CompressionAuto {
+		e.chooseCompression(m)
+	}
+	if e.opts.ImportantColors < 0 || e.opts.ImportantColors > len(e.palette)/4 {
+		return FormatError("bad important color count: " + strconv.Itoa(e.opts.ImportantColors))
+	}
+	return e.layout()
+}
+
+// layout sets the size of the rows for the planned bit depth and checks the file size.
+func (e *encoder) layout() error {
+	e.step = ((e.dx*e.bpp + 31) / 32) * 4
+	if e.opts.Compression != CompressionRLE4 && e.fileSize() > math.MaxUint32 && (!e.opts.LargeFile || len(e.opts.ICCProfile) > 0) {
+		return ErrTooLarge
+	}
+	return nil
+}
+
+// fileSize returns the size of the file with uncompressed pixels.
+func (e *encoder) fileSize() int64 {
+	return int64(e.headerLen()) + int64(e.dy)*int64(e.step) + int64(len(e.opts.ICCProfile))
+}
+
+// rawImage is an image backed by pixels stored in a PixelFormat other than Paletted8.
+type rawImage struct {
+	pix    []byte
+	stride int
+	format PixelFormat
+	rect   image.Rectangle
+}
+
+func (m *rawImage) ColorModel() color.Model { return color.NRGBAModel }
+
+func (m *rawImage) Bounds() image.Rectangle { return m.rect }
+
+// Opaque scans the entire image and reports whether it is fully opaque.
+func (m *rawImage) Opaque() bool {
+	if m.format != BGRA32 && m.format != RGBA32 {
+		return true
+	}
+	n := m.format.Stride(m.rect.Dx())
+	for y := 0; y < m.rect.Dy(); y++ {
+		if !opaqueRow(m.pix[y*m.stride : y*m.stride+n]) {
+			return false
+		}
+	}
+	return true
+}
+
+// opaqueRow reports whether the BGRA32 or RGBA32 pixels in b are fully opaque.
+func opaqueRow(b []byte) bool {
+	for i := 3; i < len(b); i += 4 {
+		if b[i] != 0xFF {
+			return false
+		}
+	}
+	return true
+}
+
+func (m *rawImage) At(x, y int) color.Color {
+	if !(image.Point{x, y}.In(m.rect)) {
+		return color.NRGBA{}
+	}
+	r, g, b, a := m.format.load(m.pix[(y-m.rect.Min.Y)*m.stride:], x-m.rect.Min.X, nil)
+	return color.NRGBA{r, g, b, a}
+}
+
+// EncodeRaw writes the width x height pixels stored in pix in format f,
+// with stride bytes between vertically adjacent pixels, to w in BMP format,
+// without requiring an image.Image.
+// Unless opts requests otherwise, the pixels are written in their own format:
+// BGR24 with 24 bits per pixel, BGRA32 and RGBA32 with 32, Gray8 with 8,
+// and RGB555 and RGB565 with 16.
+// Paletted8 pixels are not supported since they have no palette.
+func EncodeRaw(w io.Writer, width, height, stride int, f PixelFormat, pix []byte, opts *Options) error {
+	if !f.valid() || f == Paletted8 {
+		return UnsupportedError("pixel format " + f.String())
+	}
+	if width < 0 || height < 0 {
+		return FormatError("negative bounds")
+	}
+	if width > 0 && height > 0 {
+		if n := f.Stride(width); stride < n || len(pix) < stride*(height-1)+n {
+			return errors.New("bmp: pixel buffer too small")
+		}
+	}
+	m, opts := newRawImage(pix, stride, f, image.Rect(0, 0, width, height), opts)
+	return EncodeWithOptions(w, m, opts)
+}
+
+// newRawImage returns an image backed by the pixels stored in pix in format f,
+// and the options to write it with based on opts.
+func newRawImage(pix []byte, stride int, f PixelFormat, r image.Rectangle, opts *Options) (image.Image, *Options) {
+	switch f {
+	case Gray8:
+		return &image.Gray{Pix: pix, Stride: stride, Rect: r}, opts
+	case RGB565:
+		var o Options
+		if opts != nil {
+			o = *opts
+		}
+		if o.BitsPerPixel == 0 || o.BitsPerPixel == 16 {
+			o.RGB565 = true
+		}
+		opts = &o
+	}
+	return &rawImage{pix: pix, stride: stride, format: f, rect: r}, opts
+}
+
+// plan chooses the output format for m and sets e.row accordingly.
+// The fast paths index Pix relative to Bounds().Min, which is where Pix
+// of the image types (including their SubImages) starts: row y is at y*Stride.
+func (e *encoder) plan(m image.Image) error {
+	e.concurrent = false
+	e.assumed = nil
+	if e.opts.Alpha == AlphaOpaqueOnly && !e.isOpaque(m) {
+		return FormatError("non-opaque image")
+	}
+	bpp := e.opts.BitsPerPixel
+	switch {
+	case e.opts.Bilevel:
+		e.bpp = 1
+		e.encodeBilevel(m)
+		return nil
+	case e.opts.A2RGB10:
+		e.bpp = 32
+		e.encodeA2RGB10(m)
+		return nil
+	}
+	if e.opts.Grayscale && !isGray(m) {
+		if !e.opts.Dither || bpp == 8 {
+			e.bpp = bpp
+			e.encodeGrayscale(m)
+			return nil
+		}
+		// The grays are dithered below.
+		g := image.NewGray(image.Rect(0, 0, e.dx, e.dy))
+		src := e.grayRow(m)
+		for y := 0; y < e.dy; y++ {
+			src(g.Pix[y*g.Stride:], y)
+		}
+		m = g
+	}
+	if p, ok := m.(*image.Paletted); !(ok && (bpp == 0 || len(p.Palette) <= 1<<bpp)) &&
+		((e.opts.Quantizer != nil && !e.opts.Grayscale) || ((e.opts.Drawer != nil || e.opts.Dither) && bpp != 0 && bpp <= 8 && !(bpp == 8 && isGray(m)))) {
+		var err error
+		if m, err = e.palettize(m, bpp); err != nil {
+			return err
+		}
+	}
+	switch m := m.(type) {
+	case *rawImage:
+		if bpp == 0 {
+			bpp = m.format.BytesPerPixel() * 8
+		}
+		if e.planRaw(m, bpp) {
+			return nil
+		}
+	case *image.Gray:
+		if e.planGray(m.Pix, m.Stride) {
+			return nil
+		}
+	case *image.Alpha:
+		// Masks are written as gray with the alpha as the luminance.
+		if e.planGray(m.Pix, m.Stride) {
+			return nil
+		}
+	case *image.Gray16:
+		if e.planGray16(m.Pix, m.Stride) {
+			return nil
+		}
+	case *image.Alpha16:
+		if e.planGray16(m.Pix, m.Stride) {
+			return nil
+		}
 	case *image.Paletted:
-		if h.bpp < 8 {
-			return encodeSmallPaletted(w, m.Pix, int(h.bpp), d.X, d.Y, m.Stride, step)
+		if len(m.Palette) > 256 && e.opts.ExpandPalette {
+			if bpp == 0 {
+				bpp = 24
+				if !e.isOpaque(m) {
+					bpp = 32
+				}
+			}
+			// The pixels are converted below.
+			break
+		}
+		if len(m.Palette) == 0 || len(m.Palette) > 256 {
+			return FormatError("bad palette length: " + strconv.Itoa(len(m.Palette)))
+		}
+		switch {
+		case len(m.Palette) <= 2:
+			e.bpp = 1
+		case len(m.Palette) <= 4:
+			e.bpp = 2
+		case len(m.Palette) <= 16:
+			e.bpp = 4
+		default:
+			e.bpp = 8
+		}
+		if bpp == 0 && e.opts.PalettedAlpha && e.opts.Header >= HeaderInfo && !opaquePalette(m.Palette) {
+			// The alpha mask is only stored by BITMAPV4HEADER and later.
+			if e.opts.Header < HeaderV4 {
+				e.opts.Header = HeaderV4
+			}
+			e.bpp = 32
+			e.encodeFormat(m, BGRA32)
+			return nil
+		}
+		if bpp == 0 && e.bpp < e.opts.MinBitsPerPixel {
+			e.bpp = e.opts.MinBitsPerPixel
+		}
+		if bpp == 0 || (bpp >= e.bpp && bpp <= 8) {
+			if bpp != 0 {
+				e.bpp = bpp
+			}
+			e.setPalette(m.Palette)
+			if e.bpp < 8 {
+				e.encodeSmallPaletted(m.Pix, m.Stride)
+			} else {
+				e.encodePaletted(m.Pix, m.Stride)
+			}
+			return nil
 		}
-		return encodePaletted(w, m.Pix, d.X, d.Y, m.Stride, step)
 	case *image.RGBA:
-		return encodeRGBA(w, m.Pix, d.X, d.Y, m.Stride, step, opaque)
+		if bpp == 0 && e.assumeOpaque(m) {
+			e.encodeAssumedOpaque(m.Pix, m.Stride)
+			return nil
+		}
+		if bpp == 0 || (bpp == 24 && (!e.opts.DropAlpha || e.isOpaque(m))) || bpp == 32 {
+			opaque := bpp == 24 || (bpp == 0 && e.isOpaque(m))
+			if opaque {
+				e.bpp = 24
+			} else {
+				e.bpp = 32
+			}
+			e.encodeRGBA(m.Pix, m.Stride, opaque)
+			return nil
+		}
 	case *image.NRGBA:
-		return encodeNRGBA(w, m.Pix, d.X, d.Y, m.Stride, step, opaque)
+		if bpp == 0 && e.assumeOpaque(m) {
+			e.encodeAssumedOpaque(m.Pix, m.Stride)
+			return nil
+		}
+		if bpp == 0 || bpp == 32 || (bpp == 24 && (e.isOpaque(m) || e.opts.DropAlpha)) {
+			opaque := bpp == 24 || (bpp == 0 && e.isOpaque(m))
+			if opaque {
+				e.bpp = 24
+			} else {
+				e.bpp = 32
+			}
+			e.encodeNRGBA(m.Pix, m.Stride, opaque)
+			return nil
+		}
+	case *image.CMYK:
+		if bpp == 0 || bpp == 24 {
+			e.bpp = 24
+			e.encodeCMYK(m.Pix, m.Stride)
+			return nil
+		}
+	case *image.YCbCr:
+		if bpp == 0 || bpp == 24 {
+			e.bpp = 24
+			e.encodeYCbCr(m)
+			return nil
+		}
+	default:
+		if bpp == 0 || (bpp == 24 && !e.opts.DropAlpha) {
+			e.bpp = 24
+			e.encode(m)
+			return nil
+		}
+	}
+	e.bpp = bpp
+	switch bpp {
+	case 16:
+		f := RGB555
+		if e.opts.RGB565 {
+			f = RGB565
+		}
+		if e.opts.Dither {
+			e.encodeDithered16(m, f)
+		} else {
+			e.encodeFormat(m, f)
+		}
+	case 24:
+		e.encodeFormat(m, BGR24)
+	case 32:
+		e.encodeFormat(m, BGRA32)
+	case 64:
+		e.encodeBGRA64(m)
+	default:
+		e.encodeMapped(m, defaultPalette(bpp))
+	}
+	return nil
+}
+
+// assumeOpaque reports whether plan may encode m as opaque without scanning it,
+// and records m as assumed to be opaque if so. The OS/2 headers and the automatic
+// compression depend on the bit depth chosen before the pixels are converted.
+func (e *encoder) assumeOpaque(m image.Image) bool {
+	if !e.lazyOpacity || e.opts.Opaque != OpacityUnknown || e.opts.Header < HeaderInfo || e.opts.Compression == CompressionAuto {
+		return false
+	}
+	e.assumed = m
+	e.translucent = 0
+	return true
+}
+
+// isOpaque reports whether all the pixels of m are fully opaque,
+// as asserted by Options.Opaque or found by scanning m otherwise.
+func (e *encoder) isOpaque(m image.Image) bool {
+	switch e.opts.Opaque {
+	case OpacityOpaque:
+		return true
+	case OpacityTranslucent:
+		return false
+	}
+	return opaque(m)
+}
+
+// opaque reports whether all the pixels of m are fully opaque.
+func opaque(m image.Image) bool {
+	if p, ok := m.(*image.Paletted); ok && len(p.Palette) > 256 {
+		// Paletted.Opaque panics, and the pixels can only use the first 256 colors.
+		return opaquePalette(p.Palette[:256])
+	}
+	if o, ok := m.(interface{ Opaque() bool }); ok {
+		return o.Opaque()
+	}
+	bounds := m.Bounds()
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			if _, _, _, a := m.At(x, y).RGBA(); a != 0xffff {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// opaquePalette reports whether all the colors of p are fully opaque.
+func opaquePalette(p color.Palette) bool {
+	for _, c := range p {
+		if _, _, _, a := c.RGBA(); a != 0xffff {
+			return false
+		}
+	}
+	return true
+}
+
+// isGray reports whether m is written with the ramp of evenly spaced grays.
+func isGray(m image.Image) bool {
+	switch m.(type) {
+	case *image.Gray, *image.Alpha, *image.Gray16, *image.Alpha16:
+		return true
+	}
+	return false
+}
+
+// palettize returns m converted by e.opts.Drawer to the palette built by e.opts.Quantizer,
+// or to the fixed or gray palette for bpp bits per pixel if there is no quantizer.
+func (e *encoder) palettize(m image.Image, bpp int) (*image.Paletted, error) {
+	var p color.Palette
+	if e.opts.Quantizer != nil {
+		n := 256
+		if bpp != 0 {
+			n = 1 << bpp
+		}
+		p = e.opts.Quantizer.Quantize(make(color.Palette, 0, n), m)
+		if len(p) == 0 || len(p) > n {
+			return nil, FormatError("bad palette length: " + strconv.Itoa(len(p)))
+		}
+	} else {
+		if isGray(m) {
+			p = grayPalette(bpp)
+		} else {
+			p = defaultPalette(bpp)
+		}
+	}
+	pm := image.NewPaletted(image.Rect(0, 0, e.dx, e.dy), p)
+	drawer := e.opts.Drawer
+	if drawer == nil {
+		drawer = draw.Src
+		if e.opts.Dither {
+			drawer = draw.FloydSteinberg
+		}
+	}
+	drawer.Draw(pm, pm.Rect, m, m.Bounds().Min)
+	return pm, nil
+}
+
+// chooseCompression replans e to store the pixels of m with RLE4
+// if this makes the output smaller.
+func (e *encoder) chooseCompression(m image.Image) {
+	e.opts.Compression = CompressionNone
+	if e.opts.TopDown || e.bpp > 4 || (e.opts.BitsPerPixel != 0 && e.opts.BitsPerPixel != 4) || e.opts.MinBitsPerPixel > 4 {
+		return
+	}
+	// The buffers of the trial are released unless it is kept.
+	mark := e.mark()
+	rle := *e
+	rle.opts.Compression, rle.opts.BitsPerPixel = CompressionRLE4, 4
+	if e.bpp != 4 {
+		if err := rle.plan(m); err != nil {
+			rle.releaseTo(mark)
+			return
+		}
+	}
+	rle.step = ((rle.dx*rle.bpp + 31) / 32) * 4
+	rle.data = rle.compress()
+	if len(rle.palette)+len(rle.data) < len(e.palette)+e.dy*((e.dx*e.bpp+31)/32)*4 {
+		*e = rle
+		return
+	}
+	rle.releaseTo(mark)
+}
+
+// compress returns the RLE4-compressed pixels.
+func (e *encoder) compress() []byte {
+	var data []byte
+	if e.dy == 0 {
+		return e.compressRow(data, nil, -1)
+	}
+	b := e.alloc(e.step)
+	y0, y1, yDelta := e.rows()
+	for y := y0; y != y1; y += yDelta {
+		data = e.compressRow(data, b, y)
+	}
+	return data
+}
+
+// compressRow stores the row y in b and appends its RLE4 encoding to data,
+// followed by the end of line code, or the end of bitmap code for the last row.
+// If y is -1, only the end of bitmap code is appended.
+func (e *encoder) compressRow(data, b []byte, y int) []byte {
+	if y == -1 {
+		return append(data, 0, 1)
+	}
+	e.row(b, y)
+	data = appendRLE4(data, b, e.dx)
+	if _, y1, yDelta := e.rows(); y+yDelta != y1 {
+		return append(data, 0, 0)
+	}
+	return append(data, 0, 1)
+}
+
+// writeCompressed compresses and writes the pixels without buffering them,
+// then patches the sizes in the header.
+func (e *encoder) writeCompressed() error {
+	var n int64
+	var data []byte
+	if e.dy == 0 {
+		data = e.compressRow(data, nil, -1)
+		if _, err := e.w.Write(data); err != nil {
+			return err
+		}
+		return e.patchSizes(int64(len(data)))
+	}
+	b := e.alloc(e.step)
+	y0, y1, yDelta := e.rows()
+	written, flushed := 0, 0
+	flush := func() error {
+		if _, err := e.w.Write(data); err != nil {
+			return err
+		}
+		n += int64(len(data))
+		data = data[:0]
+		for ; flushed < written; flushed++ {
+			e.progress(flushed + 1)
+		}
+		return nil
+	}
+	for y := y0; y != y1; y += yDelta {
+		data = e.compressRow(data, b, y)
+		written++
+		if len(data) >= e.chunkSize() || y+yDelta == y1 {
+			if err := flush(); err != nil {
+				return err
+			}
+		}
+	}
+	return e.patchSizes(n)
+}
+
+// patchSizes rewrites the sizes in the header written by writeHeader
+// for n bytes of compressed pixels, and seeks back to the end of the pixels.
+// e.w must be an io.WriteSeeker.
+func (e *encoder) patchSizes(n int64) error {
+	if int64(e.pixOffset)+n+int64(len(e.opts.ICCProfile)) > math.MaxUint32 {
+		return ErrTooLarge
+	}
+	size := uint32(n)
+	ws := e.w.(io.WriteSeeker)
+	end, err := ws.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return err
+	}
+	patch := func(offset int64, v uint32) error {
+		if _, err := ws.Seek(e.start+offset, io.SeekStart); err != nil {
+			return err
+		}
+		var b [4]byte
+		binary.LittleEndian.PutUint32(b[:], v)
+		_, err := ws.Write(b[:])
+		return err
+	}
+	// bfSize.
+	if err := patch(2, e.pixOffset+size+uint32(len(e.opts.ICCProfile))); err != nil {
+		return err
+	}
+	// biSizeImage.
+	if err := patch(fileHeaderLen+20, size); err != nil {
+		return err
+	}
+	if len(e.opts.ICCProfile) > 0 {
+		// bV5ProfileData.
+		if err := patch(fileHeaderLen+112, e.pixOffset-fileHeaderLen+size); err != nil {
+			return err
+		}
+	}
+	_, err = ws.Seek(end, io.SeekStart)
+	return err
+}
+
+// errTranslucent reports that the image assumed to be opaque is not.
+var errTranslucent = errors.New("bmp: translucent image")
+
+// writeAll writes the headers, the color table, the pixels and the trailing data.
+func (e *encoder) writeAll() error {
+	if e.assumed != nil {
+		return e.writeAssumed()
+	}
+	if _, ok := e.w.(io.WriteSeeker); e.opts.Compression == CompressionRLE4 && e.data == nil && !ok {
+		e.data = e.compress()
+	}
+	if err := e.writeHeader(); err != nil {
+		return err
+	}
+	if e.data != nil {
+		if _, err := e.w.Write(e.data); err != nil {
+			return err
+		}
+		e.progress(e.dy)
+	} else if e.opts.Compression == CompressionRLE4 {
+		// The sizes are only known once the pixels are written.
+		if err := e.writeCompressed(); err != nil {
+			return err
+		}
+	} else if e.dx != 0 && e.dy != 0 && e.opts.Workers > 1 && e.concurrent {
+		if err := e.writeRowsParallel(); err != nil {
+			return err
+		}
+	} else if e.dx != 0 && e.dy != 0 {
+		n := e.chunkRows()
+		buf := e.alloc(n * e.step)
+		y0, _, yDelta := e.rows()
+		for i := 0; i < e.dy; i += n {
+			rows := e.dy - i
+			if rows > n {
+				rows = n
+			}
+			for r := 0; r < rows; r++ {
+				e.row(buf[r*e.step:(r+1)*e.step], y0+(i+r)*yDelta)
+			}
+			if atomic.LoadUint32(&e.translucent) != 0 {
+				return errTranslucent
+			}
+			if _, err := e.w.Write(buf[:rows*e.step]); err != nil {
+				return err
+			}
+			for r := 1; r <= rows; r++ {
+				e.progress(i + r)
+			}
+		}
+	} else {
+		e.progress(e.dy)
+	}
+	return e.writeTrailer()
+}
+
+// writeAssumed writes e.assumed, checking that it is opaque as its rows are converted.
+// If the rows fit in a chunk, they are all converted before the headers are written.
+// Otherwise, if e.w is seekable, they are written as they are converted and rewritten
+// from the start with 32 bits per pixel once a translucent chunk is found,
+// in which case Options.Progress starts over. If e.w is not seekable,
+// the image is scanned before it is written.
+func (e *encoder) writeAssumed() error {
+	m := e.assumed
+	e.assumed = nil
+	if e.dx == 0 || e.dy == 0 {
+		return e.writeAll()
+	}
+	if n := e.chunkRows(); n == e.dy {
+		buf := e.alloc(e.dy * e.step)
+		y0, _, yDelta := e.rows()
+		for i := 0; i < e.dy; i++ {
+			e.row(buf[i*e.step:(i+1)*e.step], y0+i*yDelta)
+		}
+		if e.translucent == 0 {
+			if err := e.writeHeader(); err != nil {
+				return err
+			}
+			if _, err := e.w.Write(buf); err != nil {
+				return err
+			}
+			for r := 1; r <= e.dy; r++ {
+				e.progress(r)
+			}
+			return e.writeTrailer()
+		}
+	} else if w, ok := e.w.(io.WriteSeeker); ok {
+		start, err := w.Seek(0, io.SeekCurrent)
+		if err != nil {
+			return err
+		}
+		if err := e.writeAll(); err != errTranslucent {
+			return err
+		}
+		if _, err := w.Seek(start, io.SeekStart); err != nil {
+			return err
+		}
+	} else if opaque(m) {
+		return e.writeAll()
+	}
+	e.assumed = m
+	if err := e.planTranslucent(); err != nil {
+		return err
+	}
+	return e.writeAll()
+}
+
+// defaultChunkSize is the default value of Options.ChunkSize.
+const defaultChunkSize = 256 << 10
+
+// chunkSize returns the number of bytes of pixels to accumulate before writing them.
+func (e *encoder) chunkSize() int {
+	if e.opts.ChunkSize > 0 {
+		return e.opts.ChunkSize
+	}
+	return defaultChunkSize
+}
+
+// chunkRows returns the number of uncompressed rows written at a time.
+func (e *encoder) chunkRows() int {
+	n := e.chunkSize() / e.step
+	if n < 1 {
+		n = 1
+	}
+	if n > e.dy {
+		n = e.dy
+	}
+	return n
+}
+
+// writeRowsParallel writes the rows converted by Options.Workers goroutines
+// in chunks of consecutive rows. e.row must be safe for concurrent use.
+func (e *encoder) writeRowsParallel() error {
+	const rowsPerWorker = 16
+	workers := e.opts.Workers
+	n := e.chunkRows()
+	if n < workers*rowsPerWorker {
+		n = workers * rowsPerWorker
+	}
+	if n > e.dy {
+		n = e.dy
+	}
+	buf := e.alloc(n * e.step)
+	y0, _, yDelta := e.rows()
+	var wg sync.WaitGroup
+	for i := 0; i < e.dy; i += n {
+		rows := e.dy - i
+		if rows > n {
+			rows = n
+		}
+		per := (rows + workers - 1) / workers
+		for j := 0; j < rows; j += per {
+			k := j + per
+			if k > rows {
+				k = rows
+			}
+			wg.Add(1)
+			go func(i, j, k int) {
+				defer wg.Done()
+				for r := j; r < k; r++ {
+					e.row(buf[r*e.step:(r+1)*e.step], y0+(i+r)*yDelta)
+				}
+			}(i, j, k)
+		}
+		wg.Wait()
+		if atomic.LoadUint32(&e.translucent) != 0 {
+			return errTranslucent
+		}
+		if _, err := e.w.Write(buf[:rows*e.step]); err != nil {
+			return err
+		}
+		for r := 1; r <= rows; r++ {
+			e.progress(i + r)
+		}
+	}
+	return nil
+}
+
+// progress calls Options.Progress if the written rows are a multiple
+// of Options.ProgressRows or all the rows.
+func (e *encoder) progress(written int) {
+	if e.opts.Progress == nil || written == 0 {
+		return
+	}
+	if n := e.opts.ProgressRows; n <= 1 || written%n == 0 || written == e.dy {
+		e.opts.Progress(written, e.dy)
+	}
+}
+
+// writeTrailer writes the data following the pixels.
+func (e *encoder) writeTrailer() error {
+	if len(e.opts.ICCProfile) > 0 {
+		_, err := e.w.Write(e.opts.ICCProfile)
+		return err
+	}
+	return nil
+}
+
+// masks returns the red, green, blue and alpha masks of the pixels,
+// or nil if they are not stored as bit fields.
+func (e *encoder) masks() []uint32 {
+	switch {
+	case e.opts.RGB565:
+		return []uint32{0xF800, 0x7E0, 0x1F, 0}
+	case e.opts.A2RGB10:
+		return []uint32{0x3FF00000, 0xFFC00, 0x3FF, 0xC0000000}
+	case e.opts.Header >= HeaderV4 && e.bpp == 16:
+		return []uint32{0x7C00, 0x3E0, 0x1F, 0}
+	case e.opts.Header >= HeaderV4 && e.bpp == 32:
+		return []uint32{0xFF0000, 0xFF00, 0xFF, 0xFF000000}
+	}
+	return nil
+}
+
+// dibHeaderLen returns the size of the DIB header.
+func (e *encoder) dibHeaderLen() uint32 {
+	switch e.opts.Header {
+	case HeaderV4:
+		return v4InfoHeaderLen
+	case HeaderV5:
+		return v5InfoHeaderLen
+	case HeaderCore:
+		return coreHeaderLen
+	case HeaderOS2:
+		return os2InfoHeaderLen
+	}
+	return infoHeaderLen
+}
+
+// headerLen returns the size of the headers, the masks, the color table
+// and the gap aligning the pixels, that is the offset of the pixels.
+func (e *encoder) headerLen() uint32 {
+	n := e.tableEnd()
+	if a := uint32(e.opts.PixelAlignment); e.opts.PixelAlignment > 1 {
+		n = (n + a - 1) / a * a
+	}
+	return n
+}
+
+// writeGap writes the zero bytes between the color table and the pixels.
+func (e *encoder) writeGap() error {
+	n := e.headerLen() - e.tableEnd()
+	if n == 0 {
+		return nil
+	}
+	_, err := e.w.Write(e.alloc(int(n)))
+	return err
+}
+
+// tableEnd returns the size of the headers, the masks and the color table.
+func (e *encoder) tableEnd() uint32 {
+	n := fileHeaderLen + e.dibHeaderLen() + uint32(len(e.palette))
+	if e.opts.Header == HeaderCore {
+		// The color table entries are RGBTRIPLEs.
+		n -= uint32(len(e.palette) / 4)
+	}
+	if e.opts.Header < HeaderV4 && e.masks() != nil {
+		n += 3 * 4
+	}
+	return n
+}
+
+// profileLink returns the null-terminated Windows-1252 representation
+// of the profile path s, or false if it cannot be represented.
+func profileLink(s string) ([]byte, bool) {
+	b := make([]byte, 0, len(s)+1)
+	for _, r := range s {
+		// Windows-1252 differs from Latin-1 in 0x80-0x9F.
+		if r == 0 || (r >= 0x80 && r < 0xA0) || r > 0xFF {
+			return nil, false
+		}
+		b = append(b, byte(r))
+	}
+	return append(b, 0), true
+}
+
+// pixelsPerMeter returns the resolution written for the option value v.
+func pixelsPerMeter(v int) uint32 {
+	switch {
+	case v == 0:
+		// 96 DPI.
+		return 3780
+	case v < 0:
+		return 0
+	}
+	return uint32(v)
+}
+
+// writeCoreHeader writes the headers and the color table with BITMAPCOREHEADER.
+func (e *encoder) writeCoreHeader() error {
+	e.pixOffset = e.headerLen()
+	b := e.hdr[:fileHeaderLen+coreHeaderLen]
+	for i := range b {
+		b[i] = 0
+	}
+	b[0], b[1] = 'B', 'M'
+	if e.fileSize() <= math.MaxUint32 {
+		binary.LittleEndian.PutUint32(b[2:], e.pixOffset+uint32(int64(e.dy)*int64(e.step)))
+	}
+	binary.LittleEndian.PutUint32(b[10:], e.pixOffset)
+	binary.LittleEndian.PutUint32(b[14:], coreHeaderLen)
+	binary.LittleEndian.PutUint16(b[18:], uint16(e.dx))
+	binary.LittleEndian.PutUint16(b[20:], uint16(e.dy))
+	binary.LittleEndian.PutUint16(b[22:], 1)
+	binary.LittleEndian.PutUint16(b[24:], uint16(e.bpp))
+	for i := 0; i < len(e.palette); i += 4 {
+		b = append(b, e.palette[i:i+3]...)
+	}
+	if _, err := e.w.Write(b); err != nil {
+		return err
+	}
+	return e.writeGap()
+}
+
+// writeHeader writes the headers and the color table.
+// The sizes of RLE4-compressed pixels that are not in e.data yet
+// are left 0 to be patched by patchSizes.
+func (e *encoder) writeHeader() error {
+	const (
+		biRGB       = 0
+		biRLE4      = 2
+		biBitFields = 3
+	)
+	if e.opts.Compression == CompressionRLE4 && e.data == nil {
+		var err error
+		if e.start, err = e.w.(io.WriteSeeker).Seek(0, io.SeekCurrent); err != nil {
+			return err
+		}
+	}
+	if e.opts.Header == HeaderCore {
+		return e.writeCoreHeader()
+	}
+	dibHeaderLen := e.dibHeaderLen()
+	pixOffset := e.headerLen()
+	height := uint32(e.dy)
+	if e.opts.TopDown {
+		height = uint32(-e.dy)
+	}
+	var compression, imageSize uint32
+	large := e.fileSize() > math.MaxUint32
+	if !large {
+		imageSize = uint32(int64(e.dy) * int64(e.step))
+	}
+	if e.opts.Compression == CompressionRLE4 {
+		if int64(pixOffset)+int64(len(e.data))+int64(len(e.opts.ICCProfile)) > math.MaxUint32 {
+			return ErrTooLarge
+		}
+		compression = biRLE4
+		imageSize = uint32(len(e.data))
+		large = false
+	}
+	masks := e.masks()
+	if masks != nil {
+		compression = biBitFields
+	}
+	var profileSize uint32
+	if e.opts.Header == HeaderV5 {
+		profileSize = uint32(len(e.opts.ICCProfile))
+	}
+
+	b := e.hdr[:fileHeaderLen+dibHeaderLen]
+	for i := range b {
+		b[i] = 0
+	}
+	// BITMAPFILEHEADER.
+	b[0], b[1] = 'B', 'M'
+	if !large {
+		// Otherwise, the sizes are 0 as allowed by LargeFile.
+		binary.LittleEndian.PutUint32(b[2:], pixOffset+imageSize+profileSize)
+	}
+	binary.LittleEndian.PutUint32(b[10:], pixOffset)
+	// BITMAPINFOHEADER.
+	h := b[fileHeaderLen:]
+	binary.LittleEndian.PutUint32(h[0:], dibHeaderLen)
+	binary.LittleEndian.PutUint32(h[4:], uint32(e.dx))
+	binary.LittleEndian.PutUint32(h[8:], height)
+	binary.LittleEndian.PutUint16(h[12:], 1)
+	binary.LittleEndian.PutUint16(h[14:], uint16(e.bpp))
+	binary.LittleEndian.PutUint32(h[16:], compression)
+	if !e.opts.ZeroImageSize || compression != biRGB {
+		binary.LittleEndian.PutUint32(h[20:], imageSize)
+	}
+	binary.LittleEndian.PutUint32(h[24:], pixelsPerMeter(e.opts.XPixelsPerMeter))
+	binary.LittleEndian.PutUint32(h[28:], pixelsPerMeter(e.opts.YPixelsPerMeter))
+	binary.LittleEndian.PutUint32(h[32:], e.colorUse)
+	binary.LittleEndian.PutUint32(h[36:], uint32(e.opts.ImportantColors))
+	if e.opts.Header == HeaderOS2 {
+		// The units are pixels per meter, the origin is the lower left corner
+		// and the colors are RGB.
+		binary.LittleEndian.PutUint16(h[46:], uint16(e.opts.Halftone))
+		binary.LittleEndian.PutUint32(h[48:], e.opts.HalftoneParams[0])
+		binary.LittleEndian.PutUint32(h[52:], e.opts.HalftoneParams[1])
+	}
+	if e.opts.Header >= HeaderV4 {
+		if masks != nil {
+			for i, m := range masks {
+				binary.LittleEndian.PutUint32(h[40+i*4:], m)
+			}
+			masks = nil
+		}
+		// LCS_WINDOWS_COLOR_SPACE.
+		csType := uint32(0x57696E20)
+		if e.opts.Header == HeaderV5 {
+			// LCS_sRGB.
+			csType = 0x73524742
+			// LCS_GM_IMAGES, LCS_GM_GRAPHICS, LCS_GM_BUSINESS and LCS_GM_ABS_COLORIMETRIC.
+			binary.LittleEndian.PutUint32(h[108:], [...]uint32{4, 2, 1, 8}[e.opts.Intent])
+			if profileSize > 0 {
+				// PROFILE_EMBEDDED. The profile follows the pixels
+				// and its offset is relative to the DIB header.
+				csType = 0x4D424544
+				if e.opts.ICCProfileLink != "" {
+					// PROFILE_LINKED.
+					csType = 0x4C494E4B
+				}
+				binary.LittleEndian.PutUint32(h[112:], pixOffset-fileHeaderLen+imageSize)
+				binary.LittleEndian.PutUint32(h[116:], profileSize)
+			}
+		}
+		if c := e.opts.Calibration; c != nil {
+			// LCS_CALIBRATED_RGB.
+			csType = 0
+			for i, v := range []float64{
+				c.Red.X, c.Red.Y, c.Red.Z,
+				c.Green.X, c.Green.Y, c.Green.Z,
+				c.Blue.X, c.Blue.Y, c.Blue.Z,
+			} {
+				binary.LittleEndian.PutUint32(h[60+i*4:], fixedPoint(v, 30))
+			}
+			binary.LittleEndian.PutUint32(h[96:], fixedPoint(c.GammaRed, 16))
+			binary.LittleEndian.PutUint32(h[100:], fixedPoint(c.GammaGreen, 16))
+			binary.LittleEndian.PutUint32(h[104:], fixedPoint(c.GammaBlue, 16))
+		}
+		binary.LittleEndian.PutUint32(h[56:], csType)
+	}
+	if masks != nil {
+		// BITMAPINFOHEADER is followed by the red, green and blue masks.
+		for _, m := range masks[:3] {
+			b = append(b, byte(m), byte(m>>8), byte(m>>16), byte(m>>24))
+		}
+	}
+	b = append(b, e.palette...)
+	e.pixOffset = pixOffset
+	if _, err := e.w.Write(b); err != nil {
+		return err
 	}
-	return encode(w, m, step)
+	return e.writeGap()
 }
@@ -2,9 +2,15 @@ package bmp
 
 import (
 	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
 	"image"
 	"image/color"
+	"image/color/palette"
+	"image/draw"
 	"io/ioutil"
+	"math"
 	"path/filepath"
 	"testing"
 )
@@ -104,3 +110,2566 @@ func TestEncode(t *testing.T) {
 		})
 	}
 }
+
+func TestEncodeTopDown(t *testing.T) {
+	files, err := filepath.Glob("testdata/*.bmp")
+	if err != nil {
+		panic("failed to list test files: " + err.Error())
+	}
+	for _, file := range files {
+		t.Run(file, func(t *testing.T) {
+			img, err := Decode(bytes.NewReader(mustReadFile(file)))
+			if err != nil {
+				t.Fatalf("Decode() = _, %v; want nil", err)
+			}
+			var buf bytes.Buffer
+			if err := EncodeWithOptions(&buf, img, &Options{TopDown: true}); err != nil {
+				t.Fatalf("EncodeWithOptions() = %v; want nil", err)
+			}
+			c, err := DecodeExtendedConfig(bytes.NewReader(buf.Bytes()))
+			if err != nil {
+				t.Fatalf("DecodeExtendedConfig() = _, %v; want nil", err)
+			}
+			if !c.TopDown {
+				t.Error("TopDown = false; want true")
+			}
+			img2, err := Decode(bytes.NewReader(buf.Bytes()))
+			if err != nil {
+				t.Fatalf("Decode() = _, %v; want nil", err)
+			}
+			compare(t, img, img2)
+		})
+	}
+}
+
+// quantizedImage is an image as written with 16 bits per pixel and decoded back.
+type quantizedImage struct {
+	image.Image
+	rgb565 bool
+}
+
+func (p quantizedImage) At(x, y int) color.Color {
+	c := color.RGBAModel.Convert(p.Image.At(x, y)).(color.RGBA)
+	quantize := func(v uint8, bits uint) uint8 {
+		max := uint32(1)<<bits - 1
+		q := (uint32(v)*max + 127) / 255
+		// The decoder replicates the high bits in the low ones.
+		return uint8(q<<(8-bits) | q>>(2*bits-8))
+	}
+	g := uint(5)
+	if p.rgb565 {
+		g = 6
+	}
+	return color.RGBA{quantize(c.R, 5), quantize(c.G, g), quantize(c.B, 5), 0xFF}
+}
+
+func TestEncodeBitsPerPixel(t *testing.T) {
+	files, err := filepath.Glob("testdata/*.bmp")
+	if err != nil {
+		panic("failed to list test files: " + err.Error())
+	}
+	for _, file := range files {
+		img, err := Decode(bytes.NewReader(mustReadFile(file)))
+		if err != nil {
+			t.Fatalf("Decode() = _, %v; want nil", err)
+		}
+		natural := 24
+		if paletted, ok := img.(*image.Paletted); ok {
+			natural = 8
+			for natural > 1 && len(paletted.Palette) <= 1<<(natural/2) {
+				natural /= 2
+			}
+		}
+		for _, bpp := range []int{1, 2, 4, 8, 16, 24, 32} {
+			t.Run(fmt.Sprintf("%s;bpp=%d", file, bpp), func(t *testing.T) {
+				var buf bytes.Buffer
+				if err := EncodeWithOptions(&buf, img, &Options{BitsPerPixel: bpp}); err != nil {
+					t.Fatalf("EncodeWithOptions() = %v; want nil", err)
+				}
+				c, err := DecodeExtendedConfig(bytes.NewReader(buf.Bytes()))
+				if err != nil {
+					t.Fatalf("DecodeExtendedConfig() = _, %v; want nil", err)
+				}
+				if c.BitsPerPixel != bpp {
+					t.Errorf("BitsPerPixel = %d; want %d", c.BitsPerPixel, bpp)
+				}
+				img2, err := Decode(bytes.NewReader(buf.Bytes()))
+				if err != nil {
+					t.Fatalf("Decode() = _, %v; want nil", err)
+				}
+				expected := img
+				switch {
+				case bpp == 16:
+					expected = quantizedImage{Image: convertedImage{img, color.RGBAModel}}
+				case bpp <= 8 && bpp < natural:
+					expected = convertedImage{img, defaultPalette(bpp)}
+				}
+				compare(t, expected, img2)
+			})
+		}
+	}
+	if err := EncodeWithOptions(ioutil.Discard, image.NewRGBA(image.Rect(0, 0, 1, 1)), &Options{BitsPerPixel: 3}); err == nil {
+		t.Error("EncodeWithOptions() = nil; want non-nil")
+	}
+}
+
+func TestEncodeRLE4(t *testing.T) {
+	files, err := filepath.Glob("testdata/*.bmp")
+	if err != nil {
+		panic("failed to list test files: " + err.Error())
+	}
+	images := map[string]image.Image{}
+	for _, file := range files {
+		img, err := Decode(bytes.NewReader(mustReadFile(file)))
+		if err != nil {
+			t.Fatalf("Decode() = _, %v; want nil", err)
+		}
+		images[file] = img
+	}
+	// Runs, alternating pairs and short literals of all lengths.
+	for _, width := range []int{1, 2, 3, 4, 5, 7, 300, 513} {
+		img := image.NewPaletted(image.Rect(0, 0, width, 5), defaultPalette(4))
+		for y := 0; y < 5; y++ {
+			for x := 0; x < width; x++ {
+				switch y {
+				case 0:
+					img.Pix[y*img.Stride+x] = 7
+				case 1:
+					img.Pix[y*img.Stride+x] = uint8(x % 2 * 9)
+				case 2:
+					img.Pix[y*img.Stride+x] = uint8(x % 16)
+				case 3:
+					img.Pix[y*img.Stride+x] = uint8(x / 3 % 16)
+				case 4:
+					img.Pix[y*img.Stride+x] = uint8(x * x % 13)
+				}
+			}
+		}
+		images[fmt.Sprintf("width=%d", width)] = img
+	}
+	for name, img := range images {
+		t.Run(name, func(t *testing.T) {
+			var buf bytes.Buffer
+			if err := EncodeWithOptions(&buf, img, &Options{Compression: CompressionRLE4}); err != nil {
+				t.Fatalf("EncodeWithOptions() = %v; want nil", err)
+			}
+			c, err := DecodeExtendedConfig(bytes.NewReader(buf.Bytes()))
+			if err != nil {
+				t.Fatalf("DecodeExtendedConfig() = _, %v; want nil", err)
+			}
+			if c.BitsPerPixel != 4 {
+				t.Errorf("BitsPerPixel = %d; want 4", c.BitsPerPixel)
+			}
+			img2, err := Decode(bytes.NewReader(buf.Bytes()))
+			if err != nil {
+				t.Fatalf("Decode() = _, %v; want nil", err)
+			}
+			var raw bytes.Buffer
+			if err := EncodeWithOptions(&raw, img, &Options{BitsPerPixel: 4}); err != nil {
+				t.Fatalf("EncodeWithOptions() = %v; want nil", err)
+			}
+			expected, err := Decode(bytes.NewReader(raw.Bytes()))
+			if err != nil {
+				t.Fatalf("Decode() = _, %v; want nil", err)
+			}
+			compare(t, expected, img2)
+		})
+	}
+	img := image.NewPaletted(image.Rect(0, 0, 1, 1), defaultPalette(4))
+	for _, opts := range []*Options{
+		{Compression: CompressionRLE4, BitsPerPixel: 8},
+		{Compression: CompressionRLE4, TopDown: true},
+		{Compression: -1},
+	} {
+		if err := EncodeWithOptions(ioutil.Discard, img, opts); err == nil {
+			t.Errorf("EncodeWithOptions(%+v) = nil; want non-nil", opts)
+		}
+	}
+}
+
+func TestEncodeCompressionAuto(t *testing.T) {
+	noise := image.NewPaletted(image.Rect(0, 0, 64, 64), defaultPalette(4))
+	for i := range noise.Pix {
+		noise.Pix[i] = uint8(i * 7 % 16)
+	}
+	flat := image.NewPaletted(image.Rect(0, 0, 64, 64), color.Palette{color.Black, color.White})
+	decode := func(file string) image.Image {
+		img, err := Decode(bytes.NewReader(mustReadFile(file)))
+		if err != nil {
+			t.Fatalf("Decode() = _, %v; want nil", err)
+		}
+		return img
+	}
+	tests := []struct {
+		name       string
+		img        image.Image
+		compressed bool
+	}{
+		{"pal4", decode("testdata/pal4.bmp"), true},
+		{"flat", flat, true},
+		{"noise", noise, false},
+		{"rgb24", decode("testdata/rgb24.bmp"), false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			if err := EncodeWithOptions(&buf, test.img, &Options{Compression: CompressionAuto}); err != nil {
+				t.Fatalf("EncodeWithOptions() = %v; want nil", err)
+			}
+			if compressed := readUint32(buf.Bytes()[30:]) != 0; compressed != test.compressed {
+				t.Errorf("compressed = %v; want %v", compressed, test.compressed)
+			}
+			var raw bytes.Buffer
+			if err := Encode(&raw, test.img); err != nil {
+				t.Fatalf("Encode() = %v; want nil", err)
+			}
+			if test.compressed && buf.Len() >= raw.Len() {
+				t.Errorf("compressed size = %d; want < %d", buf.Len(), raw.Len())
+			}
+			img, err := Decode(bytes.NewReader(buf.Bytes()))
+			if err != nil {
+				t.Fatalf("Decode() = _, %v; want nil", err)
+			}
+			compare(t, test.img, img)
+		})
+	}
+}
+
+func TestEncodeCompressionAutoRelease(t *testing.T) {
+	// RLE4 makes the noise of a 1 bit-per-pixel image larger.
+	noise := image.NewPaletted(image.Rect(0, 0, 64, 64), color.Palette{color.Black, color.White})
+	for i := range noise.Pix {
+		noise.Pix[i] = uint8(i * i * 7 / 5 % 2)
+	}
+	for _, s := range []*scratch{nil, {}} {
+		var used [2]allocMark
+		for i, c := range []Compression{CompressionNone, CompressionAuto} {
+			if s != nil {
+				s.n = 0
+			}
+			e, err := newEncoder(ioutil.Discard, 64, 64, &Options{Compression: c})
+			if err != nil {
+				t.Fatalf("newEncoder() = _, %v; want nil", err)
+			}
+			e.scratch = s
+			if err := e.prepare(noise); err != nil {
+				t.Fatalf("prepare() = %v; want nil", err)
+			}
+			if e.opts.Compression != CompressionNone {
+				t.Fatalf("Compression = %d; want %d", e.opts.Compression, CompressionNone)
+			}
+			used[i] = e.mark()
+			e.release()
+		}
+		if used[1] != used[0] {
+			t.Errorf("scratch = %v: buffers in use = %+v; want %+v", s != nil, used[1], used[0])
+		}
+	}
+}
+
+func TestEncodeRGB565(t *testing.T) {
+	img, err := Decode(bytes.NewReader(mustReadFile("testdata/rgb24.bmp")))
+	if err != nil {
+		t.Fatalf("Decode() = _, %v; want nil", err)
+	}
+	var buf bytes.Buffer
+	if err := EncodeWithOptions(&buf, img, &Options{RGB565: true}); err != nil {
+		t.Fatalf("EncodeWithOptions() = %v; want nil", err)
+	}
+	c, err := DecodeExtendedConfig(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatalf("DecodeExtendedConfig() = _, %v; want nil", err)
+	}
+	if c.PixelFormat != RGB565 || c.BitsPerPixel != 16 {
+		t.Errorf("PixelFormat, BitsPerPixel = %s, %d; want RGB565, 16", c.PixelFormat, c.BitsPerPixel)
+	}
+	img2, err := Decode(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatalf("Decode() = _, %v; want nil", err)
+	}
+	compare(t, quantizedImage{Image: img, rgb565: true}, img2)
+	for _, opts := range []*Options{
+		{RGB565: true, BitsPerPixel: 24},
+		{RGB565: true, Compression: CompressionRLE4},
+	} {
+		if err := EncodeWithOptions(ioutil.Discard, img, opts); err == nil {
+			t.Errorf("EncodeWithOptions(%+v) = nil; want non-nil", opts)
+		}
+	}
+}
+
+func TestEncodeRGB555(t *testing.T) {
+	img, err := Decode(bytes.NewReader(mustReadFile("testdata/rgb16.bmp")))
+	if err != nil {
+		t.Fatalf("Decode() = _, %v; want nil", err)
+	}
+	var buf bytes.Buffer
+	if err := EncodeWithOptions(&buf, img, &Options{BitsPerPixel: 16}); err != nil {
+		t.Fatalf("EncodeWithOptions() = %v; want nil", err)
+	}
+	c, err := DecodeExtendedConfig(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatalf("DecodeExtendedConfig() = _, %v; want nil", err)
+	}
+	if c.PixelFormat != RGB555 || c.BitsPerPixel != 16 {
+		t.Errorf("PixelFormat, BitsPerPixel = %s, %d; want RGB555, 16", c.PixelFormat, c.BitsPerPixel)
+	}
+	if compression := readUint32(buf.Bytes()[30:]); compression != 0 {
+		t.Errorf("compression = %d; want 0", compression)
+	}
+	img2, err := Decode(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatalf("Decode() = _, %v; want nil", err)
+	}
+	compare(t, quantizedImage{Image: img}, img2)
+}
+
+func TestEncodeHeader(t *testing.T) {
+	files, err := filepath.Glob("testdata/*.bmp")
+	if err != nil {
+		panic("failed to list test files: " + err.Error())
+	}
+	headers := []struct {
+		version HeaderVersion
+		size    uint32
+	}{
+		{HeaderV4, v4InfoHeaderLen},
+		{HeaderV5, v5InfoHeaderLen},
+	}
+	for _, file := range files {
+		for _, header := range headers {
+			t.Run(fmt.Sprintf("%s;size=%d", file, header.size), func(t *testing.T) {
+				img, err := Decode(bytes.NewReader(mustReadFile(file)))
+				if err != nil {
+					t.Fatalf("Decode() = _, %v; want nil", err)
+				}
+				var buf bytes.Buffer
+				if err := EncodeWithOptions(&buf, img, &Options{Header: header.version}); err != nil {
+					t.Fatalf("EncodeWithOptions() = %v; want nil", err)
+				}
+				if size := readUint32(buf.Bytes()[14:]); size != header.size {
+					t.Errorf("header size = %d; want %d", size, header.size)
+				}
+				img2, err := Decode(bytes.NewReader(buf.Bytes()))
+				if err != nil {
+					t.Fatalf("Decode() = _, %v; want nil", err)
+				}
+				compare(t, img, img2)
+			})
+		}
+	}
+	t.Run("sRGB", func(t *testing.T) {
+		var buf bytes.Buffer
+		if err := EncodeWithOptions(&buf, image.NewRGBA(image.Rect(0, 0, 1, 1)), &Options{Header: HeaderV5}); err != nil {
+			t.Fatalf("EncodeWithOptions() = %v; want nil", err)
+		}
+		b := buf.Bytes()
+		if csType := string(b[70:74]); csType != "BGRs" {
+			t.Errorf("bV5CSType = %q; want %q", csType, "BGRs")
+		}
+		if intent := readUint32(b[122:]); intent != 4 {
+			t.Errorf("bV5Intent = %d; want 4", intent)
+		}
+	})
+	t.Run("Intent", func(t *testing.T) {
+		for _, test := range []struct {
+			intent   RenderingIntent
+			header   HeaderVersion
+			expected uint32
+		}{
+			{IntentPerceptual, HeaderV5, 4},
+			{IntentRelativeColorimetric, HeaderInfo, 2},
+			{IntentSaturation, HeaderV4, 1},
+			{IntentAbsoluteColorimetric, HeaderV5, 8},
+		} {
+			var buf bytes.Buffer
+			if err := EncodeWithOptions(&buf, image.NewRGBA(image.Rect(0, 0, 1, 1)), &Options{Header: test.header, Intent: test.intent}); err != nil {
+				t.Fatalf("EncodeWithOptions() = %v; want nil", err)
+			}
+			b := buf.Bytes()
+			if size := readUint32(b[14:]); size != v5InfoHeaderLen {
+				t.Errorf("header size = %d; want %d", size, v5InfoHeaderLen)
+			}
+			if intent := readUint32(b[122:]); intent != test.expected {
+				t.Errorf("bV5Intent of %d = %d; want %d", test.intent, intent, test.expected)
+			}
+		}
+		for _, opts := range []*Options{
+			{Intent: IntentAbsoluteColorimetric + 1},
+			{Intent: IntentSaturation, Header: HeaderCore},
+		} {
+			if err := EncodeWithOptions(ioutil.Discard, image.NewRGBA(image.Rect(0, 0, 1, 1)), opts); err == nil {
+				t.Errorf("EncodeWithOptions(%+v) = nil; want non-nil", opts)
+			}
+		}
+	})
+	t.Run("Alpha", func(t *testing.T) {
+		img := image.NewNRGBA(image.Rect(0, 0, 3, 2))
+		for i := range img.Pix {
+			img.Pix[i] = uint8(i * 10)
+		}
+		var buf bytes.Buffer
+		if err := EncodeWithOptions(&buf, img, &Options{Header: HeaderV4}); err != nil {
+			t.Fatalf("EncodeWithOptions() = %v; want nil", err)
+		}
+		b := buf.Bytes()
+		if compression := readUint32(b[30:]); compression != 3 {
+			t.Errorf("compression = %d; want 3", compression)
+		}
+		masks := [4]uint32{readUint32(b[54:]), readUint32(b[58:]), readUint32(b[62:]), readUint32(b[66:])}
+		if expected := [4]uint32{0xFF0000, 0xFF00, 0xFF, 0xFF000000}; masks != expected {
+			t.Errorf("masks = %#x; want %#x", masks, expected)
+		}
+		c, err := DecodeExtendedConfigWithOptions(bytes.NewReader(b), &DecodeOptions{ScanAlpha: true})
+		if err != nil {
+			t.Fatalf("DecodeExtendedConfigWithOptions() = _, %v; want nil", err)
+		}
+		if !c.HasAlpha {
+			t.Error("HasAlpha = false; want true")
+		}
+		img2, err := Decode(bytes.NewReader(b))
+		if err != nil {
+			t.Fatalf("Decode() = _, %v; want nil", err)
+		}
+		compare(t, img, img2)
+	})
+	if err := EncodeWithOptions(ioutil.Discard, image.NewRGBA(image.Rect(0, 0, 1, 1)), &Options{Header: HeaderOS2 - 1}); err == nil {
+		t.Error("EncodeWithOptions() = nil; want non-nil")
+	}
+}
+
+func TestEncodeICCProfile(t *testing.T) {
+	img, err := Decode(bytes.NewReader(mustReadFile("testdata/pal8.bmp")))
+	if err != nil {
+		t.Fatalf("Decode() = _, %v; want nil", err)
+	}
+	profile := []byte("not really an ICC profile")
+	var buf bytes.Buffer
+	if err := EncodeWithOptions(&buf, img, &Options{ICCProfile: profile}); err != nil {
+		t.Fatalf("EncodeWithOptions() = %v; want nil", err)
+	}
+	b := buf.Bytes()
+	if size := readUint32(b[14:]); size != v5InfoHeaderLen {
+		t.Errorf("header size = %d; want %d", size, v5InfoHeaderLen)
+	}
+	if fileSize := readUint32(b[2:]); fileSize != uint32(len(b)) {
+		t.Errorf("bfSize = %d; want %d", fileSize, len(b))
+	}
+	if csType := readUint32(b[70:]); csType != 0x4D424544 {
+		t.Errorf("bV5CSType = %#x; want %#x", csType, 0x4D424544)
+	}
+	offset, size := readUint32(b[126:]), readUint32(b[130:])
+	if int(size) != len(profile) {
+		t.Fatalf("bV5ProfileSize = %d; want %d", size, len(profile))
+	}
+	if offset != uint32(len(b)-fileHeaderLen-len(profile)) {
+		t.Fatalf("bV5ProfileData = %d; want %d", offset, len(b)-fileHeaderLen-len(profile))
+	}
+	if data := b[fileHeaderLen+offset:]; !bytes.Equal(data, profile) {
+		t.Errorf("profile = %q; want %q", data, profile)
+	}
+	img2, err := Decode(bytes.NewReader(b))
+	if err != nil {
+		t.Fatalf("Decode() = _, %v; want nil", err)
+	}
+	compare(t, img, img2)
+}
+
+func TestEncodeICCProfileLink(t *testing.T) {
+	img, err := Decode(bytes.NewReader(mustReadFile("testdata/pal8.bmp")))
+	if err != nil {
+		t.Fatalf("Decode() = _, %v; want nil", err)
+	}
+	var buf bytes.Buffer
+	if err := EncodeWithOptions(&buf, img, &Options{ICCProfileLink: `C:\profiles\café.icc`}); err != nil {
+		t.Fatalf("EncodeWithOptions() = %v; want nil", err)
+	}
+	b := buf.Bytes()
+	if size := readUint32(b[14:]); size != v5InfoHeaderLen {
+		t.Errorf("header size = %d; want %d", size, v5InfoHeaderLen)
+	}
+	if fileSize := readUint32(b[2:]); fileSize != uint32(len(b)) {
+		t.Errorf("bfSize = %d; want %d", fileSize, len(b))
+	}
+	if csType := readUint32(b[70:]); csType != 0x4C494E4B {
+		t.Errorf("bV5CSType = %#x; want %#x", csType, 0x4C494E4B)
+	}
+	expected := []byte("C:\\profiles\\caf\xE9.icc\x00")
+	offset, size := readUint32(b[126:]), readUint32(b[130:])
+	if int(size) != len(expected) {
+		t.Fatalf("bV5ProfileSize = %d; want %d", size, len(expected))
+	}
+	if data := b[fileHeaderLen+offset:]; !bytes.Equal(data, expected) {
+		t.Errorf("profile = %q; want %q", data, expected)
+	}
+	img2, err := Decode(bytes.NewReader(b))
+	if err != nil {
+		t.Fatalf("Decode() = _, %v; want nil", err)
+	}
+	compare(t, img, img2)
+	for _, opts := range []*Options{
+		{ICCProfileLink: "profile.icc", ICCProfile: []byte("profile")},
+		{ICCProfileLink: "\u20ac.icc"},
+		{ICCProfileLink: "a\x00b"},
+		{ICCProfileLink: "profile.icc", Header: HeaderCore},
+	} {
+		if err := EncodeWithOptions(ioutil.Discard, img, opts); err == nil {
+			t.Errorf("EncodeWithOptions(%+v) = nil; want non-nil", opts)
+		}
+	}
+}
+
+func TestEncodeResolution(t *testing.T) {
+	var buf bytes.Buffer
+	opts := &Options{XPixelsPerMeter: 3780, YPixelsPerMeter: 2835}
+	if err := EncodeWithOptions(&buf, image.NewRGBA(image.Rect(0, 0, 1, 1)), opts); err != nil {
+		t.Fatalf("EncodeWithOptions() = %v; want nil", err)
+	}
+	b := buf.Bytes()
+	if x, y := readUint32(b[38:]), readUint32(b[42:]); x != 3780 || y != 2835 {
+		t.Errorf("biXPelsPerMeter, biYPelsPerMeter = %d, %d; want 3780, 2835", x, y)
+	}
+	for _, test := range []struct {
+		opts *Options
+		x, y uint32
+	}{
+		{nil, 3780, 3780},
+		{&Options{XPixelsPerMeter: -1, YPixelsPerMeter: 2835}, 0, 2835},
+	} {
+		buf.Reset()
+		if err := EncodeWithOptions(&buf, image.NewRGBA(image.Rect(0, 0, 1, 1)), test.opts); err != nil {
+			t.Fatalf("EncodeWithOptions() = %v; want nil", err)
+		}
+		b := buf.Bytes()
+		if x, y := readUint32(b[38:]), readUint32(b[42:]); x != test.x || y != test.y {
+			t.Errorf("biXPelsPerMeter, biYPelsPerMeter = %d, %d; want %d, %d", x, y, test.x, test.y)
+		}
+	}
+}
+
+func TestEncodeImportantColors(t *testing.T) {
+	img := image.NewPaletted(image.Rect(0, 0, 1, 1), defaultPalette(4))
+	var buf bytes.Buffer
+	if err := EncodeWithOptions(&buf, img, &Options{ImportantColors: 3}); err != nil {
+		t.Fatalf("EncodeWithOptions() = %v; want nil", err)
+	}
+	if n := readUint32(buf.Bytes()[50:]); n != 3 {
+		t.Errorf("biClrImportant = %d; want 3", n)
+	}
+	for _, test := range []struct {
+		img image.Image
+		n   int
+	}{
+		{img, -1},
+		{img, 17},
+		{image.NewRGBA(image.Rect(0, 0, 1, 1)), 1},
+	} {
+		if err := EncodeWithOptions(ioutil.Discard, test.img, &Options{ImportantColors: test.n}); err == nil {
+			t.Errorf("EncodeWithOptions(ImportantColors: %d) = nil; want non-nil", test.n)
+		}
+	}
+}
+
+func TestEncodePadPalette(t *testing.T) {
+	img := image.NewPaletted(image.Rect(0, 0, 2, 2), color.Palette{color.White, color.Black, color.Gray{0x80}})
+	img.Pix = []uint8{0, 1, 2, 1}
+	for _, pad := range []bool{false, true} {
+		t.Run(fmt.Sprintf("pad=%v", pad), func(t *testing.T) {
+			var buf bytes.Buffer
+			if err := EncodeWithOptions(&buf, img, &Options{PadPalette: pad}); err != nil {
+				t.Fatalf("EncodeWithOptions() = %v; want nil", err)
+			}
+			b := buf.Bytes()
+			colors, colorUse := 3, uint32(3)
+			if pad {
+				colors, colorUse = 4, 0
+			}
+			if n := readUint32(b[46:]); n != colorUse {
+				t.Errorf("biClrUsed = %d; want %d", n, colorUse)
+			}
+			if offset := readUint32(b[10:]); offset != uint32(fileHeaderLen+infoHeaderLen+colors*4) {
+				t.Errorf("bfOffBits = %d; want %d", offset, fileHeaderLen+infoHeaderLen+colors*4)
+			}
+			img2, err := Decode(bytes.NewReader(b))
+			if err != nil {
+				t.Fatalf("Decode() = _, %v; want nil", err)
+			}
+			compare(t, img, img2)
+		})
+	}
+}
+
+func TestEncodeBilevel(t *testing.T) {
+	gradient := image.NewGray(image.Rect(0, 0, 256, 2))
+	for x := 0; x < 256; x++ {
+		gradient.Pix[x], gradient.Pix[256+x] = uint8(x), uint8(x)
+	}
+	decode := func(opts *Options, img image.Image) *image.Paletted {
+		var buf bytes.Buffer
+		if err := EncodeWithOptions(&buf, img, opts); err != nil {
+			t.Fatalf("EncodeWithOptions() = %v; want nil", err)
+		}
+		c, err := DecodeExtendedConfig(bytes.NewReader(buf.Bytes()))
+		if err != nil {
+			t.Fatalf("DecodeExtendedConfig() = _, %v; want nil", err)
+		}
+		if c.BitsPerPixel != 1 {
+			t.Errorf("BitsPerPixel = %d; want 1", c.BitsPerPixel)
+		}
+		img2, err := Decode(bytes.NewReader(buf.Bytes()))
+		if err != nil {
+			t.Fatalf("Decode() = _, %v; want nil", err)
+		}
+		return img2.(*image.Paletted)
+	}
+	for _, threshold := range []uint8{0, 1, 200} {
+		t.Run(fmt.Sprintf("threshold=%d", threshold), func(t *testing.T) {
+			img := decode(&Options{Bilevel: true, Threshold: threshold}, gradient)
+			expected := int(threshold)
+			if expected == 0 {
+				expected = 0x80
+			}
+			for x := 0; x < 256; x++ {
+				want := uint8(0)
+				if x >= expected {
+					want = 1
+				}
+				if i := img.ColorIndexAt(x, 1); i != want {
+					t.Fatalf("ColorIndexAt(%d, 1) = %d; want %d", x, i, want)
+				}
+			}
+		})
+	}
+	t.Run("Dither", func(t *testing.T) {
+		gray := image.NewGray(image.Rect(0, 0, 64, 64))
+		for _, v := range []uint8{0, 0x40, 0x80, 0xC0, 0xFF} {
+			for i := range gray.Pix {
+				gray.Pix[i] = v
+			}
+			img := decode(&Options{Bilevel: true, Dither: true}, gray)
+			white := 0
+			for _, i := range img.Pix {
+				white += int(i)
+			}
+			// The share of white pixels should match the luminance.
+			if expected := int(v) * len(img.Pix) / 0xFF; white < expected-len(img.Pix)/100 || white > expected+len(img.Pix)/100 {
+				t.Errorf("white pixels for %#x = %d; want %d", v, white, expected)
+			}
+		}
+	})
+	if err := EncodeWithOptions(ioutil.Discard, gradient, &Options{Bilevel: true, BitsPerPixel: 8}); err == nil {
+		t.Error("EncodeWithOptions() = nil; want non-nil")
+	}
+}
+
+func TestEncodeGrayRamp(t *testing.T) {
+	img := image.NewGray(image.Rect(0, 0, 256, 3))
+	for i := range img.Pix {
+		img.Pix[i] = uint8(i)
+	}
+	for _, bpp := range []int{1, 2, 4} {
+		t.Run(fmt.Sprintf("bpp=%d", bpp), func(t *testing.T) {
+			var buf bytes.Buffer
+			if err := EncodeWithOptions(&buf, img, &Options{BitsPerPixel: bpp}); err != nil {
+				t.Fatalf("EncodeWithOptions() = %v; want nil", err)
+			}
+			img2, err := Decode(bytes.NewReader(buf.Bytes()))
+			if err != nil {
+				t.Fatalf("Decode() = _, %v; want nil", err)
+			}
+			p := img2.(*image.Paletted).Palette
+			if len(p) != 1<<bpp {
+				t.Fatalf("len(Palette) = %d; want %d", len(p), 1<<bpp)
+			}
+			for i, c := range p {
+				if expected := (color.Gray{uint8(i * 0xFF / (len(p) - 1))}); color.GrayModel.Convert(c) != expected {
+					t.Errorf("Palette[%d] = %v; want %v", i, c, expected)
+				}
+			}
+			compare(t, convertedImage{img, grayPalette(bpp)}, img2)
+		})
+	}
+}
+
+func TestEncodeGray16(t *testing.T) {
+	img := image.NewGray16(image.Rect(0, 0, 256, 256))
+	for y := 0; y < 256; y++ {
+		for x := 0; x < 256; x++ {
+			img.SetGray16(x, y, color.Gray16{uint16(y<<8 | x)})
+		}
+	}
+	for _, bpp := range []int{0, 1, 2, 4, 8} {
+		t.Run(fmt.Sprintf("bpp=%d", bpp), func(t *testing.T) {
+			var buf bytes.Buffer
+			if err := EncodeWithOptions(&buf, img, &Options{BitsPerPixel: bpp}); err != nil {
+				t.Fatalf("EncodeWithOptions() = %v; want nil", err)
+			}
+			img2, err := Decode(bytes.NewReader(buf.Bytes()))
+			if err != nil {
+				t.Fatalf("Decode() = _, %v; want nil", err)
+			}
+			if bpp == 0 {
+				bpp = 8
+			}
+			levels := 1<<bpp - 1
+			for y := 0; y < 256; y++ {
+				for x := 0; x < 256; x++ {
+					// The nearest level, rounding the 16-bit value.
+					i := ((y<<8|x)*levels + 0x7FFF) / 0xFFFF
+					expected := color.Gray{uint8(i * 0xFF / levels)}
+					if c := color.GrayModel.Convert(img2.At(x, y)); c != expected {
+						t.Fatalf("At(%d, %d) = %v; want %v", x, y, c, expected)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestEncodeBGRA64(t *testing.T) {
+	nrgba := image.NewNRGBA64(image.Rect(0, 0, 3, 1))
+	nrgba.SetNRGBA64(0, 0, color.NRGBA64{0xFFFF, 0, 0x8000, 0xFFFF})
+	nrgba.SetNRGBA64(1, 0, color.NRGBA64{0xFFFF, 0xFFFF, 0xFFFF, 0x8000})
+	nrgba.SetNRGBA64(2, 0, color.NRGBA64{0, 0, 0, 0})
+	rgba := image.NewRGBA64(nrgba.Bounds())
+	for x := 0; x < 3; x++ {
+		rgba.Set(x, 0, nrgba.At(x, 0))
+	}
+	// B, G, R, A in s2.13 linear light.
+	expected := []uint16{
+		1753, 0, 8192, 8192,
+		8192, 8192, 8192, 4096,
+		0, 0, 0, 0,
+	}
+	for _, img := range []image.Image{nrgba, rgba} {
+		t.Run(fmt.Sprintf("%T", img), func(t *testing.T) {
+			var buf bytes.Buffer
+			if err := EncodeWithOptions(&buf, img, &Options{BitsPerPixel: 64}); err != nil {
+				t.Fatalf("EncodeWithOptions() = %v; want nil", err)
+			}
+			b := buf.Bytes()
+			if bpp := readUint16(b[28:]); bpp != 64 {
+				t.Errorf("biBitCount = %d; want 64", bpp)
+			}
+			pix := b[readUint32(b[10:]):]
+			if len(pix) != 24 {
+				t.Fatalf("len(pixels) = %d; want 24", len(pix))
+			}
+			for i, v := range expected {
+				// Allow rounding differences after premultiplication.
+				if actual := int(readUint16(pix[i*2:])); actual < int(v)-1 || actual > int(v)+1 {
+					t.Errorf("channel %d = %d; want %d", i, actual, v)
+				}
+			}
+		})
+	}
+}
+
+func TestEncodeA2RGB10(t *testing.T) {
+	img := image.NewNRGBA(image.Rect(0, 0, 2, 1))
+	img.SetNRGBA(0, 0, color.NRGBA{0xFF, 0x80, 0, 0xFF})
+	img.SetNRGBA(1, 0, color.NRGBA{0, 0, 0xFF, 0x55})
+	var buf bytes.Buffer
+	if err := EncodeWithOptions(&buf, img, &Options{A2RGB10: true}); err != nil {
+		t.Fatalf("EncodeWithOptions() = %v; want nil", err)
+	}
+	b := buf.Bytes()
+	if size := readUint32(b[14:]); size != v4InfoHeaderLen {
+		t.Errorf("header size = %d; want %d", size, v4InfoHeaderLen)
+	}
+	if bpp, compression := readUint16(b[28:]), readUint32(b[30:]); bpp != 32 || compression != 3 {
+		t.Errorf("biBitCount, biCompression = %d, %d; want 32, 3", bpp, compression)
+	}
+	masks := [4]uint32{readUint32(b[54:]), readUint32(b[58:]), readUint32(b[62:]), readUint32(b[66:])}
+	if expected := [4]uint32{0x3FF00000, 0xFFC00, 0x3FF, 0xC0000000}; masks != expected {
+		t.Errorf("masks = %#x; want %#x", masks, expected)
+	}
+	pix := b[readUint32(b[10:]):]
+	for i, expected := range []uint32{
+		3<<30 | 0x3FF<<20 | 0x202<<10,
+		1<<30 | 0x3FF,
+	} {
+		if actual := readUint32(pix[i*4:]); actual != expected {
+			t.Errorf("pixel %d = %#x; want %#x", i, actual, expected)
+		}
+	}
+	if err := EncodeWithOptions(ioutil.Discard, img, &Options{A2RGB10: true, BitsPerPixel: 24}); err == nil {
+		t.Error("EncodeWithOptions() = nil; want non-nil")
+	}
+}
+
+func TestEncodeCMYK(t *testing.T) {
+	img := image.NewCMYK(image.Rect(0, 0, 16, 16))
+	for i := range img.Pix {
+		img.Pix[i] = uint8(i * 37)
+	}
+	for _, bpp := range []int{0, 32} {
+		t.Run(fmt.Sprintf("bpp=%d", bpp), func(t *testing.T) {
+			var buf bytes.Buffer
+			if err := EncodeWithOptions(&buf, img, &Options{BitsPerPixel: bpp}); err != nil {
+				t.Fatalf("EncodeWithOptions() = %v; want nil", err)
+			}
+			img2, err := Decode(bytes.NewReader(buf.Bytes()))
+			if err != nil {
+				t.Fatalf("Decode() = _, %v; want nil", err)
+			}
+			compare(t, convertedImage{img, color.RGBAModel}, img2)
+		})
+	}
+}
+
+func TestEncodeYCbCr(t *testing.T) {
+	for _, ratio := range []image.YCbCrSubsampleRatio{
+		image.YCbCrSubsampleRatio444,
+		image.YCbCrSubsampleRatio422,
+		image.YCbCrSubsampleRatio420,
+		image.YCbCrSubsampleRatio440,
+		image.YCbCrSubsampleRatio411,
+		image.YCbCrSubsampleRatio410,
+	} {
+		img := image.NewYCbCr(image.Rect(0, 0, 17, 9), ratio)
+		for i := range img.Y {
+			img.Y[i] = uint8(i * 7)
+		}
+		for i := range img.Cb {
+			img.Cb[i], img.Cr[i] = uint8(i*13), uint8(i*29)
+		}
+		for _, bpp := range []int{0, 32} {
+			t.Run(fmt.Sprintf("%s;bpp=%d", ratio, bpp), func(t *testing.T) {
+				var buf bytes.Buffer
+				if err := EncodeWithOptions(&buf, img, &Options{BitsPerPixel: bpp}); err != nil {
+					t.Fatalf("EncodeWithOptions() = %v; want nil", err)
+				}
+				img2, err := Decode(bytes.NewReader(buf.Bytes()))
+				if err != nil {
+					t.Fatalf("Decode() = _, %v; want nil", err)
+				}
+				compare(t, convertedImage{img, color.RGBAModel}, img2)
+			})
+		}
+	}
+}
+
+func TestEncodeAlpha(t *testing.T) {
+	alpha := image.NewAlpha(image.Rect(0, 0, 256, 2))
+	alpha16 := image.NewAlpha16(alpha.Bounds())
+	gray := image.NewGray(alpha.Bounds())
+	for x := 0; x < 256; x++ {
+		for y := 0; y < 2; y++ {
+			alpha.SetAlpha(x, y, color.Alpha{uint8(x)})
+			alpha16.SetAlpha16(x, y, color.Alpha16{uint16(x) * 0x101})
+			gray.SetGray(x, y, color.Gray{uint8(x)})
+		}
+	}
+	for _, img := range []image.Image{alpha, alpha16} {
+		t.Run(fmt.Sprintf("%T", img), func(t *testing.T) {
+			var buf bytes.Buffer
+			if err := Encode(&buf, img); err != nil {
+				t.Fatalf("Encode() = %v; want nil", err)
+			}
+			if bpp := readUint16(buf.Bytes()[28:]); bpp != 8 {
+				t.Errorf("biBitCount = %d; want 8", bpp)
+			}
+			img2, err := Decode(bytes.NewReader(buf.Bytes()))
+			if err != nil {
+				t.Fatalf("Decode() = _, %v; want nil", err)
+			}
+			compare(t, gray, img2)
+		})
+	}
+}
+
+// rgba64OnlyImage panics if its colors are read with At.
+type rgba64OnlyImage struct {
+	*image.RGBA64
+}
+
+func (rgba64OnlyImage) At(x, y int) color.Color { panic("At() called") }
+
+func TestEncodeRGBA64At(t *testing.T) {
+	img := image.NewRGBA64(image.Rect(0, 0, 16, 16))
+	for i := range img.Pix {
+		img.Pix[i] = uint8(i * 31)
+	}
+	for i := 6; i < len(img.Pix); i += 8 {
+		img.Pix[i], img.Pix[i+1] = 0xFF, 0xFF
+	}
+	for _, bpp := range []int{0, 32, 64} {
+		t.Run(fmt.Sprintf("bpp=%d", bpp), func(t *testing.T) {
+			var buf bytes.Buffer
+			if err := EncodeWithOptions(&buf, rgba64OnlyImage{img}, &Options{BitsPerPixel: bpp}); err != nil {
+				t.Fatalf("EncodeWithOptions() = %v; want nil", err)
+			}
+			if bpp == 64 {
+				return
+			}
+			img2, err := Decode(bytes.NewReader(buf.Bytes()))
+			if err != nil {
+				t.Fatalf("Decode() = _, %v; want nil", err)
+			}
+			compare(t, convertedImage{img, color.RGBAModel}, img2)
+		})
+	}
+}
+
+// rebase returns a copy of m that shares its pixels but has its bounds at the origin.
+func rebase(m image.Image) image.Image {
+	r := m.Bounds().Sub(m.Bounds().Min)
+	switch m := m.(type) {
+	case *image.RGBA:
+		return &image.RGBA{Pix: m.Pix[m.PixOffset(m.Rect.Min.X, m.Rect.Min.Y):], Stride: m.Stride, Rect: r}
+	case *image.NRGBA:
+		return &image.NRGBA{Pix: m.Pix[m.PixOffset(m.Rect.Min.X, m.Rect.Min.Y):], Stride: m.Stride, Rect: r}
+	case *image.RGBA64:
+		return &image.RGBA64{Pix: m.Pix[m.PixOffset(m.Rect.Min.X, m.Rect.Min.Y):], Stride: m.Stride, Rect: r}
+	case *image.NRGBA64:
+		return &image.NRGBA64{Pix: m.Pix[m.PixOffset(m.Rect.Min.X, m.Rect.Min.Y):], Stride: m.Stride, Rect: r}
+	case *image.Paletted:
+		return &image.Paletted{Pix: m.Pix[m.PixOffset(m.Rect.Min.X, m.Rect.Min.Y):], Stride: m.Stride, Rect: r, Palette: m.Palette}
+	case *image.Gray:
+		return &image.Gray{Pix: m.Pix[m.PixOffset(m.Rect.Min.X, m.Rect.Min.Y):], Stride: m.Stride, Rect: r}
+	case *image.Gray16:
+		return &image.Gray16{Pix: m.Pix[m.PixOffset(m.Rect.Min.X, m.Rect.Min.Y):], Stride: m.Stride, Rect: r}
+	case *image.Alpha:
+		return &image.Alpha{Pix: m.Pix[m.PixOffset(m.Rect.Min.X, m.Rect.Min.Y):], Stride: m.Stride, Rect: r}
+	case *image.Alpha16:
+		return &image.Alpha16{Pix: m.Pix[m.PixOffset(m.Rect.Min.X, m.Rect.Min.Y):], Stride: m.Stride, Rect: r}
+	case *image.CMYK:
+		return &image.CMYK{Pix: m.Pix[m.PixOffset(m.Rect.Min.X, m.Rect.Min.Y):], Stride: m.Stride, Rect: r}
+	case *image.YCbCr:
+		// The chroma planes are only rebased correctly if Min is aligned to the subsampling.
+		yi, ci := m.YOffset(m.Rect.Min.X, m.Rect.Min.Y), m.COffset(m.Rect.Min.X, m.Rect.Min.Y)
+		return &image.YCbCr{
+			Y:              m.Y[yi:],
+			Cb:             m.Cb[ci:],
+			Cr:             m.Cr[ci:],
+			YStride:        m.YStride,
+			CStride:        m.CStride,
+			SubsampleRatio: m.SubsampleRatio,
+			Rect:           r,
+		}
+	}
+	panic(fmt.Sprintf("unsupported image type %T", m))
+}
+
+func TestEncodeSubImage(t *testing.T) {
+	r := image.Rect(0, 0, 40, 30)
+	p := make(color.Palette, 16)
+	for i := range p {
+		p[i] = color.NRGBA{uint8(i * 16), uint8(255 - i*16), uint8(i * 5), 0xFF}
+	}
+	images := []image.Image{
+		image.NewRGBA(r),
+		image.NewNRGBA(r),
+		image.NewRGBA64(r),
+		image.NewNRGBA64(r),
+		image.NewPaletted(r, p),
+		image.NewPaletted(r, palette.Plan9),
+		image.NewGray(r),
+		image.NewGray16(r),
+		image.NewAlpha(r),
+		image.NewAlpha16(r),
+		image.NewCMYK(r),
+		image.NewYCbCr(r, image.YCbCrSubsampleRatio420),
+		image.NewYCbCr(r, image.YCbCrSubsampleRatio410),
+	}
+	for _, img := range images {
+		switch img := img.(type) {
+		case *image.Paletted:
+			for i := range img.Pix {
+				img.Pix[i] = uint8(i * 7 % len(img.Palette))
+			}
+		case *image.YCbCr:
+			for i := range img.Y {
+				img.Y[i] = uint8(i * 7)
+			}
+			for i := range img.Cb {
+				img.Cb[i], img.Cr[i] = uint8(i*13), uint8(i*29)
+			}
+		default:
+			for y := r.Min.Y; y < r.Max.Y; y++ {
+				for x := r.Min.X; x < r.Max.X; x++ {
+					img.(interface{ Set(x, y int, c color.Color) }).Set(x, y, color.NRGBA{uint8(x * 6), uint8(y * 8), uint8(x * y), uint8(0x80 + x + y)})
+				}
+			}
+		}
+		sub := img.(interface {
+			SubImage(r image.Rectangle) image.Image
+		}).SubImage(image.Rect(8, 4, 33, 27))
+		for _, bpp := range []int{0, 1, 4, 8, 16, 24, 32, 64} {
+			t.Run(fmt.Sprintf("%T;bpp=%d", img, bpp), func(t *testing.T) {
+				var buf, expected bytes.Buffer
+				if err := EncodeWithOptions(&buf, sub, &Options{BitsPerPixel: bpp}); err != nil {
+					t.Fatalf("EncodeWithOptions() = %v; want nil", err)
+				}
+				if err := EncodeWithOptions(&expected, rebase(sub), &Options{BitsPerPixel: bpp}); err != nil {
+					t.Fatalf("EncodeWithOptions() = %v; want nil", err)
+				}
+				if !bytes.Equal(buf.Bytes(), expected.Bytes()) {
+					t.Error("EncodeWithOptions() of a SubImage differs from the rebased image")
+				}
+			})
+		}
+	}
+}
+
+func TestEncodeRaw(t *testing.T) {
+	in := mustReadFile("testdata/rgb24.bmp")
+	c, err := DecodeConfig(bytes.NewReader(in))
+	if err != nil {
+		t.Fatalf("DecodeConfig() = _, %v; want nil", err)
+	}
+	tests := []struct {
+		f   PixelFormat
+		bpp int
+	}{
+		{Gray8, 8},
+		{RGB555, 16},
+		{RGB565, 16},
+		{BGR24, 24},
+		{BGRA32, 32},
+		{RGBA32, 32},
+	}
+	for _, test := range tests {
+		t.Run(test.f.String(), func(t *testing.T) {
+			// Padding the rows checks the stride is honored.
+			stride := test.f.Stride(c.Width) + 3
+			pix := make([]byte, stride*c.Height)
+			if _, err := DecodeRaw(bytes.NewReader(in), pix, stride, test.f); err != nil {
+				t.Fatalf("DecodeRaw() = _, %v; want nil", err)
+			}
+			var buf bytes.Buffer
+			if err := EncodeRaw(&buf, c.Width, c.Height, stride, test.f, pix, nil); err != nil {
+				t.Fatalf("EncodeRaw() = %v; want nil", err)
+			}
+			c2, err := DecodeExtendedConfig(bytes.NewReader(buf.Bytes()))
+			if err != nil {
+				t.Fatalf("DecodeExtendedConfig() = _, %v; want nil", err)
+			}
+			if c2.BitsPerPixel != test.bpp {
+				t.Errorf("BitsPerPixel = %d; want %d", c2.BitsPerPixel, test.bpp)
+			}
+			pix2 := make([]byte, len(pix))
+			if _, err := DecodeRaw(bytes.NewReader(buf.Bytes()), pix2, stride, test.f); err != nil {
+				t.Fatalf("DecodeRaw() = _, %v; want nil", err)
+			}
+			for y := 0; y < c.Height; y++ {
+				row, row2 := pix[y*stride:y*stride+test.f.Stride(c.Width)], pix2[y*stride:y*stride+test.f.Stride(c.Width)]
+				if !bytes.Equal(row, row2) {
+					t.Fatalf("row %d = %v; want %v", y, row2, row)
+				}
+			}
+		})
+	}
+	pix := make([]byte, 4*4)
+	for _, test := range []struct {
+		width, height, stride int
+		f                     PixelFormat
+	}{
+		{2, 2, 8, Paletted8},
+		{2, 2, 8, 0},
+		{3, 2, 8, BGRA32},
+		{2, 3, 8, BGRA32},
+		{-1, 2, 8, BGRA32},
+	} {
+		if err := EncodeRaw(ioutil.Discard, test.width, test.height, test.stride, test.f, pix, nil); err == nil {
+			t.Errorf("EncodeRaw(%+v) = nil; want non-nil", test)
+		}
+	}
+}
+
+func TestEncodedSize(t *testing.T) {
+	files, err := filepath.Glob("testdata/*.bmp")
+	if err != nil {
+		panic("failed to list test files: " + err.Error())
+	}
+	for _, file := range files {
+		img, err := Decode(bytes.NewReader(mustReadFile(file)))
+		if err != nil {
+			continue
+		}
+		for _, opts := range []*Options{
+			nil,
+			{BitsPerPixel: 16},
+			{BitsPerPixel: 64},
+			{Header: HeaderV4, BitsPerPixel: 32},
+			{ICCProfile: []byte("profile"), RGB565: true},
+			{Bilevel: true, PadPalette: true},
+			{Compression: CompressionAuto},
+			{Compression: CompressionRLE4},
+		} {
+			var b bytes.Buffer
+			if err := EncodeWithOptions(&b, img, opts); err != nil {
+				t.Fatalf("EncodeWithOptions(%q) = %v; want nil", file, err)
+			}
+			n, err := EncodedSize(img, opts)
+			if err != nil {
+				t.Fatalf("EncodedSize(%q) = _, %v; want nil", file, err)
+			}
+			if opts != nil && opts.Compression == CompressionRLE4 {
+				if n < int64(b.Len()) {
+					t.Errorf("EncodedSize(%q) = %d; want >= %d", file, n, b.Len())
+				}
+			} else if n != int64(b.Len()) {
+				t.Errorf("EncodedSize(%q, %+v) = %d; want %d", file, opts, n, b.Len())
+			}
+		}
+	}
+	if _, err := EncodedSize(image.NewGray(image.Rect(0, 0, 1, 1)), &Options{BitsPerPixel: 3}); err == nil {
+		t.Error("EncodedSize() = _, nil; want non-nil")
+	}
+}
+
+// fixedQuantizer quantizes to the first cap(p) colors of its palette.
+type fixedQuantizer color.Palette
+
+func (q fixedQuantizer) Quantize(p color.Palette, m image.Image) color.Palette {
+	n := cap(p)
+	if n > len(q) {
+		n = len(q)
+	}
+	return append(p, q[:n]...)
+}
+
+func TestEncodeQuantizer(t *testing.T) {
+	img, err := Decode(bytes.NewReader(mustReadFile("testdata/rgb24.bmp")))
+	if err != nil {
+		t.Fatalf("Decode() = _, %v; want nil", err)
+	}
+	decode := func(opts *Options) (*image.Paletted, int) {
+		var buf bytes.Buffer
+		if err := EncodeWithOptions(&buf, img, opts); err != nil {
+			t.Fatalf("EncodeWithOptions() = %v; want nil", err)
+		}
+		c, err := DecodeExtendedConfig(bytes.NewReader(buf.Bytes()))
+		if err != nil {
+			t.Fatalf("DecodeExtendedConfig() = _, %v; want nil", err)
+		}
+		img2, err := Decode(bytes.NewReader(buf.Bytes()))
+		if err != nil {
+			t.Fatalf("Decode() = _, %v; want nil", err)
+		}
+		return img2.(*image.Paletted), c.BitsPerPixel
+	}
+	q := fixedQuantizer(palette.WebSafe)
+	for _, tt := range []struct {
+		opts   *Options
+		colors int
+		bpp    int
+	}{
+		{&Options{Quantizer: q}, 216, 8},
+		{&Options{Quantizer: q, BitsPerPixel: 4}, 16, 4},
+		{&Options{Quantizer: q[:3]}, 3, 2},
+		{&Options{Quantizer: q, Compression: CompressionRLE4}, 16, 4},
+	} {
+		m, bpp := decode(tt.opts)
+		if bpp != tt.bpp {
+			t.Errorf("BitsPerPixel = %d; want %d", bpp, tt.bpp)
+		}
+		if len(m.Palette) != tt.colors {
+			t.Fatalf("len(Palette) = %d; want %d", len(m.Palette), tt.colors)
+		}
+		p := color.Palette(q[:tt.colors])
+		bounds := img.Bounds()
+		for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+			for x := bounds.Min.X; x < bounds.Max.X; x++ {
+				if i, want := m.ColorIndexAt(x, y), p.Index(img.At(x, y)); int(i) != want {
+					t.Fatalf("ColorIndexAt(%d, %d) = %d; want %d", x, y, i, want)
+				}
+			}
+		}
+	}
+	// Dithering changes some pixels.
+	m1, _ := decode(&Options{Quantizer: q})
+	m2, _ := decode(&Options{Quantizer: q, Drawer: draw.FloydSteinberg})
+	if bytes.Equal(m1.Pix, m2.Pix) {
+		t.Error("Drawer is not used")
+	}
+	m3, _ := decode(&Options{BitsPerPixel: 4, Drawer: draw.FloydSteinberg})
+	if len(m3.Palette) != 16 {
+		t.Errorf("len(Palette) = %d; want 16", len(m3.Palette))
+	}
+	for _, opts := range []*Options{
+		{Quantizer: q, BitsPerPixel: 24},
+		{Quantizer: fixedQuantizer{}},
+	} {
+		if err := EncodeWithOptions(ioutil.Discard, img, opts); err == nil {
+			t.Error("EncodeWithOptions() = nil; want non-nil")
+		}
+	}
+}
+
+func TestEncodeDither(t *testing.T) {
+	solid := image.NewNRGBA(image.Rect(0, 0, 64, 64))
+	for i := 0; i < len(solid.Pix); i += 4 {
+		solid.Pix[i+0], solid.Pix[i+1], solid.Pix[i+2], solid.Pix[i+3] = 0x86, 0x40, 0x10, 0xFF
+	}
+	decode := func(opts *Options) image.Image {
+		var buf bytes.Buffer
+		if err := EncodeWithOptions(&buf, solid, opts); err != nil {
+			t.Fatalf("EncodeWithOptions() = %v; want nil", err)
+		}
+		img, err := Decode(bytes.NewReader(buf.Bytes()))
+		if err != nil {
+			t.Fatalf("Decode() = _, %v; want nil", err)
+		}
+		return img
+	}
+	for _, rgb565 := range []bool{false, true} {
+		t.Run(fmt.Sprintf("rgb565=%t", rgb565), func(t *testing.T) {
+			for _, dither := range []bool{false, true} {
+				img := decode(&Options{BitsPerPixel: 16, RGB565: rgb565, Dither: dither}).(*image.RGBA)
+				var sum int
+				for i := 0; i < len(img.Pix); i += 4 {
+					sum += int(img.Pix[i] >> 3)
+				}
+				// The mean red level should match 0x86 * 31 / 0xFF = 16.3 if dithered.
+				mean := float64(sum) / float64(len(img.Pix)/4)
+				if expected := 16.0; dither {
+					if expected = float64(0x86) * 31 / 0xFF; mean < expected-0.05 || mean > expected+0.05 {
+						t.Errorf("mean red level = %.2f; want %.2f", mean, expected)
+					}
+				} else if mean != expected {
+					t.Errorf("mean red level = %.2f; want %.2f", mean, expected)
+				}
+			}
+		})
+	}
+	t.Run("Paletted", func(t *testing.T) {
+		for _, tt := range []struct {
+			dither bool
+			min    int
+		}{
+			{false, 1},
+			{true, 2},
+		} {
+			img := decode(&Options{BitsPerPixel: 8, Dither: tt.dither}).(*image.Paletted)
+			seen := make(map[uint8]bool)
+			for _, i := range img.Pix {
+				seen[i] = true
+			}
+			if tt.dither && len(seen) < tt.min || !tt.dither && len(seen) != tt.min {
+				t.Errorf("used colors with Dither = %t: %d; want %d", tt.dither, len(seen), tt.min)
+			}
+		}
+	})
+}
+
+func TestEncodeGrayscale(t *testing.T) {
+	img, err := Decode(bytes.NewReader(mustReadFile("testdata/rgb24.bmp")))
+	if err != nil {
+		t.Fatalf("Decode() = _, %v; want nil", err)
+	}
+	bounds := img.Bounds()
+	for _, tt := range []struct {
+		opts *Options
+		bpp  int
+	}{
+		{&Options{Grayscale: true}, 8},
+		{&Options{Grayscale: true, BitsPerPixel: 4}, 4},
+		{&Options{Grayscale: true, Compression: CompressionRLE4}, 4},
+		{&Options{Grayscale: true, BitsPerPixel: 2, Dither: true}, 2},
+		{&Options{Grayscale: true, Quantizer: fixedQuantizer(palette.WebSafe)}, 8},
+	} {
+		var buf bytes.Buffer
+		if err := EncodeWithOptions(&buf, img, tt.opts); err != nil {
+			t.Fatalf("EncodeWithOptions() = %v; want nil", err)
+		}
+		img2, err := Decode(bytes.NewReader(buf.Bytes()))
+		if err != nil {
+			t.Fatalf("Decode() = _, %v; want nil", err)
+		}
+		m := img2.(*image.Paletted)
+		if len(m.Palette) != 1<<tt.bpp {
+			t.Fatalf("len(Palette) = %d; want %d", len(m.Palette), 1<<tt.bpp)
+		}
+		for i, c := range grayPalette(tt.bpp) {
+			if r, _, _, _ := m.Palette[i].RGBA(); uint8(r>>8) != c.(color.Gray).Y {
+				t.Fatalf("Palette[%d] = %v; want %v", i, m.Palette[i], c)
+			}
+		}
+		max := 1<<tt.bpp - 1
+		for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+			for x := bounds.Min.X; x < bounds.Max.X; x++ {
+				gray := int(color.GrayModel.Convert(img.At(x, y)).(color.Gray).Y)
+				want := (gray*max + 0x7F) / 0xFF
+				if i := int(m.ColorIndexAt(x, y)); tt.opts.Dither && (i < want-1 || i > want+1) || !tt.opts.Dither && i != want {
+					t.Fatalf("ColorIndexAt(%d, %d) = %d; want %d", x, y, i, want)
+				}
+			}
+		}
+	}
+	if err := EncodeWithOptions(ioutil.Discard, img, &Options{Grayscale: true, BitsPerPixel: 24}); err == nil {
+		t.Error("EncodeWithOptions() = nil; want non-nil")
+	}
+}
+
+func TestEncodeAlphaMode(t *testing.T) {
+	nrgba := image.NewNRGBA(image.Rect(0, 0, 1, 1))
+	nrgba.Pix = []uint8{200, 100, 50, 128}
+	rgba := image.NewRGBA(image.Rect(0, 0, 1, 1))
+	rgba.Pix = []uint8{100, 50, 25, 128}
+	nrgba64 := image.NewNRGBA64(image.Rect(0, 0, 1, 1))
+	nrgba64.SetNRGBA64(0, 0, color.NRGBA64{200 * 0x101, 100 * 0x101, 50 * 0x101, 128 * 0x101})
+	raw := &rawImage{pix: []uint8{50, 100, 200, 128}, stride: 4, format: BGRA32, rect: nrgba.Rect}
+	for _, mode := range []AlphaMode{AlphaStraight, AlphaPremultiplied} {
+		expected := []uint8{50, 100, 200, 128}
+		if mode == AlphaPremultiplied {
+			expected = []uint8{25, 50, 100, 128}
+		}
+		for _, img := range []image.Image{nrgba, rgba, nrgba64, raw} {
+			var buf bytes.Buffer
+			if err := EncodeWithOptions(&buf, img, &Options{BitsPerPixel: 32, Header: HeaderV4, Alpha: mode}); err != nil {
+				t.Fatalf("EncodeWithOptions() = %v; want nil", err)
+			}
+			b := buf.Bytes()[buf.Len()-4:]
+			for i := range b {
+				if d := int(b[i]) - int(expected[i]); d < -1 || d > 1 {
+					t.Errorf("pixel of %T with mode %d = %v; want %v", img, mode, b, expected)
+					break
+				}
+			}
+		}
+	}
+	for _, img := range []image.Image{nrgba, rgba, nrgba64, raw} {
+		if err := EncodeWithOptions(ioutil.Discard, img, &Options{BitsPerPixel: 24, Alpha: AlphaOpaqueOnly}); err == nil {
+			t.Errorf("EncodeWithOptions(%T) = nil; want non-nil", img)
+		}
+	}
+	nrgba.Pix[3] = 0xFF
+	if err := EncodeWithOptions(ioutil.Discard, nrgba, &Options{Alpha: AlphaOpaqueOnly}); err != nil {
+		t.Errorf("EncodeWithOptions() = %v; want nil", err)
+	}
+	enc, err := NewEncoder(ioutil.Discard, 1, 2, BGRA32, &Options{Alpha: AlphaOpaqueOnly})
+	if err != nil {
+		t.Fatalf("NewEncoder() = _, %v; want nil", err)
+	}
+	if err := enc.WriteRow([]uint8{1, 2, 3, 0xFF}); err != nil {
+		t.Errorf("WriteRow() = %v; want nil", err)
+	}
+	if err := enc.WriteRow([]uint8{1, 2, 3, 4}); err == nil {
+		t.Error("WriteRow() = nil; want non-nil")
+	}
+	if err := EncodeWithOptions(ioutil.Discard, nrgba, &Options{Alpha: AlphaOpaqueOnly + 1}); err == nil {
+		t.Error("EncodeWithOptions() = nil; want non-nil")
+	}
+}
+
+func TestEncodeDropAlpha(t *testing.T) {
+	nrgba := image.NewNRGBA(image.Rect(0, 0, 1, 1))
+	nrgba.Pix = []uint8{200, 100, 50, 128}
+	rgba := image.NewRGBA(image.Rect(0, 0, 1, 1))
+	rgba.Pix = []uint8{100, 50, 25, 128}
+	nrgba64 := image.NewNRGBA64(image.Rect(0, 0, 1, 1))
+	nrgba64.SetNRGBA64(0, 0, color.NRGBA64{200 * 0x101, 100 * 0x101, 50 * 0x101, 128 * 0x101})
+	paletted := image.NewPaletted(image.Rect(0, 0, 1, 1), color.Palette{color.NRGBA{200, 100, 50, 128}})
+	raw := &rawImage{pix: []uint8{50, 100, 200, 128}, stride: 4, format: BGRA32, rect: nrgba.Rect}
+	expected := []uint8{50, 100, 200}
+	for _, img := range []image.Image{nrgba, rgba, nrgba64, paletted, raw} {
+		var buf bytes.Buffer
+		if err := EncodeWithOptions(&buf, img, &Options{DropAlpha: true}); err != nil {
+			t.Fatalf("EncodeWithOptions() = %v; want nil", err)
+		}
+		c, err := DecodeExtendedConfig(bytes.NewReader(buf.Bytes()))
+		if err != nil {
+			t.Fatalf("DecodeExtendedConfig() = _, %v; want nil", err)
+		}
+		if c.BitsPerPixel != 24 {
+			t.Errorf("BitsPerPixel of %T = %d; want 24", img, c.BitsPerPixel)
+		}
+		// The pixel is padded to 4 bytes.
+		b := buf.Bytes()[buf.Len()-4 : buf.Len()-1]
+		for i := range b {
+			if d := int(b[i]) - int(expected[i]); d < -1 || d > 1 {
+				t.Errorf("pixel of %T = %v; want %v", img, b, expected)
+				break
+			}
+		}
+	}
+	for _, opts := range []*Options{
+		{DropAlpha: true, BitsPerPixel: 32},
+		{DropAlpha: true, Bilevel: true},
+		{DropAlpha: true, Grayscale: true},
+	} {
+		if err := EncodeWithOptions(ioutil.Discard, nrgba, opts); err == nil {
+			t.Errorf("EncodeWithOptions(%+v) = nil; want non-nil", opts)
+		}
+	}
+}
+
+func TestEncodeHeaderCore(t *testing.T) {
+	files, err := filepath.Glob("testdata/*.bmp")
+	if err != nil {
+		panic("failed to list test files: " + err.Error())
+	}
+	images := map[string]image.Image{}
+	for _, file := range files {
+		img, err := Decode(bytes.NewReader(mustReadFile(file)))
+		if err != nil {
+			t.Fatalf("Decode() = _, %v; want nil", err)
+		}
+		images[file] = img
+	}
+	transparent := image.NewNRGBA(image.Rect(0, 0, 3, 3))
+	transparent.Pix[3] = 0x80
+	images["transparent"] = transparent
+	images["3 colors"] = image.NewPaletted(image.Rect(0, 0, 5, 2), defaultPalette(2)[:3])
+	for name, img := range images {
+		t.Run(name, func(t *testing.T) {
+			var buf bytes.Buffer
+			if err := EncodeWithOptions(&buf, img, &Options{Header: HeaderCore}); err != nil {
+				t.Fatalf("EncodeWithOptions() = %v; want nil", err)
+			}
+			b := buf.Bytes()
+			if n := readUint32(b[2:]); int(n) != len(b) {
+				t.Errorf("bfSize = %d; want %d", n, len(b))
+			}
+			if n := readUint32(b[14:]); n != coreHeaderLen {
+				t.Fatalf("bcSize = %d; want %d", n, coreHeaderLen)
+			}
+			bounds := img.Bounds()
+			if w, h := readUint16(b[18:]), readUint16(b[20:]); int(w) != bounds.Dx() || int(h) != bounds.Dy() {
+				t.Errorf("size = %dx%d; want %dx%d", w, h, bounds.Dx(), bounds.Dy())
+			}
+			bpp := int(readUint16(b[24:]))
+			switch bpp {
+			case 1, 4, 8, 24:
+			default:
+				t.Fatalf("bcBitCount = %d; want 1, 4, 8 or 24", bpp)
+			}
+			// The pixels and colors are the same as with BITMAPINFOHEADER.
+			var info bytes.Buffer
+			if err := EncodeWithOptions(&info, img, &Options{BitsPerPixel: bpp, PadPalette: true}); err != nil {
+				t.Fatalf("EncodeWithOptions() = %v; want nil", err)
+			}
+			ib := info.Bytes()
+			offset, infoOffset := readUint32(b[10:]), readUint32(ib[10:])
+			if !bytes.Equal(b[offset:], ib[infoOffset:]) {
+				t.Error("pixels differ from BITMAPINFOHEADER")
+			}
+			colors := int(offset-fileHeaderLen-coreHeaderLen) / 3
+			if bpp <= 8 && colors != 1<<bpp {
+				t.Errorf("colors = %d; want %d", colors, 1<<bpp)
+			}
+			for i := 0; i < colors; i++ {
+				c := b[fileHeaderLen+coreHeaderLen+i*3:]
+				ic := ib[fileHeaderLen+infoHeaderLen+i*4:]
+				if !bytes.Equal(c[:3], ic[:3]) {
+					t.Fatalf("color %d = %v; want %v", i, c[:3], ic[:3])
+				}
+			}
+			n, err := EncodedSize(img, &Options{Header: HeaderCore})
+			if err != nil {
+				t.Fatalf("EncodedSize() = _, %v; want nil", err)
+			}
+			if n != int64(len(b)) {
+				t.Errorf("EncodedSize() = %d; want %d", n, len(b))
+			}
+			// The image reads back like the one with BITMAPINFOHEADER.
+			decoded, err := Decode(bytes.NewReader(b))
+			if err != nil {
+				t.Fatalf("Decode() = _, %v; want nil", err)
+			}
+			expected, err := Decode(bytes.NewReader(ib))
+			if err != nil {
+				t.Fatalf("Decode() = _, %v; want nil", err)
+			}
+			compare(t, expected, decoded)
+		})
+	}
+	img := images["testdata/rgb24.bmp"]
+	for _, opts := range []*Options{
+		{Header: HeaderCore, BitsPerPixel: 32},
+		{Header: HeaderCore, BitsPerPixel: 2},
+		{Header: HeaderCore, TopDown: true},
+		{Header: HeaderCore, Compression: CompressionRLE4},
+		{Header: HeaderCore, ICCProfile: []byte("profile")},
+		{Header: HeaderCore, RGB565: true},
+	} {
+		if err := EncodeWithOptions(ioutil.Discard, img, opts); err == nil {
+			t.Errorf("EncodeWithOptions(%+v) = nil; want non-nil", opts)
+		}
+	}
+	if err := EncodeWithOptions(ioutil.Discard, image.NewGray(image.Rect(0, 0, 0x10000, 1)), &Options{Header: HeaderCore}); err == nil {
+		t.Error("EncodeWithOptions() = nil; want non-nil")
+	}
+}
+
+// hugeImage is a black image of any size that takes no memory.
+type hugeImage struct{ image.Rectangle }
+
+func (hugeImage) ColorModel() color.Model { return color.RGBAModel }
+
+func (m hugeImage) Bounds() image.Rectangle { return m.Rectangle }
+
+func (hugeImage) At(x, y int) color.Color { return color.Black }
+
+// headerWriter keeps the first n bytes written and fails afterwards.
+type headerWriter struct {
+	b []byte
+	n int
+}
+
+func (w *headerWriter) Write(p []byte) (int, error) {
+	if len(w.b) >= w.n {
+		return 0, errors.New("header written")
+	}
+	w.b = append(w.b, p...)
+	return len(p), nil
+}
+
+func TestEncodeTooLarge(t *testing.T) {
+	img := hugeImage{image.Rect(0, 0, 70000, 70000)}
+	if _, err := EncodedSize(img, nil); err != ErrTooLarge {
+		t.Errorf("EncodedSize() = _, %v; want %v", err, ErrTooLarge)
+	}
+	if err := EncodeWithOptions(ioutil.Discard, img, &Options{LargeFile: true, ICCProfile: []byte("profile")}); err != ErrTooLarge {
+		t.Errorf("EncodeWithOptions() = %v; want %v", err, ErrTooLarge)
+	}
+	n, err := EncodedSize(img, &Options{LargeFile: true})
+	if err != nil {
+		t.Fatalf("EncodedSize() = _, %v; want nil", err)
+	}
+	if expected := int64(fileHeaderLen+infoHeaderLen) + 70000*70000*3; n != expected {
+		t.Errorf("EncodedSize() = %d; want %d", n, expected)
+	}
+	for _, tt := range []struct {
+		img        image.Image
+		opts       *Options
+		headerLen  int
+		sizeOffset int
+	}{
+		{img, &Options{LargeFile: true}, fileHeaderLen + infoHeaderLen, fileHeaderLen + 20},
+		{hugeImage{image.Rect(0, 0, 0xFFFF, 0xFFFF)}, &Options{LargeFile: true, Header: HeaderCore}, fileHeaderLen + coreHeaderLen, 0},
+	} {
+		w := &headerWriter{n: tt.headerLen}
+		EncodeWithOptions(w, tt.img, tt.opts)
+		if len(w.b) < tt.headerLen {
+			t.Fatalf("header length = %d; want %d", len(w.b), tt.headerLen)
+		}
+		if n := readUint32(w.b[2:]); n != 0 {
+			t.Errorf("bfSize = %d; want 0", n)
+		}
+		if tt.sizeOffset != 0 {
+			if n := readUint32(w.b[tt.sizeOffset:]); n != 0 {
+				t.Errorf("biSizeImage = %d; want 0", n)
+			}
+		}
+	}
+}
+
+func TestEncodeDeterministic(t *testing.T) {
+	files, err := filepath.Glob("testdata/*.bmp")
+	if err != nil {
+		panic("failed to list test files: " + err.Error())
+	}
+	var imgs []image.Image
+	for _, file := range files {
+		img, err := Decode(bytes.NewReader(mustReadFile(file)))
+		if err != nil {
+			t.Fatalf("Decode() = _, %v; want nil", err)
+		}
+		imgs = append(imgs, img)
+	}
+	// noise dirties the buffers reused by ImageEncoder.
+	noise := image.NewNRGBA(image.Rect(0, 0, 131, 67))
+	for i := range noise.Pix {
+		noise.Pix[i] = uint8(i * 7919 >> 3)
+	}
+	for _, opts := range []*Options{
+		nil,
+		{BitsPerPixel: 1},
+		{BitsPerPixel: 2},
+		{BitsPerPixel: 4, Dither: true},
+		{BitsPerPixel: 16},
+		{BitsPerPixel: 24},
+		{Grayscale: true, BitsPerPixel: 4},
+		{Bilevel: true},
+		{Compression: CompressionRLE4},
+		{Header: HeaderCore},
+	} {
+		enc := NewImageEncoder(ioutil.Discard, opts)
+		for _, img := range imgs {
+			var first, second, reused bytes.Buffer
+			if err := EncodeWithOptions(&first, img, opts); err != nil {
+				t.Fatalf("EncodeWithOptions() = %v; want nil", err)
+			}
+			if err := EncodeWithOptions(&second, img, opts); err != nil {
+				t.Fatalf("EncodeWithOptions() = %v; want nil", err)
+			}
+			enc.Reset(ioutil.Discard)
+			if err := enc.Encode(noise); err != nil {
+				t.Fatalf("Encode() = %v; want nil", err)
+			}
+			enc.Reset(&reused)
+			if err := enc.Encode(img); err != nil {
+				t.Fatalf("Encode() = %v; want nil", err)
+			}
+			b := first.Bytes()
+			if !bytes.Equal(b, second.Bytes()) || !bytes.Equal(b, reused.Bytes()) {
+				t.Fatalf("output with %+v is not deterministic", opts)
+			}
+			if opts != nil && (opts.Compression != CompressionNone || opts.Header == HeaderCore) {
+				continue
+			}
+			// The padding bits of every row are 0.
+			width, height := int(readUint32(b[18:])), int(int32(readUint32(b[22:])))
+			if height < 0 {
+				height = -height
+			}
+			bits := width * int(readUint16(b[28:]))
+			step := (bits + 31) / 32 * 4
+			pix := b[readUint32(b[10:]):]
+			for y := 0; y < height; y++ {
+				row := pix[y*step : (y+1)*step]
+				if bits%8 != 0 && row[bits/8]<<uint(bits%8) != 0 {
+					t.Fatalf("padding bits of row %d with %+v are not 0", y, opts)
+				}
+				for _, c := range row[(bits+7)/8:] {
+					if c != 0 {
+						t.Fatalf("padding of row %d with %+v is not 0", y, opts)
+					}
+				}
+			}
+		}
+	}
+}
+
+func TestEncodeMinBitsPerPixel(t *testing.T) {
+	img := image.NewPaletted(image.Rect(0, 0, 5, 3), defaultPalette(2)[:3])
+	for i := range img.Pix {
+		img.Pix[i] = uint8(i % 3)
+	}
+	for _, test := range []struct {
+		opts *Options
+		bpp  int
+	}{
+		{&Options{}, 2},
+		{&Options{MinBitsPerPixel: 2}, 2},
+		{&Options{MinBitsPerPixel: 4}, 4},
+		{&Options{MinBitsPerPixel: 8}, 8},
+		{&Options{MinBitsPerPixel: 8, Compression: CompressionAuto}, 8},
+		{&Options{MinBitsPerPixel: 8, BitsPerPixel: 2}, 2},
+	} {
+		var buf bytes.Buffer
+		if err := EncodeWithOptions(&buf, img, test.opts); err != nil {
+			t.Fatalf("EncodeWithOptions() = %v; want nil", err)
+		}
+		c, err := DecodeExtendedConfig(bytes.NewReader(buf.Bytes()))
+		if err != nil {
+			t.Fatalf("DecodeExtendedConfig() = _, %v; want nil", err)
+		}
+		if c.BitsPerPixel != test.bpp {
+			t.Errorf("BitsPerPixel with %+v = %d; want %d", test.opts, c.BitsPerPixel, test.bpp)
+		}
+		img2, err := Decode(bytes.NewReader(buf.Bytes()))
+		if err != nil {
+			t.Fatalf("Decode() = _, %v; want nil", err)
+		}
+		compare(t, img, img2)
+	}
+	if err := EncodeWithOptions(ioutil.Discard, img, &Options{MinBitsPerPixel: 3}); err == nil {
+		t.Error("EncodeWithOptions() = nil; want non-nil")
+	}
+}
+
+func TestEncodeCompactGrayPalette(t *testing.T) {
+	img := image.NewGray(image.Rect(0, 0, 7, 5))
+	for i := range img.Pix {
+		img.Pix[i] = []uint8{0xFF, 0xF0, 0x20}[i%3]
+	}
+	var buf bytes.Buffer
+	if err := EncodeWithOptions(&buf, img, &Options{CompactGrayPalette: true}); err != nil {
+		t.Fatalf("EncodeWithOptions() = %v; want nil", err)
+	}
+	b := buf.Bytes()
+	if n := readUint32(b[46:]); n != 3 {
+		t.Errorf("biClrUsed = %d; want 3", n)
+	}
+	img2, err := Decode(bytes.NewReader(b))
+	if err != nil {
+		t.Fatalf("Decode() = _, %v; want nil", err)
+	}
+	p := img2.(*image.Paletted).Palette
+	for i, c := range []uint8{0x20, 0xF0, 0xFF} {
+		if r, _, _, _ := p[i].RGBA(); uint8(r>>8) != c {
+			t.Errorf("Palette[%d] = %v; want gray %#x", i, p[i], c)
+		}
+	}
+	compare(t, img, img2)
+	var full bytes.Buffer
+	if err := Encode(&full, img); err != nil {
+		t.Fatalf("Encode() = %v; want nil", err)
+	}
+	if expected := full.Len() - (256-3)*4; buf.Len() != expected {
+		t.Errorf("size = %d; want %d", buf.Len(), expected)
+	}
+	if err := EncodeWithOptions(ioutil.Discard, image.NewGray(image.Rect(0, 0, 0, 0)), &Options{CompactGrayPalette: true}); err != nil {
+		t.Errorf("EncodeWithOptions() = %v; want nil", err)
+	}
+}
+
+func TestEncodePaletteReserved(t *testing.T) {
+	img := image.NewPaletted(image.Rect(0, 0, 1, 1), defaultPalette(4))
+	for _, reserved := range []uint8{0, 0xFF} {
+		var buf bytes.Buffer
+		if err := EncodeWithOptions(&buf, img, &Options{PaletteReserved: reserved}); err != nil {
+			t.Fatalf("EncodeWithOptions() = %v; want nil", err)
+		}
+		p := buf.Bytes()[fileHeaderLen+infoHeaderLen : fileHeaderLen+infoHeaderLen+16*4]
+		for i := 3; i < len(p); i += 4 {
+			if p[i] != reserved {
+				t.Fatalf("reserved byte of color %d = %#x; want %#x", i/4, p[i], reserved)
+			}
+		}
+	}
+}
+
+func TestEncodeSmallPalettedPadding(t *testing.T) {
+	img := image.NewPaletted(image.Rect(0, 0, 5, 2), defaultPalette(2)[:3])
+	// The bottom row, written first, has out-of-range indexes.
+	for x := 0; x < 5; x++ {
+		img.Pix[img.Stride+x] = 0xFF
+	}
+	for _, test := range []struct {
+		bpp      int
+		expected []byte
+	}{
+		{1, []byte{0xF8, 0, 0, 0, 0, 0, 0, 0}},
+		{2, []byte{0xFF, 0xC0, 0, 0, 0, 0, 0, 0}},
+		{4, []byte{0xFF, 0xFF, 0xF0, 0, 0, 0, 0, 0}},
+	} {
+		opts := &Options{BitsPerPixel: test.bpp}
+		if test.bpp == 1 {
+			img.Palette = img.Palette[:2]
+		}
+		var buf bytes.Buffer
+		if err := EncodeWithOptions(&buf, img, opts); err != nil {
+			t.Fatalf("EncodeWithOptions() = %v; want nil", err)
+		}
+		b := buf.Bytes()
+		if pix := b[readUint32(b[10:]):]; !bytes.Equal(pix, test.expected) {
+			t.Errorf("pixels with %d bits per pixel = %#v; want %#v", test.bpp, pix, test.expected)
+		}
+		img.Palette = defaultPalette(2)[:3]
+	}
+}
+
+func TestEncodeZeroImageSize(t *testing.T) {
+	for _, test := range []struct {
+		opts *Options
+		size uint32
+	}{
+		{&Options{}, 4 * 2},
+		{&Options{ZeroImageSize: true}, 0},
+		{&Options{ZeroImageSize: true, ICCProfile: []byte("profile")}, 0},
+		// Color masks and compression require the size.
+		{&Options{ZeroImageSize: true, RGB565: true}, 4 * 2},
+		{&Options{ZeroImageSize: true, Compression: CompressionRLE4}, 2 * 4},
+	} {
+		var buf bytes.Buffer
+		if err := EncodeWithOptions(&buf, image.NewGray(image.Rect(0, 0, 1, 2)), test.opts); err != nil {
+			t.Fatalf("EncodeWithOptions() = %v; want nil", err)
+		}
+		b := buf.Bytes()
+		if n := readUint32(b[fileHeaderLen+20:]); n != test.size {
+			t.Errorf("biSizeImage with %+v = %d; want %d", test.opts, n, test.size)
+		}
+		if n := readUint32(b[2:]); int(n) != len(b) {
+			t.Errorf("bfSize with %+v = %d; want %d", test.opts, n, len(b))
+		}
+		img, err := Decode(bytes.NewReader(b))
+		if err != nil {
+			t.Fatalf("Decode() = _, %v; want nil", err)
+		}
+		if img.Bounds() != image.Rect(0, 0, 1, 2) {
+			t.Errorf("Bounds() = %v; want %v", img.Bounds(), image.Rect(0, 0, 1, 2))
+		}
+	}
+}
+
+func TestEncodePalettedAlpha(t *testing.T) {
+	img := image.NewPaletted(image.Rect(0, 0, 3, 2), color.Palette{
+		color.NRGBA{0xFF, 0, 0, 0xFF},
+		color.NRGBA{0, 0xFF, 0, 0x80},
+		color.NRGBA{0, 0, 0, 0},
+	})
+	for i := range img.Pix {
+		img.Pix[i] = uint8(i % 3)
+	}
+	for _, test := range []struct {
+		opts  *Options
+		bpp   int
+		alpha bool
+	}{
+		{&Options{}, 2, false},
+		{&Options{PalettedAlpha: true}, 32, true},
+		{&Options{PalettedAlpha: true, BitsPerPixel: 8}, 8, false},
+		{&Options{PalettedAlpha: true, Header: HeaderCore}, 4, false},
+	} {
+		var buf bytes.Buffer
+		if err := EncodeWithOptions(&buf, img, test.opts); err != nil {
+			t.Fatalf("EncodeWithOptions() = %v; want nil", err)
+		}
+		c, err := DecodeExtendedConfig(bytes.NewReader(buf.Bytes()))
+		if err != nil {
+			t.Fatalf("DecodeExtendedConfig() = _, %v; want nil", err)
+		}
+		if c.BitsPerPixel != test.bpp {
+			t.Errorf("BitsPerPixel with %+v = %d; want %d", test.opts, c.BitsPerPixel, test.bpp)
+		}
+		if !test.alpha {
+			continue
+		}
+		img2, err := Decode(bytes.NewReader(buf.Bytes()))
+		if err != nil {
+			t.Fatalf("Decode() = _, %v; want nil", err)
+		}
+		compare(t, img, img2)
+	}
+}
+
+func TestEncodeGrayPalette(t *testing.T) {
+	p := make(color.Palette, 256)
+	for i := range p {
+		p[i] = color.RGBA{uint8(i), uint8(255 - i), uint8(i / 2), 0xFF}
+	}
+	gray := image.NewGray(image.Rect(0, 0, 16, 16))
+	for i := range gray.Pix {
+		gray.Pix[i] = uint8(i)
+	}
+	for _, opts := range []*Options{
+		{GrayPalette: p},
+		{GrayPalette: p, Dither: true, BitsPerPixel: 8},
+		{GrayPalette: p, CompactGrayPalette: true},
+	} {
+		var buf bytes.Buffer
+		if err := EncodeWithOptions(&buf, gray, opts); err != nil {
+			t.Fatalf("EncodeWithOptions() = %v; want nil", err)
+		}
+		img, err := Decode(bytes.NewReader(buf.Bytes()))
+		if err != nil {
+			t.Fatalf("Decode() = _, %v; want nil", err)
+		}
+		compare(t, convertedImage{gray, lutModel(p)}, img)
+	}
+	if err := EncodeWithOptions(ioutil.Discard, gray, &Options{GrayPalette: p[:255]}); err == nil {
+		t.Error("EncodeWithOptions() = nil; want non-nil")
+	}
+}
+
+// lutModel converts gray colors to the colors of a palette indexed by the gray level.
+type lutModel color.Palette
+
+func (p lutModel) Convert(c color.Color) color.Color {
+	return p[color.GrayModel.Convert(c).(color.Gray).Y]
+}
+
+func TestEncodeGDIOptions(t *testing.T) {
+	img := image.NewNRGBA(image.Rect(0, 0, 3, 2))
+	for i := range img.Pix {
+		img.Pix[i] = uint8(i * 13)
+	}
+	img.Pix[3] = 0x80
+	var buf bytes.Buffer
+	if err := EncodeWithOptions(&buf, img, GDIOptions()); err != nil {
+		t.Fatalf("EncodeWithOptions() = %v; want nil", err)
+	}
+	b := buf.Bytes()
+	if n := readUint32(b[fileHeaderLen:]); n != infoHeaderLen {
+		t.Errorf("biSize = %d; want %d", n, infoHeaderLen)
+	}
+	if h := int32(readUint32(b[22:])); h != -2 {
+		t.Errorf("biHeight = %d; want -2", h)
+	}
+	if bpp := readUint16(b[28:]); bpp != 32 {
+		t.Errorf("biBitCount = %d; want 32", bpp)
+	}
+	if c := readUint32(b[30:]); c != 0 {
+		t.Errorf("biCompression = %d; want 0", c)
+	}
+	pix := b[readUint32(b[10:]):]
+	if len(pix) != 3*2*4 {
+		t.Fatalf("pixels length = %d; want %d", len(pix), 3*2*4)
+	}
+	// The first pixel is premultiplied and stored first.
+	if expected := []byte{(26*0x80 + 0x7F) / 0xFF, (13*0x80 + 0x7F) / 0xFF, 0, 0x80}; !bytes.Equal(pix[:4], expected) {
+		t.Errorf("first pixel = %v; want %v", pix[:4], expected)
+	}
+}
+
+func TestEncodeProgress(t *testing.T) {
+	img := image.NewPaletted(image.Rect(0, 0, 5, 10), defaultPalette(4))
+	for _, test := range []struct {
+		opts     *Options
+		expected []int
+	}{
+		{&Options{}, []int{1, 2, 3, 4, 5, 6, 7, 8, 9, 10}},
+		{&Options{ProgressRows: 4}, []int{4, 8, 10}},
+		{&Options{ProgressRows: 5, TopDown: true}, []int{5, 10}},
+		{&Options{ProgressRows: 3, Compression: CompressionRLE4}, []int{10}},
+	} {
+		var got []int
+		test.opts.Progress = func(written, total int) {
+			if total != 10 {
+				t.Errorf("total = %d; want 10", total)
+			}
+			got = append(got, written)
+		}
+		if err := EncodeWithOptions(ioutil.Discard, img, test.opts); err != nil {
+			t.Fatalf("EncodeWithOptions() = %v; want nil", err)
+		}
+		if fmt.Sprint(got) != fmt.Sprint(test.expected) {
+			t.Errorf("progress with %+v = %v; want %v", test.opts, got, test.expected)
+		}
+	}
+	// Unbuffered compressed pixels are reported as they are written.
+	var got []int
+	opts := &Options{ProgressRows: 3, Compression: CompressionRLE4, Progress: func(written, total int) {
+		got = append(got, written)
+	}}
+	if err := EncodeWithOptions(&seekBuffer{}, img, opts); err != nil {
+		t.Fatalf("EncodeWithOptions() = %v; want nil", err)
+	}
+	if expected := []int{3, 6, 9, 10}; fmt.Sprint(got) != fmt.Sprint(expected) {
+		t.Errorf("progress = %v; want %v", got, expected)
+	}
+}
+
+func TestEncodeWorkers(t *testing.T) {
+	files, err := filepath.Glob("testdata/*.bmp")
+	if err != nil {
+		panic("failed to list test files: " + err.Error())
+	}
+	images := map[string]image.Image{}
+	for _, file := range files {
+		img, err := Decode(bytes.NewReader(mustReadFile(file)))
+		if err != nil {
+			t.Fatalf("Decode() = _, %v; want nil", err)
+		}
+		images[file] = img
+	}
+	large := image.NewNRGBA(image.Rect(0, 0, 97, 211))
+	for i := range large.Pix {
+		large.Pix[i] = uint8(i * 7)
+	}
+	images["large"] = large
+	for name, img := range images {
+		t.Run(name, func(t *testing.T) {
+			for _, opts := range []Options{
+				{},
+				{TopDown: true},
+				{BitsPerPixel: 24},
+				{BitsPerPixel: 32},
+				{Bilevel: true, Dither: true},
+				{BitsPerPixel: 16, Dither: true},
+			} {
+				var expected bytes.Buffer
+				if err := EncodeWithOptions(&expected, img, &opts); err != nil {
+					t.Fatalf("EncodeWithOptions() = %v; want nil", err)
+				}
+				var rows int
+				opts.Workers = 3
+				opts.Progress = func(written, total int) {
+					rows++
+					if written != rows {
+						t.Errorf("written = %d; want %d", written, rows)
+					}
+				}
+				var buf bytes.Buffer
+				if err := EncodeWithOptions(&buf, img, &opts); err != nil {
+					t.Fatalf("EncodeWithOptions() = %v; want nil", err)
+				}
+				if !bytes.Equal(buf.Bytes(), expected.Bytes()) {
+					t.Errorf("output with %+v differs from the sequential one", opts)
+				}
+			}
+		})
+	}
+}
+
+type writeCounter struct {
+	bytes.Buffer
+	writes int
+}
+
+func (w *writeCounter) Write(p []byte) (int, error) {
+	w.writes++
+	return w.Buffer.Write(p)
+}
+
+func TestEncodeChunkSize(t *testing.T) {
+	img := image.NewNRGBA(image.Rect(0, 0, 10, 100))
+	for i := range img.Pix {
+		img.Pix[i] = uint8(i * 3)
+	}
+	var expected writeCounter
+	if err := EncodeWithOptions(&expected, img, &Options{ChunkSize: 1}); err != nil {
+		t.Fatalf("EncodeWithOptions() = %v; want nil", err)
+	}
+	rowWrites := expected.writes
+	for _, test := range []struct {
+		size, writes int
+	}{
+		{0, rowWrites - 99},
+		{40 * 10, rowWrites - 90},
+		{40*10 + 39, rowWrites - 90},
+	} {
+		var buf writeCounter
+		if err := EncodeWithOptions(&buf, img, &Options{ChunkSize: test.size}); err != nil {
+			t.Fatalf("EncodeWithOptions() = %v; want nil", err)
+		}
+		if buf.writes != test.writes {
+			t.Errorf("writes with ChunkSize %d = %d; want %d", test.size, buf.writes, test.writes)
+		}
+		if !bytes.Equal(buf.Bytes(), expected.Bytes()) {
+			t.Errorf("output with ChunkSize %d differs", test.size)
+		}
+	}
+}
+
+func TestEncodePixelAlignment(t *testing.T) {
+	img := image.NewPaletted(image.Rect(0, 0, 5, 3), defaultPalette(4))
+	for i := range img.Pix {
+		img.Pix[i] = uint8(i % 16)
+	}
+	profile := []byte("profile")
+	for _, opts := range []*Options{
+		{PixelAlignment: 4096},
+		{PixelAlignment: 100, Header: HeaderCore},
+		{PixelAlignment: 512, ICCProfile: profile},
+		{PixelAlignment: 4, Compression: CompressionRLE4},
+	} {
+		var buf bytes.Buffer
+		if err := EncodeWithOptions(&buf, img, opts); err != nil {
+			t.Fatalf("EncodeWithOptions() = %v; want nil", err)
+		}
+		b := buf.Bytes()
+		off := readUint32(b[10:])
+		if off%uint32(opts.PixelAlignment) != 0 {
+			t.Errorf("bfOffBits with %+v = %d; want a multiple of %d", opts, off, opts.PixelAlignment)
+		}
+		if n := readUint32(b[2:]); int(n) != len(b) {
+			t.Errorf("bfSize with %+v = %d; want %d", opts, n, len(b))
+		}
+		// The size of RLE4-compressed pixels is an upper bound.
+		if n, err := EncodedSize(img, opts); err != nil || n < int64(len(b)) || (n != int64(len(b)) && opts.Compression != CompressionRLE4) {
+			t.Errorf("EncodedSize(%+v) = %d, %v; want %d, nil", opts, n, err, len(b))
+		}
+		if opts.ICCProfile != nil {
+			data := fileHeaderLen + readUint32(b[fileHeaderLen+112:])
+			if got := b[data : data+uint32(len(profile))]; !bytes.Equal(got, profile) {
+				t.Errorf("profile = %q; want %q", got, profile)
+			}
+		}
+		if opts.Header == HeaderCore {
+			continue
+		}
+		m, err := Decode(bytes.NewReader(b))
+		if err != nil {
+			t.Fatalf("Decode() = _, %v; want nil", err)
+		}
+		compare(t, img, m)
+	}
+}
+
+func TestEncodeHeaderOS2(t *testing.T) {
+	img, err := Decode(bytes.NewReader(mustReadFile("testdata/rgb32.bmp")))
+	if err != nil {
+		t.Fatalf("Decode() = _, %v; want nil", err)
+	}
+	var buf bytes.Buffer
+	opts := &Options{Halftone: HalftonePanda, HalftoneParams: [2]uint32{8, 16}}
+	if err := EncodeWithOptions(&buf, img, opts); err != nil {
+		t.Fatalf("EncodeWithOptions() = %v; want nil", err)
+	}
+	b := buf.Bytes()
+	if n := readUint32(b[14:]); n != os2InfoHeaderLen {
+		t.Fatalf("cbFix = %d; want %d", n, os2InfoHeaderLen)
+	}
+	if n := readUint32(b[2:]); int(n) != len(b) {
+		t.Errorf("bfSize = %d; want %d", n, len(b))
+	}
+	if bpp := readUint16(b[28:]); bpp != 24 {
+		t.Errorf("cBitCount = %d; want 24", bpp)
+	}
+	if rendering := readUint16(b[fileHeaderLen+46:]); rendering != uint16(HalftonePanda) {
+		t.Errorf("usRendering = %d; want %d", rendering, HalftonePanda)
+	}
+	if size1, size2 := readUint32(b[fileHeaderLen+48:]), readUint32(b[fileHeaderLen+52:]); size1 != 8 || size2 != 16 {
+		t.Errorf("cSize1, cSize2 = %d, %d; want 8, 16", size1, size2)
+	}
+	img2, err := Decode(bytes.NewReader(b))
+	if err != nil {
+		t.Fatalf("Decode() = _, %v; want nil", err)
+	}
+	compare(t, img, img2)
+	// Huffman 1D has the value of BITFIELDS.
+	huffman := append([]byte(nil), b...)
+	binary.LittleEndian.PutUint32(huffman[30:], 3)
+	if _, err := Decode(bytes.NewReader(huffman)); err == nil || err.Error() != "bmp: unsupported feature: compression method" {
+		t.Errorf("Decode() of Huffman 1D = _, %v; want compression method", err)
+	}
+	paletted := image.NewPaletted(image.Rect(0, 0, 13, 5), palette.Plan9)
+	for i := range paletted.Pix {
+		paletted.Pix[i] = uint8(i * 5)
+	}
+	for _, opts := range []*Options{
+		{Header: HeaderOS2},
+		{Header: HeaderOS2, BitsPerPixel: 1},
+		{Header: HeaderOS2, BitsPerPixel: 4},
+		{Header: HeaderOS2, Compression: CompressionRLE4},
+	} {
+		buf.Reset()
+		if err := EncodeWithOptions(&buf, paletted, opts); err != nil {
+			t.Fatalf("EncodeWithOptions(%+v) = %v; want nil", opts, err)
+		}
+		got, err := Decode(bytes.NewReader(buf.Bytes()))
+		if err != nil {
+			t.Fatalf("Decode() with %+v = _, %v; want nil", opts, err)
+		}
+		// The pixels read back like the ones with BITMAPINFOHEADER.
+		info := *opts
+		info.Header = HeaderInfo
+		var ib bytes.Buffer
+		if err := EncodeWithOptions(&ib, paletted, &info); err != nil {
+			t.Fatalf("EncodeWithOptions(%+v) = %v; want nil", info, err)
+		}
+		want, err := Decode(&ib)
+		if err != nil {
+			t.Fatalf("Decode() = _, %v; want nil", err)
+		}
+		compare(t, want, got)
+	}
+	for _, opts := range []*Options{
+		{Header: HeaderOS2, TopDown: true},
+		{Header: HeaderOS2, BitsPerPixel: 16},
+		{Header: HeaderOS2, ICCProfile: []byte("profile")},
+		{Header: HeaderV4, Halftone: HalftoneErrorDiffusion},
+		{Halftone: HalftoneSuperCircle + 1},
+	} {
+		if err := EncodeWithOptions(ioutil.Discard, img, opts); err == nil {
+			t.Errorf("EncodeWithOptions(%+v) = nil; want non-nil", opts)
+		}
+	}
+}
+
+func TestEncodeFixed24(t *testing.T) {
+	translucent := image.NewNRGBA(image.Rect(0, 0, 2, 2))
+	translucent.Pix[3] = 0x80
+	for _, img := range []image.Image{
+		translucent,
+		image.NewRGBA(image.Rect(0, 0, 2, 2)),
+		image.NewNRGBA64(image.Rect(0, 0, 2, 2)),
+		image.NewGray(image.Rect(0, 0, 2, 2)),
+		image.NewAlpha16(image.Rect(0, 0, 2, 2)),
+		image.NewCMYK(image.Rect(0, 0, 2, 2)),
+		image.NewPaletted(image.Rect(0, 0, 2, 2), color.Palette{color.NRGBA{1, 2, 3, 4}}),
+	} {
+		for _, opts := range []*Options{{BitsPerPixel: 24}, {DropAlpha: true}, {BitsPerPixel: 24, Header: HeaderV5}} {
+			var buf bytes.Buffer
+			if err := EncodeWithOptions(&buf, img, opts); err != nil {
+				t.Fatalf("EncodeWithOptions() = %v; want nil", err)
+			}
+			b := buf.Bytes()
+			if bpp, compression := readUint16(b[28:]), readUint32(b[30:]); bpp != 24 || compression != 0 {
+				t.Errorf("biBitCount, biCompression of %T with %+v = %d, %d; want 24, 0", img, opts, bpp, compression)
+			}
+		}
+	}
+}
+
+func TestEncodeFixed32(t *testing.T) {
+	translucent := image.NewNRGBA(image.Rect(0, 0, 2, 2))
+	for i := 3; i < len(translucent.Pix); i += 4 {
+		translucent.Pix[i] = 0x80
+	}
+	for _, test := range []struct {
+		img   image.Image
+		alpha uint8
+	}{
+		{translucent, 0x80},
+		{image.NewRGBA(image.Rect(0, 0, 2, 2)), 0},
+		{image.NewGray(image.Rect(0, 0, 2, 2)), 0xFF},
+		{image.NewCMYK(image.Rect(0, 0, 2, 2)), 0xFF},
+		{image.NewYCbCr(image.Rect(0, 0, 2, 2), image.YCbCrSubsampleRatio420), 0xFF},
+		{image.NewPaletted(image.Rect(0, 0, 2, 2), color.Palette{color.Black}), 0xFF},
+	} {
+		var buf bytes.Buffer
+		if err := EncodeWithOptions(&buf, test.img, &Options{BitsPerPixel: 32}); err != nil {
+			t.Fatalf("EncodeWithOptions() = %v; want nil", err)
+		}
+		b := buf.Bytes()
+		if bpp := readUint16(b[28:]); bpp != 32 {
+			t.Errorf("biBitCount of %T = %d; want 32", test.img, bpp)
+		}
+		pix := b[readUint32(b[10:]):]
+		if len(pix) != 2*2*4 {
+			t.Fatalf("pixels of %T = %d bytes; want %d", test.img, len(pix), 2*2*4)
+		}
+		if a := pix[3]; a != test.alpha {
+			t.Errorf("alpha of %T = %#x; want %#x", test.img, a, test.alpha)
+		}
+	}
+}
+
+func TestEncodeExpandPalette(t *testing.T) {
+	p := make(color.Palette, 300)
+	for i := range p {
+		p[i] = color.NRGBA{uint8(i), uint8(i >> 8), uint8(i * 3), 0xFF}
+	}
+	img := image.NewPaletted(image.Rect(0, 0, 5, 3), p)
+	for i := range img.Pix {
+		img.Pix[i] = uint8(i * 17)
+	}
+	if err := EncodeWithOptions(ioutil.Discard, img, nil); err == nil {
+		t.Error("EncodeWithOptions() = nil; want non-nil")
+	}
+	for _, test := range []struct {
+		opts *Options
+		bpp  uint16
+	}{
+		{&Options{ExpandPalette: true}, 24},
+		{&Options{ExpandPalette: true, BitsPerPixel: 32}, 32},
+		{&Options{ExpandPalette: true, Header: HeaderCore}, 24},
+	} {
+		var buf bytes.Buffer
+		if err := EncodeWithOptions(&buf, img, test.opts); err != nil {
+			t.Fatalf("EncodeWithOptions() = %v; want nil", err)
+		}
+		b := buf.Bytes()
+		if test.opts.Header == HeaderCore {
+			if bpp := readUint16(b[24:]); bpp != test.bpp {
+				t.Errorf("bcBitCount with %+v = %d; want %d", test.opts, bpp, test.bpp)
+			}
+			continue
+		}
+		if bpp := readUint16(b[28:]); bpp != test.bpp {
+			t.Errorf("biBitCount with %+v = %d; want %d", test.opts, bpp, test.bpp)
+		}
+		img2, err := Decode(bytes.NewReader(b))
+		if err != nil {
+			t.Fatalf("Decode() = _, %v; want nil", err)
+		}
+		compare(t, img, img2)
+	}
+	img.Palette[img.Pix[0]] = color.NRGBA{1, 2, 3, 0x80}
+	var buf bytes.Buffer
+	if err := EncodeWithOptions(&buf, img, &Options{ExpandPalette: true}); err != nil {
+		t.Fatalf("EncodeWithOptions() = %v; want nil", err)
+	}
+	if bpp := readUint16(buf.Bytes()[28:]); bpp != 32 {
+		t.Errorf("biBitCount of non-opaque image = %d; want 32", bpp)
+	}
+}
+
+func TestEncodeCalibration(t *testing.T) {
+	c := &Calibration{
+		Red:        CIEXYZ{0.64, 0.33, 0.03},
+		Green:      CIEXYZ{0.3, 0.6, 0.1},
+		Blue:       CIEXYZ{0.15, 0.06, 0.79},
+		GammaRed:   2.2,
+		GammaGreen: 1,
+		GammaBlue:  3.9999999999,
+	}
+	for _, header := range []HeaderVersion{HeaderInfo, HeaderV4, HeaderV5} {
+		var buf bytes.Buffer
+		if err := EncodeWithOptions(&buf, image.NewRGBA(image.Rect(0, 0, 1, 1)), &Options{Header: header, Calibration: c}); err != nil {
+			t.Fatalf("EncodeWithOptions() = %v; want nil", err)
+		}
+		b := buf.Bytes()
+		if size := readUint32(b[14:]); size < v4InfoHeaderLen {
+			t.Fatalf("header size = %d; want at least %d", size, v4InfoHeaderLen)
+		}
+		if csType := readUint32(b[70:]); csType != 0 {
+			t.Errorf("bV4CSType = %#x; want 0", csType)
+		}
+		if x, z := readUint32(b[74:]), readUint32(b[82:]); x != 687194767 || z != 32212255 {
+			t.Errorf("bV4Endpoints.ciexyzRed = %d, _, %d; want 687194767, _, 32212255", x, z)
+		}
+		if r, g, bl := readUint32(b[110:]), readUint32(b[114:]), readUint32(b[118:]); r != 144179 || g != 65536 || bl != 262144 {
+			t.Errorf("bV4GammaRed, bV4GammaGreen, bV4GammaBlue = %d, %d, %d; want 144179, 65536, 262144", r, g, bl)
+		}
+		if _, err := Decode(bytes.NewReader(b)); err != nil {
+			t.Fatalf("Decode() = _, %v; want nil", err)
+		}
+	}
+	for _, opts := range []*Options{
+		{Calibration: c, ICCProfile: []byte("profile")},
+		{Calibration: c, Header: HeaderCore},
+		{Calibration: &Calibration{Red: CIEXYZ{X: 4}}},
+		{Calibration: &Calibration{GammaRed: -1}},
+		{Calibration: &Calibration{GammaBlue: math.NaN()}},
+	} {
+		if err := EncodeWithOptions(ioutil.Discard, image.NewRGBA(image.Rect(0, 0, 1, 1)), opts); err == nil {
+			t.Errorf("EncodeWithOptions(%+v) = nil; want non-nil", opts)
+		}
+	}
+}
+
+func TestEncodeLazyOpacity(t *testing.T) {
+	const prefix = "prefix"
+	for _, test := range []struct {
+		name        string
+		translucent int
+		bpp         uint16
+	}{
+		{"Opaque", -1, 24},
+		{"TranslucentTop", 0, 32},
+		{"TranslucentBottom", 99, 32},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			rgba := image.NewRGBA(image.Rect(0, 0, 10, 100))
+			for i := range rgba.Pix {
+				rgba.Pix[i] = uint8(i * 7)
+				if i%4 == 3 {
+					rgba.Pix[i] = 0xFF
+				}
+			}
+			if test.translucent >= 0 {
+				rgba.Pix[test.translucent*rgba.Stride+4*5+3] = 0x80
+			}
+			nrgba := image.NewNRGBA(rgba.Rect)
+			copy(nrgba.Pix, rgba.Pix)
+			for _, img := range []image.Image{rgba, nrgba} {
+				var expected bytes.Buffer
+				if err := EncodeWithOptions(&expected, img, &Options{BitsPerPixel: int(test.bpp)}); err != nil {
+					t.Fatalf("EncodeWithOptions() = %v; want nil", err)
+				}
+				for _, opts := range []*Options{{}, {ChunkSize: 40 * 10}, {ChunkSize: 40 * 10, Workers: 4}} {
+					var buf bytes.Buffer
+					if err := EncodeWithOptions(&buf, img, opts); err != nil {
+						t.Fatalf("EncodeWithOptions() = %v; want nil", err)
+					}
+					if !bytes.Equal(buf.Bytes(), expected.Bytes()) {
+						t.Errorf("output of %T with %+v differs from %d bpp", img, *opts, test.bpp)
+					}
+					sb := &seekBuffer{b: []byte(prefix), off: len(prefix)}
+					if err := EncodeWithOptions(sb, img, opts); err != nil {
+						t.Fatalf("EncodeWithOptions() = %v; want nil", err)
+					}
+					if !bytes.Equal(sb.b[len(prefix):], expected.Bytes()) || string(sb.b[:len(prefix)]) != prefix {
+						t.Errorf("seekable output of %T with %+v differs from %d bpp", img, *opts, test.bpp)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestEncodeOpaque(t *testing.T) {
+	translucent := image.NewNRGBA(image.Rect(0, 0, 5, 3))
+	for i := range translucent.Pix {
+		translucent.Pix[i] = uint8(i * 11)
+	}
+	opaque := image.NewNRGBA(translucent.Rect)
+	copy(opaque.Pix, translucent.Pix)
+	for i := 3; i < len(opaque.Pix); i += 4 {
+		opaque.Pix[i] = 0xFF
+	}
+	rgba := &image.RGBA{Pix: translucent.Pix, Stride: translucent.Stride, Rect: translucent.Rect}
+	for _, test := range []struct {
+		name     string
+		img      image.Image
+		opts     *Options
+		expected image.Image
+		bpp      uint16
+	}{
+		{"NRGBAOpaque", translucent, &Options{Opaque: OpacityOpaque}, opaque, 24},
+		{"RGBAOpaque", rgba, &Options{Opaque: OpacityOpaque}, opaque, 24},
+		{"Translucent", opaque, &Options{Opaque: OpacityTranslucent}, nil, 32},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			if err := EncodeWithOptions(&buf, test.img, test.opts); err != nil {
+				t.Fatalf("EncodeWithOptions() = %v; want nil", err)
+			}
+			if bpp := readUint16(buf.Bytes()[28:]); bpp != test.bpp {
+				t.Errorf("bpp = %d; want %d", bpp, test.bpp)
+			}
+			if test.expected == nil {
+				return
+			}
+			var expected bytes.Buffer
+			if err := Encode(&expected, test.expected); err != nil {
+				t.Fatalf("Encode() = %v; want nil", err)
+			}
+			if !bytes.Equal(buf.Bytes(), expected.Bytes()) {
+				t.Errorf("output differs from the opaque image")
+			}
+		})
+	}
+	if err := EncodeWithOptions(ioutil.Discard, opaque, &Options{Opaque: OpacityTranslucent, Alpha: AlphaOpaqueOnly}); err == nil {
+		t.Errorf("EncodeWithOptions() of asserted translucent image with AlphaOpaqueOnly = nil; want error")
+	}
+	if err := EncodeWithOptions(ioutil.Discard, opaque, &Options{Opaque: OpacityTranslucent + 1}); err == nil {
+		t.Errorf("EncodeWithOptions() with invalid opacity = nil; want error")
+	}
+}
+
+func TestEncodeFallback(t *testing.T) {
+	// The rows are wider than a chunk of encode.
+	r := image.Rect(1, 2, 2*fallbackChunk+9, 7)
+	rgba64 := image.NewRGBA64(r)
+	nrgba64 := image.NewNRGBA64(r)
+	nycbcra := image.NewNYCbCrA(r, image.YCbCrSubsampleRatio420)
+	for i := range rgba64.Pix {
+		rgba64.Pix[i] = uint8(i * 13)
+		nrgba64.Pix[i] = uint8(i * 13)
+	}
+	for i := range nycbcra.Y {
+		nycbcra.Y[i] = uint8(i * 7)
+		nycbcra.A[i] = uint8(i * 29)
+	}
+	for i := range nycbcra.Cb {
+		nycbcra.Cb[i] = uint8(i * 17)
+		nycbcra.Cr[i] = uint8(i * 23)
+	}
+	// Unless written with 24 bits per pixel, the colors of NRGBA64 are not
+	// premultiplied on the way to 8 bits per channel.
+	nrgba := image.NewNRGBA(r)
+	for i := range nrgba.Pix {
+		nrgba.Pix[i] = nrgba64.Pix[i*2]
+	}
+	for _, img := range []image.Image{rgba64, nrgba64, nycbcra} {
+		for _, opts := range []*Options{nil, {BitsPerPixel: 32}, {BitsPerPixel: 16}, {BitsPerPixel: 16, Dither: true}} {
+			var expected, actual bytes.Buffer
+			// The wrapper only has the methods of image.Image.
+			var src image.Image = struct{ image.Image }{img}
+			if img == nrgba64 && opts != nil {
+				src = nrgba
+			}
+			if err := EncodeWithOptions(&expected, src, opts); err != nil {
+				t.Fatalf("EncodeWithOptions() = %v; want nil", err)
+			}
+			if err := EncodeWithOptions(&actual, img, opts); err != nil {
+				t.Fatalf("EncodeWithOptions() = %v; want nil", err)
+			}
+			if !bytes.Equal(actual.Bytes(), expected.Bytes()) {
+				t.Errorf("output of %T with %+v differs from the image.Image one", img, opts)
+			}
+		}
+	}
+}
+
+func TestEncodeFallbackAllocs(t *testing.T) {
+	img := image.NewRGBA64(image.Rect(0, 0, 2*fallbackChunk+9, 2))
+	e, err := newEncoder(ioutil.Discard, img.Rect.Dx(), img.Rect.Dy(), nil)
+	if err != nil {
+		t.Fatalf("newEncoder() = _, %v; want nil", err)
+	}
+	e.encode(rgba64OnlyImage{img})
+	buf := make([]byte, img.Rect.Dx()*3)
+	if n := testing.AllocsPerRun(10, func() { e.row(buf, 1) }); n != 0 {
+		t.Errorf("row() allocations = %v; want 0", n)
+	}
+}
+
+func TestEncodeHeaderAllocs(t *testing.T) {
+	img := image.NewPaletted(image.Rect(0, 0, 4, 4), palette.Plan9[:16])
+	var expected float64
+	for _, h := range []HeaderVersion{HeaderInfo, HeaderCore, HeaderOS2, HeaderV4, HeaderV5} {
+		enc := NewImageEncoder(ioutil.Discard, &Options{Header: h, BitsPerPixel: 4})
+		allocs := testing.AllocsPerRun(10, func() { enc.Encode(img) })
+		if h == HeaderInfo {
+			expected = allocs
+		} else if allocs != expected {
+			t.Errorf("Encode() allocations with %v = %v; want %v", h, allocs, expected)
+		}
+	}
+}
+
+func TestEncodeGrayAllocs(t *testing.T) {
+	gray := image.NewGray(image.Rect(0, 0, 4, 4))
+	paletted := image.NewPaletted(gray.Rect, palette.Plan9)
+	enc := NewImageEncoder(ioutil.Discard, nil)
+	allocs := testing.AllocsPerRun(10, func() { enc.Encode(gray) })
+	if want := testing.AllocsPerRun(10, func() { enc.Encode(paletted) }); allocs > want {
+		t.Errorf("Encode() allocations = %v; want <= %v", allocs, want)
+	}
+}
+
+func TestEncodeUniformRows(t *testing.T) {
+	const w, h = 301, 6
+	uniform := image.NewNRGBA(image.Rect(0, 0, w, h))
+	// The last column breaks the runs, so its rows are converted pixel by pixel.
+	mixed := image.NewNRGBA(image.Rect(0, 0, w+1, h))
+	for y := 0; y < h; y++ {
+		c := color.NRGBA{uint8(y * 50), uint8(255 - y*40), uint8(y * 7), uint8(0xFF - y*30)}
+		for x := 0; x < w; x++ {
+			uniform.SetNRGBA(x, y, c)
+			mixed.SetNRGBA(x, y, c)
+		}
+		mixed.SetNRGBA(w, y, color.NRGBA{1, 2, 3, 4})
+	}
+	for _, opts := range []*Options{
+		{BitsPerPixel: 16},
+		{BitsPerPixel: 16, RGB565: true},
+		{BitsPerPixel: 24},
+		{BitsPerPixel: 32},
+		{BitsPerPixel: 4},
+		{BitsPerPixel: 8},
+		{BitsPerPixel: 4, Compression: CompressionRLE4},
+	} {
+		decode := func(m image.Image) image.Image {
+			var buf bytes.Buffer
+			// The wrapper only has the methods of image.Image.
+			if err := EncodeWithOptions(&buf, struct{ image.Image }{m}, opts); err != nil {
+				t.Fatalf("EncodeWithOptions() with %+v = %v; want nil", *opts, err)
+			}
+			img, err := Decode(bytes.NewReader(buf.Bytes()))
+			if err != nil {
+				t.Fatalf("Decode() = _, %v; want nil", err)
+			}
+			return img
+		}
+		expected := decode(mixed).(interface {
+			SubImage(image.Rectangle) image.Image
+		}).SubImage(uniform.Rect)
+		compare(t, expected, decode(uniform))
+	}
+}
+
+// benchImage returns an opaque image of a 512x512 gradient.
+func benchImage() *image.NRGBA {
+	img := image.NewNRGBA(image.Rect(0, 0, 512, 512))
+	for y := 0; y < 512; y++ {
+		for x := 0; x < 512; x++ {
+			img.SetNRGBA(x, y, color.NRGBA{uint8(x), uint8(y), uint8(x + y), 0xFF})
+		}
+	}
+	return img
+}
+
+// benchOptions are the options of the benchmarks of every bit depth.
+var benchOptions = []struct {
+	name string
+	opts Options
+}{
+	{"1bpp", Options{BitsPerPixel: 1}},
+	{"2bpp", Options{BitsPerPixel: 2}},
+	{"4bpp", Options{BitsPerPixel: 4}},
+	{"4bppRLE", Options{BitsPerPixel: 4, Compression: CompressionRLE4}},
+	{"8bpp", Options{BitsPerPixel: 8}},
+	{"16bpp", Options{BitsPerPixel: 16}},
+	{"16bppRGB565", Options{BitsPerPixel: 16, RGB565: true}},
+	{"24bpp", Options{BitsPerPixel: 24}},
+	{"32bpp", Options{BitsPerPixel: 32}},
+	{"64bpp", Options{BitsPerPixel: 64}},
+}
+
+func BenchmarkEncode(b *testing.B) {
+	img := benchImage()
+	for _, bench := range benchOptions {
+		b.Run(bench.name, func(b *testing.B) {
+			enc := NewImageEncoder(ioutil.Discard, &bench.opts)
+			b.SetBytes(int64(len(img.Pix)))
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				if err := enc.Encode(img); err != nil {
+					b.Fatalf("Encode() = %v; want nil", err)
+				}
+			}
+		})
+	}
+}